@@ -0,0 +1,384 @@
+package main
+
+import (
+	"context"
+	"crypto/subtle"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"strings"
+	"sync"
+	"time"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/health/grpc_health_v1"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/peer"
+	"google.golang.org/grpc/status"
+	"gopkg.in/yaml.v3"
+
+	"github.com/rootwarp/snippets/golang/grpc/reflection/tlsconfig"
+)
+
+// authzPolicy decides which caller may call which plugin method. A policy
+// file looks like:
+//
+//	default: deny
+//	tokens:
+//	  - token: s3cret
+//	    identity: ci-bot
+//	rules:
+//	  - identities: ["ci-bot", "*.example.com"]
+//	    allow: ["snippet.grpc.reflection.HelloService/*"]
+//	    deny: ["snippet.grpc.reflection.HelloService/HelloChat"]
+//
+// Identities are the names of the caller's client certificate and the
+// identities of the bearer tokens it presents. Identity and method patterns
+// are path.Match patterns over the identity and "service/method", so "*/*"
+// covers every method. Identity patterns match label by label, a "*" never
+// spans a dot: "*.example.com" covers "a.example.com" but not
+// "a.b.example.com". The identity pattern "*" covers unauthenticated callers
+// as well.
+//
+// A method denied by any rule matching the caller is denied, one allowed by
+// any of them is allowed, anything else gets the default, deny unless set
+// otherwise.
+//
+// The policy covers the agent's own methods too, plugins need to be allowed
+// "snippet.grpc.reflection.RegistrationService/RegisterPlugin" and
+// "snippet.grpc.reflection.RegistrationService/Heartbeat", peer agents
+// "snippet.grpc.reflection.RegistrationService/WatchPlugins". Health checks
+// are left open.
+type authzPolicy struct {
+	Default string       `yaml:"default"`
+	Tokens  []authzToken `yaml:"tokens"`
+	Rules   []authzRule  `yaml:"rules"`
+}
+
+type authzToken struct {
+	Token    string `yaml:"token"`
+	Identity string `yaml:"identity"`
+}
+
+type authzRule struct {
+	Identities []string `yaml:"identities"`
+	Allow      []string `yaml:"allow"`
+	Deny       []string `yaml:"deny"`
+}
+
+func parseAuthzPolicy(data []byte) (*authzPolicy, error) {
+	policy := &authzPolicy{}
+	if err := yaml.Unmarshal(data, policy); err != nil {
+		return nil, err
+	}
+
+	switch policy.Default {
+	case "":
+		policy.Default = "deny"
+	case "allow", "deny":
+	default:
+		return nil, fmt.Errorf("default must be allow or deny, not %q", policy.Default)
+	}
+
+	for _, token := range policy.Tokens {
+		if token.Token == "" || token.Identity == "" {
+			return nil, fmt.Errorf("token entries need a token and an identity")
+		}
+	}
+
+	for _, rule := range policy.Rules {
+		patterns := append(append(append([]string{}, rule.Identities...), rule.Allow...), rule.Deny...)
+		for _, pattern := range patterns {
+			if _, err := path.Match(pattern, ""); err != nil {
+				return nil, fmt.Errorf("invalid pattern %q: %w", pattern, err)
+			}
+		}
+	}
+
+	return policy, nil
+}
+
+// allowed decides whether a caller with identities may call fullMethod,
+// given as "service/method", and explains why.
+func (p *authzPolicy) allowed(identities []string, fullMethod string) (bool, string) {
+	allowedBy := -1
+	for i, rule := range p.Rules {
+		if !matchIdentities(rule.Identities, identities) {
+			continue
+		}
+
+		if matchAny(rule.Deny, fullMethod) {
+			return false, fmt.Sprintf("denied by rule %d", i)
+		}
+
+		if allowedBy < 0 && matchAny(rule.Allow, fullMethod) {
+			allowedBy = i
+		}
+	}
+
+	if allowedBy >= 0 {
+		return true, fmt.Sprintf("allowed by rule %d", allowedBy)
+	}
+
+	return p.Default == "allow", "no rule matches, default " + p.Default
+}
+
+// tokenIdentity returns the identity of the bearer token.
+func (p *authzPolicy) tokenIdentity(token string) (string, bool) {
+	identity, found := "", false
+	for _, t := range p.Tokens {
+		if subtle.ConstantTimeCompare([]byte(t.Token), []byte(token)) == 1 && !found {
+			identity, found = t.Identity, true
+		}
+	}
+
+	return identity, found
+}
+
+func matchIdentities(patterns, identities []string) bool {
+	for _, pattern := range patterns {
+		if pattern == "*" {
+			return true
+		}
+
+		for _, identity := range identities {
+			if matchIdentity(pattern, identity) {
+				return true
+			}
+		}
+	}
+
+	return false
+}
+
+// matchIdentity matches identity against pattern one dot separated label at
+// a time.
+func matchIdentity(pattern, identity string) bool {
+	patternLabels := strings.Split(pattern, ".")
+	labels := strings.Split(identity, ".")
+	if len(patternLabels) != len(labels) {
+		return false
+	}
+
+	for i, label := range labels {
+		if ok, _ := path.Match(patternLabels[i], label); !ok {
+			return false
+		}
+	}
+
+	return true
+}
+
+func matchAny(patterns []string, name string) bool {
+	for _, pattern := range patterns {
+		if ok, _ := path.Match(pattern, name); ok {
+			return true
+		}
+	}
+
+	return false
+}
+
+// authorizer enforces the policy of a YAML file, which is reloaded when it
+// changes. Denials are written to audit as JSON lines.
+type authorizer struct {
+	path  string
+	audit io.Writer
+
+	mu      sync.RWMutex
+	policy  *authzPolicy
+	modTime time.Time
+
+	auditMu sync.Mutex
+}
+
+func newAuthorizer(path string, audit io.Writer) (*authorizer, error) {
+	a := &authorizer{path: path, audit: audit}
+	if _, err := a.Reload(); err != nil {
+		return nil, err
+	}
+
+	return a, nil
+}
+
+// Reload reads the policy file again if it changed since the last load and
+// reports whether it did. An invalid file leaves the current policy in
+// place.
+func (a *authorizer) Reload() (bool, error) {
+	info, err := os.Stat(a.path)
+	if err != nil {
+		return false, err
+	}
+
+	a.mu.RLock()
+	unchanged := a.policy != nil && info.ModTime().Equal(a.modTime)
+	a.mu.RUnlock()
+
+	if unchanged {
+		return false, nil
+	}
+
+	data, err := os.ReadFile(a.path)
+	if err != nil {
+		return false, err
+	}
+
+	policy, err := parseAuthzPolicy(data)
+	if err != nil {
+		return false, fmt.Errorf("%s: %w", a.path, err)
+	}
+
+	a.mu.Lock()
+	a.policy = policy
+	a.modTime = info.ModTime()
+	a.mu.Unlock()
+
+	return true, nil
+}
+
+// Watch reloads the policy every interval until ctx ends.
+func (a *authorizer) Watch(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			reloaded, err := a.Reload()
+			if err != nil {
+				fmt.Println("Reload authorization policy", err)
+			} else if reloaded {
+				fmt.Println("Reloaded authorization policy", a.path)
+			}
+		}
+	}
+}
+
+// authzAuditEntry is a line of the audit log.
+type authzAuditEntry struct {
+	Time       time.Time `json:"time"`
+	Method     string    `json:"method"`
+	Identities []string  `json:"identities"`
+	Peer       string    `json:"peer,omitempty"`
+	Reason     string    `json:"reason"`
+}
+
+// Authorize checks the caller of ctx may call funcName of serviceName. A
+// caller presenting an unknown bearer token is unauthenticated, one the
+// policy does not allow is denied.
+func (a *authorizer) Authorize(ctx context.Context, serviceName, funcName string) error {
+	a.mu.RLock()
+	policy := a.policy
+	a.mu.RUnlock()
+
+	fullMethod := serviceName + "/" + funcName
+
+	p, _ := peer.FromContext(ctx)
+	identities := tlsconfig.PeerIdentities(p)
+
+	md, _ := metadata.FromIncomingContext(ctx)
+	for _, value := range md.Get("authorization") {
+		token, ok := strings.CutPrefix(value, "Bearer ")
+		if !ok {
+			continue
+		}
+
+		identity, ok := policy.tokenIdentity(strings.TrimSpace(token))
+		if !ok {
+			a.deny(fullMethod, identities, p, "unknown bearer token")
+			return status.Error(codes.Unauthenticated, "unknown bearer token")
+		}
+
+		identities = append(identities, identity)
+	}
+
+	ok, reason := policy.allowed(identities, fullMethod)
+	if !ok {
+		a.deny(fullMethod, identities, p, reason)
+		return status.Errorf(codes.PermissionDenied, "not allowed to call %s", fullMethod)
+	}
+
+	return nil
+}
+
+func (a *authorizer) deny(fullMethod string, identities []string, p *peer.Peer, reason string) {
+	entry := authzAuditEntry{
+		Time:       time.Now(),
+		Method:     fullMethod,
+		Identities: identities,
+		Reason:     reason,
+	}
+
+	if entry.Identities == nil {
+		entry.Identities = []string{}
+	}
+
+	if p != nil && p.Addr != nil {
+		entry.Peer = p.Addr.String()
+	}
+
+	line, err := json.Marshal(entry)
+	if err != nil {
+		fmt.Println("Audit", err)
+		return
+	}
+
+	a.auditMu.Lock()
+	defer a.auditMu.Unlock()
+
+	if _, err := a.audit.Write(append(line, '\n')); err != nil {
+		fmt.Println("Audit", err)
+	}
+}
+
+// authorize applies the authorization policy of r, if any, to a call of
+// funcName of serviceName made with ctx.
+func (r *reflectionHandler) authorize(ctx context.Context, serviceName, funcName string) error {
+	if r.authz == nil {
+		return nil
+	}
+
+	return r.authz.Authorize(ctx, serviceName, funcName)
+}
+
+// authzServerOptions applies the authorization policy to the methods the
+// agent serves itself. The calls the agent forwards to plugins are authorized
+// by proxyHandler.
+func authzServerOptions() []grpc.ServerOption {
+	return []grpc.ServerOption{
+		grpc.ChainUnaryInterceptor(func(ctx context.Context, req any, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (any, error) {
+			if err := r.authorizeServerMethod(ctx, info.Server, info.FullMethod); err != nil {
+				return nil, err
+			}
+
+			return handler(ctx, req)
+		}),
+		grpc.ChainStreamInterceptor(func(srv any, ss grpc.ServerStream, info *grpc.StreamServerInfo, handler grpc.StreamHandler) error {
+			if err := r.authorizeServerMethod(ss.Context(), srv, info.FullMethod); err != nil {
+				return err
+			}
+
+			return handler(srv, ss)
+		}),
+	}
+}
+
+// authorizeServerMethod authorizes a call of fullMethod of the service
+// implementation srv, which is nil for the services of plugins.
+func (r *reflectionHandler) authorizeServerMethod(ctx context.Context, srv any, fullMethod string) error {
+	if srv == nil {
+		return nil
+	}
+
+	serviceName, funcName, _ := strings.Cut(strings.TrimPrefix(fullMethod, "/"), "/")
+	if serviceName == grpc_health_v1.Health_ServiceDesc.ServiceName {
+		return nil
+	}
+
+	return r.authorize(ctx, serviceName, funcName)
+}
@@ -0,0 +1,221 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+
+	"github.com/rootwarp/snippets/golang/grpc/reflection/proto/agent"
+	"github.com/rootwarp/snippets/golang/grpc/reflection/proto/plugin"
+)
+
+const testAuthzPolicy = `
+tokens:
+  - token: ci-token
+    identity: ci-bot
+  - token: ops-token
+    identity: ops
+rules:
+  - identities: ["ci-bot", "*.example.com"]
+    allow: ["snippet.grpc.reflection.HelloService/*"]
+    deny: ["snippet.grpc.reflection.HelloService/HelloChat"]
+  - identities: ["ops"]
+    allow: ["*/*"]
+  - identities: ["*"]
+    deny: ["snippet.grpc.reflection.AdminService/*"]
+`
+
+func TestAuthzPolicy(t *testing.T) {
+	policy, err := parseAuthzPolicy([]byte(testAuthzPolicy))
+	assert.Nil(t, err)
+
+	tests := []struct {
+		identities []string
+		method     string
+		allowed    bool
+	}{
+		{[]string{"ci-bot"}, "snippet.grpc.reflection.HelloService/Hello", true},
+		{[]string{"ci-bot"}, "snippet.grpc.reflection.HelloService/HelloChat", false},
+		{[]string{"ci-bot"}, "other.Service/Call", false},
+		{[]string{"agent.example.com"}, "snippet.grpc.reflection.HelloService/HelloFeed", true},
+		{[]string{"a.agent.example.com"}, "snippet.grpc.reflection.HelloService/HelloFeed", false},
+		{[]string{"ops"}, "other.Service/Call", true},
+		{[]string{"ops"}, "snippet.grpc.reflection.AdminService/Reset", false},
+		{[]string{"example.com"}, "snippet.grpc.reflection.HelloService/Hello", false},
+		{nil, "snippet.grpc.reflection.HelloService/Hello", false},
+	}
+
+	for _, test := range tests {
+		allowed, reason := policy.allowed(test.identities, test.method)
+		assert.Equal(t, test.allowed, allowed, test.identities, test.method, reason)
+	}
+
+	identity, ok := policy.tokenIdentity("ops-token")
+	assert.True(t, ok)
+	assert.Equal(t, "ops", identity)
+
+	_, ok = policy.tokenIdentity("ops-token2")
+	assert.False(t, ok)
+
+	policy.Default = "allow"
+	allowed, _ := policy.allowed(nil, "other.Service/Call")
+	assert.True(t, allowed)
+}
+
+func TestParseAuthzPolicyInvalid(t *testing.T) {
+	for _, data := range []string{
+		"default: maybe",
+		"tokens: [{token: t}]",
+		"rules: [{identities: ['['], allow: ['*/*']}]",
+		"rules: {}",
+	} {
+		_, err := parseAuthzPolicy([]byte(data))
+		assert.NotNil(t, err, data)
+	}
+}
+
+func writeTestPolicy(t *testing.T, path, policy string, modTime time.Time) {
+	assert.Nil(t, os.WriteFile(path, []byte(policy), 0600))
+	assert.Nil(t, os.Chtimes(path, modTime, modTime))
+}
+
+func TestAuthorizer(t *testing.T) {
+	address, port := startTestPlugin(t)
+
+	policyFile := filepath.Join(t.TempDir(), "policy.yaml")
+	writeTestPolicy(t, policyFile, testAuthzPolicy, time.Now().Add(-time.Minute))
+
+	audit := &bytes.Buffer{}
+	authz, err := newAuthorizer(policyFile, audit)
+	assert.Nil(t, err)
+
+	r = &reflectionHandler{
+		authz: authz,
+	}
+	defer r.conns.Close()
+
+	ctx := context.Background()
+	serviceName := "snippet.grpc.reflection.HelloService"
+
+	_, err = r.Query(ctx, "hello", address, port, []string{serviceName})
+	assert.Nil(t, err)
+
+	withToken := func(token string) context.Context {
+		return metadata.NewIncomingContext(ctx, metadata.Pairs("authorization", "Bearer "+token))
+	}
+
+	_, err = r.Invoke(withToken("ci-token"), serviceName, "Hello", nil)
+	assert.Nil(t, err)
+
+	_, err = r.Invoke(ctx, serviceName, "Hello", nil)
+	assert.Equal(t, codes.PermissionDenied, status.Code(err))
+
+	_, err = r.Invoke(withToken("stolen"), serviceName, "Hello", nil)
+	assert.Equal(t, codes.Unauthenticated, status.Code(err))
+
+	err = r.InvokeStream(withToken("ci-token"), serviceName, "HelloChat", nil, nil)
+	assert.Equal(t, codes.PermissionDenied, status.Code(err))
+
+	// Every denial is audited.
+	lines := strings.Split(strings.TrimSpace(audit.String()), "\n")
+	assert.Len(t, lines, 3)
+
+	entry := authzAuditEntry{}
+	assert.Nil(t, json.Unmarshal([]byte(lines[2]), &entry))
+	assert.Equal(t, serviceName+"/HelloChat", entry.Method)
+	assert.Equal(t, []string{"ci-bot"}, entry.Identities)
+	assert.Equal(t, "denied by rule 0", entry.Reason)
+
+	// An invalid policy leaves the current one in place.
+	writeTestPolicy(t, policyFile, "default: maybe", time.Now().Add(-30*time.Second))
+	reloaded, err := authz.Reload()
+	assert.False(t, reloaded)
+	assert.NotNil(t, err)
+
+	_, err = r.Invoke(withToken("ci-token"), serviceName, "Hello", nil)
+	assert.Nil(t, err)
+
+	writeTestPolicy(t, policyFile, "default: allow", time.Now())
+	reloaded, err = authz.Reload()
+	assert.True(t, reloaded)
+	assert.Nil(t, err)
+
+	_, err = r.Invoke(ctx, serviceName, "Hello", nil)
+	assert.Nil(t, err)
+}
+
+func TestAuthorizerProxy(t *testing.T) {
+	address, port := startTestPlugin(t)
+
+	policyFile := filepath.Join(t.TempDir(), "policy.yaml")
+	writeTestPolicy(t, policyFile, testAuthzPolicy, time.Now())
+
+	audit := &bytes.Buffer{}
+	authz, err := newAuthorizer(policyFile, audit)
+	assert.Nil(t, err)
+
+	r = &reflectionHandler{
+		authz: authz,
+	}
+	defer r.conns.Close()
+
+	_, err = r.Query(context.Background(), "hello", address, port, []string{"snippet.grpc.reflection.HelloService"})
+	assert.Nil(t, err)
+
+	cli := plugin.NewHelloServiceClient(startTestAgent(t))
+
+	ctx := metadata.AppendToOutgoingContext(context.Background(), "authorization", "Bearer ci-token")
+	_, err = cli.Hello(ctx, &plugin.HelloRequest{Name: "rootwarp"})
+	assert.Nil(t, err)
+
+	_, err = cli.Hello(context.Background(), &plugin.HelloRequest{Name: "rootwarp"})
+	assert.Equal(t, codes.PermissionDenied, status.Code(err))
+	assert.Contains(t, audit.String(), `"peer":"127.0.0.1:`)
+}
+
+func TestAuthorizerRegistration(t *testing.T) {
+	address, port := startTestPlugin(t)
+
+	policyFile := filepath.Join(t.TempDir(), "policy.yaml")
+	writeTestPolicy(t, policyFile, testAuthzPolicy, time.Now())
+
+	audit := &bytes.Buffer{}
+	authz, err := newAuthorizer(policyFile, audit)
+	assert.Nil(t, err)
+
+	r = &reflectionHandler{authz: authz}
+	defer r.conns.Close()
+
+	cli := agent.NewRegistrationServiceClient(startTestAgent(t))
+	register := &agent.RegisterRequest{Name: "hello", Address: address, Port: int32(port)}
+
+	// ci-bot may call the plugin, not manage the registry.
+	ctx := metadata.AppendToOutgoingContext(context.Background(), "authorization", "Bearer ci-token")
+
+	_, err = cli.RegisterPlugin(ctx, register)
+	assert.Equal(t, codes.PermissionDenied, status.Code(err))
+	assert.Empty(t, r.registry.Services())
+
+	ops := metadata.AppendToOutgoingContext(context.Background(), "authorization", "Bearer ops-token")
+
+	_, err = cli.RegisterPlugin(ops, register)
+	assert.Nil(t, err)
+
+	_, err = cli.DeregisterPlugin(ctx, &agent.DeregisterRequest{Name: "hello"})
+	assert.Equal(t, codes.PermissionDenied, status.Code(err))
+	assert.NotEmpty(t, r.registry.Services())
+	assert.Contains(t, audit.String(), `"method":"snippet.grpc.reflection.RegistrationService/DeregisterPlugin"`)
+
+	_, err = cli.DeregisterPlugin(ops, &agent.DeregisterRequest{Name: "hello"})
+	assert.Nil(t, err)
+}
@@ -0,0 +1,142 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"hash/fnv"
+	"sync"
+
+	"google.golang.org/grpc/metadata"
+)
+
+// lbPolicy chooses which instance of a plugin takes a call.
+type lbPolicy int
+
+const (
+	// lbRoundRobin cycles through the instances.
+	lbRoundRobin lbPolicy = iota
+	// lbLeastOutstanding picks the instance with the fewest calls in flight.
+	lbLeastOutstanding
+	// lbConsistentHash sends calls carrying the same value of the hash key
+	// metadata to the same instance. Calls without it are balanced
+	// round-robin.
+	lbConsistentHash
+)
+
+func parseLBPolicy(s string) (lbPolicy, error) {
+	switch s {
+	case "round_robin":
+		return lbRoundRobin, nil
+	case "least_outstanding":
+		return lbLeastOutstanding, nil
+	case "consistent_hash":
+		return lbConsistentHash, nil
+	}
+
+	return 0, fmt.Errorf("unknown load balancing policy %q", s)
+}
+
+func (p lbPolicy) String() string {
+	switch p {
+	case lbLeastOutstanding:
+		return "least_outstanding"
+	case lbConsistentHash:
+		return "consistent_hash"
+	}
+
+	return "round_robin"
+}
+
+// balancer spreads the calls of a service over its instances. The zero value
+// balances round-robin.
+type balancer struct {
+	policy lbPolicy
+	// hashKey is the metadata key consistent hashing uses.
+	hashKey string
+
+	mu sync.Mutex
+	// next is the round-robin position of each service.
+	next map[string]int
+	// outstanding counts the calls in flight per instance address.
+	outstanding map[string]int
+}
+
+// Pick chooses the address of one of endpoints, which must not be empty, for
+// a call of serviceName made with ctx. The caller calls done once the call
+// ends.
+func (b *balancer) Pick(ctx context.Context, serviceName string, endpoints []endpoint) (address string, done func()) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if b.next == nil {
+		b.next = map[string]int{}
+		b.outstanding = map[string]int{}
+	}
+
+	start := b.next[serviceName] % len(endpoints)
+	b.next[serviceName] = start + 1
+
+	address = endpoints[start].Address
+
+	switch b.policy {
+	case lbLeastOutstanding:
+		// Ties go to the round-robin choice.
+		for i := 1; i < len(endpoints); i++ {
+			candidate := endpoints[(start+i)%len(endpoints)].Address
+			if b.outstanding[candidate] < b.outstanding[address] {
+				address = candidate
+			}
+		}
+	case lbConsistentHash:
+		if key, ok := hashKeyValue(ctx, b.hashKey); ok {
+			address = rendezvous(key, endpoints)
+		}
+	}
+
+	b.outstanding[address]++
+
+	var once sync.Once
+	return address, func() {
+		once.Do(func() {
+			b.mu.Lock()
+			defer b.mu.Unlock()
+
+			if b.outstanding[address]--; b.outstanding[address] <= 0 {
+				delete(b.outstanding, address)
+			}
+		})
+	}
+}
+
+// hashKeyValue returns the value of the metadata key which ctx carries.
+func hashKeyValue(ctx context.Context, key string) (string, bool) {
+	if key == "" {
+		return "", false
+	}
+
+	md, _ := metadata.FromIncomingContext(ctx)
+	if values := md.Get(key); len(values) > 0 {
+		return values[0], true
+	}
+
+	return "", false
+}
+
+// rendezvous returns the address of the endpoint ranking highest for key.
+// Only the keys of an instance move when it joins or leaves.
+func rendezvous(key string, endpoints []endpoint) string {
+	var best string
+	var bestScore uint64
+	for _, e := range endpoints {
+		h := fnv.New64a()
+		h.Write([]byte(key))
+		h.Write([]byte{0})
+		h.Write([]byte(e.Address))
+
+		if score := h.Sum64(); best == "" || score > bestScore {
+			best, bestScore = e.Address, score
+		}
+	}
+
+	return best
+}
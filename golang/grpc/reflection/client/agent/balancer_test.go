@@ -0,0 +1,96 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"google.golang.org/grpc/metadata"
+)
+
+func testEndpoints(addresses ...string) []endpoint {
+	endpoints := []endpoint{}
+	for _, address := range addresses {
+		endpoints = append(endpoints, endpoint{Address: address})
+	}
+
+	return endpoints
+}
+
+func TestBalancerRoundRobin(t *testing.T) {
+	b := &balancer{}
+	endpoints := testEndpoints("a:1", "b:1", "c:1")
+
+	picked := []string{}
+	for i := 0; i < 4; i++ {
+		address, done := b.Pick(context.Background(), "svc", endpoints)
+		done()
+
+		picked = append(picked, address)
+	}
+
+	assert.Equal(t, []string{"a:1", "b:1", "c:1", "a:1"}, picked)
+	assert.Empty(t, b.outstanding)
+}
+
+func TestBalancerLeastOutstanding(t *testing.T) {
+	b := &balancer{policy: lbLeastOutstanding}
+	endpoints := testEndpoints("a:1", "b:1", "c:1")
+	ctx := context.Background()
+
+	// a:1 keeps a call in flight.
+	address, _ := b.Pick(ctx, "svc", endpoints)
+	assert.Equal(t, "a:1", address)
+
+	for i := 0; i < 6; i++ {
+		address, done := b.Pick(ctx, "svc", endpoints)
+		assert.NotEqual(t, "a:1", address)
+
+		done()
+		done()
+	}
+
+	assert.Equal(t, map[string]int{"a:1": 1}, b.outstanding)
+}
+
+func TestBalancerConsistentHash(t *testing.T) {
+	b := &balancer{policy: lbConsistentHash, hashKey: "x-lb-key"}
+	endpoints := testEndpoints("a:1", "b:1", "c:1", "d:1")
+
+	pick := func(key string, endpoints []endpoint) string {
+		ctx := metadata.NewIncomingContext(context.Background(), metadata.Pairs("x-lb-key", key))
+		address, done := b.Pick(ctx, "svc", endpoints)
+		done()
+
+		return address
+	}
+
+	picked := map[string]string{}
+	for i := 0; i < 32; i++ {
+		key := fmt.Sprintf("user-%d", i)
+		picked[key] = pick(key, endpoints)
+
+		// The same key sticks to its instance.
+		assert.Equal(t, picked[key], pick(key, endpoints))
+	}
+
+	// Only the keys of an instance leaving move.
+	remaining := testEndpoints("a:1", "b:1", "d:1")
+	used := map[string]bool{}
+	for key, address := range picked {
+		used[address] = true
+		if address != "c:1" {
+			assert.Equal(t, address, pick(key, remaining), key)
+		}
+	}
+
+	assert.Len(t, used, 4)
+
+	// Calls without a key are balanced round-robin.
+	first, done := b.Pick(context.Background(), "other", endpoints)
+	done()
+	second, done := b.Pick(context.Background(), "other", endpoints)
+	done()
+	assert.NotEqual(t, first, second)
+}
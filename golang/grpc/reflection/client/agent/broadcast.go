@@ -0,0 +1,195 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"sync"
+
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/types/dynamicpb"
+
+	"github.com/rootwarp/snippets/golang/grpc/reflection/telemetry"
+)
+
+// broadcastMode tells how a broadcast deals with failing plugins.
+type broadcastMode int
+
+const (
+	// broadcastCollectAll calls every plugin regardless of failures.
+	broadcastCollectAll broadcastMode = iota
+	// broadcastFailFast cancels the calls still pending once a plugin
+	// fails.
+	broadcastFailFast
+)
+
+func parseBroadcastMode(s string) (broadcastMode, error) {
+	switch s {
+	case "", "collect_all":
+		return broadcastCollectAll, nil
+	case "fail_fast":
+		return broadcastFailFast, nil
+	}
+
+	return 0, fmt.Errorf("unknown broadcast mode %q", s)
+}
+
+// broadcastOptions configure a broadcast.
+type broadcastOptions struct {
+	Mode broadcastMode
+	// Concurrency is the number of plugins called at once. Zero or less
+	// means the agent's limit, which also caps larger values.
+	Concurrency int
+}
+
+// broadcastResult is the outcome of the call of one plugin.
+type broadcastResult struct {
+	Plugin  string
+	Address string
+	// Output is the protojson response of the plugin, if Err is nil.
+	Output []byte
+	Err    error
+}
+
+// Broadcast calls funcName of serviceName on every plugin serving it, one
+// instance each, with the same protojson payload. It returns the result of
+// every plugin, sorted by plugin name. The error is set when the call cannot
+// be made at all, like for an unknown method or an invalid payload; failures
+// of plugins are part of the results.
+//
+// Calls follow the timeout and circuit breaker configured for the method but
+// are not retried.
+func (r *reflectionHandler) Broadcast(ctx context.Context, serviceName, funcName string, payload []byte, opts broadcastOptions) (_ []broadcastResult, err error) {
+	fmt.Println("Broadcast")
+
+	if err := r.authorize(ctx, serviceName, funcName); err != nil {
+		return nil, err
+	}
+
+	service, fMeta, err := r.lookup(serviceName, funcName)
+	if err != nil {
+		return nil, err
+	}
+
+	if fMeta.Desc.IsClientStreaming() || fMeta.Desc.IsServerStreaming() {
+		return nil, status.Errorf(codes.InvalidArgument, "%s/%s is a streaming method", serviceName, funcName)
+	}
+
+	in, err := newDynamicMessage(fMeta.InDesc, payload)
+	if err != nil {
+		return nil, status.Error(codes.InvalidArgument, err.Error())
+	}
+
+	if !trace.SpanContextFromContext(ctx).IsValid() {
+		ctx = telemetry.Extract(ctx)
+	}
+
+	plugins := service.plugins()
+
+	ctx, span := r.startSpan(ctx, "Broadcast",
+		attribute.String("rpc.method", serviceName+"/"+funcName),
+		attribute.Int("plugin.count", len(plugins)))
+	defer func() { endSpan(span, err) }()
+
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	policy := r.callPolicy(service, serviceName, funcName)
+	limit := r.broadcastConcurrency(opts.Concurrency, len(plugins))
+	sem := make(chan struct{}, limit)
+
+	results := make([]broadcastResult, len(plugins))
+	wg := sync.WaitGroup{}
+	for i, name := range plugins {
+		results[i].Plugin = name
+
+		select {
+		case sem <- struct{}{}:
+		case <-ctx.Done():
+			results[i].Err = status.FromContextError(ctx.Err()).Err()
+			continue
+		}
+
+		wg.Add(1)
+		go func(result *broadcastResult) {
+			defer func() {
+				<-sem
+				wg.Done()
+			}()
+
+			// A slot may have been freed by a failure which canceled
+			// the broadcast.
+			if ctx.Err() != nil {
+				result.Err = status.FromContextError(ctx.Err()).Err()
+				return
+			}
+
+			instances := service
+			instances.Endpoints = service.pluginEndpoints(result.Plugin)
+
+			result.Address, result.Output, result.Err = r.broadcastOnce(ctx, serviceName, funcName, instances, fMeta, policy, in)
+			if result.Err != nil && opts.Mode == broadcastFailFast {
+				cancel()
+			}
+		}(&results[i])
+	}
+
+	wg.Wait()
+
+	return results, nil
+}
+
+// broadcastOnce calls an instance of service, whose endpoints are those of a
+// single plugin, and returns its address and response.
+func (r *reflectionHandler) broadcastOnce(ctx context.Context, serviceName, funcName string, service serviceMeta, fMeta funcMeta, policy callPolicy, in *dynamicpb.Message) (_ string, _ []byte, err error) {
+	ctx, finish := r.startCall(ctx, serviceName, funcName)
+	defer func() { finish(err) }()
+
+	ctx, cancel := withCallTimeout(ctx, policy)
+	defer cancel()
+
+	address, done, err := r.pick(ctx, serviceName, service, policy)
+	if err != nil {
+		return "", nil, err
+	}
+
+	conn, err := r.conns.Get(address)
+	if err != nil {
+		done(nil)
+		return address, nil, err
+	}
+
+	out := dynamicpb.NewMessage(fMeta.OutDesc.UnwrapMessage())
+
+	funcURL := fmt.Sprintf("/%s/%s", serviceName, funcName)
+	err = conn.Invoke(telemetry.OutgoingContext(r.forwardContext(ctx, service, address)), funcURL, in, out)
+	done(err)
+
+	if err != nil {
+		return address, nil, err
+	}
+
+	output, err := marshalDynamicMessage(fMeta.OutDesc, out)
+	return address, output, err
+}
+
+// broadcastConcurrency returns how many of n plugins a broadcast asking for
+// requested calls at once.
+func (r *reflectionHandler) broadcastConcurrency(requested, n int) int {
+	limit := n
+	if requested > 0 && requested < limit {
+		limit = requested
+	}
+
+	if r.broadcastLimit > 0 && r.broadcastLimit < limit {
+		limit = r.broadcastLimit
+	}
+
+	if limit < 1 {
+		limit = 1
+	}
+
+	return limit
+}
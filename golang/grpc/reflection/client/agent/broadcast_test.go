@@ -0,0 +1,193 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// registerTestBroadcastPlugins registers each of servers as a plugin of its
+// own, named by the key, all of them serving HelloService.
+func registerTestBroadcastPlugins(t *testing.T, h *reflectionHandler, servers map[string]*flakyHelloServer) {
+	for name, server := range servers {
+		address, port := startTestFlakyPlugin(t, server)
+
+		_, err := h.Register(context.Background(), name, address, port, registerOptions{})
+		assert.Nil(t, err)
+	}
+}
+
+func TestBroadcast(t *testing.T) {
+	servers := map[string]*flakyHelloServer{
+		"a": {},
+		"b": {},
+		"c": {failures: 100, code: codes.Internal},
+	}
+
+	h := &reflectionHandler{}
+	defer h.conns.Close()
+
+	registerTestBroadcastPlugins(t, h, servers)
+
+	ctx := context.Background()
+	serviceName := "snippet.grpc.reflection.HelloService"
+
+	// The plugins share the service.
+	assert.Equal(t, []string{"a", "b", "c"}, h.registry.Services()[serviceName].plugins())
+
+	results, err := h.Broadcast(ctx, serviceName, "Hello", []byte(`{"name": "rootwarp", "age": 40}`), broadcastOptions{})
+	assert.Nil(t, err)
+
+	if assert.Len(t, results, 3) {
+		for i, name := range []string{"a", "b"} {
+			assert.Equal(t, name, results[i].Plugin)
+			assert.Nil(t, results[i].Err)
+			assert.NotEmpty(t, results[i].Address)
+			assert.Contains(t, string(results[i].Output), "Hey rootwarp(40)")
+		}
+
+		assert.Equal(t, "c", results[2].Plugin)
+		assert.Equal(t, codes.Internal, status.Code(results[2].Err))
+		assert.Empty(t, results[2].Output)
+	}
+
+	for name, server := range servers {
+		assert.Equal(t, int32(1), server.calls.Load(), name)
+	}
+
+	// The call cannot be made at all.
+	_, err = h.Broadcast(ctx, serviceName, "Hello", []byte(`{"name": 1}`), broadcastOptions{})
+	assert.Equal(t, codes.InvalidArgument, status.Code(err))
+
+	_, err = h.Broadcast(ctx, serviceName, "HelloFeed", nil, broadcastOptions{})
+	assert.Equal(t, codes.InvalidArgument, status.Code(err))
+
+	_, err = h.Broadcast(ctx, serviceName, "Bye", nil, broadcastOptions{})
+	assert.ErrorIs(t, err, ErrFunctionNotFound)
+}
+
+func TestBroadcastFailFast(t *testing.T) {
+	ctx := context.Background()
+	serviceName := "snippet.grpc.reflection.HelloService"
+
+	// The failure of a cancels the calls in flight.
+	servers := map[string]*flakyHelloServer{
+		"a": {failures: 100, code: codes.Internal},
+		"b": {delay: 10 * time.Second},
+		"c": {delay: 10 * time.Second},
+	}
+
+	h := &reflectionHandler{}
+	defer h.conns.Close()
+
+	registerTestBroadcastPlugins(t, h, servers)
+
+	start := time.Now()
+	results, err := h.Broadcast(ctx, serviceName, "Hello", nil, broadcastOptions{Mode: broadcastFailFast})
+	assert.Nil(t, err)
+	assert.Less(t, time.Since(start), 5*time.Second)
+
+	if assert.Len(t, results, 3) {
+		assert.Equal(t, codes.Internal, status.Code(results[0].Err))
+		assert.Equal(t, codes.Canceled, status.Code(results[1].Err))
+		assert.Equal(t, codes.Canceled, status.Code(results[2].Err))
+	}
+
+	// Plugins one at a time, the ones after a are never called.
+	servers = map[string]*flakyHelloServer{
+		"a": {failures: 100, code: codes.Internal},
+		"b": {},
+		"c": {},
+	}
+
+	h = &reflectionHandler{}
+	defer h.conns.Close()
+
+	registerTestBroadcastPlugins(t, h, servers)
+
+	results, err = h.Broadcast(ctx, serviceName, "Hello", nil, broadcastOptions{Mode: broadcastFailFast, Concurrency: 1})
+	assert.Nil(t, err)
+
+	if assert.Len(t, results, 3) {
+		assert.Equal(t, codes.Internal, status.Code(results[0].Err))
+		assert.Equal(t, codes.Canceled, status.Code(results[1].Err))
+		assert.Equal(t, codes.Canceled, status.Code(results[2].Err))
+	}
+
+	assert.Equal(t, int32(0), servers["b"].calls.Load())
+	assert.Equal(t, int32(0), servers["c"].calls.Load())
+}
+
+func TestBroadcastConcurrency(t *testing.T) {
+	tests := []struct {
+		Limit     int
+		Requested int
+		Plugins   int
+		Expected  int
+	}{
+		{0, 0, 5, 5},
+		{0, 2, 5, 2},
+		{0, 10, 5, 5},
+		{3, 0, 5, 3},
+		{3, 4, 5, 3},
+		{3, 2, 5, 2},
+		{3, 0, 0, 1},
+	}
+
+	for _, test := range tests {
+		h := &reflectionHandler{broadcastLimit: test.Limit}
+		assert.Equal(t, test.Expected, h.broadcastConcurrency(test.Requested, test.Plugins), test)
+	}
+}
+
+func TestGatewayBroadcast(t *testing.T) {
+	r = &reflectionHandler{}
+	defer r.conns.Close()
+
+	registerTestBroadcastPlugins(t, r, map[string]*flakyHelloServer{
+		"a": {},
+		"b": {failures: 100, code: codes.Unavailable},
+	})
+
+	srv := httptest.NewServer(&gateway{})
+	defer srv.Close()
+
+	path := srv.URL + "/v1/snippet.grpc.reflection.HelloService/Hello"
+
+	resp, err := http.Post(path+"?broadcast=collect_all&concurrency=2", "application/json", strings.NewReader(`{"name": "rootwarp"}`))
+	assert.Nil(t, err)
+	defer resp.Body.Close()
+
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+
+	body := gatewayBroadcast{}
+	assert.Nil(t, json.NewDecoder(resp.Body).Decode(&body))
+
+	if assert.Len(t, body.Results, 2) {
+		assert.Equal(t, "a", body.Results[0].Plugin)
+		assert.Contains(t, string(body.Results[0].Result), "Hey rootwarp(0)")
+		assert.Nil(t, body.Results[0].Error)
+
+		assert.Equal(t, "b", body.Results[1].Plugin)
+		assert.Empty(t, body.Results[1].Result)
+		if assert.NotNil(t, body.Results[1].Error) {
+			assert.Equal(t, int(codes.Unavailable), body.Results[1].Error.Code)
+		}
+	}
+
+	for _, query := range []string{"?broadcast=all", "?broadcast&concurrency=0", "?broadcast&concurrency=x"} {
+		resp, err := http.Post(path+query, "application/json", nil)
+		assert.Nil(t, err)
+		resp.Body.Close()
+
+		assert.Equal(t, http.StatusBadRequest, resp.StatusCode, query)
+	}
+}
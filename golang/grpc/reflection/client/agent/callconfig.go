@@ -0,0 +1,339 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math/rand"
+	"sync"
+	"time"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// serviceConfig holds the call settings of plugin methods in the format of a
+// gRPC service config, extended with a circuit breaker:
+//
+//	{"methodConfig": [{
+//	  "name": [{"service": "snippet.grpc.reflection.HelloService", "method": "Hello"}],
+//	  "timeout": "1.5s",
+//	  "retryPolicy": {
+//	    "maxAttempts": 3,
+//	    "initialBackoff": "0.1s",
+//	    "maxBackoff": "1s",
+//	    "backoffMultiplier": 2,
+//	    "retryableStatusCodes": ["UNAVAILABLE"]
+//	  },
+//	  "circuitBreaker": {"failureThreshold": 5, "openDuration": "30s"}
+//	}]}
+//
+// A name without method covers the whole service, an empty name every
+// service.
+type serviceConfig struct {
+	MethodConfig []methodConfig `json:"methodConfig"`
+}
+
+type methodConfig struct {
+	Name           []methodName   `json:"name"`
+	Timeout        string         `json:"timeout"`
+	RetryPolicy    *retryConfig   `json:"retryPolicy"`
+	CircuitBreaker *breakerConfig `json:"circuitBreaker"`
+
+	policy callPolicy
+}
+
+type methodName struct {
+	Service string `json:"service"`
+	Method  string `json:"method"`
+}
+
+type retryConfig struct {
+	MaxAttempts          int          `json:"maxAttempts"`
+	InitialBackoff       string       `json:"initialBackoff"`
+	MaxBackoff           string       `json:"maxBackoff"`
+	BackoffMultiplier    float64      `json:"backoffMultiplier"`
+	RetryableStatusCodes []codes.Code `json:"retryableStatusCodes"`
+}
+
+type breakerConfig struct {
+	FailureThreshold int    `json:"failureThreshold"`
+	OpenDuration     string `json:"openDuration"`
+}
+
+// maxRetryAttempts caps maxAttempts like gRPC does.
+const maxRetryAttempts = 5
+
+// callPolicy is how the agent calls one plugin method.
+type callPolicy struct {
+	// Timeout bounds the call including its retries, zero leaves the
+	// caller's deadline alone.
+	Timeout time.Duration
+
+	// MaxAttempts is at least one, a call is retried while it fails with
+	// one of RetryableCodes.
+	MaxAttempts       int
+	InitialBackoff    time.Duration
+	MaxBackoff        time.Duration
+	BackoffMultiplier float64
+	RetryableCodes    []codes.Code
+
+	// BreakerThreshold consecutive failures of an instance open its circuit
+	// breaker for BreakerOpen. Zero disables the breaker.
+	BreakerThreshold int
+	BreakerOpen      time.Duration
+}
+
+var defaultCallPolicy = callPolicy{MaxAttempts: 1}
+
+func parseServiceConfig(data []byte) (*serviceConfig, error) {
+	config := &serviceConfig{}
+	if err := json.Unmarshal(data, config); err != nil {
+		return nil, err
+	}
+
+	return config, nil
+}
+
+// UnmarshalJSON decodes and validates a service config, which also happens
+// when the registry store loads one.
+func (c *serviceConfig) UnmarshalJSON(data []byte) error {
+	type plain serviceConfig
+	if err := json.Unmarshal(data, (*plain)(c)); err != nil {
+		return err
+	}
+
+	for i := range c.MethodConfig {
+		mc := &c.MethodConfig[i]
+		policy, err := mc.parse()
+		if err != nil {
+			return fmt.Errorf("methodConfig %d: %w", i, err)
+		}
+
+		mc.policy = policy
+	}
+
+	return nil
+}
+
+func (mc *methodConfig) parse() (callPolicy, error) {
+	policy := defaultCallPolicy
+
+	var err error
+	if mc.Timeout != "" {
+		if policy.Timeout, err = parsePositiveDuration("timeout", mc.Timeout); err != nil {
+			return callPolicy{}, err
+		}
+	}
+
+	if rc := mc.RetryPolicy; rc != nil {
+		if rc.MaxAttempts < 2 {
+			return callPolicy{}, errors.New("retryPolicy.maxAttempts must be at least 2")
+		}
+
+		if rc.BackoffMultiplier <= 0 {
+			return callPolicy{}, errors.New("retryPolicy.backoffMultiplier must be positive")
+		}
+
+		if len(rc.RetryableStatusCodes) == 0 {
+			return callPolicy{}, errors.New("retryPolicy.retryableStatusCodes must not be empty")
+		}
+
+		policy.MaxAttempts = rc.MaxAttempts
+		if policy.MaxAttempts > maxRetryAttempts {
+			policy.MaxAttempts = maxRetryAttempts
+		}
+
+		if policy.InitialBackoff, err = parsePositiveDuration("retryPolicy.initialBackoff", rc.InitialBackoff); err != nil {
+			return callPolicy{}, err
+		}
+
+		if policy.MaxBackoff, err = parsePositiveDuration("retryPolicy.maxBackoff", rc.MaxBackoff); err != nil {
+			return callPolicy{}, err
+		}
+
+		policy.BackoffMultiplier = rc.BackoffMultiplier
+		policy.RetryableCodes = rc.RetryableStatusCodes
+	}
+
+	if bc := mc.CircuitBreaker; bc != nil {
+		if bc.FailureThreshold < 1 {
+			return callPolicy{}, errors.New("circuitBreaker.failureThreshold must be positive")
+		}
+
+		if policy.BreakerOpen, err = parsePositiveDuration("circuitBreaker.openDuration", bc.OpenDuration); err != nil {
+			return callPolicy{}, err
+		}
+
+		policy.BreakerThreshold = bc.FailureThreshold
+	}
+
+	return policy, nil
+}
+
+func parsePositiveDuration(field, s string) (time.Duration, error) {
+	d, err := time.ParseDuration(s)
+	if err != nil {
+		return 0, fmt.Errorf("%s: %w", field, err)
+	}
+
+	if d <= 0 {
+		return 0, fmt.Errorf("%s must be positive", field)
+	}
+
+	return d, nil
+}
+
+// find returns the method config covering funcName of serviceName and how
+// specific its name is: 2 for the method, 1 for the service, 0 for every
+// service and -1 when none matches.
+func (c *serviceConfig) find(serviceName, funcName string) (*methodConfig, int) {
+	if c == nil {
+		return nil, -1
+	}
+
+	var found *methodConfig
+	specificity := -1
+	for i := range c.MethodConfig {
+		mc := &c.MethodConfig[i]
+		for _, name := range mc.Name {
+			s := -1
+			switch {
+			case name.Service == "" && name.Method == "":
+				s = 0
+			case name.Service == serviceName && name.Method == "":
+				s = 1
+			case name.Service == serviceName && name.Method == funcName:
+				s = 2
+			}
+
+			if s > specificity {
+				found, specificity = mc, s
+			}
+		}
+	}
+
+	return found, specificity
+}
+
+// callPolicy returns the policy of funcName of service. The most specific
+// method config of the plugin's service config and the agent's config
+// applies, the agent's at equal specificity so operators can override
+// plugins.
+func (r *reflectionHandler) callPolicy(service serviceMeta, serviceName, funcName string) callPolicy {
+	pluginConfig, pluginSpecificity := service.Config.find(serviceName, funcName)
+	agentConfig, agentSpecificity := r.callConfig.find(serviceName, funcName)
+
+	switch {
+	case agentConfig != nil && agentSpecificity >= pluginSpecificity:
+		return agentConfig.policy
+	case pluginConfig != nil:
+		return pluginConfig.policy
+	}
+
+	return defaultCallPolicy
+}
+
+func (p callPolicy) retryable(err error) bool {
+	code := status.Code(err)
+	for _, retryable := range p.RetryableCodes {
+		if code == retryable {
+			return true
+		}
+	}
+
+	return false
+}
+
+// backoff returns the randomized delay before retry attempt, counting from
+// one.
+func (p callPolicy) backoff(attempt int) time.Duration {
+	limit := float64(p.InitialBackoff)
+	for i := 1; i < attempt; i++ {
+		limit *= p.BackoffMultiplier
+	}
+
+	if limit > float64(p.MaxBackoff) {
+		limit = float64(p.MaxBackoff)
+	}
+
+	return time.Duration(rand.Float64() * limit)
+}
+
+// breakerSet keeps the circuit breaker of every service instance. The zero
+// value is ready to use.
+type breakerSet struct {
+	mu       sync.Mutex
+	breakers map[string]*breakerState
+}
+
+type breakerState struct {
+	failures  int
+	openUntil time.Time
+}
+
+func breakerKey(serviceName, address string) string {
+	return serviceName + "@" + address
+}
+
+// Allow reports whether the breaker of key lets calls through. Once it was
+// open for long enough, calls go through again until one fails.
+func (b *breakerSet) Allow(key string) bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	state, ok := b.breakers[key]
+	return !ok || !time.Now().Before(state.openUntil)
+}
+
+// Report records the outcome of a call through the breaker of key.
+func (b *breakerSet) Report(key string, policy callPolicy, err error) {
+	if policy.BreakerThreshold == 0 {
+		return
+	}
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if !isInstanceFailure(err) {
+		delete(b.breakers, key)
+		return
+	}
+
+	if b.breakers == nil {
+		b.breakers = map[string]*breakerState{}
+	}
+
+	state, ok := b.breakers[key]
+	if !ok {
+		state = &breakerState{}
+		b.breakers[key] = state
+	}
+
+	state.failures++
+	if state.failures >= policy.BreakerThreshold {
+		fmt.Println("Circuit breaker open", key)
+		state.openUntil = time.Now().Add(policy.BreakerOpen)
+	}
+}
+
+// isInstanceFailure reports whether err tells the instance is in trouble, as
+// opposed to rejecting a call.
+func isInstanceFailure(err error) bool {
+	switch status.Code(err) {
+	case codes.Unavailable, codes.DeadlineExceeded, codes.Internal, codes.Unknown, codes.DataLoss:
+		return true
+	}
+
+	return false
+}
+
+// withCallTimeout applies the timeout of policy to ctx.
+func withCallTimeout(ctx context.Context, policy callPolicy) (context.Context, context.CancelFunc) {
+	if policy.Timeout == 0 {
+		return context.WithCancel(ctx)
+	}
+
+	return context.WithTimeout(ctx, policy.Timeout)
+}
@@ -0,0 +1,301 @@
+package main
+
+import (
+	"context"
+	"net"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/reflection"
+	"google.golang.org/grpc/status"
+
+	"github.com/rootwarp/snippets/golang/grpc/reflection/proto/agent"
+	"github.com/rootwarp/snippets/golang/grpc/reflection/proto/plugin"
+)
+
+// flakyHelloServer fails the first failures calls of Hello with code and
+// sleeps delay before answering.
+type flakyHelloServer struct {
+	testHelloServer
+
+	failures int32
+	code     codes.Code
+	delay    time.Duration
+	calls    atomic.Int32
+}
+
+func (s *flakyHelloServer) Hello(ctx context.Context, in *plugin.HelloRequest) (*plugin.HelloResponse, error) {
+	if s.calls.Add(1) <= s.failures {
+		return nil, status.Error(s.code, "flaky")
+	}
+
+	select {
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	case <-time.After(s.delay):
+	}
+
+	return s.testHelloServer.Hello(ctx, in)
+}
+
+func startTestFlakyPlugin(t *testing.T, server *flakyHelloServer) (string, int) {
+	s := grpc.NewServer()
+	plugin.RegisterHelloServiceServer(s, server)
+	reflection.Register(s)
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.Nil(t, err)
+
+	go s.Serve(l)
+	t.Cleanup(s.Stop)
+
+	addr := l.Addr().(*net.TCPAddr)
+	return addr.IP.String(), addr.Port
+}
+
+func TestParseServiceConfig(t *testing.T) {
+	config, err := parseServiceConfig([]byte(`{"methodConfig": [{
+		"name": [{"service": "snippet.grpc.reflection.HelloService", "method": "Hello"}],
+		"timeout": "1.5s",
+		"retryPolicy": {
+			"maxAttempts": 10,
+			"initialBackoff": "0.1s",
+			"maxBackoff": "1s",
+			"backoffMultiplier": 2,
+			"retryableStatusCodes": ["UNAVAILABLE", "RESOURCE_EXHAUSTED"]
+		},
+		"circuitBreaker": {"failureThreshold": 3, "openDuration": "30s"}
+	}]}`))
+	assert.Nil(t, err)
+
+	assert.Equal(t, callPolicy{
+		Timeout:           1500 * time.Millisecond,
+		MaxAttempts:       maxRetryAttempts,
+		InitialBackoff:    100 * time.Millisecond,
+		MaxBackoff:        time.Second,
+		BackoffMultiplier: 2,
+		RetryableCodes:    []codes.Code{codes.Unavailable, codes.ResourceExhausted},
+		BreakerThreshold:  3,
+		BreakerOpen:       30 * time.Second,
+	}, config.MethodConfig[0].policy)
+
+	tests := []string{
+		`{"methodConfig": [{"timeout": "soon"}]}`,
+		`{"methodConfig": [{"timeout": "-1s"}]}`,
+		`{"methodConfig": [{"retryPolicy": {"maxAttempts": 1, "initialBackoff": "1s", "maxBackoff": "1s", "backoffMultiplier": 1, "retryableStatusCodes": ["UNAVAILABLE"]}}]}`,
+		`{"methodConfig": [{"retryPolicy": {"maxAttempts": 2, "initialBackoff": "1s", "maxBackoff": "1s", "backoffMultiplier": 1}}]}`,
+		`{"methodConfig": [{"retryPolicy": {"maxAttempts": 2, "maxBackoff": "1s", "backoffMultiplier": 1, "retryableStatusCodes": ["UNAVAILABLE"]}}]}`,
+		`{"methodConfig": [{"retryPolicy": {"maxAttempts": 2, "initialBackoff": "1s", "maxBackoff": "1s", "retryableStatusCodes": ["UNAVAILABLE"]}}]}`,
+		`{"methodConfig": [{"retryPolicy": {"maxAttempts": 2, "initialBackoff": "1s", "maxBackoff": "1s", "backoffMultiplier": 1, "retryableStatusCodes": ["NOPE"]}}]}`,
+		`{"methodConfig": [{"circuitBreaker": {"failureThreshold": 0, "openDuration": "1s"}}]}`,
+		`{"methodConfig": [{"circuitBreaker": {"failureThreshold": 1}}]}`,
+		`{"methodConfig": {}}`,
+	}
+
+	for _, test := range tests {
+		_, err := parseServiceConfig([]byte(test))
+		assert.NotNil(t, err, test)
+	}
+}
+
+func TestCallPolicy(t *testing.T) {
+	serviceName := "snippet.grpc.reflection.HelloService"
+
+	pluginConfig, err := parseServiceConfig([]byte(`{"methodConfig": [
+		{"name": [{"service": "snippet.grpc.reflection.HelloService"}], "timeout": "1s"},
+		{"name": [{"service": "snippet.grpc.reflection.HelloService", "method": "Hello"}], "timeout": "2s"}
+	]}`))
+	assert.Nil(t, err)
+
+	agentConfig, err := parseServiceConfig([]byte(`{"methodConfig": [
+		{"name": [{}], "timeout": "3s"},
+		{"name": [{"service": "snippet.grpc.reflection.HelloService", "method": "HelloFeed"}], "timeout": "4s"}
+	]}`))
+	assert.Nil(t, err)
+
+	h := &reflectionHandler{callConfig: agentConfig}
+	service := serviceMeta{Config: pluginConfig}
+
+	tests := []struct {
+		Service  string
+		Method   string
+		Expected time.Duration
+	}{
+		{serviceName, "Hello", 2 * time.Second},
+		{serviceName, "HelloAll", time.Second},
+		// The agent wins at equal specificity.
+		{serviceName, "HelloFeed", 4 * time.Second},
+		{"snippet.other.Service", "Call", 3 * time.Second},
+	}
+
+	for _, test := range tests {
+		policy := h.callPolicy(service, test.Service, test.Method)
+		assert.Equal(t, test.Expected, policy.Timeout, test.Method)
+	}
+
+	assert.Equal(t, defaultCallPolicy, (&reflectionHandler{}).callPolicy(serviceMeta{}, serviceName, "Hello"))
+}
+
+func TestBreakerSet(t *testing.T) {
+	b := &breakerSet{}
+	policy := callPolicy{BreakerThreshold: 2, BreakerOpen: 50 * time.Millisecond}
+	key := breakerKey("snippet.grpc.reflection.HelloService", "127.0.0.1:1")
+	unavailable := status.Error(codes.Unavailable, "down")
+
+	// Rejected calls do not count.
+	b.Report(key, policy, status.Error(codes.InvalidArgument, "bad"))
+	b.Report(key, policy, unavailable)
+	assert.True(t, b.Allow(key))
+
+	// A success resets the count.
+	b.Report(key, policy, nil)
+	b.Report(key, policy, unavailable)
+	assert.True(t, b.Allow(key))
+
+	b.Report(key, policy, unavailable)
+	assert.False(t, b.Allow(key))
+	assert.True(t, b.Allow(breakerKey("snippet.grpc.reflection.HelloService", "127.0.0.1:2")))
+
+	// Half open after the open duration, the next failure opens it again.
+	assert.Eventually(t, func() bool { return b.Allow(key) }, time.Second, 10*time.Millisecond)
+	b.Report(key, policy, unavailable)
+	assert.False(t, b.Allow(key))
+
+	// Without a threshold nothing is tracked.
+	other := breakerKey("snippet.grpc.reflection.HelloService", "127.0.0.1:3")
+	for i := 0; i < 10; i++ {
+		b.Report(other, defaultCallPolicy, unavailable)
+	}
+	assert.True(t, b.Allow(other))
+}
+
+func TestInvokeRetry(t *testing.T) {
+	serviceName := "snippet.grpc.reflection.HelloService"
+	config := `{"methodConfig": [{
+		"name": [{"service": "snippet.grpc.reflection.HelloService"}],
+		"retryPolicy": {
+			"maxAttempts": 3,
+			"initialBackoff": "0.01s",
+			"maxBackoff": "0.05s",
+			"backoffMultiplier": 2,
+			"retryableStatusCodes": ["UNAVAILABLE"]
+		}
+	}]}`
+
+	tests := []struct {
+		Failures int32
+		Code     codes.Code
+		Calls    int32
+		Expected codes.Code
+	}{
+		{Failures: 2, Code: codes.Unavailable, Calls: 3, Expected: codes.OK},
+		{Failures: 3, Code: codes.Unavailable, Calls: 3, Expected: codes.Unavailable},
+		{Failures: 1, Code: codes.InvalidArgument, Calls: 1, Expected: codes.InvalidArgument},
+	}
+
+	for _, test := range tests {
+		server := &flakyHelloServer{failures: test.Failures, code: test.Code}
+		address, port := startTestFlakyPlugin(t, server)
+
+		h := &reflectionHandler{}
+		defer h.conns.Close()
+
+		ctx := context.Background()
+		sc, err := parseServiceConfig([]byte(config))
+		assert.Nil(t, err)
+
+		_, err = h.Register(ctx, "hello", address, port, registerOptions{Config: sc})
+		assert.Nil(t, err)
+
+		_, err = h.Invoke(ctx, serviceName, "Hello", []byte(`{"name": "rootwarp", "age": 40}`))
+		assert.Equal(t, test.Expected, status.Code(err))
+		assert.Equal(t, test.Calls, server.calls.Load())
+	}
+}
+
+func TestInvokeTimeout(t *testing.T) {
+	server := &flakyHelloServer{delay: time.Second}
+	address, port := startTestFlakyPlugin(t, server)
+
+	h := &reflectionHandler{}
+	defer h.conns.Close()
+
+	h.callConfig, _ = parseServiceConfig([]byte(`{"methodConfig": [{"name": [{}], "timeout": "0.05s"}]}`))
+
+	ctx := context.Background()
+	serviceName := "snippet.grpc.reflection.HelloService"
+
+	_, err := h.Query(ctx, "hello", address, port, nil)
+	assert.Nil(t, err)
+
+	start := time.Now()
+	_, err = h.Invoke(ctx, serviceName, "Hello", []byte(`{"name": "rootwarp", "age": 40}`))
+	assert.Equal(t, codes.DeadlineExceeded, status.Code(err))
+	assert.Less(t, time.Since(start), 500*time.Millisecond)
+}
+
+func TestInvokeCircuitBreaker(t *testing.T) {
+	server := &flakyHelloServer{failures: 100, code: codes.Unavailable}
+	address, port := startTestFlakyPlugin(t, server)
+
+	h := &reflectionHandler{}
+	defer h.conns.Close()
+
+	h.callConfig, _ = parseServiceConfig([]byte(`{"methodConfig": [{
+		"name": [{}],
+		"circuitBreaker": {"failureThreshold": 2, "openDuration": "1m"}
+	}]}`))
+
+	ctx := context.Background()
+	serviceName := "snippet.grpc.reflection.HelloService"
+	payload := []byte(`{"name": "rootwarp", "age": 40}`)
+
+	_, err := h.Query(ctx, "hello", address, port, nil)
+	assert.Nil(t, err)
+
+	for i := 0; i < 2; i++ {
+		_, err := h.Invoke(ctx, serviceName, "Hello", payload)
+		assert.Equal(t, codes.Unavailable, status.Code(err))
+	}
+
+	// The plugin is not called while the breaker is open.
+	_, err = h.Invoke(ctx, serviceName, "Hello", payload)
+	assert.Equal(t, codes.Unavailable, status.Code(err))
+	assert.Contains(t, err.Error(), "circuit breaker")
+	assert.Equal(t, int32(2), server.calls.Load())
+}
+
+func TestRegisterServiceConfig(t *testing.T) {
+	address, port := startTestPlugin(t)
+
+	r = &reflectionHandler{}
+	defer r.conns.Close()
+
+	ctx := context.Background()
+	serviceName := "snippet.grpc.reflection.HelloService"
+	s := &registrationServer{lease: 30 * time.Second}
+
+	_, err := s.RegisterPlugin(ctx, &agent.RegisterRequest{
+		Name:          "hello",
+		Address:       address,
+		Port:          int32(port),
+		ServiceConfig: `{"methodConfig": [{"timeout": "never"}]}`,
+	})
+	assert.Equal(t, codes.InvalidArgument, status.Code(err))
+	assert.NotContains(t, r.registry.Services(), serviceName)
+
+	_, err = s.RegisterPlugin(ctx, &agent.RegisterRequest{
+		Name:          "hello",
+		Address:       address,
+		Port:          int32(port),
+		ServiceConfig: `{"methodConfig": [{"name": [{"service": "snippet.grpc.reflection.HelloService"}], "timeout": "2s"}]}`,
+	})
+	assert.Nil(t, err)
+
+	policy := r.callPolicy(r.registry.Services()[serviceName], serviceName, "Hello")
+	assert.Equal(t, 2*time.Second, policy.Timeout)
+}
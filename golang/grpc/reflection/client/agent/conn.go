@@ -0,0 +1,145 @@
+package main
+
+import (
+	"sync"
+	"time"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/backoff"
+	"google.golang.org/grpc/connectivity"
+	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/credentials/insecure"
+
+	"github.com/rootwarp/snippets/golang/grpc/reflection/transport"
+)
+
+// connPool keeps one long-lived ClientConn per plugin address, which may be
+// any address the transport package dials. The
+// ClientConn reconnects by itself with exponential backoff when the plugin
+// goes away, so callers only see errors while it is unreachable.
+//
+// The zero value is ready to use.
+type connPool struct {
+	mu    sync.Mutex
+	conns map[string]*grpc.ClientConn
+	// held counts the holders of each address, Retain keeps their
+	// connections open.
+	held map[string]int
+
+	// creds secures the connections, they are insecure when it is nil.
+	creds credentials.TransportCredentials
+	// peerCreds secures the connections to the peer agents at peers
+	// instead, creds does when it is nil.
+	peerCreds credentials.TransportCredentials
+	peers     map[string]bool
+}
+
+func (p *connPool) Get(address string) (*grpc.ClientConn, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	return p.get(address)
+}
+
+// Hold is Get keeping the connection open, whatever Retain is asked to
+// close, until release is called.
+func (p *connPool) Hold(address string) (_ *grpc.ClientConn, release func(), err error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	conn, err := p.get(address)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	if p.held == nil {
+		p.held = map[string]int{}
+	}
+
+	p.held[address]++
+
+	once := sync.Once{}
+	release = func() {
+		once.Do(func() {
+			p.mu.Lock()
+			defer p.mu.Unlock()
+
+			if p.held[address]--; p.held[address] == 0 {
+				delete(p.held, address)
+			}
+		})
+	}
+
+	return conn, release, nil
+}
+
+func (p *connPool) get(address string) (*grpc.ClientConn, error) {
+	if conn, ok := p.conns[address]; ok && conn.GetState() != connectivity.Shutdown {
+		return conn, nil
+	}
+
+	cred := p.creds
+	if p.peers[address] && p.peerCreds != nil {
+		cred = p.peerCreds
+	}
+
+	if cred == nil {
+		cred = insecure.NewCredentials()
+	}
+
+	conn, err := transport.Dial(address,
+		grpc.WithTransportCredentials(cred),
+		grpc.WithConnectParams(grpc.ConnectParams{
+			Backoff: backoff.Config{
+				BaseDelay:  100 * time.Millisecond,
+				Multiplier: 1.6,
+				Jitter:     0.2,
+				MaxDelay:   5 * time.Second,
+			},
+			MinConnectTimeout: 5 * time.Second,
+		}),
+	)
+	if err != nil {
+		return nil, err
+	}
+
+	if p.conns == nil {
+		p.conns = map[string]*grpc.ClientConn{}
+	}
+
+	p.conns[address] = conn
+
+	return conn, nil
+}
+
+// Retain closes every connection whose address is not in inUse and not
+// held.
+func (p *connPool) Retain(inUse map[string]bool) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	for address, conn := range p.conns {
+		if !inUse[address] && p.held[address] == 0 {
+			conn.Close()
+			delete(p.conns, address)
+		}
+	}
+}
+
+// Close closes every connection of the pool.
+func (p *connPool) Close() {
+	p.Retain(nil)
+}
+
+// releaseConns closes the pooled connections which no registered service
+// uses anymore. The registry must be locked.
+func (r *reflectionHandler) releaseConns() {
+	inUse := map[string]bool{}
+	for _, service := range r.registry.all() {
+		for _, e := range service.Endpoints {
+			inUse[e.Address] = true
+		}
+	}
+
+	r.conns.Retain(inUse)
+}
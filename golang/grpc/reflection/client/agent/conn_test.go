@@ -0,0 +1,97 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"google.golang.org/grpc"
+
+	"github.com/rootwarp/snippets/golang/grpc/reflection/proto/plugin"
+)
+
+func TestConnPoolReuse(t *testing.T) {
+	address, port := startTestPlugin(t)
+	host := fmt.Sprintf("%s:%d", address, port)
+
+	h := &reflectionHandler{}
+
+	ctx := context.Background()
+	serviceName := "snippet.grpc.reflection.HelloService"
+
+	_, err := h.Query(ctx, "hello", address, port, nil)
+	assert.Nil(t, err)
+	assert.Len(t, h.conns.conns, 1)
+
+	conn := h.conns.conns[host]
+
+	for i := 0; i < 3; i++ {
+		_, err := h.Invoke(ctx, serviceName, "Hello", nil)
+		assert.Nil(t, err)
+	}
+
+	assert.Len(t, h.conns.conns, 1)
+	assert.Same(t, conn, h.conns.conns[host])
+
+	err = h.Deregister("hello", "")
+	assert.Nil(t, err)
+	assert.Empty(t, h.conns.conns)
+}
+
+func TestConnPoolReconnect(t *testing.T) {
+	s, address, port := startTestPluginServer(t)
+	host := fmt.Sprintf("%s:%d", address, port)
+
+	h := &reflectionHandler{}
+	defer h.conns.Close()
+
+	ctx := context.Background()
+	serviceName := "snippet.grpc.reflection.HelloService"
+
+	_, err := h.Query(ctx, "hello", address, port, nil)
+	assert.Nil(t, err)
+
+	s.Stop()
+
+	_, err = h.Invoke(ctx, serviceName, "Hello", nil)
+	assert.NotNil(t, err)
+
+	// Bring the plugin back on the same address.
+	l, err := net.Listen("tcp", host)
+	assert.Nil(t, err)
+
+	s = grpc.NewServer()
+	plugin.RegisterHelloServiceServer(s, &testHelloServer{})
+	go s.Serve(l)
+	defer s.Stop()
+
+	assert.Eventually(t, func() bool {
+		_, err := h.Invoke(ctx, serviceName, "Hello", nil)
+		return err == nil
+	}, 5*time.Second, 50*time.Millisecond)
+}
+
+func TestConnPoolHold(t *testing.T) {
+	address, port := startTestPlugin(t)
+	host := fmt.Sprintf("%s:%d", address, port)
+
+	p := &connPool{}
+	defer p.Close()
+
+	conn, release, err := p.Hold(host)
+	assert.Nil(t, err)
+
+	// Held connections survive Retain.
+	p.Retain(nil)
+	assert.Same(t, conn, p.conns[host])
+
+	release()
+	release()
+	assert.Empty(t, p.held)
+
+	p.Retain(nil)
+	assert.Empty(t, p.conns)
+}
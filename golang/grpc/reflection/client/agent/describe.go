@@ -0,0 +1,106 @@
+package main
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/jhump/protoreflect/desc"
+	"github.com/jhump/protoreflect/desc/protoprint"
+)
+
+// describeService renders service as proto source: the service definition
+// followed by the messages and enums of its package its methods use, in the
+// order they are first used.
+func describeService(service serviceMeta) (string, error) {
+	pkg := service.Desc.GetFile().GetPackage()
+
+	types := []desc.Descriptor{}
+	seen := map[string]bool{}
+
+	var add func(d desc.Descriptor)
+	add = func(d desc.Descriptor) {
+		// Nested types are printed along with the message declaring them.
+		for {
+			parent, ok := d.GetParent().(*desc.MessageDescriptor)
+			if !ok {
+				break
+			}
+
+			d = parent
+		}
+
+		if seen[d.GetFullyQualifiedName()] || d.GetFile().GetPackage() != pkg {
+			return
+		}
+
+		seen[d.GetFullyQualifiedName()] = true
+		types = append(types, d)
+
+		md, ok := d.(*desc.MessageDescriptor)
+		if !ok {
+			return
+		}
+
+		addFields(md, add)
+	}
+
+	funcNames := make([]string, 0, len(service.Functions))
+	for funcName := range service.Functions {
+		funcNames = append(funcNames, funcName)
+	}
+
+	sort.Strings(funcNames)
+
+	for _, funcName := range funcNames {
+		fMeta := service.Functions[funcName]
+		add(fMeta.InDesc)
+		add(fMeta.OutDesc)
+	}
+
+	printer := &protoprint.Printer{Compact: true}
+
+	sb := &strings.Builder{}
+	fmt.Fprintf(sb, "syntax = %q;\n", syntaxOf(service.Desc.GetFile()))
+	if pkg != "" {
+		fmt.Fprintf(sb, "\npackage %s;\n", pkg)
+	}
+
+	for _, d := range append([]desc.Descriptor{service.Desc}, types...) {
+		source, err := printer.PrintProtoToString(d)
+		if err != nil {
+			return "", err
+		}
+
+		sb.WriteString("\n")
+		sb.WriteString(source)
+	}
+
+	return sb.String(), nil
+}
+
+// addFields calls add with the message and enum types of the fields of md
+// and of the messages nested in it.
+func addFields(md *desc.MessageDescriptor, add func(desc.Descriptor)) {
+	for _, nested := range md.GetNestedMessageTypes() {
+		addFields(nested, add)
+	}
+
+	for _, field := range md.GetFields() {
+		if mt := field.GetMessageType(); mt != nil {
+			add(mt)
+		}
+
+		if et := field.GetEnumType(); et != nil {
+			add(et)
+		}
+	}
+}
+
+func syntaxOf(fd *desc.FileDescriptor) string {
+	if fd.IsProto3() {
+		return "proto3"
+	}
+
+	return "proto2"
+}
@@ -0,0 +1,79 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestDescribeService(t *testing.T) {
+	services := loadTestServices(t, `
+syntax = "proto3";
+
+package snippet.describe;
+
+enum Kind {
+    KIND_UNSPECIFIED = 0;
+    KIND_EVENT = 1;
+}
+
+message Label {
+    string value = 1;
+}
+
+message Event {
+    message Source {
+        string host = 1;
+    }
+
+    Kind kind = 1;
+    Source source = 2;
+    map<string, Label> labels = 3;
+}
+
+message Ack {
+}
+
+message Unused {
+}
+
+service Hooks {
+    rpc Notify(Event) returns (Ack);
+}
+`)
+
+	source, err := describeService(newServiceMeta(services["snippet.describe.Hooks"]))
+	assert.Nil(t, err)
+
+	// Unused is left out, Source and the map entry come with Event.
+	expected := `syntax = "proto3";
+
+package snippet.describe;
+
+service Hooks {
+  rpc Notify ( Event ) returns ( Ack );
+}
+
+message Event {
+  Kind kind = 1;
+  Source source = 2;
+  map<string, Label> labels = 3;
+  message Source {
+    string host = 1;
+  }
+}
+
+message Label {
+  string value = 1;
+}
+
+enum Kind {
+  KIND_UNSPECIFIED = 0;
+  KIND_EVENT = 1;
+}
+
+message Ack {
+}
+`
+	assert.Equal(t, expected, source)
+}
@@ -0,0 +1,168 @@
+package main
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/jhump/protoreflect/desc"
+	"go.opentelemetry.io/otel/attribute"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/peer"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/proto"
+	"google.golang.org/protobuf/types/descriptorpb"
+
+	"github.com/rootwarp/snippets/golang/grpc/reflection/telemetry"
+	"github.com/rootwarp/snippets/golang/grpc/reflection/tlsconfig"
+)
+
+// newServiceMeta builds the registry entry of serviceDesc. The entry has no
+// endpoint yet.
+func newServiceMeta(serviceDesc *desc.ServiceDescriptor) serviceMeta {
+	meta := serviceMeta{
+		Desc:      serviceDesc,
+		Functions: map[string]funcMeta{},
+	}
+
+	for _, method := range serviceDesc.GetMethods() {
+		fmt.Println("*****", method.GetName())
+
+		meta.Functions[method.GetName()] = funcMeta{
+			Desc:    method,
+			InDesc:  method.GetInputType(),
+			OutDesc: method.GetOutputType(),
+		}
+	}
+
+	return meta
+}
+
+// serviceDescriptorSet returns the files defining services along with all
+// their imports, dependencies first.
+func serviceDescriptorSet(services []*desc.ServiceDescriptor) *descriptorpb.FileDescriptorSet {
+	files := []*desc.FileDescriptor{}
+	for _, service := range services {
+		files = append(files, service.GetFile())
+	}
+
+	return desc.ToFileDescriptorSet(files...)
+}
+
+// servicesFromDescriptorSet resolves the services names from set.
+func servicesFromDescriptorSet(set *descriptorpb.FileDescriptorSet, names []string) (map[string]*desc.ServiceDescriptor, error) {
+	files, err := desc.CreateFileDescriptorsFromSet(set)
+	if err != nil {
+		return nil, err
+	}
+
+	services := map[string]*desc.ServiceDescriptor{}
+	for _, name := range names {
+		for _, fd := range files {
+			if serviceDesc := fd.FindService(name); serviceDesc != nil {
+				services[name] = serviceDesc
+				break
+			}
+		}
+
+		if _, ok := services[name]; !ok {
+			return nil, fmt.Errorf("cannot find %s in the descriptor set", name)
+		}
+	}
+
+	return services, nil
+}
+
+// probePayload is not a valid protobuf message. A server serving the probed
+// method fails to decode it before doing any work, one which does not serve
+// the method answers Unimplemented. Methods streaming requests run as the
+// stream opens, they get no request at all instead.
+var probePayload = []byte{0xff}
+
+// probeServices resolves the services of the plugin behind conn matching
+// allowed from the serialized FileDescriptorSet data instead of server
+// reflection, and checks the plugin serves each of their methods.
+func (r *reflectionHandler) probeServices(ctx context.Context, conn *grpc.ClientConn, name, host string, allowed []string, data []byte) (_ map[string]*desc.ServiceDescriptor, err error) {
+	ctx, span := r.startSpan(ctx, "Descriptor probe", attribute.String("plugin.name", name), attribute.String("plugin.address", host))
+	defer func() { endSpan(span, err) }()
+
+	ctx = telemetry.OutgoingContext(ctx)
+
+	set := &descriptorpb.FileDescriptorSet{}
+	if err := proto.Unmarshal(data, set); err != nil {
+		return nil, status.Errorf(codes.InvalidArgument, "invalid descriptor set: %v", err)
+	}
+
+	files, err := desc.CreateFileDescriptorsFromSet(set)
+	if err != nil {
+		return nil, status.Errorf(codes.InvalidArgument, "invalid descriptor set: %v", err)
+	}
+
+	resolved := map[string]*desc.ServiceDescriptor{}
+	for _, fd := range files {
+		for _, serviceDesc := range fd.GetServices() {
+			serviceName := serviceDesc.GetFullyQualifiedName()
+			if isInternalService(serviceName) || !isAllowedService(serviceName, allowed) {
+				continue
+			}
+
+			resolved[serviceName] = serviceDesc
+		}
+	}
+
+	if len(resolved) == 0 {
+		return nil, fmt.Errorf("cannot find any service of %s in its descriptor set", name)
+	}
+
+	for serviceName, serviceDesc := range resolved {
+		for _, method := range serviceDesc.GetMethods() {
+			identities, err := probeMethod(ctx, conn, serviceName, method)
+			if err != nil {
+				return nil, err
+			}
+
+			if r.verifyIdentity && !tlsconfig.MatchIdentity(identities, serviceName) {
+				return nil, status.Errorf(codes.PermissionDenied, "certificate of %s is not valid for %s", name, serviceName)
+			}
+		}
+	}
+
+	return resolved, nil
+}
+
+// probeMethod checks the plugin behind conn serves method of serviceName and
+// returns the identities of its certificate.
+func probeMethod(ctx context.Context, conn *grpc.ClientConn, serviceName string, method *desc.MethodDescriptor) ([]string, error) {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	streamDesc := &grpc.StreamDesc{
+		ServerStreams: true,
+		ClientStreams: true,
+	}
+
+	funcURL := fmt.Sprintf("/%s/%s", serviceName, method.GetName())
+	stream, err := conn.NewStream(ctx, streamDesc, funcURL, grpc.ForceCodec(proxyCodec{}))
+	if err != nil {
+		return nil, err
+	}
+
+	p, _ := peer.FromContext(stream.Context())
+	identities := tlsconfig.PeerIdentities(p)
+
+	if method.IsClientStreaming() {
+		stream.CloseSend()
+	} else if err := stream.SendMsg(&rawFrame{payload: probePayload}); err == nil {
+		stream.CloseSend()
+	}
+
+	err = stream.RecvMsg(&rawFrame{})
+	switch status.Code(err) {
+	case codes.Unimplemented:
+		return nil, status.Errorf(codes.FailedPrecondition, "plugin does not serve %s", funcURL)
+	case codes.Unavailable, codes.DeadlineExceeded, codes.Canceled:
+		return nil, err
+	}
+
+	return identities, nil
+}
@@ -0,0 +1,125 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"net"
+	"sync/atomic"
+	"testing"
+
+	"github.com/jhump/protoreflect/desc"
+	"github.com/stretchr/testify/assert"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/proto"
+
+	"github.com/rootwarp/snippets/golang/grpc/reflection/proto/plugin"
+)
+
+// startTestOfflinePlugin starts a plugin which does not serve reflection.
+func startTestOfflinePlugin(t *testing.T) (string, int) {
+	return startTestOfflinePluginServer(t, grpc.NewServer())
+}
+
+func startTestOfflinePluginServer(t *testing.T, s *grpc.Server) (string, int) {
+	plugin.RegisterHelloServiceServer(s, &testHelloServer{})
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.Nil(t, err)
+
+	go s.Serve(l)
+	t.Cleanup(s.Stop)
+
+	addr := l.Addr().(*net.TCPAddr)
+	return addr.IP.String(), addr.Port
+}
+
+func testDescriptorSet(t *testing.T, files ...*desc.FileDescriptor) []byte {
+	data, err := proto.Marshal(desc.ToFileDescriptorSet(files...))
+	assert.Nil(t, err)
+
+	return data
+}
+
+func TestRegisterDescriptorSet(t *testing.T) {
+	address, port := startTestOfflinePlugin(t)
+
+	h := &reflectionHandler{}
+	defer h.conns.Close()
+
+	ctx := context.Background()
+	serviceName := "snippet.grpc.reflection.HelloService"
+
+	// Reflection is missing.
+	_, err := h.Query(ctx, "hello", address, port, nil)
+	assert.Equal(t, codes.FailedPrecondition, status.Code(err))
+	assert.Contains(t, err.Error(), "descriptor set")
+
+	fd, err := desc.WrapFile(plugin.File_plugin_hello_service_proto)
+	assert.Nil(t, err)
+
+	reg, err := h.Register(ctx, "hello", address, port, registerOptions{DescriptorSet: testDescriptorSet(t, fd)})
+	assert.Nil(t, err)
+	assert.Equal(t, []string{serviceName}, reg.Services)
+	assert.True(t, h.registry.Services()[serviceName].Endpoints[0].Offline)
+	assert.Len(t, h.registry.Services()[serviceName].Functions, 4)
+
+	out, err := h.Invoke(ctx, serviceName, "Hello", []byte(`{"name": "rootwarp", "age": 40}`))
+	assert.Nil(t, err)
+
+	resp := map[string]string{}
+	assert.Nil(t, json.Unmarshal(out, &resp))
+	assert.Equal(t, "Hey rootwarp(40)", resp["greetingMsg"])
+
+	// The plugin does not serve the methods of the set.
+	other := loadTestServices(t, baseSchema)["snippet.schema.Store"].GetFile()
+	_, err = h.Register(ctx, "store", address, port, registerOptions{DescriptorSet: testDescriptorSet(t, other)})
+	assert.Equal(t, codes.FailedPrecondition, status.Code(err))
+	assert.Contains(t, err.Error(), "does not serve /snippet.schema.Store/")
+	assert.NotContains(t, h.registry.Services(), "snippet.schema.Store")
+
+	_, err = h.Register(ctx, "store", address, port, registerOptions{DescriptorSet: []byte("invalid")})
+	assert.Equal(t, codes.InvalidArgument, status.Code(err))
+}
+
+// receivingStream counts the requests a plugin receives, including those it
+// fails to decode.
+type receivingStream struct {
+	grpc.ServerStream
+
+	received *atomic.Int32
+}
+
+func (s *receivingStream) RecvMsg(m any) error {
+	err := s.ServerStream.RecvMsg(m)
+	if err != io.EOF {
+		s.received.Add(1)
+	}
+
+	return err
+}
+
+func TestProbeStreamingMethods(t *testing.T) {
+	received := &atomic.Int32{}
+	address, port := startTestOfflinePluginServer(t, grpc.NewServer(grpc.StreamInterceptor(func(srv any, ss grpc.ServerStream, info *grpc.StreamServerInfo, handler grpc.StreamHandler) error {
+		if info.IsClientStream {
+			ss = &receivingStream{ServerStream: ss, received: received}
+		}
+
+		return handler(srv, ss)
+	})))
+
+	h := &reflectionHandler{}
+	defer h.conns.Close()
+
+	fd, err := desc.WrapFile(plugin.File_plugin_hello_service_proto)
+	assert.Nil(t, err)
+
+	_, err = h.Register(context.Background(), "hello", address, port, registerOptions{DescriptorSet: testDescriptorSet(t, fd)})
+	assert.Nil(t, err)
+
+	// The methods streaming requests are probed without one.
+	assert.Equal(t, int32(0), received.Load())
+}
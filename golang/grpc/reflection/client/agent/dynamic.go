@@ -0,0 +1,93 @@
+package main
+
+import (
+	"strings"
+
+	"github.com/jhump/protoreflect/desc"
+	"google.golang.org/protobuf/encoding/protojson"
+	"google.golang.org/protobuf/reflect/protoreflect"
+	"google.golang.org/protobuf/reflect/protoregistry"
+	"google.golang.org/protobuf/types/dynamicpb"
+
+	"github.com/rootwarp/snippets/golang/grpc/reflection/protofiles"
+)
+
+// descTypeResolver resolves message types referenced by a plugin schema,
+// e.g. the contents of google.protobuf.Any, from the plugin's own file
+// descriptors before falling back to the types linked into the agent.
+type descTypeResolver struct {
+	files *protoregistry.Files
+}
+
+func newDescTypeResolver(md *desc.MessageDescriptor) *descTypeResolver {
+	files := &protoregistry.Files{}
+	protofiles.Register(files, md.GetFile())
+
+	return &descTypeResolver{files: files}
+}
+
+func (d *descTypeResolver) FindMessageByName(name protoreflect.FullName) (protoreflect.MessageType, error) {
+	found, err := d.files.FindDescriptorByName(name)
+	if err != nil {
+		return protoregistry.GlobalTypes.FindMessageByName(name)
+	}
+
+	md, ok := found.(protoreflect.MessageDescriptor)
+	if !ok {
+		return nil, protoregistry.NotFound
+	}
+
+	return dynamicpb.NewMessageType(md), nil
+}
+
+func (d *descTypeResolver) FindMessageByURL(url string) (protoreflect.MessageType, error) {
+	name := url[strings.LastIndexByte(url, '/')+1:]
+
+	return d.FindMessageByName(protoreflect.FullName(name))
+}
+
+func (d *descTypeResolver) FindExtensionByName(field protoreflect.FullName) (protoreflect.ExtensionType, error) {
+	found, err := d.files.FindDescriptorByName(field)
+	if err != nil {
+		return protoregistry.GlobalTypes.FindExtensionByName(field)
+	}
+
+	xd, ok := found.(protoreflect.ExtensionDescriptor)
+	if !ok {
+		return nil, protoregistry.NotFound
+	}
+
+	return dynamicpb.NewExtensionType(xd), nil
+}
+
+func (d *descTypeResolver) FindExtensionByNumber(message protoreflect.FullName, field protoreflect.FieldNumber) (protoreflect.ExtensionType, error) {
+	return protoregistry.GlobalTypes.FindExtensionByNumber(message, field)
+}
+
+// newDynamicMessage builds a message of type md from a protojson payload.
+// An empty payload yields an empty message.
+func newDynamicMessage(md *desc.MessageDescriptor, payload []byte) (*dynamicpb.Message, error) {
+	msg := dynamicpb.NewMessage(md.UnwrapMessage())
+	if len(payload) == 0 {
+		return msg, nil
+	}
+
+	opts := protojson.UnmarshalOptions{
+		Resolver: newDescTypeResolver(md),
+	}
+
+	if err := opts.Unmarshal(payload, msg); err != nil {
+		return nil, err
+	}
+
+	return msg, nil
+}
+
+// marshalDynamicMessage renders a message built from md as protojson.
+func marshalDynamicMessage(md *desc.MessageDescriptor, msg *dynamicpb.Message) ([]byte, error) {
+	opts := protojson.MarshalOptions{
+		Resolver: newDescTypeResolver(md),
+	}
+
+	return opts.Marshal(msg)
+}
@@ -0,0 +1,256 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"strings"
+	"testing"
+
+	"github.com/jhump/protoreflect/desc"
+	"github.com/jhump/protoreflect/desc/protoparse"
+	"github.com/stretchr/testify/assert"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/health"
+	"google.golang.org/grpc/health/grpc_health_v1"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/reflection"
+	"google.golang.org/grpc/status"
+
+	"github.com/rootwarp/snippets/golang/grpc/reflection/proto/agent"
+	"github.com/rootwarp/snippets/golang/grpc/reflection/proto/plugin"
+)
+
+const testSchema = `
+syntax = "proto3";
+
+package snippet.test;
+
+import "google/protobuf/any.proto";
+import "google/protobuf/struct.proto";
+import "google/protobuf/timestamp.proto";
+
+enum Level {
+    LEVEL_UNSPECIFIED = 0;
+    LEVEL_HIGH = 1;
+}
+
+message Inner {
+    string value = 1;
+}
+
+message Complex {
+    Inner inner = 1;
+    repeated Inner items = 2;
+    repeated int64 numbers = 3;
+    map<string, Inner> named = 4;
+    Level level = 5;
+    oneof choice {
+        string text = 6;
+        int32 number = 7;
+    }
+    google.protobuf.Timestamp created_at = 8;
+    google.protobuf.Struct extra = 9;
+    google.protobuf.Any detail = 10;
+}
+`
+
+func loadTestMessage(t *testing.T, name string) *desc.MessageDescriptor {
+	parser := protoparse.Parser{
+		Accessor: protoparse.FileContentsFromMap(map[string]string{
+			"test.proto": testSchema,
+		}),
+	}
+
+	fds, err := parser.ParseFiles("test.proto")
+	assert.Nil(t, err)
+
+	md := fds[0].FindMessage(name)
+	assert.NotNil(t, md)
+
+	return md
+}
+
+func TestDynamicMessageRoundTrip(t *testing.T) {
+	md := loadTestMessage(t, "snippet.test.Complex")
+
+	payload := `{
+		"inner": {"value": "a"},
+		"items": [{"value": "b"}, {"value": "c"}],
+		"numbers": ["1", "2"],
+		"named": {"k": {"value": "d"}},
+		"level": "LEVEL_HIGH",
+		"number": 7,
+		"createdAt": "2023-10-18T00:00:00Z",
+		"extra": {"key": [1, "two", true]},
+		"detail": {"@type": "type.googleapis.com/snippet.test.Inner", "value": "e"}
+	}`
+
+	msg, err := newDynamicMessage(md, []byte(payload))
+	assert.Nil(t, err)
+
+	out, err := marshalDynamicMessage(md, msg)
+	assert.Nil(t, err)
+
+	assert.JSONEq(t, payload, string(out))
+}
+
+func TestDynamicMessageEmptyPayload(t *testing.T) {
+	md := loadTestMessage(t, "snippet.test.Inner")
+
+	msg, err := newDynamicMessage(md, nil)
+	assert.Nil(t, err)
+
+	out, err := marshalDynamicMessage(md, msg)
+	assert.Nil(t, err)
+	assert.JSONEq(t, `{}`, string(out))
+}
+
+func TestDynamicMessageInvalidPayload(t *testing.T) {
+	md := loadTestMessage(t, "snippet.test.Complex")
+
+	tests := []string{
+		`{"unknown": 1}`,
+		`{"level": "LEVEL_LOW"}`,
+		`{"text": "a", "number": 1}`,
+		`{"numbers": "1"}`,
+	}
+
+	for _, payload := range tests {
+		_, err := newDynamicMessage(md, []byte(payload))
+		assert.NotNil(t, err, payload)
+	}
+}
+
+type testHelloServer struct {
+	plugin.UnimplementedHelloServiceServer
+}
+
+func (s *testHelloServer) Hello(ctx context.Context, in *plugin.HelloRequest) (*plugin.HelloResponse, error) {
+	// Echo the metadata of the call so tests can see what reached the plugin.
+	if echo := metadata.ValueFromIncomingContext(ctx, "x-echo"); len(echo) > 0 {
+		grpc.SetHeader(ctx, metadata.Pairs("x-echo", echo[0]))
+		grpc.SetTrailer(ctx, metadata.Pairs("x-echo-trailer", echo[0]))
+	}
+
+	if _, ok := ctx.Deadline(); ok {
+		grpc.SetHeader(ctx, metadata.Pairs("x-deadline", "true"))
+	}
+
+	return &plugin.HelloResponse{
+		GreetingMsg: fmt.Sprintf("Hey %s(%d)", in.Name, in.Age),
+	}, nil
+}
+
+func (s *testHelloServer) HelloFeed(in *plugin.HelloRequest, stream plugin.HelloService_HelloFeedServer) error {
+	if in.Age < 0 {
+		return status.Error(codes.InvalidArgument, "negative age")
+	}
+
+	for i := int32(1); i <= in.Age; i++ {
+		err := stream.Send(&plugin.HelloResponse{
+			GreetingMsg: fmt.Sprintf("Hey %s(%d/%d)", in.Name, i, in.Age),
+		})
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func (s *testHelloServer) HelloAll(stream plugin.HelloService_HelloAllServer) error {
+	names := []string{}
+	for {
+		in, err := stream.Recv()
+		if err == io.EOF {
+			break
+		}
+
+		if err != nil {
+			return err
+		}
+
+		names = append(names, in.Name)
+	}
+
+	return stream.SendAndClose(&plugin.HelloResponse{
+		GreetingMsg: fmt.Sprintf("Hey %s", strings.Join(names, ", ")),
+	})
+}
+
+func (s *testHelloServer) HelloChat(stream plugin.HelloService_HelloChatServer) error {
+	for {
+		in, err := stream.Recv()
+		if err == io.EOF {
+			return nil
+		}
+
+		if err != nil {
+			return err
+		}
+
+		err = stream.Send(&plugin.HelloResponse{
+			GreetingMsg: fmt.Sprintf("Hey %s(%d)", in.Name, in.Age),
+		})
+		if err != nil {
+			return err
+		}
+	}
+}
+
+func startTestPlugin(t *testing.T) (string, int) {
+	_, address, port := startTestPluginServer(t)
+	return address, port
+}
+
+func startTestPluginServer(t *testing.T) (*grpc.Server, string, int) {
+	s := grpc.NewServer()
+	plugin.RegisterHelloServiceServer(s, &testHelloServer{})
+	agent.RegisterRegistrationServiceServer(s, &agent.UnimplementedRegistrationServiceServer{})
+	reflection.Register(s)
+
+	healthServer := health.NewServer()
+	healthServer.SetServingStatus(plugin.HelloService_ServiceDesc.ServiceName, grpc_health_v1.HealthCheckResponse_SERVING)
+	grpc_health_v1.RegisterHealthServer(s, healthServer)
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.Nil(t, err)
+
+	go s.Serve(l)
+	t.Cleanup(s.Stop)
+
+	addr := l.Addr().(*net.TCPAddr)
+	return s, addr.IP.String(), addr.Port
+}
+
+func TestInvoke(t *testing.T) {
+	address, port := startTestPlugin(t)
+
+	h := &reflectionHandler{}
+
+	ctx := context.Background()
+	serviceName := "snippet.grpc.reflection.HelloService"
+
+	_, err := h.Query(ctx, serviceName, address, port, nil)
+	assert.Nil(t, err)
+
+	out, err := h.Invoke(ctx, serviceName, "Hello", []byte(`{"name": "rootwarp", "age": 40}`))
+	assert.Nil(t, err)
+
+	resp := map[string]string{}
+	assert.Nil(t, json.Unmarshal(out, &resp))
+	assert.Equal(t, "Hey rootwarp(40)", resp["greetingMsg"])
+
+	_, err = h.Invoke(ctx, serviceName, "Bye", nil)
+	assert.ErrorIs(t, err, ErrFunctionNotFound)
+
+	_, err = h.Invoke(ctx, "unknown.Service", "Hello", nil)
+	assert.ErrorIs(t, err, ErrServiceNotFound)
+
+	_, err = h.Invoke(ctx, serviceName, "Hello", []byte(`{"name": 1}`))
+	assert.NotNil(t, err)
+}
@@ -0,0 +1,194 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sort"
+	"time"
+
+	"google.golang.org/grpc/metadata"
+
+	"github.com/rootwarp/snippets/golang/grpc/reflection/proto/agent"
+	"github.com/rootwarp/snippets/golang/grpc/reflection/transport"
+)
+
+// forwardedByKey is the metadata key of the calls an agent forwards to a
+// peer, its value is the name of the agent.
+const forwardedByKey = "x-agent-forwarded-by"
+
+// peerPluginName is the plugin name the peer agent at address is registered
+// under.
+func peerPluginName(address string) string {
+	return "peer/" + address
+}
+
+// isForwarded reports whether the call of ctx was forwarded by a peer agent.
+func isForwarded(ctx context.Context) bool {
+	md, _ := metadata.FromIncomingContext(ctx)
+	return len(md.Get(forwardedByKey)) > 0
+}
+
+// localEndpoints returns the endpoints of endpoints which are not peer
+// agents.
+func localEndpoints(endpoints []endpoint) []endpoint {
+	local := []endpoint{}
+	for _, e := range endpoints {
+		if !e.Peer {
+			local = append(local, e)
+		}
+	}
+
+	return local
+}
+
+// forwardContext marks the call made with ctx as forwarded when the
+// instance of service at address is a peer agent.
+func (r *reflectionHandler) forwardContext(ctx context.Context, service serviceMeta, address string) context.Context {
+	for _, e := range service.Endpoints {
+		if e.Address == address && e.Peer {
+			return metadata.AppendToOutgoingContext(ctx, forwardedByKey, r.name)
+		}
+	}
+
+	return ctx
+}
+
+// peerState is what the agent knows of the registry of a peer.
+type peerState struct {
+	address  string
+	revision uint64
+	// plugins holds the services of every plugin instance of the peer.
+	plugins map[pluginInstance][]string
+}
+
+// apply updates p with a response of the peer's WatchPlugins. The instances
+// the peer knows from its own peers are left out, registries are shared one
+// hop only.
+func (p *peerState) apply(resp *agent.WatchPluginsResponse) {
+	if resp.Snapshot || p.plugins == nil {
+		p.plugins = map[pluginInstance][]string{}
+	}
+
+	for _, event := range resp.Events {
+		if event.Peer {
+			continue
+		}
+
+		key := pluginInstance{Plugin: event.Name, Address: event.Address}
+		if event.Type == agent.PluginEvent_REMOVED {
+			delete(p.plugins, key)
+			continue
+		}
+
+		services := make([]string, 0, len(event.Services))
+		for _, service := range event.Services {
+			services = append(services, service.Name)
+		}
+
+		p.plugins[key] = services
+	}
+
+	p.revision = resp.Revision
+}
+
+// services returns the services of every plugin instance of the peer.
+func (p *peerState) services() []string {
+	seen := map[string]bool{}
+	for _, services := range p.plugins {
+		for _, name := range services {
+			seen[name] = true
+		}
+	}
+
+	services := make([]string, 0, len(seen))
+	for name := range seen {
+		services = append(services, name)
+	}
+
+	sort.Strings(services)
+
+	return services
+}
+
+// followPeer registers the peer agent at address as an instance of the
+// services of the plugins registered with it, following the changes of its
+// registry until ctx is done. While the peer cannot be reached it is
+// deregistered, and it is tried again every retry.
+func (r *reflectionHandler) followPeer(ctx context.Context, address string, retry time.Duration) {
+	p := &peerState{address: address}
+
+	for {
+		err := r.syncPeer(ctx, p)
+		fmt.Println("Peer", address, err)
+
+		if err := r.Deregister(peerPluginName(address), address); err == nil {
+			fmt.Println("Deregister peer", address)
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(retry):
+		}
+	}
+}
+
+// syncPeer watches the registry of the peer, resuming from the revision it
+// saw last, and registers the peer for the services of its plugins as they
+// change. It returns once the watch fails.
+func (r *reflectionHandler) syncPeer(ctx context.Context, p *peerState) error {
+	conn, release, err := r.conns.Hold(p.address)
+	if err != nil {
+		return err
+	}
+	defer release()
+
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	stream, err := agent.NewRegistrationServiceClient(conn).WatchPlugins(ctx, &agent.WatchPluginsRequest{Revision: p.revision})
+	if err != nil {
+		return err
+	}
+
+	for {
+		resp, err := stream.Recv()
+		if err != nil {
+			return err
+		}
+
+		p.apply(resp)
+
+		if err := r.registerPeer(ctx, p); err != nil {
+			return err
+		}
+	}
+}
+
+// registerPeer registers the peer for the services of its plugins, or
+// deregisters it when it has none.
+func (r *reflectionHandler) registerPeer(ctx context.Context, p *peerState) error {
+	name := peerPluginName(p.address)
+
+	services := p.services()
+	if len(services) == 0 {
+		if err := r.Deregister(name, p.address); err != nil && !errors.Is(err, ErrServiceNotFound) {
+			return err
+		}
+
+		return nil
+	}
+
+	host, port, err := transport.SplitTarget(p.address)
+	if err != nil {
+		return err
+	}
+
+	_, err = r.Register(ctx, name, host, port, registerOptions{
+		Allowed: services,
+		Peer:    true,
+	})
+
+	return err
+}
@@ -0,0 +1,292 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"net"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+
+	"github.com/rootwarp/snippets/golang/grpc/reflection/proto/agent"
+	"github.com/rootwarp/snippets/golang/grpc/reflection/proto/plugin"
+)
+
+func TestPickPeer(t *testing.T) {
+	h := &reflectionHandler{name: "a"}
+	serviceName := "a.Service"
+
+	local := endpoint{Plugin: "a", Address: "127.0.0.1:1"}
+	peer := endpoint{Plugin: peerPluginName("127.0.0.1:2"), Address: "127.0.0.1:2", Peer: true}
+
+	forwarded := metadata.NewIncomingContext(context.Background(), metadata.Pairs(forwardedByKey, "b"))
+
+	tests := []struct {
+		Endpoints []endpoint
+		Forwarded bool
+		Expected  string
+		Code      codes.Code
+	}{
+		{[]endpoint{local, peer}, false, local.Address, codes.OK},
+		{[]endpoint{local, peer}, true, local.Address, codes.OK},
+		{[]endpoint{peer}, false, peer.Address, codes.OK},
+		// A forwarded call never goes on to another peer.
+		{[]endpoint{peer}, true, "", codes.Unavailable},
+	}
+
+	for _, test := range tests {
+		ctx := context.Background()
+		if test.Forwarded {
+			ctx = forwarded
+		}
+
+		service := serviceMeta{Endpoints: test.Endpoints}
+
+		address, done, err := h.pick(ctx, serviceName, service, callPolicy{})
+		assert.Equal(t, test.Code, status.Code(err), test)
+		assert.Equal(t, test.Expected, address, test)
+
+		if err != nil {
+			continue
+		}
+
+		done(nil)
+
+		// Only the calls to peers are marked.
+		md, _ := metadata.FromOutgoingContext(h.forwardContext(context.Background(), service, address))
+		if address == peer.Address {
+			assert.Equal(t, []string{"a"}, md.Get(forwardedByKey))
+		} else {
+			assert.Empty(t, md.Get(forwardedByKey))
+		}
+	}
+
+	// Unhealthy local instances are no matter of forwarding.
+	unhealthy := local
+	unhealthy.Health = healthUnhealthy
+
+	_, _, err := h.pick(context.Background(), serviceName, serviceMeta{Endpoints: []endpoint{unhealthy}}, callPolicy{})
+	assert.Equal(t, codes.Unavailable, status.Code(err))
+	assert.Equal(t, "a.Service is unhealthy", status.Convert(err).Message())
+}
+
+func TestPeerState(t *testing.T) {
+	p := &peerState{address: "127.0.0.1:2"}
+
+	p.apply(&agent.WatchPluginsResponse{
+		Revision: 3,
+		Snapshot: true,
+		Events: []*agent.PluginEvent{
+			{Type: agent.PluginEvent_ADDED, Name: "a", Address: "127.0.0.1:3", Services: []*agent.PluginService{{Name: "b.Service"}, {Name: "a.Service"}}},
+			{Type: agent.PluginEvent_ADDED, Name: "b", Address: "127.0.0.1:4", Services: []*agent.PluginService{{Name: "a.Service"}}},
+			// What the peer knows from its peers is not shared.
+			{Type: agent.PluginEvent_ADDED, Name: "peer/127.0.0.1:1", Address: "127.0.0.1:1", Peer: true, Services: []*agent.PluginService{{Name: "c.Service"}}},
+		},
+	})
+
+	assert.Equal(t, uint64(3), p.revision)
+	assert.Equal(t, []string{"a.Service", "b.Service"}, p.services())
+
+	p.apply(&agent.WatchPluginsResponse{
+		Revision: 5,
+		Events: []*agent.PluginEvent{
+			{Type: agent.PluginEvent_REMOVED, Name: "a", Address: "127.0.0.1:3", Services: []*agent.PluginService{{Name: "b.Service"}, {Name: "a.Service"}}},
+		},
+	})
+
+	assert.Equal(t, uint64(5), p.revision)
+	assert.Equal(t, []string{"a.Service"}, p.services())
+
+	// A snapshot replaces everything.
+	p.apply(&agent.WatchPluginsResponse{Revision: 9, Snapshot: true})
+	assert.Equal(t, uint64(9), p.revision)
+	assert.Empty(t, p.services())
+}
+
+func TestRegisterPeerSchemaPolicy(t *testing.T) {
+	address, port := startTestPlugin(t)
+	peerAddress := fmt.Sprintf("%s:%d", address, port)
+
+	h := &reflectionHandler{schemaPolicy: schemaReject}
+	defer h.conns.Close()
+
+	// The test plugin stands in for a peer serving the services of two
+	// plugins.
+	p := &peerState{
+		address: peerAddress,
+		plugins: map[pluginInstance][]string{
+			{Plugin: "hello", Address: "127.0.0.1:3"}: {plugin.HelloService_ServiceDesc.ServiceName},
+			{Plugin: "agent", Address: "127.0.0.1:4"}: {agent.RegistrationService_ServiceDesc.ServiceName},
+		},
+	}
+
+	ctx := context.Background()
+	assert.Nil(t, h.registerPeer(ctx, p))
+	assert.Len(t, h.registry.Services(), 2)
+
+	// A plugin leaving the peer is no breaking change of the peer.
+	delete(p.plugins, pluginInstance{Plugin: "agent", Address: "127.0.0.1:4"})
+	assert.Nil(t, h.registerPeer(ctx, p))
+
+	services := h.registry.Services()
+	assert.Len(t, services, 1)
+	assert.Equal(t, []string{peerPluginName(peerAddress)}, services[plugin.HelloService_ServiceDesc.ServiceName].plugins())
+	assert.Empty(t, h.schemas)
+}
+
+// testAgent is an agent process listening on localhost.
+type testAgent struct {
+	Address string
+	Client  agent.RegistrationServiceClient
+}
+
+// buildTestAgent builds the agent binary.
+func buildTestAgent(t *testing.T) string {
+	bin := filepath.Join(t.TempDir(), "agent")
+
+	out, err := exec.Command("go", "build", "-o", bin, ".").CombinedOutput()
+	if err != nil {
+		t.Fatalf("build agent: %v\n%s", err, out)
+	}
+
+	return bin
+}
+
+func freeTestAddress(t *testing.T) string {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.Nil(t, err)
+	defer l.Close()
+
+	return l.Addr().String()
+}
+
+// startTestAgentProcess runs the agent bin named name at address, following
+// peers.
+func startTestAgentProcess(t *testing.T, bin, name, address string, peers ...string) *testAgent {
+	cmd := exec.Command(bin,
+		"-name", name,
+		"-grpc", address,
+		"-http", freeTestAddress(t),
+		"-metrics", "",
+		"-peers", strings.Join(peers, ","),
+		"-peer-retry", "100ms",
+	)
+
+	output := &bytes.Buffer{}
+	cmd.Stdout = output
+	cmd.Stderr = output
+
+	if err := cmd.Start(); err != nil {
+		t.Fatal(err)
+	}
+
+	t.Cleanup(func() {
+		cmd.Process.Kill()
+		cmd.Wait()
+
+		if t.Failed() {
+			t.Logf("agent %s:\n%s", name, output)
+		}
+	})
+
+	conn, err := grpc.Dial(address, grpc.WithTransportCredentials(insecure.NewCredentials()))
+	assert.Nil(t, err)
+	t.Cleanup(func() { conn.Close() })
+
+	return &testAgent{Address: address, Client: agent.NewRegistrationServiceClient(conn)}
+}
+
+// TestFederation runs agents a, b and c on localhost. a and b peer with each
+// other, c peers with b only.
+func TestFederation(t *testing.T) {
+	if testing.Short() {
+		t.Skip("runs agent processes")
+	}
+
+	bin := buildTestAgent(t)
+
+	addresses := map[string]string{}
+	for _, name := range []string{"a", "b", "c"} {
+		addresses[name] = freeTestAddress(t)
+	}
+
+	a := startTestAgentProcess(t, bin, "a", addresses["a"], addresses["b"])
+	b := startTestAgentProcess(t, bin, "b", addresses["b"], addresses["a"])
+	c := startTestAgentProcess(t, bin, "c", addresses["c"], addresses["b"])
+
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+
+	address, port := startTestPlugin(t)
+	serviceName := "snippet.grpc.reflection.HelloService"
+
+	assert.Eventually(t, func() bool {
+		_, err := a.Client.RegisterPlugin(ctx, &agent.RegisterRequest{
+			Name:            "hello",
+			Address:         address,
+			Port:            int32(port),
+			AllowedServices: []string{serviceName},
+		})
+
+		return err == nil
+	}, 10*time.Second, 50*time.Millisecond)
+
+	call := func(target *testAgent) (string, error) {
+		resp, err := target.Client.CallMethod(ctx, &agent.CallMethodRequest{
+			Service: serviceName,
+			Method:  "Hello",
+			Payload: `{"name": "rootwarp", "age": 40}`,
+		})
+		if err != nil {
+			return "", err
+		}
+
+		return resp.Payload, nil
+	}
+
+	// b forwards the call to a, which calls its plugin.
+	assert.Eventually(t, func() bool {
+		_, err := call(b)
+		return err == nil
+	}, 10*time.Second, 50*time.Millisecond)
+
+	out, err := call(b)
+	assert.Nil(t, err)
+	assert.Contains(t, out, "Hey rootwarp(40)")
+
+	descResp, err := b.Client.DescribeService(ctx, &agent.DescribeServiceRequest{Name: serviceName})
+	assert.Nil(t, err)
+	assert.Equal(t, []string{peerPluginName(a.Address)}, descResp.Plugins)
+
+	// a keeps serving the call itself rather than going back to b.
+	out, err = call(a)
+	assert.Nil(t, err)
+	assert.Contains(t, out, "Hey rootwarp(40)")
+
+	descResp, err = a.Client.DescribeService(ctx, &agent.DescribeServiceRequest{Name: serviceName})
+	assert.Nil(t, err)
+	assert.Equal(t, []string{"hello"}, descResp.Plugins)
+
+	// What b knows from a does not travel on to c.
+	_, err = call(c)
+	assert.Equal(t, codes.NotFound, status.Code(err))
+
+	// The plugin leaving a leaves b too.
+	_, err = a.Client.DeregisterPlugin(ctx, &agent.DeregisterRequest{Name: "hello"})
+	assert.Nil(t, err)
+
+	assert.Eventually(t, func() bool {
+		_, err := call(b)
+		return status.Code(err) == codes.NotFound
+	}, 10*time.Second, 50*time.Millisecond, "b still serves the service")
+}
@@ -0,0 +1,436 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/peer"
+	"google.golang.org/grpc/status"
+)
+
+const maxGatewayBodySize = 4 << 20
+
+// gateway exposes registered plugin methods over HTTP.
+//
+//	POST /v1/{service}/{method}
+//
+// The request body is the protojson payload of the method's input message and
+// the response body is the protojson rendering of its output message.
+//
+// Methods streaming requests take a sequence of payloads, one per line.
+// Methods streaming responses reply with one line per message, each wrapped
+// as {"result": ...}, and a failure after the first message is reported as a
+// final {"error": ...} line. Interleaving requests and responses of a bidi
+// stream requires HTTP/2, HTTP/1.x clients have to send all requests first.
+//
+//	POST /v1/{service}/{method}?broadcast=collect_all|fail_fast&concurrency=N
+//
+// broadcasts a unary call to every plugin serving the service and replies
+// with {"results": [...]}, one entry per plugin holding its "plugin",
+// "address" and either "result" or "error". fail_fast cancels the calls
+// still pending once a plugin fails.
+type gateway struct{}
+
+type gatewayStreamLine struct {
+	Result json.RawMessage `json:"result,omitempty"`
+	Error  *gatewayError   `json:"error,omitempty"`
+}
+
+type gatewayBroadcast struct {
+	Results []gatewayBroadcastResult `json:"results"`
+}
+
+type gatewayBroadcastResult struct {
+	Plugin  string          `json:"plugin"`
+	Address string          `json:"address,omitempty"`
+	Result  json.RawMessage `json:"result,omitempty"`
+	Error   *gatewayError   `json:"error,omitempty"`
+}
+
+type gatewayError struct {
+	Code    int    `json:"code"`
+	Message string `json:"message"`
+}
+
+func (g *gateway) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	fmt.Println("Gateway", req.Method, req.URL.Path)
+
+	if req.Method != http.MethodPost {
+		w.Header().Set("Allow", http.MethodPost)
+		writeGatewayError(w, http.StatusMethodNotAllowed, status.New(codes.Unimplemented, "only POST is supported"))
+		return
+	}
+
+	serviceName, funcName, ok := parseGatewayPath(req.URL.Path)
+	if !ok {
+		writeGatewayError(w, http.StatusNotFound, status.New(codes.NotFound, "path must be /v1/{service}/{method}"))
+		return
+	}
+
+	// Headers are the metadata of the call, consistent hash balancing
+	// reads its key there, authorization the bearer token and tracing the
+	// traceparent of the caller.
+	ctx := metadata.NewIncomingContext(req.Context(), gatewayMetadata(req.Header))
+	req = req.WithContext(peer.NewContext(ctx, gatewayPeer(req)))
+
+	// Callers learn whether a service exists only once they may call it.
+	if err := r.authorize(req.Context(), serviceName, funcName); err != nil {
+		st := statusFromError(err)
+		writeGatewayError(w, httpStatusFromCode(st.Code()), st)
+		return
+	}
+
+	_, fMeta, err := r.lookup(serviceName, funcName)
+	if err != nil {
+		st := statusFromError(err)
+		writeGatewayError(w, httpStatusFromCode(st.Code()), st)
+		return
+	}
+
+	if req.URL.Query().Has("broadcast") {
+		g.serveBroadcast(w, req, serviceName, funcName)
+		return
+	}
+
+	if fMeta.Desc.IsClientStreaming() || fMeta.Desc.IsServerStreaming() {
+		g.serveStream(w, req, serviceName, funcName, fMeta)
+		return
+	}
+
+	payload, err := io.ReadAll(http.MaxBytesReader(w, req.Body, maxGatewayBodySize))
+	if err != nil {
+		writeBodyError(w, err)
+		return
+	}
+
+	out, err := r.Invoke(req.Context(), serviceName, funcName, payload)
+	if err != nil {
+		st := statusFromError(err)
+		writeGatewayError(w, httpStatusFromCode(st.Code()), st)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	w.Write(out)
+}
+
+func (g *gateway) serveStream(w http.ResponseWriter, req *http.Request, serviceName, funcName string, fMeta funcMeta) {
+	var recv func() ([]byte, error)
+	if fMeta.Desc.IsClientStreaming() {
+		// The size limit applies to all requests together.
+		dec := json.NewDecoder(http.MaxBytesReader(w, req.Body, maxGatewayBodySize))
+		recv = func() ([]byte, error) {
+			payload := json.RawMessage{}
+			var tooLarge *http.MaxBytesError
+			if err := dec.Decode(&payload); err == io.EOF {
+				return nil, io.EOF
+			} else if errors.As(err, &tooLarge) {
+				return nil, err
+			} else if err != nil {
+				return nil, status.Error(codes.InvalidArgument, err.Error())
+			}
+
+			return payload, nil
+		}
+	} else {
+		// A single request, which may be empty just like for unary calls.
+		payload, err := io.ReadAll(http.MaxBytesReader(w, req.Body, maxGatewayBodySize))
+		if err != nil {
+			writeBodyError(w, err)
+			return
+		}
+
+		sent := false
+		recv = func() ([]byte, error) {
+			if sent {
+				return nil, io.EOF
+			}
+
+			sent = true
+			return payload, nil
+		}
+	}
+
+	if !fMeta.Desc.IsServerStreaming() {
+		var out []byte
+		err := r.InvokeStream(req.Context(), serviceName, funcName, recv, func(msg []byte) error {
+			out = msg
+			return nil
+		})
+		if err != nil {
+			writeStreamError(w, err)
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusOK)
+		w.Write(out)
+		return
+	}
+
+	flusher, _ := w.(http.Flusher)
+	enc := json.NewEncoder(w)
+
+	wroteHeader := false
+	writeHeader := func() {
+		if !wroteHeader {
+			w.Header().Set("Content-Type", "application/x-ndjson")
+			w.WriteHeader(http.StatusOK)
+			wroteHeader = true
+		}
+	}
+
+	err := r.InvokeStream(req.Context(), serviceName, funcName, recv, func(msg []byte) error {
+		writeHeader()
+
+		if err := enc.Encode(gatewayStreamLine{Result: msg}); err != nil {
+			return err
+		}
+
+		if flusher != nil {
+			flusher.Flush()
+		}
+
+		return nil
+	})
+	if err != nil {
+		if !wroteHeader {
+			writeStreamError(w, err)
+			return
+		}
+
+		st := statusFromError(err)
+		enc.Encode(gatewayStreamLine{Error: &gatewayError{
+			Code:    int(st.Code()),
+			Message: st.Message(),
+		}})
+		return
+	}
+
+	writeHeader()
+}
+
+func (g *gateway) serveBroadcast(w http.ResponseWriter, req *http.Request, serviceName, funcName string) {
+	query := req.URL.Query()
+
+	mode, err := parseBroadcastMode(query.Get("broadcast"))
+	if err != nil {
+		writeGatewayError(w, http.StatusBadRequest, status.New(codes.InvalidArgument, err.Error()))
+		return
+	}
+
+	opts := broadcastOptions{Mode: mode}
+	if concurrency := query.Get("concurrency"); concurrency != "" {
+		if opts.Concurrency, err = strconv.Atoi(concurrency); err != nil || opts.Concurrency < 1 {
+			writeGatewayError(w, http.StatusBadRequest, status.New(codes.InvalidArgument, "concurrency must be a positive number"))
+			return
+		}
+	}
+
+	payload, err := io.ReadAll(http.MaxBytesReader(w, req.Body, maxGatewayBodySize))
+	if err != nil {
+		writeBodyError(w, err)
+		return
+	}
+
+	results, err := r.Broadcast(req.Context(), serviceName, funcName, payload, opts)
+	if err != nil {
+		st := statusFromError(err)
+		writeGatewayError(w, httpStatusFromCode(st.Code()), st)
+		return
+	}
+
+	resp := gatewayBroadcast{Results: make([]gatewayBroadcastResult, 0, len(results))}
+	for _, result := range results {
+		line := gatewayBroadcastResult{
+			Plugin:  result.Plugin,
+			Address: result.Address,
+			Result:  result.Output,
+		}
+
+		if result.Err != nil {
+			st := statusFromError(result.Err)
+			line.Error = &gatewayError{
+				Code:    int(st.Code()),
+				Message: st.Message(),
+			}
+		}
+
+		resp.Results = append(resp.Results, line)
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(resp)
+}
+
+// gatewayPeer describes the HTTP client as the peer of a gRPC call, along
+// with its client certificate.
+func gatewayPeer(req *http.Request) *peer.Peer {
+	p := &peer.Peer{}
+	if addr, err := net.ResolveTCPAddr("tcp", req.RemoteAddr); err == nil {
+		p.Addr = addr
+	}
+
+	if req.TLS != nil {
+		p.AuthInfo = credentials.TLSInfo{State: *req.TLS}
+	}
+
+	return p
+}
+
+// gatewayTransportHeaders are the headers of the HTTP connection and body,
+// which are no metadata of the call. gRPC servers reject some of them, such
+// as Connection.
+var gatewayTransportHeaders = map[string]bool{
+	"Accept-Encoding":   true,
+	"Connection":        true,
+	"Content-Length":    true,
+	"Content-Type":      true,
+	"Host":              true,
+	"Keep-Alive":        true,
+	"Proxy-Connection":  true,
+	"Te":                true,
+	"Trailer":           true,
+	"Transfer-Encoding": true,
+	"Upgrade":           true,
+}
+
+// gatewayMetadata returns the headers of an HTTP call as the metadata of the
+// gRPC call, leaving out the transport headers along with those Connection
+// names.
+func gatewayMetadata(header http.Header) metadata.MD {
+	hopByHop := map[string]bool{}
+	for _, value := range header.Values("Connection") {
+		for _, name := range strings.Split(value, ",") {
+			hopByHop[http.CanonicalHeaderKey(strings.TrimSpace(name))] = true
+		}
+	}
+
+	md := metadata.MD{}
+	for key, values := range header {
+		key = http.CanonicalHeaderKey(key)
+		if gatewayTransportHeaders[key] || hopByHop[key] {
+			continue
+		}
+
+		md.Append(key, values...)
+	}
+
+	return md
+}
+
+func parseGatewayPath(path string) (string, string, bool) {
+	path, ok := strings.CutPrefix(path, "/v1/")
+	if !ok {
+		return "", "", false
+	}
+
+	serviceName, funcName, ok := strings.Cut(path, "/")
+	if !ok || serviceName == "" || funcName == "" || strings.Contains(funcName, "/") {
+		return "", "", false
+	}
+
+	return serviceName, funcName, true
+}
+
+func writeGatewayError(w http.ResponseWriter, httpCode int, st *status.Status) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(httpCode)
+
+	json.NewEncoder(w).Encode(gatewayError{
+		Code:    int(st.Code()),
+		Message: st.Message(),
+	})
+}
+
+// writeBodyError reports that the request body could not be read, because
+// it is too large or the client sent it wrong.
+func writeBodyError(w http.ResponseWriter, err error) {
+	var tooLarge *http.MaxBytesError
+	if errors.As(err, &tooLarge) {
+		writeGatewayError(w, http.StatusRequestEntityTooLarge, status.New(codes.ResourceExhausted, err.Error()))
+		return
+	}
+
+	writeGatewayError(w, http.StatusBadRequest, status.New(codes.InvalidArgument, err.Error()))
+}
+
+// writeStreamError reports the failure of a stream before its first
+// response, which may be the one to read its requests.
+func writeStreamError(w http.ResponseWriter, err error) {
+	var tooLarge *http.MaxBytesError
+	if errors.As(err, &tooLarge) {
+		writeBodyError(w, err)
+		return
+	}
+
+	st := statusFromError(err)
+	writeGatewayError(w, httpStatusFromCode(st.Code()), st)
+}
+
+// statusFromError converts errors returned by the reflectionHandler into a
+// gRPC status.
+func statusFromError(err error) *status.Status {
+	var tooLarge *http.MaxBytesError
+	switch {
+	case errors.Is(err, ErrServiceNotFound), errors.Is(err, ErrFunctionNotFound):
+		return status.New(codes.NotFound, err.Error())
+	case errors.As(err, &tooLarge):
+		return status.New(codes.ResourceExhausted, err.Error())
+	}
+
+	return status.Convert(err)
+}
+
+// httpStatusFromCode maps a gRPC status code to the matching HTTP status.
+func httpStatusFromCode(code codes.Code) int {
+	switch code {
+	case codes.OK:
+		return http.StatusOK
+	case codes.Canceled:
+		return 499 // Client Closed Request
+	case codes.Unknown:
+		return http.StatusInternalServerError
+	case codes.InvalidArgument:
+		return http.StatusBadRequest
+	case codes.DeadlineExceeded:
+		return http.StatusGatewayTimeout
+	case codes.NotFound:
+		return http.StatusNotFound
+	case codes.AlreadyExists:
+		return http.StatusConflict
+	case codes.PermissionDenied:
+		return http.StatusForbidden
+	case codes.Unauthenticated:
+		return http.StatusUnauthorized
+	case codes.ResourceExhausted:
+		return http.StatusTooManyRequests
+	case codes.FailedPrecondition:
+		return http.StatusBadRequest
+	case codes.Aborted:
+		return http.StatusConflict
+	case codes.OutOfRange:
+		return http.StatusBadRequest
+	case codes.Unimplemented:
+		return http.StatusNotImplemented
+	case codes.Internal:
+		return http.StatusInternalServerError
+	case codes.Unavailable:
+		return http.StatusServiceUnavailable
+	case codes.DataLoss:
+		return http.StatusInternalServerError
+	}
+
+	return http.StatusInternalServerError
+}
@@ -0,0 +1,151 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"google.golang.org/grpc/codes"
+)
+
+func TestGateway(t *testing.T) {
+	address, port := startTestPlugin(t)
+
+	r = &reflectionHandler{}
+
+	_, err := r.Query(context.Background(), "snippet.grpc.reflection.HelloService", address, port, nil)
+	assert.Nil(t, err)
+
+	srv := httptest.NewServer(&gateway{})
+	defer srv.Close()
+
+	tests := []struct {
+		method   string
+		path     string
+		body     string
+		httpCode int
+		grpcCode codes.Code
+	}{
+		{http.MethodPost, "/v1/snippet.grpc.reflection.HelloService/Hello", `{"name": "rootwarp", "age": 40}`, http.StatusOK, codes.OK},
+		{http.MethodPost, "/v1/snippet.grpc.reflection.HelloService/Hello", ``, http.StatusOK, codes.OK},
+		{http.MethodPost, "/v1/snippet.grpc.reflection.HelloService/Hello", `{"age": "old"}`, http.StatusBadRequest, codes.InvalidArgument},
+		{http.MethodPost, "/v1/snippet.grpc.reflection.HelloService/Hello", strings.Repeat(" ", maxGatewayBodySize+1), http.StatusRequestEntityTooLarge, codes.ResourceExhausted},
+		{http.MethodPost, "/v1/snippet.grpc.reflection.HelloService/Bye", `{}`, http.StatusNotFound, codes.NotFound},
+		{http.MethodPost, "/v1/unknown.Service/Hello", `{}`, http.StatusNotFound, codes.NotFound},
+		{http.MethodPost, "/v2/snippet.grpc.reflection.HelloService/Hello", `{}`, http.StatusNotFound, codes.NotFound},
+		{http.MethodGet, "/v1/snippet.grpc.reflection.HelloService/Hello", ``, http.StatusMethodNotAllowed, codes.Unimplemented},
+	}
+
+	for _, test := range tests {
+		req, err := http.NewRequest(test.method, srv.URL+test.path, strings.NewReader(test.body))
+		assert.Nil(t, err)
+
+		resp, err := http.DefaultClient.Do(req)
+		assert.Nil(t, err)
+
+		body, err := io.ReadAll(resp.Body)
+		resp.Body.Close()
+		assert.Nil(t, err)
+
+		assert.Equal(t, test.httpCode, resp.StatusCode, test.path)
+		assert.Equal(t, "application/json", resp.Header.Get("Content-Type"))
+
+		if test.grpcCode == codes.OK {
+			continue
+		}
+
+		gwErr := gatewayError{}
+		assert.Nil(t, json.Unmarshal(body, &gwErr))
+		assert.Equal(t, int(test.grpcCode), gwErr.Code, test.path)
+	}
+}
+
+func TestParseGatewayPath(t *testing.T) {
+	tests := []struct {
+		path        string
+		serviceName string
+		funcName    string
+		ok          bool
+	}{
+		{"/v1/a.B/C", "a.B", "C", true},
+		{"/v1/a.B/", "", "", false},
+		{"/v1/a.B", "", "", false},
+		{"/v1//C", "", "", false},
+		{"/v1/a.B/C/D", "", "", false},
+		{"/a.B/C", "", "", false},
+	}
+
+	for _, test := range tests {
+		serviceName, funcName, ok := parseGatewayPath(test.path)
+		assert.Equal(t, test.ok, ok, test.path)
+		assert.Equal(t, test.serviceName, serviceName, test.path)
+		assert.Equal(t, test.funcName, funcName, test.path)
+	}
+}
+
+func TestWriteBodyError(t *testing.T) {
+	tooLarge := httptest.NewRecorder()
+	_, err := io.ReadAll(http.MaxBytesReader(tooLarge, io.NopCloser(strings.NewReader("{}")), 1))
+	writeBodyError(tooLarge, err)
+
+	assert.Equal(t, http.StatusRequestEntityTooLarge, tooLarge.Code)
+
+	gwErr := gatewayError{}
+	assert.Nil(t, json.Unmarshal(tooLarge.Body.Bytes(), &gwErr))
+	assert.Equal(t, int(codes.ResourceExhausted), gwErr.Code)
+
+	// A body the client failed to send is no fault of its size.
+	broken := httptest.NewRecorder()
+	writeBodyError(broken, io.ErrUnexpectedEOF)
+
+	assert.Equal(t, http.StatusBadRequest, broken.Code)
+
+	gwErr = gatewayError{}
+	assert.Nil(t, json.Unmarshal(broken.Body.Bytes(), &gwErr))
+	assert.Equal(t, int(codes.InvalidArgument), gwErr.Code)
+}
+
+func TestGatewayAuthorization(t *testing.T) {
+	policyFile := filepath.Join(t.TempDir(), "policy.yaml")
+	writeTestPolicy(t, policyFile, testAuthzPolicy, time.Now())
+
+	authz, err := newAuthorizer(policyFile, io.Discard)
+	assert.Nil(t, err)
+
+	r = &reflectionHandler{authz: authz}
+
+	srv := httptest.NewServer(&gateway{})
+	defer srv.Close()
+
+	// Unauthorized callers cannot tell which services exist.
+	tests := []struct {
+		token    string
+		httpCode int
+	}{
+		{"", http.StatusForbidden},
+		{"ci-token", http.StatusForbidden},
+		{"ops-token", http.StatusNotFound},
+	}
+
+	for _, test := range tests {
+		req, err := http.NewRequest(http.MethodPost, srv.URL+"/v1/unknown.Service/Call", strings.NewReader(`{}`))
+		assert.Nil(t, err)
+
+		if test.token != "" {
+			req.Header.Set("Authorization", "Bearer "+test.token)
+		}
+
+		resp, err := http.DefaultClient.Do(req)
+		assert.Nil(t, err)
+		resp.Body.Close()
+
+		assert.Equal(t, test.httpCode, resp.StatusCode, test.token)
+	}
+}
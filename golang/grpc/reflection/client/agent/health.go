@@ -0,0 +1,165 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/health/grpc_health_v1"
+	"google.golang.org/grpc/status"
+)
+
+type healthState int
+
+const (
+	healthUnknown healthState = iota
+	healthServing
+	healthUnhealthy
+	// healthPending marks a service restored from the registry store which
+	// was not revalidated yet.
+	healthPending
+)
+
+func (h healthState) String() string {
+	switch h {
+	case healthServing:
+		return "SERVING"
+	case healthUnhealthy:
+		return "UNHEALTHY"
+	case healthPending:
+		return "PENDING"
+	}
+
+	return "UNKNOWN"
+}
+
+// healthChecker periodically runs the grpc.health.v1 check against every
+// registered plugin instance. An instance failing a check is marked unhealthy
+// and it is dropped from the registry after maxFailures consecutive failures.
+type healthChecker struct {
+	interval    time.Duration
+	timeout     time.Duration
+	maxFailures int
+}
+
+func (c *healthChecker) Run(ctx context.Context) {
+	ticker := time.NewTicker(c.interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			c.checkAll(ctx)
+		}
+	}
+}
+
+func (c *healthChecker) checkAll(ctx context.Context) {
+	for _, target := range r.healthTargets() {
+		err := c.check(ctx, target.Service, target.Address)
+		if err != nil {
+			fmt.Println("Health check failed", target.Service, target.Address, err)
+		}
+
+		r.reportHealth(target.Service, target.Address, err == nil, c.maxFailures)
+	}
+}
+
+func (c *healthChecker) check(ctx context.Context, name, address string) error {
+	ctx, cancel := context.WithTimeout(ctx, c.timeout)
+	defer cancel()
+
+	conn, err := r.conns.Get(address)
+	if err != nil {
+		return err
+	}
+
+	cli := grpc_health_v1.NewHealthClient(conn)
+	resp, err := cli.Check(ctx, &grpc_health_v1.HealthCheckRequest{Service: name})
+	if status.Code(err) == codes.NotFound {
+		// The plugin does not report per service, use its overall health.
+		resp, err = cli.Check(ctx, &grpc_health_v1.HealthCheckRequest{})
+	}
+
+	if err != nil {
+		return err
+	}
+
+	if resp.GetStatus() != grpc_health_v1.HealthCheckResponse_SERVING {
+		return fmt.Errorf("%s is %s", name, resp.GetStatus())
+	}
+
+	return nil
+}
+
+// healthTarget is one instance of a registered service.
+type healthTarget struct {
+	Service string
+	Address string
+}
+
+// healthTargets returns every instance of every registered service. Pending
+// instances are left to their revalidation.
+func (r *reflectionHandler) healthTargets() []healthTarget {
+	targets := []healthTarget{}
+	for name, service := range r.registry.Services() {
+		for _, e := range service.Endpoints {
+			if e.Health != healthPending {
+				targets = append(targets, healthTarget{Service: name, Address: e.Address})
+			}
+		}
+	}
+
+	return targets
+}
+
+// reportHealth records the result of a health check of the instance of the
+// service name at address.
+func (r *reflectionHandler) reportHealth(name, address string, healthy bool, maxFailures int) {
+	r.registry.Lock()
+	defer r.registry.Unlock()
+
+	service, ok := r.registry.get(name)
+	if !ok {
+		return
+	}
+
+	var e endpoint
+	for _, existing := range service.Endpoints {
+		if existing.Address == address {
+			e = existing
+		}
+	}
+
+	if e.Address == "" {
+		return
+	}
+
+	if healthy {
+		// Checks confirming what the registry holds publish no revision.
+		if e.Health == healthServing && e.Failures == 0 {
+			return
+		}
+
+		e.Health = healthServing
+		e.Failures = 0
+		r.registry.set(name, service.withEndpoint(e))
+		return
+	}
+
+	e.Health = healthUnhealthy
+	e.Failures++
+
+	if e.Failures >= maxFailures {
+		fmt.Println("Deregister", name, address)
+		r.removeEndpoint(name, address)
+		r.releaseConns()
+		r.persist()
+		return
+	}
+
+	r.registry.set(name, service.withEndpoint(e))
+}
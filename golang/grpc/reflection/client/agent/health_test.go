@@ -0,0 +1,74 @@
+package main
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+func TestHealthChecker(t *testing.T) {
+	s, address, port := startTestPluginServer(t)
+
+	r = &reflectionHandler{}
+
+	ctx := context.Background()
+	serviceName := "snippet.grpc.reflection.HelloService"
+
+	_, err := r.Query(ctx, serviceName, address, port, nil)
+	assert.Nil(t, err)
+	assert.Equal(t, healthUnknown, r.registry.Services()[serviceName].Endpoints[0].Health)
+
+	checker := &healthChecker{
+		interval:    time.Second,
+		timeout:     time.Second,
+		maxFailures: 2,
+	}
+
+	checker.checkAll(ctx)
+	assert.Equal(t, healthServing, r.registry.Services()[serviceName].Endpoints[0].Health)
+
+	// Healthy checks of a serving instance leave the registry as it is.
+	revision := r.registry.State().Revision
+	for i := 0; i < 3; i++ {
+		checker.checkAll(ctx)
+	}
+
+	assert.Equal(t, revision, r.registry.State().Revision)
+
+	s.Stop()
+
+	checker.checkAll(ctx)
+	assert.Equal(t, healthUnhealthy, r.registry.Services()[serviceName].Endpoints[0].Health)
+	assert.Equal(t, 1, r.registry.Services()[serviceName].Endpoints[0].Failures)
+
+	_, err = r.Invoke(ctx, serviceName, "Hello", nil)
+	assert.Equal(t, codes.Unavailable, status.Code(err))
+
+	checker.checkAll(ctx)
+	assert.NotContains(t, r.registry.Services(), serviceName)
+}
+
+func TestHealthCheckerOverallStatus(t *testing.T) {
+	address, port := startTestPlugin(t)
+
+	r = &reflectionHandler{}
+
+	ctx := context.Background()
+	serviceName := "snippet.grpc.reflection.RegistrationService"
+
+	_, err := r.Query(ctx, "hello", address, port, nil)
+	assert.Nil(t, err)
+
+	checker := &healthChecker{
+		interval:    time.Second,
+		timeout:     time.Second,
+		maxFailures: 2,
+	}
+
+	checker.checkAll(ctx)
+	assert.Equal(t, healthServing, r.registry.Services()[serviceName].Endpoints[0].Health)
+}
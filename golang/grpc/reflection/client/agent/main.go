@@ -3,17 +3,31 @@ package main
 import (
 	"context"
 	"errors"
+	"flag"
 	"fmt"
-	"net"
+	"io"
+	"net/http"
+	"os"
+	"sort"
+	"strings"
+	"time"
 
 	//"github.com/jhump/protoreflect/desc"
 	"github.com/jhump/protoreflect/desc"
 	"github.com/jhump/protoreflect/grpcreflect"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/collectors"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
 	"google.golang.org/grpc"
-	"google.golang.org/grpc/credentials/insecure"
-	"google.golang.org/grpc/reflection"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/health"
+	"google.golang.org/grpc/health/grpc_health_v1"
+	"google.golang.org/grpc/peer"
 	"google.golang.org/grpc/reflection/grpc_reflection_v1"
-	"google.golang.org/protobuf/reflect/protoreflect"
+	"google.golang.org/grpc/reflection/grpc_reflection_v1alpha"
+	"google.golang.org/grpc/status"
 	"google.golang.org/protobuf/types/dynamicpb"
 
 	//"google.golang.org/protobuf/encoding/protojson"
@@ -21,40 +35,376 @@ import (
 	// "google.golang.org/protobuf/types/descriptorpb"
 
 	"github.com/rootwarp/snippets/golang/grpc/reflection/proto/agent"
+	"github.com/rootwarp/snippets/golang/grpc/reflection/replay"
+	"github.com/rootwarp/snippets/golang/grpc/reflection/telemetry"
+	"github.com/rootwarp/snippets/golang/grpc/reflection/tlsconfig"
+	"github.com/rootwarp/snippets/golang/grpc/reflection/transport"
 )
 
 var (
-	ErrServiceNotFound = errors.New("cannot find service")
+	ErrServiceNotFound  = errors.New("cannot find service")
+	ErrFunctionNotFound = errors.New("cannot find function")
 )
 
 type reflectionHandler struct {
-	ServiceSpecs map[string]serviceMeta
+	registry registry
+	leases   leaseTable
+
+	conns connPool
+
+	// verifyIdentity makes registration check that the certificate of a
+	// plugin was issued for every service it registers.
+	verifyIdentity bool
+
+	// store persists the registry, nothing is persisted when it is nil.
+	store *registryStore
+
+	// schemas caches the descriptors of registered plugins by content hash,
+	// it is guarded by the registry's lock.
+	schemas      map[string]*cachedSchema
+	schemaPolicy schemaPolicy
+
+	balancer balancer
+
+	// authz restricts which caller may call which method, everything is
+	// allowed when it is nil.
+	authz *authorizer
+
+	// callConfig holds the agent's call settings of plugin methods, it
+	// takes precedence over the service configs of plugins.
+	callConfig *serviceConfig
+	breakers   breakerSet
+
+	// broadcastLimit caps the plugins a broadcast calls at once, there is
+	// no cap when it is zero.
+	broadcastLimit int
+
+	// metrics measures plugin calls and tracing traces them and
+	// registrations, nothing is recorded when they are nil.
+	metrics *agentMetrics
+	tracing trace.TracerProvider
+
+	// name identifies the agent in the calls it forwards to peers.
+	name string
+
+	// recorder records the calls of Invoke, nothing is recorded when it is
+	// nil.
+	recorder *replay.Writer
 }
 
+// serviceMeta is a registered service. Several plugins defining the same
+// service share it, calls are balanced over the instances of all of them.
 type serviceMeta struct {
-	Address   string
+	Desc      *desc.ServiceDescriptor
 	Functions map[string]funcMeta
+	// Schema is the content hash of the descriptors of the plugin which
+	// registered the service last.
+	Schema string
+	// Config is the gRPC service config of the plugin ConfigPlugin, if any.
+	// Only that plugin replaces or clears it while it serves the service.
+	Config       *serviceConfig
+	ConfigPlugin string
+
+	// Endpoints are the plugin instances serving the service, sorted by
+	// address.
+	Endpoints []endpoint
+}
+
+// endpoint is one instance of a plugin.
+type endpoint struct {
+	Plugin  string
+	Address string
+	// Offline tells the descriptors came with the registration rather than
+	// from server reflection.
+	Offline bool
+	// Peer tells the instance is a peer agent, which forwards the calls to
+	// its own plugins.
+	Peer bool
+	// Schema is the content hash of the descriptors the instance
+	// registered, which may differ compatibly from the service's.
+	Schema string
+
+	Health   healthState
+	Failures int
+	LastSeen time.Time
+}
+
+// available returns the endpoints of s able to take calls.
+func (s serviceMeta) available() []endpoint {
+	endpoints := []endpoint{}
+	for _, e := range s.Endpoints {
+		if e.Health != healthUnhealthy && e.Health != healthPending {
+			endpoints = append(endpoints, e)
+		}
+	}
+
+	return endpoints
 }
 
 type funcMeta struct {
+	Desc    *desc.MethodDescriptor
 	InDesc  *desc.MessageDescriptor
 	OutDesc *desc.MessageDescriptor
 }
 
-func (r *reflectionHandler) Query(ctx context.Context, name, address string, port int) error {
+// Query discovers the services served by the plugin name at address:port and
+// registers every one of them which matches allowed. An empty allowed
+// registers all services. It returns the names of the registered services.
+//
+// Every address a plugin registers from is an instance of it, calls are
+// balanced over its instances. The address may also be a unix:///path or
+// inproc://name address of the transport package, port is ignored then.
+func (r *reflectionHandler) Query(ctx context.Context, name, address string, port int, allowed []string) ([]string, error) {
+	reg, err := r.Register(ctx, name, address, port, registerOptions{Allowed: allowed})
+	if err != nil {
+		return nil, err
+	}
+
+	return reg.Services, nil
+}
+
+// registration is the outcome of Register.
+type registration struct {
+	Services []string
+	// Changes lists how the schema differs from the previous registration
+	// of the plugin.
+	Changes []schemaChange
+}
+
+// registerOptions are the optional settings of a registration.
+type registerOptions struct {
+	// Allowed restricts the registered services as in Query.
+	Allowed []string
+	// DescriptorSet is the serialized FileDescriptorSet of a plugin without
+	// server reflection, the plugin is only probed for the methods it
+	// defines.
+	DescriptorSet []byte
+	// Config is the plugin's service config.
+	Config *serviceConfig
+	// Peer registers a peer agent instead of a plugin.
+	Peer bool
+	// Pending registers the instance as pending, it takes no calls until
+	// a health check reports it. A live registration of the instance in
+	// the meantime is left as it is.
+	Pending bool
+}
+
+// Register is Query reporting the schema changes of the plugin too. A
+// breaking change fails the registration under the reject policy, the
+// previous registration stays in place then.
+func (r *reflectionHandler) Register(ctx context.Context, name, address string, port int, opts registerOptions) (_ registration, err error) {
 	fmt.Println("Query")
 
-	host := fmt.Sprintf("%s:%d", address, port)
-	cred := insecure.NewCredentials()
-	conn, err := grpc.Dial(host, grpc.WithTransportCredentials(cred))
+	host := transport.Target(address, port)
+
+	ctx, span := r.startSpan(ctx, "Register", attribute.String("plugin.name", name), attribute.String("plugin.address", host))
+	defer func() { endSpan(span, err) }()
+
+	// Registrations running at the same time must not close the
+	// connection before the instance is registered.
+	conn, release, err := r.conns.Hold(host)
 	if err != nil {
-		return err
+		return registration{}, err
 	}
+	defer release()
 
-	defer conn.Close()
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	var services map[string]*desc.ServiceDescriptor
+	if len(opts.DescriptorSet) > 0 {
+		services, err = r.probeServices(ctx, conn, name, host, opts.Allowed, opts.DescriptorSet)
+	} else {
+		services, err = r.resolveServices(ctx, conn, name, host, opts.Allowed)
+	}
+
+	if err != nil {
+		r.registry.Lock()
+		r.releaseConns()
+		r.registry.Unlock()
+
+		return registration{}, err
+	}
+
+	hash, schema, err := newCachedSchema(services)
+	if err != nil {
+		return registration{}, err
+	}
+
+	r.registry.Lock()
+	defer r.registry.Unlock()
+
+	// A peer registers whatever its plugins serve, the schema policy
+	// applies to them at the peer already.
+	var changes []schemaChange
+	if !opts.Peer {
+		changes, err = r.checkSchema(name, host, hash, services)
+		if err != nil {
+			r.releaseConns()
+			return registration{}, err
+		}
+	}
+
+	conflicts, err := r.checkSharedSchemas(name, services)
+	if err != nil {
+		r.releaseConns()
+		return registration{}, err
+	}
+
+	if !opts.Peer {
+		schema = r.cacheSchema(hash, schema)
+	}
+
+	// The instance stops serving whatever it registered before and dropped.
+	for serviceName, service := range r.registry.all() {
+		if _, ok := services[serviceName]; !ok && service.servedBy(name) {
+			r.removeEndpoint(serviceName, host)
+		}
+	}
+
+	registered := make([]string, 0, len(services))
+	for serviceName, serviceDesc := range schema.services {
+		service, _ := r.registry.get(serviceName)
+
+		// Other plugins keep serving the service as long as they define
+		// it compatibly, the instances of one conflicting with it are
+		// replaced. An older version leaves the newer descriptors in
+		// place.
+		meta := newServiceMeta(serviceDesc)
+		meta.Schema = hash
+		if conflicts[serviceName] == sharedOlder {
+			meta = service
+			meta.Endpoints = nil
+		}
+
+		for _, e := range service.Endpoints {
+			if e.Plugin == name || conflicts[serviceName] != sharedReplaced {
+				meta.Endpoints = append(meta.Endpoints, e)
+				continue
+			}
+
+			fmt.Println("Evict", e.Plugin, e.Address, serviceName, "conflicting with", name)
+		}
+
+		// The first plugin registering a config keeps it, other plugins'
+		// configs only apply once it is gone.
+		meta.Config, meta.ConfigPlugin = service.Config, service.ConfigPlugin
+		if meta.ConfigPlugin == "" || meta.ConfigPlugin == name || !meta.servedBy(meta.ConfigPlugin) {
+			meta.Config, meta.ConfigPlugin = opts.Config, ""
+			if opts.Config != nil {
+				meta.ConfigPlugin = name
+			}
+		}
+
+		e := endpoint{
+			Plugin:   name,
+			Address:  host,
+			Offline:  len(opts.DescriptorSet) > 0,
+			Peer:     opts.Peer,
+			Schema:   hash,
+			LastSeen: time.Now(),
+		}
+
+		if opts.Pending {
+			e.Health = healthPending
+			for _, existing := range service.pluginEndpoints(name) {
+				if existing.Address == host && existing.Health != healthPending {
+					e.Health, e.Failures = existing.Health, existing.Failures
+				}
+			}
+		}
+
+		r.registry.set(serviceName, meta.withEndpoint(e))
+		registered = append(registered, serviceName)
+	}
+
+	r.releaseConns()
+	r.persist()
+
+	sort.Strings(registered)
+
+	return registration{Services: registered, Changes: changes}, nil
+}
+
+// checkSchema compares the schema the instance of the plugin name at host
+// registers to the one the plugin registered before and applies the schema
+// policy. Services other instances keep serving do not count as removed.
+// The registry must be locked.
+func (r *reflectionHandler) checkSchema(name, host, hash string, services map[string]*desc.ServiceDescriptor) ([]schemaChange, error) {
+	previous := map[string]*desc.ServiceDescriptor{}
+	changed := false
+	for serviceName, service := range r.registry.all() {
+		instances := service.pluginEndpoints(name)
+		if len(instances) == 0 {
+			continue
+		}
+
+		_, kept := services[serviceName]
+		if !kept && (len(instances) != 1 || instances[0].Address != host) {
+			continue
+		}
+
+		// The plugin's own descriptors, the service's may be another
+		// plugin's compatible version.
+		own := instances[0]
+		for _, e := range instances {
+			if e.Address == host {
+				own = e
+			}
+		}
+
+		previous[serviceName] = service.Desc
+		if cached, ok := r.schemas[own.Schema]; ok && cached.services[serviceName] != nil {
+			previous[serviceName] = cached.services[serviceName]
+		}
+
+		changed = changed || !kept || own.Schema != hash
+	}
+
+	if !changed {
+		return nil, nil
+	}
+
+	changes := diffServices(previous, services)
+	if !hasBreakingChange(changes) {
+		return changes, nil
+	}
+
+	breaking := []string{}
+	for _, change := range changes {
+		if change.Breaking {
+			breaking = append(breaking, change.Description)
+		}
+	}
+
+	switch r.schemaPolicy {
+	case schemaReject:
+		return nil, status.Errorf(codes.FailedPrecondition, "schema of %s has breaking changes: %s", name, strings.Join(breaking, "; "))
+	case schemaWarn:
+		for _, description := range breaking {
+			fmt.Println("Breaking schema change", name, description)
+		}
+	}
+
+	return changes, nil
+}
+
+// resolveServices lists the services of the plugin behind conn through
+// server reflection and resolves the methods of those matching allowed.
+func (r *reflectionHandler) resolveServices(ctx context.Context, conn *grpc.ClientConn, name, host string, allowed []string) (_ map[string]*desc.ServiceDescriptor, err error) {
+	ctx, span := r.startSpan(ctx, "Reflection query", attribute.String("plugin.name", name), attribute.String("plugin.address", host))
+	defer func() { endSpan(span, err) }()
+
+	ctx = telemetry.OutgoingContext(ctx)
 
 	reflectCli := grpc_reflection_v1.NewServerReflectionClient(conn)
 	reflectInfoCli, err := reflectCli.ServerReflectionInfo(ctx)
+	if err != nil {
+		return nil, reflectionError(name, err)
+	}
+
+	p, _ := peer.FromContext(reflectInfoCli.Context())
+	identities := tlsconfig.PeerIdentities(p)
 
 	listReq := grpc_reflection_v1.ServerReflectionRequest_ListServices{}
 	reflectReq := grpc_reflection_v1.ServerReflectionRequest{
@@ -64,145 +414,468 @@ func (r *reflectionHandler) Query(ctx context.Context, name, address string, por
 
 	err = reflectInfoCli.Send(&reflectReq)
 	if err != nil {
-		return err
+		return nil, err
 	}
 
 	reflectResp, err := reflectInfoCli.Recv()
 	if err != nil {
-		return err
+		return nil, reflectionError(name, err)
 	}
 
 	listServiceResp := reflectResp.GetListServicesResponse()
 	services := listServiceResp.GetService()
 
-	var findService *grpc_reflection_v1.ServiceResponse
+	grpcReflectCli := grpcreflect.NewClientAuto(ctx, conn)
+	defer grpcReflectCli.Reset()
+
+	resolved := map[string]*desc.ServiceDescriptor{}
 	for _, service := range services {
 		fmt.Println("service", service.Name)
-		if service.Name == name {
-			findService = service
+
+		if isInternalService(service.Name) || !isAllowedService(service.Name, allowed) {
+			continue
+		}
+
+		if r.verifyIdentity && !tlsconfig.MatchIdentity(identities, service.Name) {
+			return nil, status.Errorf(codes.PermissionDenied, "certificate of %s is not valid for %s", name, service.Name)
 		}
+
+		// List functions
+		serviceDesc, err := grpcReflectCli.ResolveService(service.Name)
+		if err != nil {
+			return nil, err
+		}
+
+		resolved[service.Name] = serviceDesc
 	}
 
-	if findService == nil {
-		return fmt.Errorf("cannot find %s", name)
+	if len(resolved) == 0 {
+		return nil, fmt.Errorf("cannot find any service of %s at %s", name, host)
 	}
 
-	fmt.Println("found", findService)
+	return resolved, nil
+}
 
-	// List functions
-	grpcReflectCli := grpcreflect.NewClientAuto(ctx, conn)
-	serviceDesc, err := grpcReflectCli.ResolveService(name)
-	if err != nil {
+// reflectionError explains a plugin without server reflection needs to
+// register with a descriptor set.
+func reflectionError(name string, err error) error {
+	if status.Code(err) != codes.Unimplemented {
 		return err
 	}
 
-	methods := serviceDesc.GetMethods()
+	return status.Errorf(codes.FailedPrecondition, "%s does not serve server reflection, register it with a descriptor set", name)
+}
 
-	r.ServiceSpecs[name] = serviceMeta{
-		Address:   fmt.Sprintf("%s:%d", address, port),
-		Functions: map[string]funcMeta{},
+// isInternalService reports whether name is one of the infrastructure
+// services every plugin exposes, which are never registered.
+func isInternalService(name string) bool {
+	switch name {
+	case grpc_reflection_v1.ServerReflection_ServiceDesc.ServiceName,
+		grpc_reflection_v1alpha.ServerReflection_ServiceDesc.ServiceName,
+		grpc_health_v1.Health_ServiceDesc.ServiceName:
+		return true
 	}
 
-	for _, method := range methods {
-		fmt.Println("*****", method.GetName())
+	return false
+}
 
-		in := method.GetInputType()
-		out := method.GetOutputType()
+// isAllowedService reports whether name matches a service name or a package
+// prefix of allowed. An empty allowed accepts every service.
+func isAllowedService(name string, allowed []string) bool {
+	if len(allowed) == 0 {
+		return true
+	}
 
-		meta := funcMeta{
-			InDesc:  in,
-			OutDesc: out,
+	for _, pattern := range allowed {
+		if name == pattern || strings.HasPrefix(name, strings.TrimSuffix(pattern, ".")+".") {
+			return true
 		}
-		r.ServiceSpecs[name].Functions[method.GetName()] = meta
 	}
 
-	return nil
+	return false
 }
 
-func (s *reflectionHandler) Invoke(ctx context.Context, serviceName, funcName string) (any, error) {
-	fmt.Println("Invoke")
+// lookup returns the service serviceName together with its method funcName,
+// provided an instance of the service is able to take calls.
+func (r *reflectionHandler) lookup(serviceName, funcName string) (serviceMeta, funcMeta, error) {
+	service, ok := r.registry.Get(serviceName)
 
-	service, ok := r.ServiceSpecs[serviceName]
 	if !ok {
-		return nil, ErrServiceNotFound
+		return serviceMeta{}, funcMeta{}, ErrServiceNotFound
 	}
 
-	fMeta := service.Functions[funcName]
-	fmt.Println(fMeta)
+	if len(service.available()) == 0 {
+		return serviceMeta{}, funcMeta{}, service.unavailable(serviceName)
+	}
 
-	// TODO: We should fill here dynamically
-	inSpec := fMeta.InDesc
+	fMeta, ok := service.Functions[funcName]
+	if !ok {
+		return serviceMeta{}, funcMeta{}, ErrFunctionNotFound
+	}
 
-	newInMsg := dynamicpb.NewMessage(inSpec.UnwrapMessage())
+	return service, fMeta, nil
+}
 
-	nameField := inSpec.FindFieldByName("name").UnwrapField()
-	ageField := inSpec.FindFieldByName("age").UnwrapField()
-	newInMsg.Set(nameField, protoreflect.ValueOfString("rootwarp"))
-	newInMsg.Set(ageField, protoreflect.ValueOfInt32(40))
+// unavailable explains why no instance of s, the service serviceName, takes
+// calls.
+func (s serviceMeta) unavailable(serviceName string) error {
+	for _, e := range s.Endpoints {
+		if e.Health == healthPending {
+			return status.Errorf(codes.Unavailable, "%s is being revalidated", serviceName)
+		}
+	}
 
-	outSpec := fMeta.OutDesc
-	newOutMsg := dynamicpb.NewMessage(outSpec.UnwrapMessage())
+	return status.Errorf(codes.Unavailable, "%s is unhealthy", serviceName)
+}
 
-	// Invoke
-	cred := insecure.NewCredentials()
-	conn, err := grpc.Dial(service.Address, grpc.WithTransportCredentials(cred))
+// pick chooses the instance of service taking a call made with ctx, leaving
+// out the instances whose circuit breaker is open. Plugins registered with
+// the agent itself are preferred over peer agents, which a call forwarded by
+// a peer never goes to. The caller calls done with the outcome of the call
+// once it ends.
+func (r *reflectionHandler) pick(ctx context.Context, serviceName string, service serviceMeta, policy callPolicy) (string, func(error), error) {
+	available := service.available()
+	if len(available) == 0 {
+		return "", nil, service.unavailable(serviceName)
+	}
+
+	candidates := localEndpoints(available)
+	if len(candidates) == 0 && !isForwarded(ctx) {
+		candidates = available
+	}
+
+	if len(candidates) == 0 {
+		return "", nil, status.Errorf(codes.Unavailable, "%s is only served by peers, which a forwarded call does not go to", serviceName)
+	}
+
+	endpoints := []endpoint{}
+	for _, e := range candidates {
+		if r.breakers.Allow(breakerKey(serviceName, e.Address)) {
+			endpoints = append(endpoints, e)
+		}
+	}
+
+	if len(endpoints) == 0 {
+		return "", nil, status.Errorf(codes.Unavailable, "circuit breaker of every %s instance is open", serviceName)
+	}
+
+	address, release := r.balancer.Pick(ctx, serviceName, endpoints)
+	trace.SpanFromContext(ctx).AddEvent("Pick instance", trace.WithAttributes(attribute.String("plugin.address", address)))
+
+	done := func(err error) {
+		release()
+		r.breakers.Report(breakerKey(serviceName, address), policy, err)
+	}
+
+	return address, done, nil
+}
+
+// Invoke calls funcName of serviceName with a protojson payload and returns
+// the response rendered as protojson. The call follows the timeout, retry
+// policy and circuit breaker configured for the method.
+func (r *reflectionHandler) Invoke(ctx context.Context, serviceName, funcName string, payload []byte) (out []byte, err error) {
+	fmt.Println("Invoke")
+
+	if err := r.authorize(ctx, serviceName, funcName); err != nil {
+		return nil, err
+	}
+
+	service, fMeta, err := r.lookup(serviceName, funcName)
 	if err != nil {
-		fmt.Println(err)
 		return nil, err
 	}
 
-	defer conn.Close()
+	if fMeta.Desc.IsClientStreaming() || fMeta.Desc.IsServerStreaming() {
+		return nil, status.Errorf(codes.InvalidArgument, "%s/%s is a streaming method", serviceName, funcName)
+	}
+
+	ctx, finish := r.startCall(ctx, serviceName, funcName)
+	defer func() { finish(err) }()
 
-	funcURL := fmt.Sprintf("%s/%s", serviceName, funcName)
-	err = conn.Invoke(ctx, funcURL, newInMsg, newOutMsg)
+	newInMsg, err := newDynamicMessage(fMeta.InDesc, payload)
 	if err != nil {
-		fmt.Println(err)
-		return nil, err
+		return nil, status.Error(codes.InvalidArgument, err.Error())
 	}
 
-	return newOutMsg, nil
-}
+	if r.recorder != nil {
+		start := time.Now()
+		defer func() { r.record(ctx, serviceName, funcName, fMeta, newInMsg, out, err, start) }()
+	}
+
+	policy := r.callPolicy(service, serviceName, funcName)
+	ctx, cancel := withCallTimeout(ctx, policy)
+	defer cancel()
+
+	for attempt := 1; ; attempt++ {
+		newOutMsg := dynamicpb.NewMessage(fMeta.OutDesc.UnwrapMessage())
+
+		err := r.invokeOnce(ctx, serviceName, funcName, service, policy, newInMsg, newOutMsg)
+		if err == nil {
+			return marshalDynamicMessage(fMeta.OutDesc, newOutMsg)
+		}
+
+		fmt.Println(err)
+
+		if attempt >= policy.MaxAttempts || !policy.retryable(err) {
+			return nil, err
+		}
+
+		select {
+		case <-ctx.Done():
+			return nil, err
+		case <-time.After(policy.backoff(attempt)):
+		}
 
-type registrationServer struct {
-	agent.UnimplementedRegistrationServiceServer
+		// Instances may have come and gone in the meantime.
+		service, _, err = r.lookup(serviceName, funcName)
+		if err != nil {
+			return nil, err
+		}
+	}
 }
 
-func (s *registrationServer) RegisterPlugin(ctx context.Context, in *agent.RegisterRequest) (*agent.RegisterResponse, error) {
-	fmt.Println("Register", in.Name, in.Address, in.Port)
+func (r *reflectionHandler) invokeOnce(ctx context.Context, serviceName, funcName string, service serviceMeta, policy callPolicy, in, out *dynamicpb.Message) error {
+	address, done, err := r.pick(ctx, serviceName, service, policy)
+	if err != nil {
+		return err
+	}
 
-	err := r.Query(ctx, in.Name, in.Address, int(in.Port))
+	conn, err := r.conns.Get(address)
 	if err != nil {
-		return nil, err
+		done(nil)
+		return err
 	}
 
-	// TODO: Testing purpose.
-	r.Invoke(ctx, in.Name, "Hello")
+	funcURL := fmt.Sprintf("/%s/%s", serviceName, funcName)
+	err = conn.Invoke(telemetry.OutgoingContext(r.forwardContext(ctx, service, address)), funcURL, in, out)
+	done(err)
 
-	return &agent.RegisterResponse{
-		Msg: fmt.Sprintf("%s - %s:%d", in.Name, in.Address, in.Port),
-	}, nil
+	return err
 }
 
 var r *reflectionHandler
 
 func main() {
+	grpcAddr := flag.String("grpc", "127.0.0.1:8080", "listen address of the registration service, host:port, unix:///path or inproc://name")
+	httpAddr := flag.String("http", "127.0.0.1:8081", "listen address of the HTTP/JSON gateway")
+	healthInterval := flag.Duration("health-interval", 10*time.Second, "interval between plugin health checks")
+	healthTimeout := flag.Duration("health-timeout", 2*time.Second, "timeout of a single plugin health check")
+	maxFailures := flag.Int("health-max-failures", 3, "consecutive failed health checks before a plugin is dropped")
+	lease := flag.Duration("lease", 30*time.Second, "how long a registration stays valid without a heartbeat, 0 disables expiry")
+	verifyIdentity := flag.Bool("tls-verify-plugin-identity", false, "require plugin certificates to be issued for the services they register instead of their host")
+	registryFile := flag.String("registry-file", "", "file persisting the registry across restarts, empty disables persistence")
+	schemaPolicyName := flag.String("schema-policy", "warn", "handling of breaking schema changes on re-registration: accept, warn or reject")
+	lbPolicyName := flag.String("lb-policy", "round_robin", "balancing of calls over plugin instances: round_robin, least_outstanding or consistent_hash")
+	lbHashKey := flag.String("lb-hash-key", "x-lb-key", "metadata key, or HTTP header of the gateway, consistent_hash balancing uses")
+	authzPolicyFile := flag.String("authz-policy", "", "YAML authorization policy of plugin methods, empty allows every call")
+	authzReload := flag.Duration("authz-reload-interval", 5*time.Second, "interval between checks of the authorization policy for changes")
+	authzAuditFile := flag.String("authz-audit-log", "", "file the denied calls are appended to, standard output when empty")
+	callConfigFile := flag.String("call-config", "", "service config JSON with timeouts, retry policies and circuit breakers of plugin methods")
+	broadcastLimit := flag.Int("broadcast-concurrency", 8, "maximum number of plugins a broadcast calls at once, 0 calls all of them at once")
+	metricsAddr := flag.String("metrics", "127.0.0.1:8082", "listen address of the Prometheus metrics endpoint, empty disables it")
+	name := flag.String("name", "", "name of the agent its peers see in the calls it forwards, the host name when empty")
+	peers := flag.String("peers", "", "comma-separated gRPC addresses of peer agents whose plugins the agent forwards calls to, peers share their own plugins only so every agent lists all the others")
+	peerRetry := flag.Duration("peer-retry", 5*time.Second, "interval between attempts to reconnect to a peer agent")
+	recordFile := flag.String("record-file", "", "JSON lines file recording the calls of the HTTP gateway and CallMethod, empty disables recording")
+	recordMaxSize := flag.Int64("record-max-size", 64<<20, "size in bytes the record file is rotated at, 0 never rotates it")
+	recordMaxFiles := flag.Int("record-max-files", 5, "number of rotated record files kept")
+
+	tlsCfg := tlsconfig.Config{}
+	tlsCfg.AddFlags(flag.CommandLine, "tls-")
+	traceCfg := telemetry.Config{}
+	traceCfg.AddFlags(flag.CommandLine, "trace-")
+	flag.Parse()
+
 	fmt.Println("Start server")
 
-	go func() {
-		r = &reflectionHandler{
-			ServiceSpecs: map[string]serviceMeta{},
+	policy, err := parseSchemaPolicy(*schemaPolicyName)
+	if err != nil {
+		panic(err)
+	}
+
+	lb, err := parseLBPolicy(*lbPolicyName)
+	if err != nil {
+		panic(err)
+	}
+
+	var callConfig *serviceConfig
+	if *callConfigFile != "" {
+		data, err := os.ReadFile(*callConfigFile)
+		if err != nil {
+			panic(err)
+		}
+
+		if callConfig, err = parseServiceConfig(data); err != nil {
+			panic(err)
+		}
+	}
+
+	var authz *authorizer
+	if *authzPolicyFile != "" {
+		audit := io.Writer(os.Stdout)
+		if *authzAuditFile != "" {
+			f, err := os.OpenFile(*authzAuditFile, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0600)
+			if err != nil {
+				panic(err)
+			}
+			defer f.Close()
+
+			audit = f
 		}
-	}()
 
-	s := grpc.NewServer()
-	agent.RegisterRegistrationServiceServer(s, &registrationServer{})
-	reflection.Register(s)
+		authz, err = newAuthorizer(*authzPolicyFile, audit)
+		if err != nil {
+			panic(err)
+		}
+
+		go authz.Watch(context.Background(), *authzReload)
+	}
+
+	serverCreds, err := tlsCfg.ServerCredentials()
+	if err != nil {
+		panic(err)
+	}
+
+	// The agent presents the same certificate when it calls plugins and
+	// peers. The names of peers are verified whatever is checked of plugins.
+	dialCfg := tlsCfg
+	dialCfg.SkipHostnameVerify = *verifyIdentity
+
+	dialCreds, err := dialCfg.ClientCredentials()
+	if err != nil {
+		panic(err)
+	}
+
+	peerCreds, err := tlsCfg.ClientCredentials()
+	if err != nil {
+		panic(err)
+	}
+
+	peerAddresses := map[string]bool{}
+	for _, address := range strings.Split(*peers, ",") {
+		if address = strings.TrimSpace(address); address != "" {
+			peerAddresses[address] = true
+		}
+	}
+
+	tracing, shutdownTracing, err := traceCfg.TracerProvider("plugin-agent")
+	if err != nil {
+		panic(err)
+	}
+	defer shutdownTracing(context.Background())
+
+	metrics := newAgentMetrics()
+	metricsRegistry := prometheus.NewRegistry()
+	metricsRegistry.MustRegister(collectors.NewGoCollector(), collectors.NewProcessCollector(collectors.ProcessCollectorOpts{}))
+
+	checker := &healthChecker{
+		interval:    *healthInterval,
+		timeout:     *healthTimeout,
+		maxFailures: *maxFailures,
+	}
+
+	// The handler is in place before anything serves, restoring the
+	// registry runs in the background.
+	r = &reflectionHandler{
+		conns:          connPool{creds: dialCreds, peerCreds: peerCreds, peers: peerAddresses},
+		verifyIdentity: *verifyIdentity,
+		schemaPolicy:   policy,
+		balancer:       balancer{policy: lb, hashKey: *lbHashKey},
+		authz:          authz,
+		callConfig:     callConfig,
+		broadcastLimit: *broadcastLimit,
+		metrics:        metrics,
+		tracing:        tracing,
+		name:           *name,
+	}
+
+	if r.name == "" {
+		r.name, _ = os.Hostname()
+	}
 
-	l, err := net.Listen("tcp", "127.0.0.1:8080")
+	if *recordFile != "" {
+		if r.recorder, err = replay.NewWriter(*recordFile, *recordMaxSize, *recordMaxFiles); err != nil {
+			panic(err)
+		}
+		defer r.recorder.Close()
+	}
+
+	// Revisions of earlier runs of the agent stay behind the ones of this
+	// run, a watcher resuming from one of them gets a snapshot.
+	r.registry.StartAt(uint64(time.Now().UnixNano()))
+
+	if err := metrics.Register(metricsRegistry, r); err != nil {
+		panic(err)
+	}
+
+	if *registryFile != "" {
+		r.store = &registryStore{path: *registryFile}
+
+		go func() {
+			if err := r.Restore(context.Background(), checker); err != nil {
+				fmt.Println("Restore registry", err)
+			}
+		}()
+	}
+
+	opts := append(proxyServerOptions(), grpc.Creds(serverCreds))
+	opts = append(opts, telemetry.ServerOptions(tracing)...)
+	opts = append(opts, authzServerOptions()...)
+	s := grpc.NewServer(opts...)
+	agent.RegisterRegistrationServiceServer(s, &registrationServer{lease: *lease})
+	registerProxyReflection(s)
+
+	// Peers check the health of the agent like the one of a plugin.
+	grpc_health_v1.RegisterHealthServer(s, health.NewServer())
+
+	l, err := transport.Listen(*grpcAddr)
 	if err != nil {
 		panic(err)
 	}
 
+	go func() {
+		fmt.Println("Start gateway", *httpAddr)
+
+		srv := &http.Server{
+			Addr:    *httpAddr,
+			Handler: &gateway{},
+		}
+
+		var err error
+		if !tlsCfg.Enabled() {
+			err = srv.ListenAndServe()
+		} else if srv.TLSConfig, err = tlsCfg.ServerTLS(); err == nil {
+			err = srv.ListenAndServeTLS("", "")
+		}
+
+		if err != nil {
+			panic(err)
+		}
+	}()
+
+	if *metricsAddr != "" {
+		go func() {
+			fmt.Println("Start metrics", *metricsAddr)
+
+			mux := http.NewServeMux()
+			mux.Handle("/metrics", promhttp.HandlerFor(metricsRegistry, promhttp.HandlerOpts{}))
+
+			if err := http.ListenAndServe(*metricsAddr, mux); err != nil {
+				panic(err)
+			}
+		}()
+	}
+
+	go checker.Run(context.Background())
+
+	for address := range peerAddresses {
+		go r.followPeer(context.Background(), address, *peerRetry)
+	}
+
+	if *lease > 0 {
+		go expireLeases(context.Background(), *lease)
+	}
+
 	if err := s.Serve(l); err != nil {
 		panic(err)
 	}
@@ -0,0 +1,284 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/encoding"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/reflection"
+	"google.golang.org/grpc/reflection/grpc_reflection_v1"
+	"google.golang.org/grpc/reflection/grpc_reflection_v1alpha"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/reflect/protoreflect"
+	"google.golang.org/protobuf/reflect/protoregistry"
+
+	"github.com/rootwarp/snippets/golang/grpc/reflection/protofiles"
+	"github.com/rootwarp/snippets/golang/grpc/reflection/telemetry"
+)
+
+// rawFrame is a message which is forwarded without being decoded.
+type rawFrame struct {
+	payload []byte
+}
+
+// proxyCodec passes rawFrames through untouched and encodes everything else
+// with the regular proto codec, so the agent's own services keep working on
+// a server which forces it.
+type proxyCodec struct{}
+
+func (proxyCodec) Marshal(v any) ([]byte, error) {
+	if frame, ok := v.(*rawFrame); ok {
+		return frame.payload, nil
+	}
+
+	return encoding.GetCodec("proto").Marshal(v)
+}
+
+func (proxyCodec) Unmarshal(data []byte, v any) error {
+	if frame, ok := v.(*rawFrame); ok {
+		frame.payload = append([]byte(nil), data...)
+		return nil
+	}
+
+	return encoding.GetCodec("proto").Unmarshal(data, v)
+}
+
+func (proxyCodec) Name() string {
+	return "proto"
+}
+
+// proxyServerOptions makes a grpc.Server forward calls to services it does
+// not know itself to the plugin which registered them.
+func proxyServerOptions() []grpc.ServerOption {
+	return []grpc.ServerOption{
+		grpc.ForceServerCodec(proxyCodec{}),
+		grpc.UnknownServiceHandler(proxyHandler),
+	}
+}
+
+func proxyHandler(srv any, serverStream grpc.ServerStream) (err error) {
+	fullMethod, ok := grpc.MethodFromServerStream(serverStream)
+	if !ok {
+		return status.Error(codes.Internal, "cannot find method of the stream")
+	}
+
+	fmt.Println("Proxy", fullMethod)
+
+	serviceName, funcName, ok := strings.Cut(strings.TrimPrefix(fullMethod, "/"), "/")
+	if !ok {
+		return status.Errorf(codes.Unimplemented, "malformed method name %q", fullMethod)
+	}
+
+	if err := r.authorize(serverStream.Context(), serviceName, funcName); err != nil {
+		return err
+	}
+
+	service, _, err := r.lookup(serviceName, funcName)
+	if errors.Is(err, ErrServiceNotFound) || errors.Is(err, ErrFunctionNotFound) {
+		return status.Errorf(codes.Unimplemented, "unknown method %s", fullMethod)
+	} else if err != nil {
+		return err
+	}
+
+	ctx, finish := r.startCall(serverStream.Context(), serviceName, funcName)
+	defer func() { finish(err) }()
+
+	policy := r.callPolicy(service, serviceName, funcName)
+
+	// The deadline travels with the context, metadata has to be copied.
+	ctx, cancel := withCallTimeout(ctx, policy)
+	defer cancel()
+
+	address, done, err := r.pick(ctx, serviceName, service, policy)
+	if err != nil {
+		return err
+	}
+
+	defer func() { done(err) }()
+
+	conn, err := r.conns.Get(address)
+	if err != nil {
+		return status.Error(codes.Unavailable, err.Error())
+	}
+
+	md, _ := metadata.FromIncomingContext(ctx)
+	forwarded := forwardedMetadata(md)
+	telemetry.Inject(ctx, forwarded)
+	ctx = r.forwardContext(metadata.NewOutgoingContext(ctx, forwarded), service, address)
+
+	streamDesc := &grpc.StreamDesc{
+		ServerStreams: true,
+		ClientStreams: true,
+	}
+
+	clientStream, err := conn.NewStream(ctx, streamDesc, fullMethod, grpc.ForceCodec(proxyCodec{}))
+	if err != nil {
+		return err
+	}
+
+	sendErr := make(chan error, 1)
+	go func() {
+		sendErr <- forwardRequests(serverStream, clientStream)
+	}()
+
+	recvErr := forwardResponses(clientStream, serverStream)
+	serverStream.SetTrailer(clientStream.Trailer())
+
+	if recvErr != nil {
+		return recvErr
+	}
+
+	// The plugin is done, a caller still sending does not matter anymore.
+	select {
+	case err := <-sendErr:
+		if err != nil {
+			return err
+		}
+	default:
+	}
+
+	return nil
+}
+
+// forwardRequests copies the caller's messages to the plugin.
+func forwardRequests(serverStream grpc.ServerStream, clientStream grpc.ClientStream) error {
+	for {
+		frame := &rawFrame{}
+		err := serverStream.RecvMsg(frame)
+		if err == io.EOF {
+			return clientStream.CloseSend()
+		}
+
+		if err != nil {
+			return err
+		}
+
+		if err := clientStream.SendMsg(frame); err != nil {
+			// The plugin ended the call, its status is reported by
+			// forwardResponses.
+			return nil
+		}
+	}
+}
+
+// forwardResponses copies headers and messages of the plugin to the caller.
+// It returns nil once the plugin ends the call successfully and the plugin's
+// status otherwise.
+func forwardResponses(clientStream grpc.ClientStream, serverStream grpc.ServerStream) error {
+	header, err := clientStream.Header()
+	if err != nil {
+		return err
+	}
+
+	if err := serverStream.SendHeader(header); err != nil {
+		return err
+	}
+
+	for {
+		frame := &rawFrame{}
+		err := clientStream.RecvMsg(frame)
+		if err == io.EOF {
+			return nil
+		}
+
+		if err != nil {
+			return err
+		}
+
+		if err := serverStream.SendMsg(frame); err != nil {
+			return err
+		}
+	}
+}
+
+// forwardedMetadata drops the pseudo and transport headers of md, which the
+// outgoing connection sets by itself.
+func forwardedMetadata(md metadata.MD) metadata.MD {
+	out := metadata.MD{}
+	for key, values := range md {
+		if strings.HasPrefix(key, ":") || key == "content-type" || key == "user-agent" {
+			continue
+		}
+
+		out[key] = append([]string(nil), values...)
+	}
+
+	return out
+}
+
+// registerProxyReflection registers a server reflection service on s which
+// advertises the services of s along with every proxied plugin service.
+func registerProxyReflection(s *grpc.Server) {
+	opts := reflection.ServerOptions{
+		Services:           &proxyServiceInfo{server: s},
+		DescriptorResolver: &proxyDescResolver{},
+	}
+
+	grpc_reflection_v1alpha.RegisterServerReflectionServer(s, reflection.NewServer(opts))
+	grpc_reflection_v1.RegisterServerReflectionServer(s, reflection.NewServerV1(opts))
+}
+
+type proxyServiceInfo struct {
+	server *grpc.Server
+}
+
+func (p *proxyServiceInfo) GetServiceInfo() map[string]grpc.ServiceInfo {
+	infos := p.server.GetServiceInfo()
+
+	for serviceName, service := range r.registry.Services() {
+		if _, ok := infos[serviceName]; ok {
+			// The agent's own services win.
+			continue
+		}
+
+		info := grpc.ServiceInfo{}
+		for funcName, fMeta := range service.Functions {
+			info.Methods = append(info.Methods, grpc.MethodInfo{
+				Name:           funcName,
+				IsClientStream: fMeta.Desc.IsClientStreaming(),
+				IsServerStream: fMeta.Desc.IsServerStreaming(),
+			})
+		}
+
+		infos[serviceName] = info
+	}
+
+	return infos
+}
+
+// proxyDescResolver looks descriptors up in the agent's own registry first and
+// in the schemas of registered plugins after.
+type proxyDescResolver struct{}
+
+func (p *proxyDescResolver) pluginFiles() *protoregistry.Files {
+	files := &protoregistry.Files{}
+
+	for _, service := range r.registry.Services() {
+		if service.Desc != nil {
+			protofiles.Register(files, service.Desc.GetFile())
+		}
+	}
+
+	return files
+}
+
+func (p *proxyDescResolver) FindFileByPath(path string) (protoreflect.FileDescriptor, error) {
+	if fd, err := protoregistry.GlobalFiles.FindFileByPath(path); err == nil {
+		return fd, nil
+	}
+
+	return p.pluginFiles().FindFileByPath(path)
+}
+
+func (p *proxyDescResolver) FindDescriptorByName(name protoreflect.FullName) (protoreflect.Descriptor, error) {
+	if d, err := protoregistry.GlobalFiles.FindDescriptorByName(name); err == nil {
+		return d, nil
+	}
+
+	return p.pluginFiles().FindDescriptorByName(name)
+}
@@ -0,0 +1,146 @@
+package main
+
+import (
+	"context"
+	"io"
+	"net"
+	"sort"
+	"testing"
+	"time"
+
+	"github.com/jhump/protoreflect/grpcreflect"
+	"github.com/stretchr/testify/assert"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+
+	"github.com/rootwarp/snippets/golang/grpc/reflection/proto/agent"
+	"github.com/rootwarp/snippets/golang/grpc/reflection/proto/plugin"
+)
+
+func startTestAgent(t *testing.T) *grpc.ClientConn {
+	s := grpc.NewServer(append(proxyServerOptions(), authzServerOptions()...)...)
+	agent.RegisterRegistrationServiceServer(s, &registrationServer{lease: time.Minute})
+	registerProxyReflection(s)
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.Nil(t, err)
+
+	go s.Serve(l)
+	t.Cleanup(s.Stop)
+
+	conn, err := grpc.Dial(l.Addr().String(), grpc.WithTransportCredentials(insecure.NewCredentials()))
+	assert.Nil(t, err)
+	t.Cleanup(func() { conn.Close() })
+
+	return conn
+}
+
+func TestProxy(t *testing.T) {
+	address, port := startTestPlugin(t)
+
+	r = &reflectionHandler{}
+	defer r.conns.Close()
+
+	_, err := r.Query(context.Background(), "hello", address, port, []string{"snippet.grpc.reflection.HelloService"})
+	assert.Nil(t, err)
+
+	conn := startTestAgent(t)
+	cli := plugin.NewHelloServiceClient(conn)
+
+	// Unary with metadata and deadline
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	ctx = metadata.AppendToOutgoingContext(ctx, "x-echo", "ping")
+
+	header, trailer := metadata.MD{}, metadata.MD{}
+	resp, err := cli.Hello(ctx, &plugin.HelloRequest{Name: "rootwarp", Age: 40}, grpc.Header(&header), grpc.Trailer(&trailer))
+	assert.Nil(t, err)
+	assert.Equal(t, "Hey rootwarp(40)", resp.GreetingMsg)
+	assert.Equal(t, []string{"ping"}, header.Get("x-echo"))
+	assert.Equal(t, []string{"true"}, header.Get("x-deadline"))
+	assert.Equal(t, []string{"ping"}, trailer.Get("x-echo-trailer"))
+
+	// Server streaming
+	feed, err := cli.HelloFeed(context.Background(), &plugin.HelloRequest{Name: "a", Age: 2})
+	assert.Nil(t, err)
+
+	msgs := []string{}
+	for {
+		resp, err := feed.Recv()
+		if err == io.EOF {
+			break
+		}
+
+		assert.Nil(t, err)
+		msgs = append(msgs, resp.GetGreetingMsg())
+	}
+
+	assert.Equal(t, []string{"Hey a(1/2)", "Hey a(2/2)"}, msgs)
+
+	// Status passes through unchanged
+	feed, err = cli.HelloFeed(context.Background(), &plugin.HelloRequest{Age: -1})
+	assert.Nil(t, err)
+
+	_, err = feed.Recv()
+	assert.Equal(t, codes.InvalidArgument, status.Code(err))
+	assert.Equal(t, "negative age", status.Convert(err).Message())
+
+	// Bidi streaming
+	chat, err := cli.HelloChat(context.Background())
+	assert.Nil(t, err)
+
+	for _, name := range []string{"a", "b"} {
+		assert.Nil(t, chat.Send(&plugin.HelloRequest{Name: name}))
+
+		resp, err := chat.Recv()
+		assert.Nil(t, err)
+		assert.Equal(t, "Hey "+name+"(0)", resp.GetGreetingMsg())
+	}
+
+	assert.Nil(t, chat.CloseSend())
+
+	_, err = chat.Recv()
+	assert.Equal(t, io.EOF, err)
+
+	// Unknown services
+	_, err = agent.NewRegistrationServiceClient(conn).ListPlugins(context.Background(), &agent.ListPluginsRequest{})
+	assert.Nil(t, err)
+
+	err = conn.Invoke(context.Background(), "/unknown.Service/Call", &plugin.HelloRequest{}, &plugin.HelloResponse{})
+	assert.Equal(t, codes.Unimplemented, status.Code(err))
+}
+
+func TestProxyReflection(t *testing.T) {
+	address, port := startTestPlugin(t)
+
+	r = &reflectionHandler{}
+	defer r.conns.Close()
+
+	_, err := r.Query(context.Background(), "hello", address, port, nil)
+	assert.Nil(t, err)
+
+	conn := startTestAgent(t)
+
+	cli := grpcreflect.NewClientAuto(context.Background(), conn)
+	defer cli.Reset()
+
+	services, err := cli.ListServices()
+	assert.Nil(t, err)
+
+	sort.Strings(services)
+	assert.Equal(t, []string{
+		"grpc.reflection.v1.ServerReflection",
+		"grpc.reflection.v1alpha.ServerReflection",
+		"snippet.grpc.reflection.HelloService",
+		"snippet.grpc.reflection.RegistrationService",
+	}, services)
+
+	serviceDesc, err := cli.ResolveService("snippet.grpc.reflection.HelloService")
+	assert.Nil(t, err)
+	assert.Len(t, serviceDesc.GetMethods(), 4)
+	assert.True(t, serviceDesc.FindMethodByName("HelloChat").IsServerStreaming())
+}
@@ -0,0 +1,49 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/protobuf/types/dynamicpb"
+
+	"github.com/rootwarp/snippets/golang/grpc/reflection/replay"
+)
+
+// record appends a call of Invoke to the recording. The call succeeds or
+// fails regardless of its recording.
+func (r *reflectionHandler) record(ctx context.Context, serviceName, funcName string, fMeta funcMeta, in *dynamicpb.Message, out []byte, err error, start time.Time) {
+	request, marshalErr := marshalDynamicMessage(fMeta.InDesc, in)
+	if marshalErr != nil {
+		fmt.Println("Record", serviceName, funcName, marshalErr)
+		return
+	}
+
+	rec := &replay.Record{
+		Time:      start,
+		Service:   serviceName,
+		Method:    funcName,
+		Request:   request,
+		LatencyMs: float64(time.Since(start).Microseconds()) / 1000,
+		Metadata:  recordedMetadata(ctx),
+	}
+
+	if err != nil {
+		st := statusFromError(err)
+		rec.Code, rec.Message = st.Code(), st.Message()
+	} else {
+		rec.Response = out
+	}
+
+	if err := r.recorder.Write(rec); err != nil {
+		fmt.Println("Record", serviceName, funcName, err)
+	}
+}
+
+// recordedMetadata returns the metadata the caller sent along, leaving out
+// what belongs to the call alone.
+func recordedMetadata(ctx context.Context) map[string][]string {
+	md, _ := metadata.FromIncomingContext(ctx)
+	return replay.CallMetadata(md)
+}
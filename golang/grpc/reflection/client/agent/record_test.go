@@ -0,0 +1,129 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+
+	"github.com/rootwarp/snippets/golang/grpc/reflection/proto/agent"
+	"github.com/rootwarp/snippets/golang/grpc/reflection/replay"
+)
+
+func TestRecord(t *testing.T) {
+	address, port := startTestPlugin(t)
+	path := filepath.Join(t.TempDir(), "calls.jsonl")
+
+	recorder, err := replay.NewWriter(path, 0, 0)
+	assert.Nil(t, err)
+
+	h := &reflectionHandler{recorder: recorder}
+	defer h.conns.Close()
+
+	serviceName := "snippet.grpc.reflection.HelloService"
+
+	_, err = h.Query(context.Background(), serviceName, address, port, nil)
+	assert.Nil(t, err)
+
+	ctx := metadata.NewIncomingContext(context.Background(), metadata.Pairs(
+		"x-request-id", "1",
+		"authorization", "Bearer secret",
+		":authority", "agent",
+		forwardedByKey, "peer",
+		"traceparent", "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01",
+	))
+
+	_, err = h.Invoke(ctx, serviceName, "Hello", []byte(`{"age": 40, "name": "rootwarp"}`))
+	assert.Nil(t, err)
+
+	_, err = h.Invoke(ctx, serviceName, "Unknown", nil)
+	assert.NotNil(t, err)
+
+	_, err = h.Invoke(ctx, serviceName, "Hello", []byte(`{"name": 1}`))
+	assert.NotNil(t, err)
+
+	assert.Nil(t, recorder.Close())
+
+	// Only the calls which reached a method are recorded.
+	records, err := replay.ReadFile(path)
+	assert.Nil(t, err)
+	if !assert.Len(t, records, 1) {
+		return
+	}
+
+	rec := records[0]
+	assert.Equal(t, serviceName, rec.Service)
+	assert.Equal(t, "Hello", rec.Method)
+	assert.JSONEq(t, `{"name": "rootwarp", "age": 40}`, string(rec.Request))
+	assert.JSONEq(t, `{"greetingMsg": "Hey rootwarp(40)"}`, string(rec.Response))
+	assert.Equal(t, codes.OK, rec.Code)
+	assert.Equal(t, map[string][]string{"x-request-id": {"1"}}, rec.Metadata)
+	assert.False(t, rec.Time.IsZero())
+}
+
+func TestRecordGatewayReplay(t *testing.T) {
+	address, port := startTestPlugin(t)
+	path := filepath.Join(t.TempDir(), "calls.jsonl")
+
+	recorder, err := replay.NewWriter(path, 0, 0)
+	assert.Nil(t, err)
+
+	r = &reflectionHandler{recorder: recorder}
+	defer r.conns.Close()
+
+	serviceName := "snippet.grpc.reflection.HelloService"
+
+	_, err = r.Query(context.Background(), serviceName, address, port, nil)
+	assert.Nil(t, err)
+
+	srv := httptest.NewServer(&gateway{})
+	defer srv.Close()
+
+	req, err := http.NewRequest(http.MethodPost, srv.URL+"/v1/"+serviceName+"/Hello", strings.NewReader(`{"name": "rootwarp", "age": 40}`))
+	assert.Nil(t, err)
+
+	req.Header.Set("Connection", "keep-alive, X-Hop")
+	req.Header.Set("X-Hop", "1")
+	req.Header.Set("X-Request-Id", "1")
+
+	resp, err := http.DefaultClient.Do(req)
+	assert.Nil(t, err)
+	resp.Body.Close()
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+
+	assert.Nil(t, recorder.Close())
+
+	records, err := replay.ReadFile(path)
+	assert.Nil(t, err)
+	if !assert.Len(t, records, 1) {
+		return
+	}
+
+	rec := records[0]
+	assert.Equal(t, map[string][]string{
+		"user-agent":   {"Go-http-client/1.1"},
+		"x-request-id": {"1"},
+	}, rec.Metadata)
+
+	// The recorded call goes through the agent again the way agentctl
+	// replay sends it.
+	r.recorder = nil
+	cli := agent.NewRegistrationServiceClient(startTestAgent(t))
+
+	ctx := metadata.NewOutgoingContext(context.Background(), metadata.MD(replay.CallMetadata(rec.Metadata)))
+	callResp, err := cli.CallMethod(ctx, &agent.CallMethodRequest{
+		Service: rec.Service,
+		Method:  rec.Method,
+		Payload: string(rec.Request),
+	})
+
+	diffs, err := replay.Check(rec, []byte(callResp.GetPayload()), err)
+	assert.Nil(t, err)
+	assert.Empty(t, diffs)
+}
@@ -0,0 +1,214 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"time"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/types/known/timestamppb"
+
+	"github.com/rootwarp/snippets/golang/grpc/reflection/proto/agent"
+	"github.com/rootwarp/snippets/golang/grpc/reflection/transport"
+)
+
+type registrationServer struct {
+	agent.UnimplementedRegistrationServiceServer
+
+	lease time.Duration
+}
+
+func (s *registrationServer) RegisterPlugin(ctx context.Context, in *agent.RegisterRequest) (*agent.RegisterResponse, error) {
+	fmt.Println("Register", in.Name, in.Address, in.Port)
+
+	opts := registerOptions{
+		Allowed:       in.AllowedServices,
+		DescriptorSet: in.DescriptorSet,
+	}
+
+	if in.ServiceConfig != "" {
+		config, err := parseServiceConfig([]byte(in.ServiceConfig))
+		if err != nil {
+			return nil, status.Errorf(codes.InvalidArgument, "invalid service config: %v", err)
+		}
+
+		opts.Config = config
+	}
+
+	reg, err := r.Register(ctx, in.Name, in.Address, int(in.Port), opts)
+	if err != nil {
+		return nil, err
+	}
+
+	return &agent.RegisterResponse{
+		Msg:           fmt.Sprintf("%s - %s", in.Name, transport.Target(in.Address, int(in.Port))),
+		LeaseSeconds:  int64(s.lease.Seconds()),
+		Services:      reg.Services,
+		SchemaChanges: newSchemaChanges(reg.Changes),
+	}, nil
+}
+
+func (s *registrationServer) DeregisterPlugin(ctx context.Context, in *agent.DeregisterRequest) (*agent.DeregisterResponse, error) {
+	fmt.Println("Deregister", in.Name)
+
+	if err := r.Deregister(in.Name, instanceAddress(in.Address, in.Port)); err != nil {
+		return nil, status.Error(codes.NotFound, err.Error())
+	}
+
+	return &agent.DeregisterResponse{}, nil
+}
+
+func (s *registrationServer) Heartbeat(ctx context.Context, in *agent.HeartbeatRequest) (*agent.HeartbeatResponse, error) {
+	if err := r.Renew(in.Name, instanceAddress(in.Address, in.Port)); err != nil {
+		return nil, status.Error(codes.NotFound, err.Error())
+	}
+
+	return &agent.HeartbeatResponse{
+		LeaseSeconds: int64(s.lease.Seconds()),
+	}, nil
+}
+
+func (s *registrationServer) ListPlugins(ctx context.Context, in *agent.ListPluginsRequest) (*agent.ListPluginsResponse, error) {
+	type instance struct {
+		plugin  string
+		address string
+	}
+
+	plugins := map[instance]*agent.PluginInfo{}
+	for name, service := range r.registry.Services() {
+		for _, e := range service.Endpoints {
+			key := instance{plugin: e.Plugin, address: e.Address}
+
+			info, ok := plugins[key]
+			if !ok {
+				info = &agent.PluginInfo{
+					Name:     e.Plugin,
+					Address:  e.Address,
+					LastSeen: timestamppb.New(r.leases.lastSeen(e)),
+					Health:   e.Health.String(),
+				}
+				plugins[key] = info
+			}
+
+			// An instance with an unhealthy service is unhealthy.
+			if e.Health == healthUnhealthy {
+				info.Health = healthUnhealthy.String()
+			}
+
+			info.Services = append(info.Services, newServiceInfo(name, service))
+		}
+	}
+
+	resp := &agent.ListPluginsResponse{}
+	for _, info := range plugins {
+		sort.Slice(info.Services, func(i, j int) bool {
+			return info.Services[i].Name < info.Services[j].Name
+		})
+
+		resp.Plugins = append(resp.Plugins, info)
+	}
+
+	sort.Slice(resp.Plugins, func(i, j int) bool {
+		if resp.Plugins[i].Name != resp.Plugins[j].Name {
+			return resp.Plugins[i].Name < resp.Plugins[j].Name
+		}
+
+		return resp.Plugins[i].Address < resp.Plugins[j].Address
+	})
+
+	return resp, nil
+}
+
+func (s *registrationServer) DescribeService(ctx context.Context, in *agent.DescribeServiceRequest) (*agent.DescribeServiceResponse, error) {
+	service, ok := r.registry.Get(in.Name)
+
+	if !ok {
+		return nil, status.Errorf(codes.NotFound, "%v: %s", ErrServiceNotFound, in.Name)
+	}
+
+	source, err := describeService(service)
+	if err != nil {
+		return nil, status.Error(codes.Internal, err.Error())
+	}
+
+	return &agent.DescribeServiceResponse{
+		Service: newServiceInfo(in.Name, service),
+		Plugins: service.plugins(),
+		Proto:   source,
+	}, nil
+}
+
+func (s *registrationServer) CallMethod(ctx context.Context, in *agent.CallMethodRequest) (*agent.CallMethodResponse, error) {
+	fmt.Println("Call", in.Service, in.Method)
+
+	out, err := r.Invoke(ctx, in.Service, in.Method, []byte(in.Payload))
+	if err != nil {
+		return nil, statusFromError(err).Err()
+	}
+
+	return &agent.CallMethodResponse{Payload: string(out)}, nil
+}
+
+func (s *registrationServer) WatchPlugins(in *agent.WatchPluginsRequest, stream agent.RegistrationService_WatchPluginsServer) error {
+	fmt.Println("Watch plugins", in.Revision)
+
+	return r.watchPlugins(stream.Context(), in.Revision, stream.Send)
+}
+
+// instanceAddress returns the registry address of the instance at
+// address:port, nothing when address is empty.
+func instanceAddress(address string, port int32) string {
+	if address == "" {
+		return ""
+	}
+
+	return transport.Target(address, int(port))
+}
+
+func newServiceInfo(name string, service serviceMeta) *agent.ServiceInfo {
+	info := &agent.ServiceInfo{Name: name}
+	for funcName, fMeta := range service.Functions {
+		info.Methods = append(info.Methods, &agent.MethodInfo{
+			Name:       funcName,
+			InputType:  fMeta.InDesc.GetFullyQualifiedName(),
+			OutputType: fMeta.OutDesc.GetFullyQualifiedName(),
+		})
+	}
+
+	sort.Slice(info.Methods, func(i, j int) bool {
+		return info.Methods[i].Name < info.Methods[j].Name
+	})
+
+	return info
+}
+
+func newSchemaChanges(changes []schemaChange) []*agent.SchemaChange {
+	out := make([]*agent.SchemaChange, 0, len(changes))
+	for _, change := range changes {
+		out = append(out, &agent.SchemaChange{
+			Description: change.Description,
+			Breaking:    change.Breaking,
+		})
+	}
+
+	return out
+}
+
+// expireLeases drops plugins which did not send a heartbeat within lease.
+func expireLeases(ctx context.Context, lease time.Duration) {
+	ticker := time.NewTicker(lease / 2)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case now := <-ticker.C:
+			for _, name := range r.Expire(now.Add(-lease)) {
+				fmt.Println("Lease expired", name)
+			}
+		}
+	}
+}
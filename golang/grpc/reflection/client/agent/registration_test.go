@@ -0,0 +1,269 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+
+	"github.com/rootwarp/snippets/golang/grpc/reflection/proto/agent"
+)
+
+func TestRegistrationLifecycle(t *testing.T) {
+	address, port := startTestPlugin(t)
+
+	r = &reflectionHandler{}
+
+	ctx := context.Background()
+	serviceName := "snippet.grpc.reflection.HelloService"
+	s := &registrationServer{lease: 30 * time.Second}
+
+	regResp, err := s.RegisterPlugin(ctx, &agent.RegisterRequest{
+		Name:            serviceName,
+		Address:         address,
+		Port:            int32(port),
+		AllowedServices: []string{serviceName},
+	})
+	assert.Nil(t, err)
+	assert.Equal(t, int64(30), regResp.LeaseSeconds)
+	assert.Equal(t, []string{serviceName}, regResp.Services)
+
+	listResp, err := s.ListPlugins(ctx, &agent.ListPluginsRequest{})
+	assert.Nil(t, err)
+	assert.Len(t, listResp.Plugins, 1)
+
+	info := listResp.Plugins[0]
+	assert.Equal(t, serviceName, info.Name)
+	assert.Len(t, info.Services, 1)
+	assert.Len(t, info.Services[0].Methods, 4)
+	assert.Equal(t, "Hello", info.Services[0].Methods[0].Name)
+	assert.Equal(t, "snippet.grpc.reflection.HelloRequest", info.Services[0].Methods[0].InputType)
+	assert.Equal(t, "snippet.grpc.reflection.HelloResponse", info.Services[0].Methods[0].OutputType)
+
+	lastSeen := info.LastSeen.AsTime()
+
+	revision := r.registry.State().Revision
+
+	hbResp, err := s.Heartbeat(ctx, &agent.HeartbeatRequest{Name: serviceName})
+	assert.Nil(t, err)
+	assert.Equal(t, int64(30), hbResp.LeaseSeconds)
+	assert.True(t, r.leases.lastSeen(r.registry.Services()[serviceName].Endpoints[0]).After(lastSeen))
+
+	// Heartbeats publish no revision.
+	assert.Equal(t, revision, r.registry.State().Revision)
+
+	_, err = s.DeregisterPlugin(ctx, &agent.DeregisterRequest{Name: serviceName})
+	assert.Nil(t, err)
+
+	_, err = s.Heartbeat(ctx, &agent.HeartbeatRequest{Name: serviceName})
+	assert.Equal(t, codes.NotFound, status.Code(err))
+
+	_, err = s.DeregisterPlugin(ctx, &agent.DeregisterRequest{Name: serviceName})
+	assert.Equal(t, codes.NotFound, status.Code(err))
+}
+
+func TestDescribeAndCall(t *testing.T) {
+	address, port := startTestPlugin(t)
+
+	r = &reflectionHandler{}
+	defer r.conns.Close()
+
+	ctx := context.Background()
+	serviceName := "snippet.grpc.reflection.HelloService"
+	s := &registrationServer{}
+
+	_, err := s.RegisterPlugin(ctx, &agent.RegisterRequest{
+		Name:            "hello",
+		Address:         address,
+		Port:            int32(port),
+		AllowedServices: []string{serviceName},
+	})
+	assert.Nil(t, err)
+
+	descResp, err := s.DescribeService(ctx, &agent.DescribeServiceRequest{Name: serviceName})
+	assert.Nil(t, err)
+	assert.Equal(t, []string{"hello"}, descResp.Plugins)
+	assert.Len(t, descResp.Service.Methods, 4)
+	assert.Contains(t, descResp.Proto, "package snippet.grpc.reflection;")
+	assert.Contains(t, descResp.Proto, "rpc HelloChat ( stream HelloRequest ) returns ( stream HelloResponse );")
+	assert.Contains(t, descResp.Proto, "message HelloRequest {")
+	assert.Contains(t, descResp.Proto, "message HelloResponse {")
+
+	_, err = s.DescribeService(ctx, &agent.DescribeServiceRequest{Name: "unknown.Service"})
+	assert.Equal(t, codes.NotFound, status.Code(err))
+
+	callResp, err := s.CallMethod(ctx, &agent.CallMethodRequest{
+		Service: serviceName,
+		Method:  "Hello",
+		Payload: `{"name": "rootwarp", "age": 40}`,
+	})
+	assert.Nil(t, err)
+	assert.Contains(t, callResp.Payload, "Hey rootwarp(40)")
+
+	tests := []struct {
+		Method  string
+		Payload string
+		Code    codes.Code
+	}{
+		{"Hello", `{"age": "old"}`, codes.InvalidArgument},
+		{"HelloFeed", `{}`, codes.InvalidArgument},
+		{"Bye", `{}`, codes.NotFound},
+	}
+
+	for _, test := range tests {
+		_, err := s.CallMethod(ctx, &agent.CallMethodRequest{Service: serviceName, Method: test.Method, Payload: test.Payload})
+		assert.Equal(t, test.Code, status.Code(err), test.Method)
+	}
+}
+
+func TestExpire(t *testing.T) {
+	now := time.Now()
+
+	r = &reflectionHandler{}
+	setTestServices(r, map[string]serviceMeta{
+		"a.Fresh": {Endpoints: []endpoint{{Plugin: "fresh", Address: "fresh:1", LastSeen: now}}},
+		"a.Stale": {Endpoints: []endpoint{{Plugin: "stale", Address: "stale:1", LastSeen: now.Add(-time.Minute)}}},
+		"b.Stale": {Endpoints: []endpoint{{Plugin: "stale", Address: "stale:1", LastSeen: now.Add(-time.Minute)}}},
+		"c.Mixed": {Endpoints: []endpoint{
+			{Plugin: "mixed", Address: "mixed:1", LastSeen: now},
+			{Plugin: "mixed", Address: "mixed:2", LastSeen: now.Add(-time.Minute)},
+		}},
+	})
+
+	expired := r.Expire(now.Add(-30 * time.Second))
+	assert.Equal(t, []string{"mixed", "stale"}, expired)
+	assert.Contains(t, r.registry.Services(), "a.Fresh")
+	assert.NotContains(t, r.registry.Services(), "a.Stale")
+	assert.NotContains(t, r.registry.Services(), "b.Stale")
+	assert.Equal(t, []endpoint{{Plugin: "mixed", Address: "mixed:1", LastSeen: now}}, r.registry.Services()["c.Mixed"].Endpoints)
+
+	// A renewed lease keeps an instance registered since long.
+	assert.Nil(t, r.Renew("fresh", ""))
+	setTestServices(r, map[string]serviceMeta{
+		"a.Fresh": {Endpoints: []endpoint{{Plugin: "fresh", Address: "fresh:1", LastSeen: now.Add(-time.Minute)}}},
+	})
+
+	assert.Empty(t, r.Expire(now.Add(-30*time.Second)))
+	assert.Contains(t, r.registry.Services(), "a.Fresh")
+}
+
+func TestQueryAllowedServices(t *testing.T) {
+	address, port := startTestPlugin(t)
+
+	ctx := context.Background()
+
+	tests := []struct {
+		allowed    []string
+		registered []string
+	}{
+		{nil, []string{"snippet.grpc.reflection.HelloService", "snippet.grpc.reflection.RegistrationService"}},
+		{[]string{"snippet.grpc.reflection.HelloService"}, []string{"snippet.grpc.reflection.HelloService"}},
+		{[]string{"snippet.grpc"}, []string{"snippet.grpc.reflection.HelloService", "snippet.grpc.reflection.RegistrationService"}},
+		{[]string{"snippet.grpc."}, []string{"snippet.grpc.reflection.HelloService", "snippet.grpc.reflection.RegistrationService"}},
+		{[]string{"other", "snippet.grpc.reflection.RegistrationService"}, []string{"snippet.grpc.reflection.RegistrationService"}},
+		{[]string{"snippet.grpc.refl"}, nil},
+		{[]string{"grpc.health.v1.Health"}, nil},
+	}
+
+	for _, test := range tests {
+		h := &reflectionHandler{}
+
+		registered, err := h.Query(ctx, "hello", address, port, test.allowed)
+		if test.registered == nil {
+			assert.NotNil(t, err, test.allowed)
+			assert.Empty(t, h.registry.Services())
+			continue
+		}
+
+		assert.Nil(t, err, test.allowed)
+		assert.Equal(t, test.registered, registered)
+		assert.Equal(t, []string{"hello"}, h.registry.Services()[registered[0]].plugins())
+	}
+}
+
+func TestQueryReplacesPluginServices(t *testing.T) {
+	address, port := startTestPlugin(t)
+	instance := fmt.Sprintf("%s:%d", address, port)
+
+	h := &reflectionHandler{}
+	setTestServices(h, map[string]serviceMeta{
+		"old.Service":   {Endpoints: []endpoint{{Plugin: "hello", Address: instance}}},
+		"kept.Service":  {Endpoints: []endpoint{{Plugin: "hello", Address: "other-instance:1"}}},
+		"other.Service": {Endpoints: []endpoint{{Plugin: "other", Address: instance}}},
+	})
+
+	_, err := h.Query(context.Background(), "hello", address, port, nil)
+	assert.Nil(t, err)
+
+	// The instance dropped old.Service, another instance still serves
+	// kept.Service.
+	assert.NotContains(t, h.registry.Services(), "old.Service")
+	assert.Contains(t, h.registry.Services(), "kept.Service")
+	assert.Contains(t, h.registry.Services(), "other.Service")
+	assert.Contains(t, h.registry.Services(), "snippet.grpc.reflection.HelloService")
+}
+
+func TestMultipleInstances(t *testing.T) {
+	first, firstAddress, firstPort := startTestPluginServer(t)
+	secondAddress, secondPort := startTestPlugin(t)
+
+	r = &reflectionHandler{}
+	defer r.conns.Close()
+
+	ctx := context.Background()
+	serviceName := "snippet.grpc.reflection.HelloService"
+	s := &registrationServer{lease: 30 * time.Second}
+
+	for _, port := range []int{firstPort, secondPort} {
+		_, err := s.RegisterPlugin(ctx, &agent.RegisterRequest{
+			Name:            "hello",
+			Address:         "127.0.0.1",
+			Port:            int32(port),
+			AllowedServices: []string{serviceName},
+		})
+		assert.Nil(t, err)
+	}
+
+	assert.Len(t, r.registry.Services()[serviceName].Endpoints, 2)
+
+	listResp, err := s.ListPlugins(ctx, &agent.ListPluginsRequest{})
+	assert.Nil(t, err)
+	assert.Len(t, listResp.Plugins, 2)
+
+	addresses := []string{listResp.Plugins[0].Address, listResp.Plugins[1].Address}
+	assert.ElementsMatch(t, []string{instanceAddress(firstAddress, int32(firstPort)), instanceAddress(secondAddress, int32(secondPort))}, addresses)
+
+	// Calls are spread over both instances, so every other one fails while
+	// the first instance is down.
+	first.Stop()
+
+	failures := 0
+	for i := 0; i < 4; i++ {
+		if _, err := r.Invoke(ctx, serviceName, "Hello", nil); err != nil {
+			failures++
+		}
+	}
+
+	assert.Equal(t, 2, failures)
+
+	// The first instance leaves, the second one keeps serving.
+	_, err = s.DeregisterPlugin(ctx, &agent.DeregisterRequest{Name: "hello", Address: firstAddress, Port: int32(firstPort)})
+	assert.Nil(t, err)
+	assert.Len(t, r.registry.Services()[serviceName].Endpoints, 1)
+
+	for i := 0; i < 2; i++ {
+		_, err := r.Invoke(ctx, serviceName, "Hello", nil)
+		assert.Nil(t, err)
+	}
+
+	_, err = s.Heartbeat(ctx, &agent.HeartbeatRequest{Name: "hello", Address: firstAddress, Port: int32(firstPort)})
+	assert.Equal(t, codes.NotFound, status.Code(err))
+
+	_, err = s.DeregisterPlugin(ctx, &agent.DeregisterRequest{Name: "hello"})
+	assert.Nil(t, err)
+	assert.NotContains(t, r.registry.Services(), serviceName)
+}
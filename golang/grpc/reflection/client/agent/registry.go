@@ -0,0 +1,479 @@
+package main
+
+import (
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// registry holds the registered services as copy-on-write snapshots.
+// Readers take the current snapshot without locking. Writers serialize on
+// Lock and publish their changes as one new revision on Unlock, so a plugin
+// registering replaces all of its entries at once. The zero value is an
+// empty registry.
+type registry struct {
+	mu      sync.Mutex
+	current atomic.Pointer[registryState]
+
+	// draft holds the changes of the writer holding mu, it is nil until
+	// the writer changes anything.
+	draft   map[string]serviceMeta
+	changed map[string]bool
+
+	subscribers map[*registrySubscription]struct{}
+
+	// history holds the latest revisions, oldest first, for watchers
+	// resuming from one of them.
+	history []*registryState
+}
+
+// registryState is one revision of the registry. It is never modified once
+// published.
+type registryState struct {
+	Revision uint64
+	Services map[string]serviceMeta
+}
+
+// registryEvent is the change of one service in a revision.
+type registryEvent struct {
+	Revision uint64
+	Name     string
+	// Service is the new entry of the service, unless it was Removed.
+	Service serviceMeta
+	Removed bool
+}
+
+// registrySubscription receives the events of every revision after the one
+// it was subscribed at. A subscriber falling behind by more than
+// maxPendingRevisions revisions is dropped, Events is closed then.
+type registrySubscription struct {
+	Events <-chan []registryEvent
+
+	events chan []registryEvent
+}
+
+const (
+	maxPendingRevisions = 64
+	maxHistory          = 256
+)
+
+// State returns the current revision of the registry.
+func (g *registry) State() *registryState {
+	if state := g.current.Load(); state != nil {
+		return state
+	}
+
+	return &registryState{}
+}
+
+// Services returns the services of the current revision. The map must not
+// be modified.
+func (g *registry) Services() map[string]serviceMeta {
+	return g.State().Services
+}
+
+// Get returns the service name of the current revision.
+func (g *registry) Get(name string) (serviceMeta, bool) {
+	service, ok := g.State().Services[name]
+	return service, ok
+}
+
+// Subscribe returns the current revision along with a subscription to the
+// changes following it. The subscriber calls Unsubscribe once done.
+func (g *registry) Subscribe() (*registryState, *registrySubscription) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	events := make(chan []registryEvent, maxPendingRevisions)
+	sub := &registrySubscription{Events: events, events: events}
+
+	if g.subscribers == nil {
+		g.subscribers = map[*registrySubscription]struct{}{}
+	}
+
+	g.subscribers[sub] = struct{}{}
+
+	return g.State(), sub
+}
+
+// Unsubscribe ends sub, its events are closed.
+func (g *registry) Unsubscribe(sub *registrySubscription) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	if _, ok := g.subscribers[sub]; ok {
+		delete(g.subscribers, sub)
+		close(sub.events)
+	}
+}
+
+// History returns the revisions from revision up to the current one, oldest
+// first. It reports false when the registry does not hold revision.
+func (g *registry) History(revision uint64) ([]*registryState, bool) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	history := g.history
+	if len(history) == 0 {
+		history = []*registryState{g.State()}
+	}
+
+	first, last := history[0].Revision, history[len(history)-1].Revision
+	if revision < first || revision > last {
+		return nil, false
+	}
+
+	return append([]*registryState{}, history[revision-first:]...), true
+}
+
+// StartAt makes revision the current one, with the services as they are,
+// and forgets the revisions before it.
+func (g *registry) StartAt(revision uint64) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	state := &registryState{Revision: revision, Services: g.Services()}
+	g.current.Store(state)
+	g.history = []*registryState{state}
+}
+
+// Lock starts a change of the registry, which Unlock publishes.
+func (g *registry) Lock() {
+	g.mu.Lock()
+}
+
+// Unlock publishes the changes made since Lock, if any, as a new revision
+// and notifies the subscribers.
+func (g *registry) Unlock() {
+	defer g.mu.Unlock()
+
+	if g.draft == nil {
+		return
+	}
+
+	state := &registryState{
+		Revision: g.State().Revision + 1,
+		Services: g.draft,
+	}
+
+	names := make([]string, 0, len(g.changed))
+	for name := range g.changed {
+		names = append(names, name)
+	}
+
+	sort.Strings(names)
+
+	events := make([]registryEvent, 0, len(names))
+	for _, name := range names {
+		service, ok := state.Services[name]
+		events = append(events, registryEvent{
+			Revision: state.Revision,
+			Name:     name,
+			Service:  service,
+			Removed:  !ok,
+		})
+	}
+
+	g.current.Store(state)
+	g.draft, g.changed = nil, nil
+
+	g.history = append(g.history, state)
+	if len(g.history) > maxHistory {
+		g.history = append([]*registryState{}, g.history[len(g.history)-maxHistory:]...)
+	}
+
+	for sub := range g.subscribers {
+		select {
+		case sub.events <- events:
+		default:
+			delete(g.subscribers, sub)
+			close(sub.events)
+		}
+	}
+}
+
+// all returns the services including the changes made so far. The map must
+// not be modified. g.mu must be held.
+func (g *registry) all() map[string]serviceMeta {
+	if g.draft != nil {
+		return g.draft
+	}
+
+	return g.Services()
+}
+
+// get returns the service name including the changes made so far. g.mu must
+// be held.
+func (g *registry) get(name string) (serviceMeta, bool) {
+	service, ok := g.all()[name]
+	return service, ok
+}
+
+// set adds or replaces the service name. g.mu must be held.
+func (g *registry) set(name string, service serviceMeta) {
+	g.edit()[name] = service
+	g.changed[name] = true
+}
+
+// remove drops the service name. g.mu must be held.
+func (g *registry) remove(name string) {
+	if _, ok := g.get(name); !ok {
+		return
+	}
+
+	delete(g.edit(), name)
+	g.changed[name] = true
+}
+
+// edit returns the draft, copying the current services on the first change.
+func (g *registry) edit() map[string]serviceMeta {
+	if g.draft == nil {
+		current := g.Services()
+
+		g.draft = make(map[string]serviceMeta, len(current)+1)
+		for name, service := range current {
+			g.draft[name] = service
+		}
+
+		g.changed = map[string]bool{}
+	}
+
+	return g.draft
+}
+
+// Deregister removes the instance of the plugin name at address from the
+// registry, every instance of it when address is empty.
+func (r *reflectionHandler) Deregister(name, address string) error {
+	r.registry.Lock()
+	defer r.registry.Unlock()
+
+	found := false
+	for serviceName := range r.registry.all() {
+		removed := r.removeEndpoints(serviceName, func(e endpoint) bool {
+			return e.Plugin == name && (address == "" || e.Address == address)
+		})
+		found = found || removed
+	}
+
+	if !found {
+		return ErrServiceNotFound
+	}
+
+	r.releaseConns()
+	r.persist()
+
+	return nil
+}
+
+// Renew extends the lease of the instance of the plugin name at address,
+// of every instance of it when address is empty. Renewals are kept out of
+// the registry, they publish no revision.
+func (r *reflectionHandler) Renew(name, address string) error {
+	found := false
+	now := time.Now()
+	for _, service := range r.registry.Services() {
+		for _, e := range service.pluginEndpoints(name) {
+			if address == "" || e.Address == address {
+				r.leases.renew(e, now)
+				found = true
+			}
+		}
+	}
+
+	if !found {
+		return ErrServiceNotFound
+	}
+
+	return nil
+}
+
+// leaseTable holds when plugin instances renewed their lease last.
+type leaseTable struct {
+	mu   sync.Mutex
+	seen map[leaseKey]time.Time
+}
+
+type leaseKey struct {
+	plugin  string
+	address string
+}
+
+func (l *leaseTable) renew(e endpoint, t time.Time) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if l.seen == nil {
+		l.seen = map[leaseKey]time.Time{}
+	}
+
+	l.seen[leaseKey{plugin: e.Plugin, address: e.Address}] = t
+}
+
+// lastSeen returns when e registered or renewed its lease last.
+func (l *leaseTable) lastSeen(e endpoint) time.Time {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if renewed, ok := l.seen[leaseKey{plugin: e.Plugin, address: e.Address}]; ok && renewed.After(e.LastSeen) {
+		return renewed
+	}
+
+	return e.LastSeen
+}
+
+// retain drops the leases of the instances services no longer holds.
+func (l *leaseTable) retain(services map[string]serviceMeta) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	registered := map[leaseKey]bool{}
+	for _, service := range services {
+		for _, e := range service.Endpoints {
+			registered[leaseKey{plugin: e.Plugin, address: e.Address}] = true
+		}
+	}
+
+	for key := range l.seen {
+		if !registered[key] {
+			delete(l.seen, key)
+		}
+	}
+}
+
+// Expire removes every plugin instance which was last seen before deadline,
+// peer agents aside, and returns the names of their plugins.
+func (r *reflectionHandler) Expire(deadline time.Time) []string {
+	r.registry.Lock()
+	defer r.registry.Unlock()
+
+	plugins := map[string]struct{}{}
+	for serviceName, service := range r.registry.all() {
+		for _, e := range service.Endpoints {
+			// Peers stay as long as their registry is watched.
+			if !e.Peer && r.leases.lastSeen(e).Before(deadline) {
+				r.removeEndpoint(serviceName, e.Address)
+				plugins[e.Plugin] = struct{}{}
+			}
+		}
+	}
+
+	if len(plugins) > 0 {
+		r.releaseConns()
+		r.persist()
+	}
+
+	r.leases.retain(r.registry.all())
+
+	expired := make([]string, 0, len(plugins))
+	for name := range plugins {
+		expired = append(expired, name)
+	}
+
+	sort.Strings(expired)
+
+	return expired
+}
+
+// withEndpoint returns s with e added, or replacing the endpoint of the same
+// address.
+func (s serviceMeta) withEndpoint(e endpoint) serviceMeta {
+	endpoints := make([]endpoint, 0, len(s.Endpoints)+1)
+	for _, existing := range s.Endpoints {
+		if existing.Address != e.Address {
+			endpoints = append(endpoints, existing)
+		}
+	}
+
+	endpoints = append(endpoints, e)
+	sort.Slice(endpoints, func(i, j int) bool {
+		return endpoints[i].Address < endpoints[j].Address
+	})
+
+	s.Endpoints = endpoints
+
+	return s
+}
+
+// removeEndpoint drops the instance at address from serviceName, and the
+// service along with its last instance. It reports whether the instance was
+// registered. The registry must be locked.
+func (r *reflectionHandler) removeEndpoint(serviceName, address string) bool {
+	return r.removeEndpoints(serviceName, func(e endpoint) bool {
+		return e.Address == address
+	})
+}
+
+// removeEndpoints is removeEndpoint for every instance of serviceName match
+// selects.
+func (r *reflectionHandler) removeEndpoints(serviceName string, match func(endpoint) bool) bool {
+	service, ok := r.registry.get(serviceName)
+	if !ok {
+		return false
+	}
+
+	endpoints := make([]endpoint, 0, len(service.Endpoints))
+	for _, e := range service.Endpoints {
+		if !match(e) {
+			endpoints = append(endpoints, e)
+		}
+	}
+
+	if len(endpoints) == len(service.Endpoints) {
+		return false
+	}
+
+	if len(endpoints) == 0 {
+		r.registry.remove(serviceName)
+		return true
+	}
+
+	service.Endpoints = endpoints
+	if service.ConfigPlugin != "" && !service.servedBy(service.ConfigPlugin) {
+		service.Config, service.ConfigPlugin = nil, ""
+	}
+
+	r.registry.set(serviceName, service)
+
+	return true
+}
+
+// pluginEndpoints returns the instances of the plugin name serving s.
+func (s serviceMeta) pluginEndpoints(name string) []endpoint {
+	endpoints := []endpoint{}
+	for _, e := range s.Endpoints {
+		if e.Plugin == name {
+			endpoints = append(endpoints, e)
+		}
+	}
+
+	return endpoints
+}
+
+// servedBy reports whether an instance of the plugin name serves s.
+func (s serviceMeta) servedBy(name string) bool {
+	return len(s.pluginEndpoints(name)) > 0
+}
+
+// plugins returns the sorted names of the plugins serving s.
+func (s serviceMeta) plugins() []string {
+	names := []string{}
+	for _, e := range s.Endpoints {
+		if !containsString(names, e.Plugin) {
+			names = append(names, e.Plugin)
+		}
+	}
+
+	sort.Strings(names)
+	return names
+}
+
+func containsString(values []string, value string) bool {
+	for _, v := range values {
+		if v == value {
+			return true
+		}
+	}
+
+	return false
+}
@@ -0,0 +1,246 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+
+	"github.com/rootwarp/snippets/golang/grpc/reflection/proto/agent"
+)
+
+// setTestServices adds services to the registry of h.
+func setTestServices(h *reflectionHandler, services map[string]serviceMeta) {
+	h.registry.Lock()
+	defer h.registry.Unlock()
+
+	for name, service := range services {
+		h.registry.set(name, service)
+	}
+}
+
+func TestRegistry(t *testing.T) {
+	g := &registry{}
+	assert.Equal(t, uint64(0), g.State().Revision)
+	assert.Empty(t, g.Services())
+
+	state, sub := g.Subscribe()
+	assert.Equal(t, uint64(0), state.Revision)
+
+	g.Lock()
+	g.set("a.Service", serviceMeta{Schema: "a"})
+	g.set("b.Service", serviceMeta{Schema: "b"})
+
+	// Nothing is published before Unlock.
+	assert.Empty(t, g.Services())
+	service, ok := g.get("a.Service")
+	assert.True(t, ok)
+	assert.Equal(t, "a", service.Schema)
+	g.Unlock()
+
+	first := g.State()
+	assert.Equal(t, uint64(1), first.Revision)
+	assert.Len(t, first.Services, 2)
+
+	events := <-sub.Events
+	assert.Equal(t, []registryEvent{
+		{Revision: 1, Name: "a.Service", Service: serviceMeta{Schema: "a"}},
+		{Revision: 1, Name: "b.Service", Service: serviceMeta{Schema: "b"}},
+	}, events)
+
+	// A change leaves the published revision as it is.
+	g.Lock()
+	g.remove("a.Service")
+	g.remove("unknown.Service")
+	g.Unlock()
+
+	assert.Len(t, first.Services, 2)
+	assert.Equal(t, uint64(2), g.State().Revision)
+
+	_, ok = g.Get("a.Service")
+	assert.False(t, ok)
+
+	events = <-sub.Events
+	assert.Equal(t, []registryEvent{{Revision: 2, Name: "a.Service", Removed: true}}, events)
+
+	// Without changes there is no new revision.
+	g.Lock()
+	g.remove("a.Service")
+	g.Unlock()
+
+	assert.Equal(t, uint64(2), g.State().Revision)
+	assert.Len(t, sub.Events, 0)
+
+	g.Unsubscribe(sub)
+	_, open := <-sub.Events
+	assert.False(t, open)
+
+	// Unsubscribing twice is fine.
+	g.Unsubscribe(sub)
+}
+
+func TestRegistrySlowSubscriber(t *testing.T) {
+	g := &registry{}
+	_, sub := g.Subscribe()
+
+	for i := 0; i <= maxPendingRevisions; i++ {
+		g.Lock()
+		g.set("a.Service", serviceMeta{Schema: fmt.Sprint(i)})
+		g.Unlock()
+	}
+
+	// The subscriber is dropped instead of holding writers up.
+	received := 0
+	for range sub.Events {
+		received++
+	}
+
+	assert.Equal(t, maxPendingRevisions, received)
+	g.Unsubscribe(sub)
+}
+
+func TestRegistryHistory(t *testing.T) {
+	g := &registry{}
+
+	states, ok := g.History(0)
+	assert.True(t, ok)
+	assert.Len(t, states, 1)
+
+	for i := 0; i < maxHistory+10; i++ {
+		g.Lock()
+		g.set("a.Service", serviceMeta{Schema: fmt.Sprint(i)})
+		g.Unlock()
+	}
+
+	last := uint64(maxHistory + 10)
+
+	states, ok = g.History(last - 2)
+	assert.True(t, ok)
+	if assert.Len(t, states, 3) {
+		assert.Equal(t, last-2, states[0].Revision)
+		assert.Equal(t, last, states[2].Revision)
+		assert.Equal(t, fmt.Sprint(maxHistory+9), states[2].Services["a.Service"].Schema)
+	}
+
+	_, ok = g.History(last - maxHistory)
+	assert.False(t, ok)
+	_, ok = g.History(last + 1)
+	assert.False(t, ok)
+
+	// Starting over keeps the services.
+	g.StartAt(1000)
+	assert.Equal(t, uint64(1000), g.State().Revision)
+	assert.Len(t, g.Services(), 1)
+
+	_, ok = g.History(last)
+	assert.False(t, ok)
+
+	states, ok = g.History(1000)
+	assert.True(t, ok)
+	assert.Len(t, states, 1)
+}
+
+// TestConcurrentRegistry registers, calls and lists plugins from many
+// goroutines at once, it is meant to run under the race detector.
+func TestConcurrentRegistry(t *testing.T) {
+	r = &reflectionHandler{}
+	defer r.conns.Close()
+
+	addresses := []string{}
+	ports := []int{}
+	for i := 0; i < 4; i++ {
+		address, port := startTestPlugin(t)
+		addresses = append(addresses, address)
+		ports = append(ports, port)
+	}
+
+	ctx := context.Background()
+	serviceName := "snippet.grpc.reflection.HelloService"
+	s := &registrationServer{}
+
+	_, sub := r.registry.Subscribe()
+	revisions := make(chan uint64, 1)
+	go func() {
+		last := uint64(0)
+		for events := range sub.Events {
+			last = events[0].Revision
+		}
+
+		revisions <- last
+	}()
+
+	wg := sync.WaitGroup{}
+	for i := range addresses {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+
+			req := &agent.RegisterRequest{
+				Name:            fmt.Sprintf("hello-%d", i),
+				Address:         addresses[i],
+				Port:            int32(ports[i]),
+				AllowedServices: []string{serviceName},
+			}
+
+			for j := 0; j < 20; j++ {
+				_, err := s.RegisterPlugin(ctx, req)
+				assert.Nil(t, err)
+
+				_, err = s.Heartbeat(ctx, &agent.HeartbeatRequest{Name: req.Name})
+				assert.Nil(t, err)
+
+				if j%2 == 1 {
+					_, err = s.DeregisterPlugin(ctx, &agent.DeregisterRequest{Name: req.Name})
+					assert.Nil(t, err)
+				}
+			}
+		}(i)
+	}
+
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+
+			for j := 0; j < 20; j++ {
+				// Every plugin may be deregistered at the moment, or
+				// while the call is on its way.
+				_, err := r.Invoke(ctx, serviceName, "Hello", []byte(`{"name": "rootwarp", "age": 40}`))
+				switch status.Code(statusFromError(err).Err()) {
+				case codes.OK, codes.NotFound, codes.Unavailable, codes.Canceled:
+				default:
+					t.Error("Invoke", err)
+				}
+
+				_, err = s.ListPlugins(ctx, &agent.ListPluginsRequest{})
+				assert.Nil(t, err)
+
+				for _, target := range r.healthTargets() {
+					r.reportHealth(target.Service, target.Address, true, 3)
+				}
+			}
+		}()
+	}
+
+	wg.Wait()
+
+	// Every plugin ended up deregistered.
+	_, err := r.Invoke(ctx, serviceName, "Hello", nil)
+	assert.ErrorIs(t, err, ErrServiceNotFound)
+
+	state := r.registry.State()
+	r.registry.Unsubscribe(sub)
+
+	last := <-revisions
+	if last != 0 {
+		// The subscriber saw every revision unless it was dropped.
+		assert.LessOrEqual(t, last, state.Revision)
+	}
+
+	_, err = s.Heartbeat(ctx, &agent.HeartbeatRequest{Name: "hello-0"})
+	assert.Equal(t, codes.NotFound, status.Code(err))
+}
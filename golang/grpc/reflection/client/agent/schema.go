@@ -0,0 +1,395 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/jhump/protoreflect/desc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/proto"
+	"google.golang.org/protobuf/types/descriptorpb"
+)
+
+// schemaPolicy decides what happens when a plugin re-registers with a schema
+// which breaks existing callers. Compatible changes are always accepted.
+type schemaPolicy int
+
+const (
+	// schemaWarn accepts the schema and logs its breaking changes.
+	schemaWarn schemaPolicy = iota
+	// schemaAccept accepts the schema silently.
+	schemaAccept
+	// schemaReject keeps the previous registration.
+	schemaReject
+)
+
+func parseSchemaPolicy(s string) (schemaPolicy, error) {
+	switch s {
+	case "warn":
+		return schemaWarn, nil
+	case "accept":
+		return schemaAccept, nil
+	case "reject":
+		return schemaReject, nil
+	}
+
+	return 0, fmt.Errorf("unknown schema policy %q", s)
+}
+
+func (p schemaPolicy) String() string {
+	switch p {
+	case schemaAccept:
+		return "accept"
+	case schemaReject:
+		return "reject"
+	}
+
+	return "warn"
+}
+
+// cachedSchema is the descriptor set of a plugin, shared by every
+// registration with the same content.
+type cachedSchema struct {
+	// data is the serialized FileDescriptorSet.
+	data     []byte
+	services map[string]*desc.ServiceDescriptor
+}
+
+// newCachedSchema serializes the descriptors of services and returns them
+// with their content hash.
+func newCachedSchema(services map[string]*desc.ServiceDescriptor) (string, *cachedSchema, error) {
+	names := make([]string, 0, len(services))
+	for name := range services {
+		names = append(names, name)
+	}
+
+	sort.Strings(names)
+
+	descs := make([]*desc.ServiceDescriptor, 0, len(names))
+	for _, name := range names {
+		descs = append(descs, services[name])
+	}
+
+	data, err := proto.MarshalOptions{Deterministic: true}.Marshal(serviceDescriptorSet(descs))
+	if err != nil {
+		return "", nil, err
+	}
+
+	return schemaHash(data), &cachedSchema{data: data, services: services}, nil
+}
+
+// loadCachedSchema is the reverse of newCachedSchema.
+func loadCachedSchema(data []byte, names []string) (string, *cachedSchema, error) {
+	set := &descriptorpb.FileDescriptorSet{}
+	if err := proto.Unmarshal(data, set); err != nil {
+		return "", nil, err
+	}
+
+	services, err := servicesFromDescriptorSet(set, names)
+	if err != nil {
+		return "", nil, err
+	}
+
+	return schemaHash(data), &cachedSchema{data: data, services: services}, nil
+}
+
+func schemaHash(data []byte) string {
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:])
+}
+
+// cacheSchema stores schema under hash, reusing the entry when it is known
+// already, and drops the entries no service refers to anymore. The registry
+// must be locked.
+func (r *reflectionHandler) cacheSchema(hash string, schema *cachedSchema) *cachedSchema {
+	if cached, ok := r.schemas[hash]; ok {
+		schema = cached
+	}
+
+	inUse := map[string]bool{hash: true}
+	for _, service := range r.registry.all() {
+		inUse[service.Schema] = true
+
+		for _, e := range service.Endpoints {
+			inUse[e.Schema] = true
+		}
+	}
+
+	for cachedHash := range r.schemas {
+		if !inUse[cachedHash] {
+			delete(r.schemas, cachedHash)
+		}
+	}
+
+	if r.schemas == nil {
+		r.schemas = map[string]*cachedSchema{}
+	}
+
+	r.schemas[hash] = schema
+
+	return schema
+}
+
+// schemaChange is a difference between two schemas of a plugin.
+type schemaChange struct {
+	Description string
+	Breaking    bool
+}
+
+func (c schemaChange) String() string {
+	if c.Breaking {
+		return "breaking: " + c.Description
+	}
+
+	return "compatible: " + c.Description
+}
+
+func hasBreakingChange(changes []schemaChange) bool {
+	for _, change := range changes {
+		if change.Breaking {
+			return true
+		}
+	}
+
+	return false
+}
+
+// sharedSchema is how the descriptors a plugin registers for a service
+// relate to the ones other plugins serve it with.
+type sharedSchema int
+
+const (
+	// sharedCompatible descriptors are the same or a compatible extension,
+	// they replace the service's.
+	sharedCompatible sharedSchema = iota
+	// sharedOlder descriptors are a version the service's extend
+	// compatibly, which stay in place.
+	sharedOlder
+	// sharedReplaced descriptors conflict, the instances of the other
+	// plugins are replaced.
+	sharedReplaced
+)
+
+// checkSharedSchemas compares the services the plugin name registers to the
+// ones other plugins serve already and applies the schema policy to the
+// conflicting ones. It returns how the descriptors of each shared service
+// relate. The registry must be locked.
+func (r *reflectionHandler) checkSharedSchemas(name string, services map[string]*desc.ServiceDescriptor) (map[string]sharedSchema, error) {
+	shared := map[string]sharedSchema{}
+	breaking := []string{}
+
+	for serviceName, serviceDesc := range services {
+		service, ok := r.registry.get(serviceName)
+		if !ok || len(service.pluginEndpoints(name)) == len(service.Endpoints) {
+			continue
+		}
+
+		before := map[string]*desc.ServiceDescriptor{serviceName: service.Desc}
+		after := map[string]*desc.ServiceDescriptor{serviceName: serviceDesc}
+
+		changes := diffServices(before, after)
+		switch {
+		case !hasBreakingChange(changes):
+			shared[serviceName] = sharedCompatible
+		case !hasBreakingChange(diffServices(after, before)):
+			shared[serviceName] = sharedOlder
+		default:
+			shared[serviceName] = sharedReplaced
+
+			for _, change := range changes {
+				if change.Breaking {
+					breaking = append(breaking, change.Description)
+				}
+			}
+		}
+	}
+
+	if len(breaking) == 0 {
+		return shared, nil
+	}
+
+	sort.Strings(breaking)
+
+	switch r.schemaPolicy {
+	case schemaReject:
+		return nil, status.Errorf(codes.FailedPrecondition, "schema of %s conflicts with other plugins: %s", name, strings.Join(breaking, "; "))
+	case schemaWarn:
+		for _, description := range breaking {
+			fmt.Println("Conflicting schema", name, description)
+		}
+	}
+
+	return shared, nil
+}
+
+// diffServices lists the changes between the services a plugin registered
+// before and the ones it registers now. Removed services and methods,
+// changed method signatures, and removed or retyped fields of the messages
+// they use are breaking. Additions are compatible.
+func diffServices(before, after map[string]*desc.ServiceDescriptor) []schemaChange {
+	d := &schemaDiff{seen: map[string]bool{}}
+
+	for _, name := range unionKeys(before, after) {
+		oldService, newService := before[name], after[name]
+		switch {
+		case newService == nil:
+			d.add(true, "service %s removed", name)
+		case oldService == nil:
+			d.add(false, "service %s added", name)
+		default:
+			d.diffService(oldService, newService)
+		}
+	}
+
+	return d.changes
+}
+
+type schemaDiff struct {
+	changes []schemaChange
+	// seen holds the messages compared already, messages may be recursive.
+	seen map[string]bool
+}
+
+func (d *schemaDiff) add(breaking bool, format string, args ...any) {
+	d.changes = append(d.changes, schemaChange{
+		Description: fmt.Sprintf(format, args...),
+		Breaking:    breaking,
+	})
+}
+
+func (d *schemaDiff) diffService(before, after *desc.ServiceDescriptor) {
+	oldMethods := map[string]*desc.MethodDescriptor{}
+	for _, method := range before.GetMethods() {
+		oldMethods[method.GetName()] = method
+	}
+
+	newMethods := map[string]*desc.MethodDescriptor{}
+	for _, method := range after.GetMethods() {
+		newMethods[method.GetName()] = method
+	}
+
+	for _, name := range unionKeys(oldMethods, newMethods) {
+		oldMethod, newMethod := oldMethods[name], newMethods[name]
+		fullName := before.GetFullyQualifiedName() + "/" + name
+
+		switch {
+		case newMethod == nil:
+			d.add(true, "method %s removed", fullName)
+		case oldMethod == nil:
+			d.add(false, "method %s added", fullName)
+		default:
+			d.diffMethod(fullName, oldMethod, newMethod)
+		}
+	}
+}
+
+func (d *schemaDiff) diffMethod(fullName string, before, after *desc.MethodDescriptor) {
+	if before.IsClientStreaming() != after.IsClientStreaming() || before.IsServerStreaming() != after.IsServerStreaming() {
+		d.add(true, "method %s changed streaming from %s to %s", fullName, streamingKind(before), streamingKind(after))
+	}
+
+	d.diffMessageType(fullName+" input", before.GetInputType(), after.GetInputType())
+	d.diffMessageType(fullName+" output", before.GetOutputType(), after.GetOutputType())
+}
+
+// diffMessageType compares the messages used at the same place of both
+// schemas, where is a description of that place.
+func (d *schemaDiff) diffMessageType(where string, before, after *desc.MessageDescriptor) {
+	if before.GetFullyQualifiedName() != after.GetFullyQualifiedName() {
+		d.add(true, "%s changed from %s to %s", where, before.GetFullyQualifiedName(), after.GetFullyQualifiedName())
+		return
+	}
+
+	d.diffMessage(before, after)
+}
+
+func (d *schemaDiff) diffMessage(before, after *desc.MessageDescriptor) {
+	name := before.GetFullyQualifiedName()
+	if d.seen[name] {
+		return
+	}
+
+	d.seen[name] = true
+
+	oldFields := map[string]*desc.FieldDescriptor{}
+	for _, field := range before.GetFields() {
+		oldFields[field.GetName()] = field
+	}
+
+	newFields := map[string]*desc.FieldDescriptor{}
+	for _, field := range after.GetFields() {
+		newFields[field.GetName()] = field
+	}
+
+	for _, fieldName := range unionKeys(oldFields, newFields) {
+		oldField, newField := oldFields[fieldName], newFields[fieldName]
+		fullName := name + "." + fieldName
+
+		switch {
+		case newField == nil:
+			d.add(true, "field %s removed", fullName)
+		case oldField == nil:
+			d.add(false, "field %s added", fullName)
+		case oldField.GetNumber() != newField.GetNumber():
+			d.add(true, "field %s changed number from %d to %d", fullName, oldField.GetNumber(), newField.GetNumber())
+		case fieldType(oldField) != fieldType(newField):
+			d.add(true, "field %s changed type from %s to %s", fullName, fieldType(oldField), fieldType(newField))
+		case oldField.GetMessageType() != nil:
+			d.diffMessage(oldField.GetMessageType(), newField.GetMessageType())
+		}
+	}
+}
+
+// fieldType describes the type of field, including its cardinality.
+func fieldType(field *desc.FieldDescriptor) string {
+	var typeName string
+	switch {
+	case field.GetMessageType() != nil:
+		typeName = field.GetMessageType().GetFullyQualifiedName()
+	case field.GetEnumType() != nil:
+		typeName = field.GetEnumType().GetFullyQualifiedName()
+	default:
+		typeName = strings.ToLower(strings.TrimPrefix(field.GetType().String(), "TYPE_"))
+	}
+
+	if field.IsRepeated() && !field.IsMap() {
+		return "repeated " + typeName
+	}
+
+	return typeName
+}
+
+func streamingKind(method *desc.MethodDescriptor) string {
+	switch {
+	case method.IsClientStreaming() && method.IsServerStreaming():
+		return "bidi streaming"
+	case method.IsClientStreaming():
+		return "client streaming"
+	case method.IsServerStreaming():
+		return "server streaming"
+	}
+
+	return "unary"
+}
+
+// unionKeys returns the keys of both maps, sorted.
+func unionKeys[V any](a, b map[string]V) []string {
+	keys := make([]string, 0, len(a)+len(b))
+	for key := range a {
+		keys = append(keys, key)
+	}
+
+	for key := range b {
+		if _, ok := a[key]; !ok {
+			keys = append(keys, key)
+		}
+	}
+
+	sort.Strings(keys)
+
+	return keys
+}
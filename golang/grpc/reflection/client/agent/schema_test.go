@@ -0,0 +1,323 @@
+package main
+
+import (
+	"context"
+	"strings"
+	"testing"
+
+	"github.com/jhump/protoreflect/desc"
+	"github.com/jhump/protoreflect/desc/protoparse"
+	"github.com/stretchr/testify/assert"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+const baseSchema = `
+syntax = "proto3";
+
+package snippet.schema;
+
+message Item {
+    string name = 1;
+    repeated int64 values = 2;
+}
+
+message Request {
+    string id = 1;
+    Item item = 2;
+}
+
+message Response {
+    string msg = 1;
+}
+
+service Store {
+    rpc Get(Request) returns (Response);
+    rpc Watch(Request) returns (stream Response);
+}
+`
+
+func loadTestServices(t *testing.T, schema string) map[string]*desc.ServiceDescriptor {
+	parser := protoparse.Parser{
+		Accessor: protoparse.FileContentsFromMap(map[string]string{
+			"schema.proto": schema,
+		}),
+	}
+
+	fds, err := parser.ParseFiles("schema.proto")
+	assert.Nil(t, err)
+
+	services := map[string]*desc.ServiceDescriptor{}
+	for _, service := range fds[0].GetServices() {
+		services[service.GetFullyQualifiedName()] = service
+	}
+
+	return services
+}
+
+func TestDiffServices(t *testing.T) {
+	tests := []struct {
+		name    string
+		schema  string
+		changes []schemaChange
+	}{
+		{
+			"unchanged",
+			baseSchema,
+			nil,
+		},
+		{
+			"service added",
+			baseSchema + `service Other { rpc Get(Request) returns (Response); }`,
+			[]schemaChange{{"service snippet.schema.Other added", false}},
+		},
+		{
+			"field added",
+			strings.Replace(baseSchema, "string msg = 1;", "string msg = 1; int32 code = 2;", 1),
+			[]schemaChange{
+				{"field snippet.schema.Response.code added", false},
+			},
+		},
+		{
+			"method removed",
+			strings.Replace(baseSchema, "rpc Watch(Request) returns (stream Response);", "", 1),
+			[]schemaChange{{"method snippet.schema.Store/Watch removed", true}},
+		},
+		{
+			"streaming changed",
+			strings.Replace(baseSchema, "returns (stream Response)", "returns (Response)", 1),
+			[]schemaChange{{"method snippet.schema.Store/Watch changed streaming from server streaming to unary", true}},
+		},
+		{
+			"field number changed",
+			strings.Replace(baseSchema, "string id = 1;", "string id = 3;", 1),
+			[]schemaChange{{"field snippet.schema.Request.id changed number from 1 to 3", true}},
+		},
+		{
+			"nested field type changed",
+			strings.Replace(baseSchema, "repeated int64 values = 2;", "int64 values = 2;", 1),
+			[]schemaChange{{"field snippet.schema.Item.values changed type from repeated int64 to int64", true}},
+		},
+		{
+			"message renamed",
+			strings.Replace(baseSchema, "Response", "Reply", -1),
+			[]schemaChange{
+				{"snippet.schema.Store/Get output changed from snippet.schema.Response to snippet.schema.Reply", true},
+				{"snippet.schema.Store/Watch output changed from snippet.schema.Response to snippet.schema.Reply", true},
+			},
+		},
+	}
+
+	before := loadTestServices(t, baseSchema)
+	for _, test := range tests {
+		after := loadTestServices(t, test.schema)
+		assert.Equal(t, test.changes, diffServices(before, after), test.name)
+	}
+}
+
+func TestCachedSchema(t *testing.T) {
+	services := loadTestServices(t, baseSchema)
+
+	hash, schema, err := newCachedSchema(services)
+	assert.Nil(t, err)
+
+	loadedHash, loaded, err := loadCachedSchema(schema.data, []string{"snippet.schema.Store"})
+	assert.Nil(t, err)
+	assert.Equal(t, hash, loadedHash)
+	assert.Empty(t, diffServices(services, loaded.services))
+
+	otherHash, _, err := newCachedSchema(loadTestServices(t, baseSchema+`service Other {}`))
+	assert.Nil(t, err)
+	assert.NotEqual(t, hash, otherHash)
+}
+
+func TestRegisterSchemaPolicy(t *testing.T) {
+	address, port := startTestPlugin(t)
+
+	ctx := context.Background()
+	serviceName := "snippet.grpc.reflection.HelloService"
+
+	// The plugin used to serve an extra method, which it dropped since.
+	previous := loadTestServices(t, `
+syntax = "proto3";
+
+package snippet.grpc.reflection;
+
+message HelloRequest {
+    string name = 1;
+    int32 age = 2;
+}
+
+message HelloResponse {
+    string greeting_msg = 1;
+}
+
+service HelloService {
+    rpc Hello(HelloRequest) returns (HelloResponse);
+    rpc Bye(HelloRequest) returns (HelloResponse);
+}
+`)
+
+	newHandler := func(policy schemaPolicy) *reflectionHandler {
+		meta := newServiceMeta(previous[serviceName])
+		meta.Schema = "previous"
+		meta = meta.withEndpoint(endpoint{Plugin: "hello", Address: "previous:1"})
+
+		h := &reflectionHandler{schemaPolicy: policy}
+		setTestServices(h, map[string]serviceMeta{serviceName: meta})
+
+		return h
+	}
+
+	h := newHandler(schemaReject)
+	_, err := h.Register(ctx, "hello", address, port, registerOptions{})
+	assert.Equal(t, codes.FailedPrecondition, status.Code(err))
+	assert.Contains(t, err.Error(), "method snippet.grpc.reflection.HelloService/Bye removed")
+	assert.Equal(t, []endpoint{{Plugin: "hello", Address: "previous:1"}}, h.registry.Services()[serviceName].Endpoints)
+
+	h = newHandler(schemaWarn)
+	reg, err := h.Register(ctx, "hello", address, port, registerOptions{})
+	assert.Nil(t, err)
+	assert.Contains(t, reg.Changes, schemaChange{"method snippet.grpc.reflection.HelloService/Bye removed", true})
+	assert.NotContains(t, h.registry.Services()[serviceName].Functions, "Bye")
+
+	// Registering the same schema again reuses the cached descriptors.
+	registered := h.registry.Services()[serviceName]
+
+	reg, err = h.Register(ctx, "hello", address, port, registerOptions{})
+	assert.Nil(t, err)
+	assert.Empty(t, reg.Changes)
+	assert.Same(t, registered.Desc, h.registry.Services()[serviceName].Desc)
+	assert.Len(t, h.schemas, 1)
+	assert.Contains(t, h.schemas, registered.Schema)
+
+	h.conns.Close()
+}
+
+// helloSchema is the schema of the test plugin's service, with extra added
+// to the service and request replacing its messages.
+func helloSchema(request, extra string) string {
+	return `
+syntax = "proto3";
+
+package snippet.grpc.reflection;
+
+` + request + `
+
+message HelloResponse {
+    string greeting_msg = 1;
+}
+
+service HelloService {
+    rpc Hello(HelloRequest) returns (HelloResponse);
+    rpc HelloFeed(HelloRequest) returns (stream HelloResponse);
+    rpc HelloAll(stream HelloRequest) returns (HelloResponse);
+    rpc HelloChat(stream HelloRequest) returns (stream HelloResponse);
+    ` + extra + `
+}
+`
+}
+
+func TestRegisterSharedSchema(t *testing.T) {
+	address, port := startTestPlugin(t)
+
+	ctx := context.Background()
+	serviceName := "snippet.grpc.reflection.HelloService"
+
+	older := loadTestServices(t, helloSchema(`message HelloRequest { string name = 1; }`, ""))
+	newer := loadTestServices(t, helloSchema(`message HelloRequest { string name = 1; int32 age = 2; }`, "rpc Bye(HelloRequest) returns (HelloResponse);"))
+	conflicting := loadTestServices(t, helloSchema(`message HelloRequest { int64 name = 1; }`, ""))
+
+	other := endpoint{Plugin: "other", Address: "other:1", Schema: "other"}
+
+	newHandler := func(policy schemaPolicy, services map[string]*desc.ServiceDescriptor) *reflectionHandler {
+		meta := newServiceMeta(services[serviceName])
+		meta.Schema = "other"
+		meta = meta.withEndpoint(other)
+
+		h := &reflectionHandler{schemaPolicy: policy}
+		setTestServices(h, map[string]serviceMeta{serviceName: meta})
+		t.Cleanup(h.conns.Close)
+
+		return h
+	}
+
+	// A plugin extending the service compatibly replaces the descriptors.
+	h := newHandler(schemaReject, older)
+	_, err := h.Register(ctx, "hello", address, port, registerOptions{})
+	assert.Nil(t, err)
+
+	service := h.registry.Services()[serviceName]
+	assert.Len(t, service.Endpoints, 2)
+	assert.NotNil(t, service.Desc.GetFile().FindMessage("snippet.grpc.reflection.HelloRequest").FindFieldByName("age"))
+
+	// A plugin of an older version leaves the newer descriptors.
+	h = newHandler(schemaReject, newer)
+	_, err = h.Register(ctx, "hello", address, port, registerOptions{})
+	assert.Nil(t, err)
+
+	service = h.registry.Services()[serviceName]
+	assert.Len(t, service.Endpoints, 2)
+	assert.Contains(t, service.Functions, "Bye")
+	assert.Equal(t, "other", service.Schema)
+
+	// Registering again is not a change of the plugin's schema.
+	reg, err := h.Register(ctx, "hello", address, port, registerOptions{})
+	assert.Nil(t, err)
+	assert.Empty(t, reg.Changes)
+
+	// Conflicting plugins fail under the reject policy, and replace the
+	// others otherwise.
+	h = newHandler(schemaReject, conflicting)
+	_, err = h.Register(ctx, "hello", address, port, registerOptions{})
+	assert.Equal(t, codes.FailedPrecondition, status.Code(err))
+	assert.Equal(t, []endpoint{other}, h.registry.Services()[serviceName].Endpoints)
+
+	h = newHandler(schemaWarn, conflicting)
+	_, err = h.Register(ctx, "hello", address, port, registerOptions{})
+	assert.Nil(t, err)
+
+	service = h.registry.Services()[serviceName]
+	assert.Equal(t, []string{"hello"}, service.plugins())
+}
+
+func TestRegisterSharedServiceConfig(t *testing.T) {
+	address, port := startTestPlugin(t)
+	_, port2 := startTestPlugin(t)
+	_, port3 := startTestPlugin(t)
+
+	ctx := context.Background()
+	serviceName := "snippet.grpc.reflection.HelloService"
+
+	first, err := parseServiceConfig([]byte(`{"methodConfig": [{"name": [{}], "timeout": "1s"}]}`))
+	assert.Nil(t, err)
+	second, err := parseServiceConfig([]byte(`{"methodConfig": [{"name": [{}], "timeout": "2s"}]}`))
+	assert.Nil(t, err)
+
+	h := &reflectionHandler{}
+	defer h.conns.Close()
+
+	_, err = h.Register(ctx, "first", address, port, registerOptions{Config: first})
+	assert.Nil(t, err)
+
+	// Other plugins neither replace nor clear the config of the first.
+	_, err = h.Register(ctx, "second", address, port2, registerOptions{Config: second})
+	assert.Nil(t, err)
+	assert.Same(t, first, h.registry.Services()[serviceName].Config)
+
+	_, err = h.Register(ctx, "third", address, port3, registerOptions{})
+	assert.Nil(t, err)
+	assert.Same(t, first, h.registry.Services()[serviceName].Config)
+
+	// The config goes along with its plugin.
+	assert.Nil(t, h.Deregister("first", ""))
+	assert.Nil(t, h.registry.Services()[serviceName].Config)
+
+	_, err = h.Register(ctx, "second", address, port2, registerOptions{Config: second})
+	assert.Nil(t, err)
+	assert.Same(t, second, h.registry.Services()[serviceName].Config)
+
+	_, err = h.Register(ctx, "second", address, port2, registerOptions{})
+	assert.Nil(t, err)
+	assert.Nil(t, h.registry.Services()[serviceName].Config)
+}
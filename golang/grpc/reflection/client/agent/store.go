@@ -0,0 +1,318 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"time"
+
+	"github.com/jhump/protoreflect/desc"
+
+	"github.com/rootwarp/snippets/golang/grpc/reflection/transport"
+)
+
+// registrySnapshot is the persisted form of the registry.
+type registrySnapshot struct {
+	Plugins []pluginRecord `json:"plugins"`
+}
+
+type pluginRecord struct {
+	Name     string   `json:"name"`
+	Address  string   `json:"address"`
+	Services []string `json:"services"`
+	// Descriptors is a serialized FileDescriptorSet defining Services.
+	Descriptors []byte `json:"descriptors"`
+	// Offline plugins registered with Descriptors instead of serving
+	// server reflection.
+	Offline bool `json:"offline,omitempty"`
+	// ServiceConfig is the service config the plugin registered with.
+	ServiceConfig *serviceConfig `json:"serviceConfig,omitempty"`
+}
+
+// registryStore keeps the registry snapshot in a JSON file.
+type registryStore struct {
+	path string
+}
+
+// Load returns the stored snapshot, an empty one when nothing was stored yet.
+func (s *registryStore) Load() (*registrySnapshot, error) {
+	data, err := os.ReadFile(s.path)
+	if errors.Is(err, os.ErrNotExist) {
+		return &registrySnapshot{}, nil
+	}
+
+	if err != nil {
+		return nil, err
+	}
+
+	snapshot := &registrySnapshot{}
+	if err := json.Unmarshal(data, snapshot); err != nil {
+		return nil, err
+	}
+
+	return snapshot, nil
+}
+
+// Save replaces the stored snapshot. The file is replaced atomically so a
+// crash never leaves a partial snapshot behind.
+func (s *registryStore) Save(snapshot *registrySnapshot) error {
+	data, err := json.MarshalIndent(snapshot, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	tmp, err := os.CreateTemp(filepath.Dir(s.path), filepath.Base(s.path)+".*")
+	if err != nil {
+		return err
+	}
+
+	defer os.Remove(tmp.Name())
+
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return err
+	}
+
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+
+	return os.Rename(tmp.Name(), s.path)
+}
+
+// snapshot returns the registry in its persisted form, one record per plugin
+// instance. The registry must be locked.
+func (r *reflectionHandler) snapshot() (*registrySnapshot, error) {
+	type instance struct {
+		plugin  string
+		address string
+	}
+
+	records := map[instance]*pluginRecord{}
+	serviceDescs := map[instance]map[string]*desc.ServiceDescriptor{}
+	schemas := map[instance]map[string]bool{}
+
+	services := r.registry.all()
+	for serviceName, service := range services {
+		for _, e := range service.Endpoints {
+			// Peers are registered again as the agent reconnects to them.
+			if e.Peer {
+				continue
+			}
+
+			key := instance{plugin: e.Plugin, address: e.Address}
+
+			record, ok := records[key]
+			if !ok {
+				record = &pluginRecord{
+					Name:    e.Plugin,
+					Address: e.Address,
+					Offline: e.Offline,
+				}
+				records[key] = record
+				serviceDescs[key] = map[string]*desc.ServiceDescriptor{}
+				schemas[key] = map[string]bool{}
+			}
+
+			if service.ConfigPlugin == e.Plugin {
+				record.ServiceConfig = service.Config
+			}
+
+			record.Services = append(record.Services, serviceName)
+			serviceDescs[key][serviceName] = service.Desc
+			if cached, ok := r.schemas[e.Schema]; ok && cached.services[serviceName] != nil {
+				serviceDescs[key][serviceName] = cached.services[serviceName]
+			}
+
+			schemas[key][e.Schema] = true
+		}
+	}
+
+	snapshot := &registrySnapshot{
+		Plugins: []pluginRecord{},
+	}
+
+	for key, record := range records {
+		sort.Strings(record.Services)
+
+		// The cached set only fits when all services of the instance were
+		// registered together.
+		hash := ""
+		for h := range schemas[key] {
+			hash = h
+		}
+
+		schema, ok := r.schemas[hash]
+		if !ok || len(schemas[key]) > 1 {
+			_, built, err := newCachedSchema(serviceDescs[key])
+			if err != nil {
+				return nil, err
+			}
+
+			schema = built
+		}
+
+		record.Descriptors = schema.data
+		snapshot.Plugins = append(snapshot.Plugins, *record)
+	}
+
+	sort.Slice(snapshot.Plugins, func(i, j int) bool {
+		if snapshot.Plugins[i].Name != snapshot.Plugins[j].Name {
+			return snapshot.Plugins[i].Name < snapshot.Plugins[j].Name
+		}
+
+		return snapshot.Plugins[i].Address < snapshot.Plugins[j].Address
+	})
+
+	return snapshot, nil
+}
+
+// persist saves the registry, if it has a store. The registry must be
+// locked.
+func (r *reflectionHandler) persist() {
+	if r.store == nil {
+		return
+	}
+
+	snapshot, err := r.snapshot()
+	if err == nil {
+		err = r.store.Save(snapshot)
+	}
+
+	if err != nil {
+		fmt.Println("Persist registry", err)
+	}
+}
+
+// Restore loads the stored registry. Restored plugins stay pending, and do
+// not take calls, until a fresh reflection query, or a probe of the plugins
+// registered offline, and a health check confirm them. Plugins failing that
+// are dropped.
+func (r *reflectionHandler) Restore(ctx context.Context, checker *healthChecker) error {
+	snapshot, err := r.store.Load()
+	if err != nil {
+		return err
+	}
+
+	r.load(snapshot)
+
+	for _, record := range snapshot.Plugins {
+		if err := r.revalidate(ctx, record, checker); err != nil {
+			fmt.Println("Revalidate", record.Name, err)
+			r.dropPending(record)
+		}
+	}
+
+	return nil
+}
+
+// load adds the plugins of snapshot to the registry as pending. Services a
+// plugin registered since the agent started are left as they are, their
+// descriptors and config are fresher than the stored ones.
+func (r *reflectionHandler) load(snapshot *registrySnapshot) {
+	r.registry.Lock()
+	defer r.registry.Unlock()
+
+	for _, record := range snapshot.Plugins {
+		hash, schema, err := loadCachedSchema(record.Descriptors, record.Services)
+		if err != nil {
+			fmt.Println("Restore", record.Name, err)
+			continue
+		}
+
+		schema = r.cacheSchema(hash, schema)
+		for serviceName, serviceDesc := range schema.services {
+			service, _ := r.registry.get(serviceName)
+			if service.servedLive() {
+				continue
+			}
+
+			meta := newServiceMeta(serviceDesc)
+			meta.Schema = hash
+			meta.Endpoints = service.Endpoints
+
+			meta.Config, meta.ConfigPlugin = service.Config, service.ConfigPlugin
+			if record.ServiceConfig != nil && meta.ConfigPlugin == "" {
+				meta.Config, meta.ConfigPlugin = record.ServiceConfig, record.Name
+			}
+
+			r.registry.set(serviceName, meta.withEndpoint(endpoint{
+				Plugin:   record.Name,
+				Address:  record.Address,
+				Offline:  record.Offline,
+				Schema:   hash,
+				Health:   healthPending,
+				LastSeen: time.Now(),
+			}))
+		}
+	}
+}
+
+// servedLive reports whether an instance which is not pending serves s.
+func (s serviceMeta) servedLive() bool {
+	for _, e := range s.Endpoints {
+		if e.Health != healthPending {
+			return true
+		}
+	}
+
+	return false
+}
+
+func (r *reflectionHandler) revalidate(ctx context.Context, record pluginRecord, checker *healthChecker) error {
+	ctx, cancel := context.WithTimeout(ctx, checker.timeout)
+	defer cancel()
+
+	host, port, err := transport.SplitTarget(record.Address)
+	if err != nil {
+		return err
+	}
+
+	opts := registerOptions{
+		Allowed: record.Services,
+		Config:  record.ServiceConfig,
+		Pending: true,
+	}
+
+	if record.Offline {
+		opts.DescriptorSet = record.Descriptors
+	}
+
+	reg, err := r.Register(ctx, record.Name, host, port, opts)
+	if err != nil {
+		return err
+	}
+
+	for _, serviceName := range reg.Services {
+		if err := checker.check(ctx, serviceName, record.Address); err != nil {
+			return err
+		}
+
+		r.reportHealth(serviceName, record.Address, true, checker.maxFailures)
+	}
+
+	return nil
+}
+
+// dropPending removes the instance of record from the registry as long as it
+// is still the pending one restored, a live registration replacing it stays.
+func (r *reflectionHandler) dropPending(record pluginRecord) {
+	r.registry.Lock()
+	defer r.registry.Unlock()
+
+	removed := false
+	for serviceName := range r.registry.all() {
+		removed = r.removeEndpoints(serviceName, func(e endpoint) bool {
+			return e.Plugin == record.Name && e.Address == record.Address && e.Health == healthPending
+		}) || removed
+	}
+
+	if removed {
+		r.releaseConns()
+		r.persist()
+	}
+}
@@ -0,0 +1,164 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+func TestRestore(t *testing.T) {
+	address, port := startTestPlugin(t)
+	stopped, stoppedAddress, stoppedPort := startTestPluginServer(t)
+
+	store := &registryStore{path: filepath.Join(t.TempDir(), "registry.json")}
+	r = &reflectionHandler{
+		store: store,
+	}
+
+	ctx := context.Background()
+	helloService := "snippet.grpc.reflection.HelloService"
+	registrationService := "snippet.grpc.reflection.RegistrationService"
+
+	_, err := r.Query(ctx, "hello", address, port, []string{helloService})
+	assert.Nil(t, err)
+
+	_, err = r.Query(ctx, "registration", stoppedAddress, stoppedPort, []string{registrationService})
+	assert.Nil(t, err)
+
+	snapshot, err := store.Load()
+	assert.Nil(t, err)
+	assert.Len(t, snapshot.Plugins, 2)
+	assert.Equal(t, "hello", snapshot.Plugins[0].Name)
+	assert.Equal(t, []string{helloService}, snapshot.Plugins[0].Services)
+
+	r.conns.Close()
+	stopped.Stop()
+
+	// Restored services do not take calls before they are revalidated.
+	r = &reflectionHandler{
+		store: store,
+	}
+
+	r.load(snapshot)
+	assert.Equal(t, healthPending, r.registry.Services()[helloService].Endpoints[0].Health)
+	assert.Len(t, r.registry.Services()[helloService].Functions, 4)
+
+	_, err = r.Invoke(ctx, helloService, "Hello", []byte(`{"name": "rootwarp"}`))
+	assert.Equal(t, codes.Unavailable, status.Code(err))
+
+	checker := &healthChecker{timeout: 2 * time.Second, maxFailures: 3}
+	assert.Nil(t, r.Restore(ctx, checker))
+
+	assert.Equal(t, healthServing, r.registry.Services()[helloService].Endpoints[0].Health)
+	assert.NotContains(t, r.registry.Services(), registrationService)
+
+	_, err = r.Invoke(ctx, helloService, "Hello", []byte(`{"name": "rootwarp"}`))
+	assert.Nil(t, err)
+
+	// The dropped plugin is gone from the store as well.
+	snapshot, err = store.Load()
+	assert.Nil(t, err)
+	assert.Len(t, snapshot.Plugins, 1)
+	assert.Equal(t, "hello", snapshot.Plugins[0].Name)
+
+	r.conns.Close()
+}
+
+func TestRevalidate(t *testing.T) {
+	address, port := startTestPlugin(t)
+	host := fmt.Sprintf("%s:%d", address, port)
+
+	r = &reflectionHandler{}
+	defer r.conns.Close()
+
+	ctx := context.Background()
+	helloService := "snippet.grpc.reflection.HelloService"
+	record := pluginRecord{Name: "hello", Address: host, Services: []string{helloService}}
+
+	// Revalidated instances take no calls before their health check.
+	_, err := r.Register(ctx, "hello", address, port, registerOptions{Allowed: record.Services, Pending: true})
+	assert.Nil(t, err)
+	assert.Equal(t, healthPending, r.registry.Services()[helloService].Endpoints[0].Health)
+
+	_, err = r.Invoke(ctx, helloService, "Hello", nil)
+	assert.Equal(t, codes.Unavailable, status.Code(err))
+
+	checker := &healthChecker{timeout: 2 * time.Second, maxFailures: 3}
+	assert.Nil(t, r.revalidate(ctx, record, checker))
+	assert.Equal(t, healthServing, r.registry.Services()[helloService].Endpoints[0].Health)
+
+	// A live registration is neither set back to pending nor dropped.
+	_, err = r.Register(ctx, "hello", address, port, registerOptions{Allowed: record.Services, Pending: true})
+	assert.Nil(t, err)
+	assert.Equal(t, healthServing, r.registry.Services()[helloService].Endpoints[0].Health)
+
+	r.dropPending(record)
+	assert.Contains(t, r.registry.Services(), helloService)
+
+	// A pending one is.
+	assert.Nil(t, r.Deregister("hello", ""))
+
+	_, err = r.Register(ctx, "hello", address, port, registerOptions{Allowed: record.Services, Pending: true})
+	assert.Nil(t, err)
+
+	r.dropPending(record)
+	assert.NotContains(t, r.registry.Services(), helloService)
+}
+
+func TestLoadAfterRegister(t *testing.T) {
+	address, port := startTestPlugin(t)
+	host := fmt.Sprintf("%s:%d", address, port)
+
+	r = &reflectionHandler{}
+	defer r.conns.Close()
+
+	ctx := context.Background()
+	helloService := "snippet.grpc.reflection.HelloService"
+
+	config := &serviceConfig{MethodConfig: []methodConfig{{Timeout: "1s"}}}
+	_, err := r.Register(ctx, "hello", address, port, registerOptions{Allowed: []string{helloService}, Config: config})
+	assert.Nil(t, err)
+
+	live := r.registry.Services()[helloService]
+
+	// The stored registry of an earlier run holds another version of the
+	// service and its config.
+	snapshot, err := r.snapshot()
+	assert.Nil(t, err)
+
+	stale := &serviceConfig{MethodConfig: []methodConfig{{Timeout: "9s"}}}
+	for i := range snapshot.Plugins {
+		snapshot.Plugins[i].ServiceConfig = stale
+	}
+
+	snapshot.Plugins = append(snapshot.Plugins, pluginRecord{
+		Name:        "hello",
+		Address:     "127.0.0.1:1",
+		Services:    snapshot.Plugins[0].Services,
+		Descriptors: snapshot.Plugins[0].Descriptors,
+	})
+
+	r.load(snapshot)
+
+	service := r.registry.Services()[helloService]
+	assert.Equal(t, live.Schema, service.Schema)
+	assert.Same(t, config, service.Config)
+	if assert.Len(t, service.Endpoints, 1) {
+		assert.Equal(t, host, service.Endpoints[0].Address)
+		assert.Equal(t, healthUnknown, service.Endpoints[0].Health)
+	}
+}
+
+func TestRegistryStoreMissingFile(t *testing.T) {
+	store := &registryStore{path: filepath.Join(t.TempDir(), "registry.json")}
+
+	snapshot, err := store.Load()
+	assert.Nil(t, err)
+	assert.Empty(t, snapshot.Plugins)
+}
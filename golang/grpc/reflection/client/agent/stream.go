@@ -0,0 +1,137 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/types/dynamicpb"
+
+	"github.com/rootwarp/snippets/golang/grpc/reflection/telemetry"
+)
+
+// InvokeStream calls funcName of serviceName, which may stream in either or
+// both directions. Request payloads are pulled from recv until it returns
+// io.EOF, a method which does not stream requests takes exactly one. Every
+// response is passed to send as protojson.
+//
+// The call follows the timeout and circuit breaker configured for the
+// method, streams are never retried.
+func (r *reflectionHandler) InvokeStream(ctx context.Context, serviceName, funcName string, recv func() ([]byte, error), send func([]byte) error) (err error) {
+	fmt.Println("InvokeStream")
+
+	if err := r.authorize(ctx, serviceName, funcName); err != nil {
+		return err
+	}
+
+	service, fMeta, err := r.lookup(serviceName, funcName)
+	if err != nil {
+		return err
+	}
+
+	ctx, finish := r.startCall(ctx, serviceName, funcName)
+	defer func() { finish(err) }()
+
+	policy := r.callPolicy(service, serviceName, funcName)
+	address, done, err := r.pick(ctx, serviceName, service, policy)
+	if err != nil {
+		return err
+	}
+
+	defer func() { done(err) }()
+
+	conn, err := r.conns.Get(address)
+	if err != nil {
+		return err
+	}
+
+	ctx, cancel := withCallTimeout(ctx, policy)
+	defer cancel()
+
+	streamDesc := &grpc.StreamDesc{
+		StreamName:    funcName,
+		ClientStreams: fMeta.Desc.IsClientStreaming(),
+		ServerStreams: fMeta.Desc.IsServerStreaming(),
+	}
+
+	funcURL := fmt.Sprintf("/%s/%s", serviceName, funcName)
+	stream, err := conn.NewStream(telemetry.OutgoingContext(r.forwardContext(ctx, service, address)), streamDesc, funcURL)
+	if err != nil {
+		return err
+	}
+
+	// Requests are sent on their own goroutine so a bidi stream can deliver
+	// responses before the caller is done sending.
+	sendErr := make(chan error, 1)
+	go func() {
+		err := sendDynamicStream(stream, fMeta, streamDesc.ClientStreams, recv)
+		if err != nil {
+			sendErr <- err
+			cancel()
+		}
+	}()
+
+	for {
+		newOutMsg := dynamicpb.NewMessage(fMeta.OutDesc.UnwrapMessage())
+
+		err := stream.RecvMsg(newOutMsg)
+		if err == io.EOF {
+			return nil
+		}
+
+		if err != nil {
+			// A failure on the sending side cancels the stream, report
+			// the cause instead of the cancellation.
+			select {
+			case err := <-sendErr:
+				return err
+			default:
+			}
+
+			return err
+		}
+
+		out, err := marshalDynamicMessage(fMeta.OutDesc, newOutMsg)
+		if err != nil {
+			return err
+		}
+
+		if err := send(out); err != nil {
+			return err
+		}
+	}
+}
+
+func sendDynamicStream(stream grpc.ClientStream, fMeta funcMeta, clientStreams bool, recv func() ([]byte, error)) error {
+	for {
+		payload, err := recv()
+		if err == io.EOF {
+			if !clientStreams {
+				return status.Error(codes.InvalidArgument, "missing request message")
+			}
+
+			return stream.CloseSend()
+		}
+
+		if err != nil {
+			return err
+		}
+
+		newInMsg, err := newDynamicMessage(fMeta.InDesc, payload)
+		if err != nil {
+			return status.Error(codes.InvalidArgument, err.Error())
+		}
+
+		if err := stream.SendMsg(newInMsg); err != nil {
+			// The actual error is reported by RecvMsg.
+			return nil
+		}
+
+		if !clientStreams {
+			return stream.CloseSend()
+		}
+	}
+}
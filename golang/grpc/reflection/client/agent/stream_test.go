@@ -0,0 +1,148 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+func payloadSource(payloads ...string) func() ([]byte, error) {
+	return func() ([]byte, error) {
+		if len(payloads) == 0 {
+			return nil, io.EOF
+		}
+
+		payload := payloads[0]
+		payloads = payloads[1:]
+
+		return []byte(payload), nil
+	}
+}
+
+func greetings(t *testing.T, outs [][]byte) []string {
+	msgs := []string{}
+	for _, out := range outs {
+		resp := map[string]string{}
+		assert.Nil(t, json.Unmarshal(out, &resp))
+		msgs = append(msgs, resp["greetingMsg"])
+	}
+
+	return msgs
+}
+
+func TestInvokeStream(t *testing.T) {
+	address, port := startTestPlugin(t)
+
+	h := &reflectionHandler{}
+	defer h.conns.Close()
+
+	ctx := context.Background()
+	serviceName := "snippet.grpc.reflection.HelloService"
+
+	_, err := h.Query(ctx, "hello", address, port, nil)
+	assert.Nil(t, err)
+
+	tests := []struct {
+		funcName string
+		payloads []string
+		msgs     []string
+		code     codes.Code
+	}{
+		{"Hello", []string{`{"name": "a", "age": 1}`}, []string{"Hey a(1)"}, codes.OK},
+		{"HelloFeed", []string{`{"name": "a", "age": 3}`}, []string{"Hey a(1/3)", "Hey a(2/3)", "Hey a(3/3)"}, codes.OK},
+		{"HelloFeed", []string{`{"name": "a", "age": -1}`}, []string{}, codes.InvalidArgument},
+		{"HelloFeed", []string{}, []string{}, codes.InvalidArgument},
+		{"HelloAll", []string{`{"name": "a"}`, `{"name": "b"}`}, []string{"Hey a, b"}, codes.OK},
+		{"HelloAll", []string{}, []string{"Hey "}, codes.OK},
+		{"HelloChat", []string{`{"name": "a", "age": 1}`, `{"name": "b", "age": 2}`}, []string{"Hey a(1)", "Hey b(2)"}, codes.OK},
+		{"HelloChat", []string{`{"name": "a", "age": 1}`, `{"name": 2}`}, nil, codes.InvalidArgument},
+	}
+
+	for _, test := range tests {
+		outs := [][]byte{}
+		err := h.InvokeStream(ctx, serviceName, test.funcName, payloadSource(test.payloads...), func(out []byte) error {
+			outs = append(outs, out)
+			return nil
+		})
+
+		assert.Equal(t, test.code, status.Code(err), test.funcName, err)
+		if test.msgs != nil {
+			assert.Equal(t, test.msgs, greetings(t, outs), test.funcName)
+		}
+	}
+
+	_, err = h.Invoke(ctx, serviceName, "HelloFeed", nil)
+	assert.Equal(t, codes.InvalidArgument, status.Code(err))
+}
+
+func TestGatewayStream(t *testing.T) {
+	address, port := startTestPlugin(t)
+
+	r = &reflectionHandler{}
+	defer r.conns.Close()
+
+	_, err := r.Query(context.Background(), "hello", address, port, nil)
+	assert.Nil(t, err)
+
+	srv := httptest.NewServer(&gateway{})
+	defer srv.Close()
+
+	url := srv.URL + "/v1/snippet.grpc.reflection.HelloService/"
+
+	// Server streaming
+	resp, err := http.Post(url+"HelloFeed", "application/json", strings.NewReader(`{"name": "a", "age": 2}`))
+	assert.Nil(t, err)
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+	assert.Equal(t, "application/x-ndjson", resp.Header.Get("Content-Type"))
+
+	lines := []gatewayStreamLine{}
+	scanner := bufio.NewScanner(resp.Body)
+	for scanner.Scan() {
+		line := gatewayStreamLine{}
+		assert.Nil(t, json.Unmarshal(scanner.Bytes(), &line))
+		lines = append(lines, line)
+	}
+	resp.Body.Close()
+
+	assert.Len(t, lines, 2)
+	assert.Equal(t, []string{"Hey a(1/2)", "Hey a(2/2)"}, greetings(t, [][]byte{lines[0].Result, lines[1].Result}))
+
+	// Server streaming failing before the first message
+	resp, err = http.Post(url+"HelloFeed", "application/json", strings.NewReader(`{"age": -1}`))
+	assert.Nil(t, err)
+	resp.Body.Close()
+	assert.Equal(t, http.StatusBadRequest, resp.StatusCode)
+
+	// Client streaming
+	resp, err = http.Post(url+"HelloAll", "application/x-ndjson", strings.NewReader("{\"name\": \"a\"}\n{\"name\": \"b\"}\n"))
+	assert.Nil(t, err)
+	body, err := io.ReadAll(resp.Body)
+	resp.Body.Close()
+	assert.Nil(t, err)
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+	assert.Equal(t, []string{"Hey a, b"}, greetings(t, [][]byte{body}))
+
+	resp, err = http.Post(url+"HelloAll", "application/x-ndjson", strings.NewReader(`{"name": "`+strings.Repeat("a", maxGatewayBodySize)+`"}`))
+	assert.Nil(t, err)
+	resp.Body.Close()
+	assert.Equal(t, http.StatusRequestEntityTooLarge, resp.StatusCode)
+
+	// Bidi streaming
+	resp, err = http.Post(url+"HelloChat", "application/x-ndjson", strings.NewReader("{\"name\": \"a\", \"age\": 1}\n{\"name\": \"b\", \"age\": 2}\n"))
+	assert.Nil(t, err)
+	body, err = io.ReadAll(resp.Body)
+	resp.Body.Close()
+	assert.Nil(t, err)
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+	assert.Equal(t, 2, strings.Count(string(body), "\n"))
+	assert.Contains(t, string(body), "Hey b(2)")
+}
@@ -0,0 +1,139 @@
+package main
+
+import (
+	"context"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"go.opentelemetry.io/otel/attribute"
+	otelcodes "go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/trace"
+	"go.opentelemetry.io/otel/trace/noop"
+	"google.golang.org/grpc/status"
+
+	"github.com/rootwarp/snippets/golang/grpc/reflection/telemetry"
+)
+
+const tracerName = "github.com/rootwarp/snippets/golang/grpc/reflection/client/agent"
+
+// agentMetrics are the Prometheus metrics of plugin calls. A nil
+// *agentMetrics records nothing.
+type agentMetrics struct {
+	invocations *prometheus.CounterVec
+	latency     *prometheus.HistogramVec
+}
+
+func newAgentMetrics() *agentMetrics {
+	return &agentMetrics{
+		invocations: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "plugin_agent_invocations_total",
+			Help: "Calls of plugin methods by status code.",
+		}, []string{"service", "method", "code"}),
+		latency: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Name:    "plugin_agent_invocation_duration_seconds",
+			Help:    "Latency of calls of plugin methods, retries included.",
+			Buckets: prometheus.DefBuckets,
+		}, []string{"service", "method"}),
+	}
+}
+
+// Register registers the metrics of m and those of the registry of h on reg.
+func (m *agentMetrics) Register(reg prometheus.Registerer, h *reflectionHandler) error {
+	for _, c := range []prometheus.Collector{m.invocations, m.latency, &registryCollector{h: h}} {
+		if err := reg.Register(c); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func (m *agentMetrics) observe(serviceName, funcName string, err error, elapsed time.Duration) {
+	if m == nil {
+		return
+	}
+
+	m.invocations.WithLabelValues(serviceName, funcName, status.Code(err).String()).Inc()
+	m.latency.WithLabelValues(serviceName, funcName).Observe(elapsed.Seconds())
+}
+
+var (
+	registeredPluginsDesc = prometheus.NewDesc(
+		"plugin_agent_registered_plugins",
+		"Plugins with at least one registered instance.",
+		nil, nil,
+	)
+	pluginInstancesDesc = prometheus.NewDesc(
+		"plugin_agent_plugin_instances",
+		"Registered instances of plugin services by health state.",
+		[]string{"service", "health"}, nil,
+	)
+)
+
+// registryCollector reports the registry of h as it is at scrape time.
+type registryCollector struct {
+	h *reflectionHandler
+}
+
+func (c *registryCollector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- registeredPluginsDesc
+	ch <- pluginInstancesDesc
+}
+
+func (c *registryCollector) Collect(ch chan<- prometheus.Metric) {
+	plugins := map[string]bool{}
+	for serviceName, service := range c.h.registry.Services() {
+		counts := map[healthState]int{}
+		for _, e := range service.Endpoints {
+			plugins[e.Plugin] = true
+			counts[e.Health]++
+		}
+
+		for _, state := range []healthState{healthUnknown, healthServing, healthUnhealthy, healthPending} {
+			ch <- prometheus.MustNewConstMetric(pluginInstancesDesc, prometheus.GaugeValue, float64(counts[state]), serviceName, state.String())
+		}
+	}
+
+	ch <- prometheus.MustNewConstMetric(registeredPluginsDesc, prometheus.GaugeValue, float64(len(plugins)))
+}
+
+// tracer returns the tracer of the agent's spans.
+func (r *reflectionHandler) tracer() trace.Tracer {
+	if r.tracing == nil {
+		return noop.NewTracerProvider().Tracer(tracerName)
+	}
+
+	return r.tracing.Tracer(tracerName)
+}
+
+// startCall starts tracing and measuring a call of funcName of serviceName.
+// The span is a child of the caller's span, taken from the incoming metadata
+// of ctx unless ctx already carries one. The caller ends the call with the
+// returned function.
+func (r *reflectionHandler) startCall(ctx context.Context, serviceName, funcName string) (context.Context, func(error)) {
+	if !trace.SpanContextFromContext(ctx).IsValid() {
+		ctx = telemetry.Extract(ctx)
+	}
+
+	ctx, span := telemetry.StartRPCSpan(ctx, r.tracer(), serviceName+"/"+funcName, trace.SpanKindClient)
+	start := time.Now()
+
+	return ctx, func(err error) {
+		r.metrics.observe(serviceName, funcName, err, time.Since(start))
+		telemetry.EndRPCSpan(span, err)
+	}
+}
+
+// startSpan starts an internal span of the agent's own work, which endSpan
+// ends.
+func (r *reflectionHandler) startSpan(ctx context.Context, name string, attrs ...attribute.KeyValue) (context.Context, trace.Span) {
+	return r.tracer().Start(ctx, name, trace.WithAttributes(attrs...))
+}
+
+func endSpan(span trace.Span, err error) {
+	if err != nil {
+		span.SetStatus(otelcodes.Error, err.Error())
+	}
+
+	span.End()
+}
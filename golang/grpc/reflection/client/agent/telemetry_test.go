@@ -0,0 +1,176 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net"
+	"strings"
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/assert"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+	"go.opentelemetry.io/otel/trace"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/reflection"
+	"google.golang.org/grpc/status"
+
+	"github.com/rootwarp/snippets/golang/grpc/reflection/proto/plugin"
+	"github.com/rootwarp/snippets/golang/grpc/reflection/telemetry"
+)
+
+// startTestTracedPlugin starts a plugin tracing its calls with tp.
+func startTestTracedPlugin(t *testing.T, tp trace.TracerProvider) (string, int) {
+	s := grpc.NewServer(telemetry.ServerOptions(tp)...)
+	plugin.RegisterHelloServiceServer(s, &testHelloServer{})
+	reflection.Register(s)
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.Nil(t, err)
+
+	go s.Serve(l)
+	t.Cleanup(s.Stop)
+
+	addr := l.Addr().(*net.TCPAddr)
+	return addr.IP.String(), addr.Port
+}
+
+func findSpan(spans tracetest.SpanStubs, name string, kind trace.SpanKind) *tracetest.SpanStub {
+	for i := range spans {
+		if spans[i].Name == name && spans[i].SpanKind == kind {
+			return &spans[i]
+		}
+	}
+
+	return nil
+}
+
+func TestTracing(t *testing.T) {
+	exporter := tracetest.NewInMemoryExporter()
+	tp := sdktrace.NewTracerProvider(sdktrace.WithSyncer(exporter))
+
+	// The agent and the plugin share the exporter, so both sides of a call
+	// show up.
+	address, port := startTestTracedPlugin(t, tp)
+
+	h := &reflectionHandler{
+		tracing: tp,
+	}
+	defer h.conns.Close()
+
+	serviceName := "snippet.grpc.reflection.HelloService"
+	method := serviceName + "/Hello"
+
+	_, err := h.Query(context.Background(), "hello", address, port, nil)
+	assert.Nil(t, err)
+
+	spans := exporter.GetSpans()
+	register := findSpan(spans, "Register", trace.SpanKindInternal)
+	query := findSpan(spans, "Reflection query", trace.SpanKindInternal)
+	reflectionInfo := findSpan(spans, "grpc.reflection.v1.ServerReflection/ServerReflectionInfo", trace.SpanKindServer)
+	if assert.NotNil(t, register) && assert.NotNil(t, query) && assert.NotNil(t, reflectionInfo) {
+		assert.Equal(t, register.SpanContext.SpanID(), query.Parent.SpanID())
+		assert.Equal(t, query.SpanContext.SpanID(), reflectionInfo.Parent.SpanID())
+	}
+
+	exporter.Reset()
+
+	// The caller's trace context arrives as metadata, like the gateway
+	// passes headers.
+	traceparent := "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01"
+	ctx := metadata.NewIncomingContext(context.Background(), metadata.Pairs("traceparent", traceparent))
+
+	_, err = h.Invoke(ctx, serviceName, "Hello", []byte(`{"name": "rootwarp", "age": 40}`))
+	assert.Nil(t, err)
+
+	spans = exporter.GetSpans()
+	client := findSpan(spans, method, trace.SpanKindClient)
+	server := findSpan(spans, method, trace.SpanKindServer)
+	if assert.NotNil(t, client) && assert.NotNil(t, server) {
+		assert.Equal(t, "4bf92f3577b34da6a3ce929d0e0e4736", client.SpanContext.TraceID().String())
+		assert.Equal(t, "00f067aa0ba902b7", client.Parent.SpanID().String())
+		assert.Equal(t, client.SpanContext.TraceID(), server.SpanContext.TraceID())
+		assert.Equal(t, client.SpanContext.SpanID(), server.Parent.SpanID())
+		assert.Len(t, client.Events, 1)
+	}
+
+	exporter.Reset()
+
+	// Streams are traced the same way.
+	sent := false
+	recv := func() ([]byte, error) {
+		if sent {
+			return nil, io.EOF
+		}
+
+		sent = true
+		return []byte(`{"name": "rootwarp", "age": -1}`), nil
+	}
+
+	err = h.InvokeStream(ctx, serviceName, "HelloFeed", recv, func([]byte) error { return nil })
+	assert.Equal(t, codes.InvalidArgument, status.Code(err))
+
+	spans = exporter.GetSpans()
+	client = findSpan(spans, serviceName+"/HelloFeed", trace.SpanKindClient)
+	server = findSpan(spans, serviceName+"/HelloFeed", trace.SpanKindServer)
+	if assert.NotNil(t, client) && assert.NotNil(t, server) {
+		assert.Equal(t, client.SpanContext.SpanID(), server.Parent.SpanID())
+		assert.Equal(t, "negative age", client.Status.Description)
+	}
+}
+
+func TestMetrics(t *testing.T) {
+	address, port := startTestPlugin(t)
+
+	h := &reflectionHandler{
+		metrics: newAgentMetrics(),
+	}
+	defer h.conns.Close()
+
+	registry := prometheus.NewRegistry()
+	assert.Nil(t, h.metrics.Register(registry, h))
+
+	ctx := context.Background()
+	serviceName := "snippet.grpc.reflection.HelloService"
+
+	_, err := h.Query(ctx, "hello", address, port, []string{serviceName})
+	assert.Nil(t, err)
+
+	for i := 0; i < 2; i++ {
+		_, err = h.Invoke(ctx, serviceName, "Hello", []byte(`{"name": "rootwarp", "age": 40}`))
+		assert.Nil(t, err)
+	}
+
+	_, err = h.Invoke(ctx, serviceName, "Hello", []byte(`{"name": 1}`))
+	assert.Equal(t, codes.InvalidArgument, status.Code(err))
+
+	// Unknown methods are not counted.
+	_, err = h.Invoke(ctx, serviceName, "Bye", nil)
+	assert.NotNil(t, err)
+
+	assert.Equal(t, 2.0, testutil.ToFloat64(h.metrics.invocations.WithLabelValues(serviceName, "Hello", "OK")))
+	assert.Equal(t, 1.0, testutil.ToFloat64(h.metrics.invocations.WithLabelValues(serviceName, "Hello", "InvalidArgument")))
+	assert.Equal(t, 2, testutil.CollectAndCount(h.metrics.invocations))
+	assert.Equal(t, 1, testutil.CollectAndCount(h.metrics.latency))
+
+	h.reportHealth(serviceName, fmt.Sprintf("%s:%d", address, port), true, 3)
+
+	expected := `
+# HELP plugin_agent_plugin_instances Registered instances of plugin services by health state.
+# TYPE plugin_agent_plugin_instances gauge
+plugin_agent_plugin_instances{health="PENDING",service="snippet.grpc.reflection.HelloService"} 0
+plugin_agent_plugin_instances{health="SERVING",service="snippet.grpc.reflection.HelloService"} 1
+plugin_agent_plugin_instances{health="UNHEALTHY",service="snippet.grpc.reflection.HelloService"} 0
+plugin_agent_plugin_instances{health="UNKNOWN",service="snippet.grpc.reflection.HelloService"} 0
+# HELP plugin_agent_registered_plugins Plugins with at least one registered instance.
+# TYPE plugin_agent_registered_plugins gauge
+plugin_agent_registered_plugins 1
+`
+	err = testutil.GatherAndCompare(registry, strings.NewReader(expected), "plugin_agent_plugin_instances", "plugin_agent_registered_plugins")
+	assert.Nil(t, err)
+}
@@ -0,0 +1,156 @@
+package main
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"fmt"
+	"math/big"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/reflection"
+	"google.golang.org/grpc/status"
+
+	"github.com/rootwarp/snippets/golang/grpc/reflection/proto/plugin"
+)
+
+// newTestCertificates returns a CA pool and a certificate it signed for
+// 127.0.0.1 with the given DNS names.
+func newTestCertificates(t *testing.T, dnsNames ...string) (*x509.CertPool, tls.Certificate) {
+	caKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	assert.Nil(t, err)
+
+	caTmpl := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "test ca"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		KeyUsage:              x509.KeyUsageCertSign,
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+	}
+
+	caDER, err := x509.CreateCertificate(rand.Reader, caTmpl, caTmpl, &caKey.PublicKey, caKey)
+	assert.Nil(t, err)
+
+	caCert, err := x509.ParseCertificate(caDER)
+	assert.Nil(t, err)
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	assert.Nil(t, err)
+
+	tmpl := &x509.Certificate{
+		SerialNumber: big.NewInt(2),
+		Subject:      pkix.Name{CommonName: "plugin"},
+		DNSNames:     dnsNames,
+		IPAddresses:  []net.IP{net.ParseIP("127.0.0.1")},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+	}
+
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, caCert, &key.PublicKey, caKey)
+	assert.Nil(t, err)
+
+	pool := x509.NewCertPool()
+	pool.AddCert(caCert)
+
+	return pool, tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key}
+}
+
+func TestQueryVerifyIdentity(t *testing.T) {
+	tests := []struct {
+		dnsNames []string
+		code     codes.Code
+	}{
+		{[]string{"snippet.grpc.reflection.HelloService"}, codes.OK},
+		{[]string{"snippet.grpc.*"}, codes.OK},
+		{[]string{"snippet.grpc.reflection.ByeService"}, codes.PermissionDenied},
+		{nil, codes.PermissionDenied},
+	}
+
+	for _, test := range tests {
+		pool, cert := newTestCertificates(t, test.dnsNames...)
+
+		s := grpc.NewServer(grpc.Creds(credentials.NewTLS(&tls.Config{Certificates: []tls.Certificate{cert}})))
+		plugin.RegisterHelloServiceServer(s, &testHelloServer{})
+		reflection.Register(s)
+
+		l, err := net.Listen("tcp", "127.0.0.1:0")
+		assert.Nil(t, err)
+
+		go s.Serve(l)
+
+		h := &reflectionHandler{
+			conns:          connPool{creds: credentials.NewTLS(&tls.Config{RootCAs: pool})},
+			verifyIdentity: true,
+		}
+
+		addr := l.Addr().(*net.TCPAddr)
+		_, err = h.Query(context.Background(), "hello", addr.IP.String(), addr.Port, nil)
+		assert.Equal(t, test.code, status.Code(err), test.dnsNames)
+
+		if test.code == codes.OK {
+			_, err = h.Invoke(context.Background(), "snippet.grpc.reflection.HelloService", "Hello", nil)
+			assert.Nil(t, err)
+		}
+
+		h.conns.Close()
+		s.Stop()
+	}
+}
+
+func TestConnPoolPeerCreds(t *testing.T) {
+	pool, cert := newTestCertificates(t)
+
+	s := grpc.NewServer(grpc.Creds(credentials.NewTLS(&tls.Config{Certificates: []tls.Certificate{cert}})))
+	plugin.RegisterHelloServiceServer(s, &testHelloServer{})
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.Nil(t, err)
+
+	go s.Serve(l)
+	defer s.Stop()
+
+	// The certificate is not issued for localhost, only plugins are dialed
+	// without checking the name.
+	address := fmt.Sprintf("localhost:%d", l.Addr().(*net.TCPAddr).Port)
+
+	skipHostname := credentials.NewTLS(&tls.Config{RootCAs: pool, InsecureSkipVerify: true})
+
+	pluginConns := &connPool{creds: skipHostname}
+	defer pluginConns.Close()
+
+	peerConns := &connPool{
+		creds:     skipHostname,
+		peerCreds: credentials.NewTLS(&tls.Config{RootCAs: pool}),
+		peers:     map[string]bool{address: true},
+	}
+	defer peerConns.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	conn, err := pluginConns.Get(address)
+	assert.Nil(t, err)
+
+	_, err = plugin.NewHelloServiceClient(conn).Hello(ctx, &plugin.HelloRequest{})
+	assert.Nil(t, err)
+
+	conn, err = peerConns.Get(address)
+	assert.Nil(t, err)
+
+	_, err = plugin.NewHelloServiceClient(conn).Hello(ctx, &plugin.HelloRequest{})
+	assert.Equal(t, codes.Unavailable, status.Code(err))
+}
@@ -0,0 +1,80 @@
+package main
+
+import (
+	"context"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"google.golang.org/grpc"
+
+	"github.com/rootwarp/snippets/golang/grpc/reflection/pluginsdk"
+	"github.com/rootwarp/snippets/golang/grpc/reflection/proto/agent"
+	"github.com/rootwarp/snippets/golang/grpc/reflection/proto/plugin"
+	"github.com/rootwarp/snippets/golang/grpc/reflection/transport"
+)
+
+// TestLocalTransports runs the agent and plugins in the test binary, talking
+// over in-process pipes and a Unix domain socket.
+func TestLocalTransports(t *testing.T) {
+	r = &reflectionHandler{}
+	defer r.conns.Close()
+
+	s := grpc.NewServer()
+	agent.RegisterRegistrationServiceServer(s, &registrationServer{})
+
+	l, err := transport.Listen("inproc://agent")
+	assert.Nil(t, err)
+
+	go s.Serve(l)
+	defer s.Stop()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	listenAddresses := []string{
+		"inproc://hello",
+		"unix://" + filepath.Join(t.TempDir(), "hello.sock"),
+	}
+
+	served := make(chan error, len(listenAddresses))
+	for _, address := range listenAddresses {
+		opts := pluginsdk.Options{
+			Name:          "hello",
+			AgentAddress:  "inproc://agent",
+			ListenAddress: address,
+			RetryInterval: 10 * time.Millisecond,
+		}
+
+		go func() {
+			served <- pluginsdk.Serve(ctx, opts, func(s *grpc.Server) {
+				plugin.RegisterHelloServiceServer(s, &testHelloServer{})
+			})
+		}()
+	}
+
+	serviceName := "snippet.grpc.reflection.HelloService"
+	assert.Eventually(t, func() bool {
+		return len(r.registry.Services()[serviceName].Endpoints) == len(listenAddresses)
+	}, 5*time.Second, 10*time.Millisecond)
+
+	endpoints := r.registry.Services()[serviceName].Endpoints
+
+	assert.ElementsMatch(t, listenAddresses, []string{endpoints[0].Address, endpoints[1].Address})
+
+	// Round-robin reaches both instances.
+	for i := 0; i < len(listenAddresses); i++ {
+		out, err := r.Invoke(ctx, serviceName, "Hello", []byte(`{"name": "rootwarp", "age": 40}`))
+		assert.Nil(t, err)
+		assert.Contains(t, string(out), "Hey rootwarp(40)")
+	}
+
+	// The plugins deregister on their way out.
+	cancel()
+	for range listenAddresses {
+		assert.Nil(t, <-served)
+	}
+
+	assert.NotContains(t, r.registry.Services(), serviceName)
+}
@@ -0,0 +1,169 @@
+package main
+
+import (
+	"context"
+	"sort"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+
+	"github.com/rootwarp/snippets/golang/grpc/reflection/proto/agent"
+)
+
+// pluginInstance identifies one instance of a plugin.
+type pluginInstance struct {
+	Plugin  string
+	Address string
+	Peer    bool
+}
+
+// pluginSchemas returns the services of every plugin instance of services,
+// mapped to the hash of their descriptors.
+func pluginSchemas(services map[string]serviceMeta) map[pluginInstance]map[string]string {
+	plugins := map[pluginInstance]map[string]string{}
+	for name, service := range services {
+		for _, e := range service.Endpoints {
+			key := pluginInstance{Plugin: e.Plugin, Address: e.Address, Peer: e.Peer}
+
+			if plugins[key] == nil {
+				plugins[key] = map[string]string{}
+			}
+
+			plugins[key][name] = service.Schema
+			if e.Schema != "" {
+				plugins[key][name] = e.Schema
+			}
+		}
+	}
+
+	return plugins
+}
+
+// diffPlugins returns the events turning the plugins of old into the ones of
+// new, sorted by plugin and address.
+func diffPlugins(old, new map[pluginInstance]map[string]string) []*agent.PluginEvent {
+	events := []*agent.PluginEvent{}
+
+	for key, services := range new {
+		oldServices, ok := old[key]
+		switch {
+		case !ok:
+			events = append(events, newPluginEvent(agent.PluginEvent_ADDED, key, services))
+		case !sameSchemas(oldServices, services):
+			events = append(events, newPluginEvent(agent.PluginEvent_UPDATED, key, services))
+		}
+	}
+
+	for key, services := range old {
+		if _, ok := new[key]; !ok {
+			events = append(events, newPluginEvent(agent.PluginEvent_REMOVED, key, services))
+		}
+	}
+
+	sort.Slice(events, func(i, j int) bool {
+		if events[i].Name != events[j].Name {
+			return events[i].Name < events[j].Name
+		}
+
+		return events[i].Address < events[j].Address
+	})
+
+	return events
+}
+
+func sameSchemas(a, b map[string]string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+
+	for name, hash := range a {
+		if other, ok := b[name]; !ok || other != hash {
+			return false
+		}
+	}
+
+	return true
+}
+
+func newPluginEvent(eventType agent.PluginEvent_Type, key pluginInstance, services map[string]string) *agent.PluginEvent {
+	event := &agent.PluginEvent{
+		Type:    eventType,
+		Name:    key.Plugin,
+		Address: key.Address,
+		Peer:    key.Peer,
+	}
+
+	for name, hash := range services {
+		event.Services = append(event.Services, &agent.PluginService{Name: name, DescriptorHash: hash})
+	}
+
+	sort.Slice(event.Services, func(i, j int) bool {
+		return event.Services[i].Name < event.Services[j].Name
+	})
+
+	return event
+}
+
+// watchPlugins sends the plugins of the registry to send, as a snapshot or
+// as the changes since revision, then the changes of every following
+// revision, until ctx is done or send fails. Revisions changing no plugin,
+// only the health of its services, are not sent.
+func (r *reflectionHandler) watchPlugins(ctx context.Context, revision uint64, send func(*agent.WatchPluginsResponse) error) error {
+	state, sub := r.registry.Subscribe()
+	defer r.registry.Unsubscribe(sub)
+
+	var history []*registryState
+	if revision != 0 {
+		history, _ = r.registry.History(revision)
+	}
+
+	if len(history) == 0 {
+		err := send(&agent.WatchPluginsResponse{
+			Revision: state.Revision,
+			Snapshot: true,
+			Events:   diffPlugins(nil, pluginSchemas(state.Services)),
+		})
+		if err != nil {
+			return err
+		}
+
+		history = []*registryState{state}
+	}
+
+	for {
+		last := history[0]
+		plugins := pluginSchemas(last.Services)
+
+		for _, state := range history[1:] {
+			next := pluginSchemas(state.Services)
+
+			if events := diffPlugins(plugins, next); len(events) > 0 {
+				err := send(&agent.WatchPluginsResponse{
+					Revision: state.Revision,
+					Events:   events,
+				})
+				if err != nil {
+					return err
+				}
+			}
+
+			last, plugins = state, next
+		}
+
+		select {
+		case <-ctx.Done():
+			return status.FromContextError(ctx.Err()).Err()
+		case _, ok := <-sub.Events:
+			if !ok {
+				return status.Errorf(codes.Aborted, "watcher fell behind at revision %d", last.Revision)
+			}
+		}
+
+		// The events may be of revisions sent already, the history tells
+		// what is new.
+		var ok bool
+		if history, ok = r.registry.History(last.Revision); !ok {
+			return status.Errorf(codes.Aborted, "watcher fell behind at revision %d", last.Revision)
+		}
+	}
+}
@@ -0,0 +1,217 @@
+package main
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/status"
+
+	"github.com/rootwarp/snippets/golang/grpc/reflection/proto/agent"
+	"github.com/rootwarp/snippets/golang/grpc/reflection/transport"
+)
+
+// startTestWatch runs watchPlugins of h from revision, the responses arrive
+// on the returned channel.
+func startTestWatch(t *testing.T, h *reflectionHandler, revision uint64) <-chan *agent.WatchPluginsResponse {
+	ctx, cancel := context.WithCancel(context.Background())
+
+	responses := make(chan *agent.WatchPluginsResponse, 16)
+	done := make(chan struct{})
+
+	go func() {
+		defer close(done)
+
+		err := h.watchPlugins(ctx, revision, func(resp *agent.WatchPluginsResponse) error {
+			responses <- resp
+			return nil
+		})
+		assert.Equal(t, codes.Canceled, status.Code(err))
+	}()
+
+	t.Cleanup(func() {
+		cancel()
+		<-done
+	})
+
+	return responses
+}
+
+func receiveTestWatch(t *testing.T, responses <-chan *agent.WatchPluginsResponse) *agent.WatchPluginsResponse {
+	select {
+	case resp := <-responses:
+		return resp
+	case <-time.After(5 * time.Second):
+		t.Fatal("no watch response")
+		return nil
+	}
+}
+
+func TestWatchPlugins(t *testing.T) {
+	h := &reflectionHandler{}
+
+	setTestServices(h, map[string]serviceMeta{
+		"a.Service": {Schema: "a1", Endpoints: []endpoint{{Plugin: "a", Address: "127.0.0.1:1"}}},
+	})
+
+	responses := startTestWatch(t, h, 0)
+
+	// The snapshot comes first.
+	resp := receiveTestWatch(t, responses)
+	assert.Equal(t, uint64(1), resp.Revision)
+	assert.True(t, resp.Snapshot)
+	if assert.Len(t, resp.Events, 1) {
+		assert.Equal(t, agent.PluginEvent_ADDED, resp.Events[0].Type)
+		assert.Equal(t, "a", resp.Events[0].Name)
+		assert.Equal(t, "127.0.0.1:1", resp.Events[0].Address)
+		assert.Equal(t, "a.Service", resp.Events[0].Services[0].Name)
+		assert.Equal(t, "a1", resp.Events[0].Services[0].DescriptorHash)
+	}
+
+	setTestServices(h, map[string]serviceMeta{
+		"b.Service": {Schema: "b1", Endpoints: []endpoint{{Plugin: "b", Address: "127.0.0.1:2"}}},
+	})
+
+	resp = receiveTestWatch(t, responses)
+	assert.Equal(t, uint64(2), resp.Revision)
+	assert.False(t, resp.Snapshot)
+	if assert.Len(t, resp.Events, 1) {
+		assert.Equal(t, agent.PluginEvent_ADDED, resp.Events[0].Type)
+		assert.Equal(t, "b", resp.Events[0].Name)
+	}
+
+	// The health of a service changes no plugin.
+	setTestServices(h, map[string]serviceMeta{
+		"b.Service": {Schema: "b1", Endpoints: []endpoint{{Plugin: "b", Address: "127.0.0.1:2", Health: healthUnhealthy}}},
+	})
+
+	// A new schema updates the plugin, in the same revision a is removed.
+	h.registry.Lock()
+	h.registry.set("b.Service", serviceMeta{Schema: "b2", Endpoints: []endpoint{{Plugin: "b", Address: "127.0.0.1:2"}}})
+	h.registry.remove("a.Service")
+	h.registry.Unlock()
+
+	resp = receiveTestWatch(t, responses)
+	assert.Equal(t, uint64(4), resp.Revision)
+	if assert.Len(t, resp.Events, 2) {
+		assert.Equal(t, agent.PluginEvent_REMOVED, resp.Events[0].Type)
+		assert.Equal(t, "a", resp.Events[0].Name)
+		assert.Equal(t, "a.Service", resp.Events[0].Services[0].Name)
+
+		assert.Equal(t, agent.PluginEvent_UPDATED, resp.Events[1].Type)
+		assert.Equal(t, "b", resp.Events[1].Name)
+		assert.Equal(t, "b2", resp.Events[1].Services[0].DescriptorHash)
+	}
+
+	// A watcher resuming gets what it missed.
+	resumed := startTestWatch(t, h, 1)
+
+	resp = receiveTestWatch(t, resumed)
+	assert.Equal(t, uint64(2), resp.Revision)
+	assert.False(t, resp.Snapshot)
+	assert.Equal(t, agent.PluginEvent_ADDED, resp.Events[0].Type)
+
+	resp = receiveTestWatch(t, resumed)
+	assert.Equal(t, uint64(4), resp.Revision)
+	assert.Len(t, resp.Events, 2)
+
+	// Up to date, nothing is sent until the next change.
+	upToDate := startTestWatch(t, h, 4)
+
+	setTestServices(h, map[string]serviceMeta{
+		"c.Service": {Schema: "c1", Endpoints: []endpoint{{Plugin: "c", Address: "127.0.0.1:3"}}},
+	})
+
+	for _, watch := range []<-chan *agent.WatchPluginsResponse{responses, resumed, upToDate} {
+		resp = receiveTestWatch(t, watch)
+		assert.Equal(t, uint64(5), resp.Revision)
+		assert.False(t, resp.Snapshot)
+		if assert.Len(t, resp.Events, 1) {
+			assert.Equal(t, "c", resp.Events[0].Name)
+		}
+	}
+
+	// A revision the registry does not hold gets a snapshot.
+	resp = receiveTestWatch(t, startTestWatch(t, h, 100))
+	assert.Equal(t, uint64(5), resp.Revision)
+	assert.True(t, resp.Snapshot)
+	assert.Len(t, resp.Events, 2)
+}
+
+func TestWatchPluginsRPC(t *testing.T) {
+	address, port := startTestPlugin(t)
+
+	r = &reflectionHandler{}
+	defer r.conns.Close()
+
+	r.registry.StartAt(1000)
+
+	s := grpc.NewServer()
+	agent.RegisterRegistrationServiceServer(s, &registrationServer{})
+
+	l, err := transport.Listen("inproc://watch-agent")
+	assert.Nil(t, err)
+
+	go s.Serve(l)
+	defer s.Stop()
+
+	conn, err := transport.Dial("inproc://watch-agent", grpc.WithTransportCredentials(insecure.NewCredentials()))
+	assert.Nil(t, err)
+	defer conn.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	cli := agent.NewRegistrationServiceClient(conn)
+
+	stream, err := cli.WatchPlugins(ctx, &agent.WatchPluginsRequest{})
+	assert.Nil(t, err)
+
+	resp, err := stream.Recv()
+	assert.Nil(t, err)
+	assert.Equal(t, uint64(1000), resp.Revision)
+	assert.True(t, resp.Snapshot)
+	assert.Empty(t, resp.Events)
+
+	serviceName := "snippet.grpc.reflection.HelloService"
+	_, err = cli.RegisterPlugin(ctx, &agent.RegisterRequest{
+		Name:            "hello",
+		Address:         address,
+		Port:            int32(port),
+		AllowedServices: []string{serviceName},
+	})
+	assert.Nil(t, err)
+
+	resp, err = stream.Recv()
+	assert.Nil(t, err)
+	assert.Equal(t, uint64(1001), resp.Revision)
+	if assert.Len(t, resp.Events, 1) {
+		assert.Equal(t, agent.PluginEvent_ADDED, resp.Events[0].Type)
+		assert.Equal(t, "hello", resp.Events[0].Name)
+		assert.Equal(t, serviceName, resp.Events[0].Services[0].Name)
+		assert.Equal(t, r.registry.Services()[serviceName].Schema, resp.Events[0].Services[0].DescriptorHash)
+	}
+
+	_, err = cli.DeregisterPlugin(ctx, &agent.DeregisterRequest{Name: "hello"})
+	assert.Nil(t, err)
+
+	resp, err = stream.Recv()
+	assert.Nil(t, err)
+	assert.Equal(t, uint64(1002), resp.Revision)
+	if assert.Len(t, resp.Events, 1) {
+		assert.Equal(t, agent.PluginEvent_REMOVED, resp.Events[0].Type)
+	}
+
+	// Resuming from before the agent started over gets a snapshot.
+	stream, err = cli.WatchPlugins(ctx, &agent.WatchPluginsRequest{Revision: 5})
+	assert.Nil(t, err)
+
+	resp, err = stream.Recv()
+	assert.Nil(t, err)
+	assert.Equal(t, uint64(1002), resp.Revision)
+	assert.True(t, resp.Snapshot)
+}
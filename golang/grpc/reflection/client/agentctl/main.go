@@ -0,0 +1,264 @@
+// agentctl inspects the plugins registered with an agent and calls their
+// methods.
+//
+//	agentctl list
+//	agentctl describe <service>
+//	agentctl call <service>/<method> -d '{json}'
+//	agentctl watch [-from revision]
+//	agentctl replay [-mock] <file>
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"os/signal"
+	"strings"
+	"syscall"
+	"text/tabwriter"
+	"time"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/status"
+
+	"github.com/rootwarp/snippets/golang/grpc/reflection/pluginsdk"
+	"github.com/rootwarp/snippets/golang/grpc/reflection/proto/agent"
+	"github.com/rootwarp/snippets/golang/grpc/reflection/tlsconfig"
+	"github.com/rootwarp/snippets/golang/grpc/reflection/transport"
+)
+
+const usage = `Usage: agentctl [flags] <command> [args]
+
+Commands:
+  list                                 list plugins and the services they serve
+  describe <service>                   print the methods and messages of a service as proto source
+  call <service>/<method> -d '{json}'  call a unary method with a protojson payload
+  watch [-from revision]               print the plugins and their changes as they happen
+  replay <file>                        call again the calls of an agent's record file and diff the responses
+  replay -mock <file>                  serve the recorded responses as a plugin registered with the agent
+
+Flags:
+`
+
+func main() {
+	agentAddr := flag.String("agent", "localhost:8080", "address of the agent's registration service, host:port or unix:///path")
+	timeout := flag.Duration("timeout", 10*time.Second, "timeout of the request to the agent")
+
+	tlsCfg := tlsconfig.Config{}
+	tlsCfg.AddFlags(flag.CommandLine, "tls-")
+
+	flag.Usage = func() {
+		fmt.Fprint(flag.CommandLine.Output(), usage)
+		flag.PrintDefaults()
+	}
+	flag.Parse()
+
+	if flag.NArg() == 0 {
+		flag.Usage()
+		os.Exit(2)
+	}
+
+	creds, err := tlsCfg.ClientCredentials()
+	if err != nil {
+		fail(err)
+	}
+
+	conn, err := transport.Dial(*agentAddr, grpc.WithTransportCredentials(creds))
+	if err != nil {
+		fail(err)
+	}
+	defer conn.Close()
+
+	cli := agent.NewRegistrationServiceClient(conn)
+	command, args := flag.Arg(0), flag.Args()[1:]
+
+	// Watching and replaying run until they are interrupted, replayed calls
+	// time out one by one.
+	ctx, cancel := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	if command != "watch" && command != "replay" {
+		ctx, cancel = context.WithTimeout(ctx, *timeout)
+	}
+	defer cancel()
+
+	switch command {
+	case "list":
+		err = list(ctx, cli, os.Stdout)
+	case "describe":
+		err = describe(ctx, cli, os.Stdout, args)
+	case "call":
+		err = call(ctx, cli, os.Stdout, args)
+	case "watch":
+		err = watch(ctx, cli, os.Stdout, args)
+	case "replay":
+		err = replayRecords(ctx, conn, os.Stdout, args, replayOptions{
+			Timeout: *timeout,
+			Plugin: pluginsdk.Options{
+				AgentAddress: *agentAddr,
+				DialCreds:    creds,
+			},
+		})
+	default:
+		err = fmt.Errorf("unknown command %q", command)
+	}
+
+	if err != nil {
+		cancel()
+		fail(err)
+	}
+}
+
+func list(ctx context.Context, cli agent.RegistrationServiceClient, w io.Writer) error {
+	resp, err := cli.ListPlugins(ctx, &agent.ListPluginsRequest{})
+	if err != nil {
+		return err
+	}
+
+	tw := tabwriter.NewWriter(w, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(tw, "PLUGIN\tADDRESS\tHEALTH\tLAST SEEN\tSERVICES")
+
+	for _, info := range resp.Plugins {
+		services := make([]string, 0, len(info.Services))
+		for _, service := range info.Services {
+			services = append(services, service.Name)
+		}
+
+		fmt.Fprintf(tw, "%s\t%s\t%s\t%s\t%s\n",
+			info.Name, info.Address, info.Health,
+			info.LastSeen.AsTime().Local().Format(time.RFC3339),
+			strings.Join(services, ","))
+	}
+
+	return tw.Flush()
+}
+
+func describe(ctx context.Context, cli agent.RegistrationServiceClient, w io.Writer, args []string) error {
+	if len(args) != 1 {
+		return errors.New("usage: agentctl describe <service>")
+	}
+
+	resp, err := cli.DescribeService(ctx, &agent.DescribeServiceRequest{Name: args[0]})
+	if err != nil {
+		return err
+	}
+
+	fmt.Fprintf(w, "// Served by %s.\n", strings.Join(resp.Plugins, ", "))
+	_, err = io.WriteString(w, resp.Proto)
+
+	return err
+}
+
+func call(ctx context.Context, cli agent.RegistrationServiceClient, w io.Writer, args []string) error {
+	fs := flag.NewFlagSet("call", flag.ContinueOnError)
+	data := fs.String("d", "{}", "protojson payload of the request, @file reads it from a file and @- from standard input")
+
+	// The method may come before the flags, as in call <method> -d '{}'.
+	method := ""
+	if len(args) > 0 && !strings.HasPrefix(args[0], "-") {
+		method, args = args[0], args[1:]
+	}
+
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+
+	if method == "" && fs.NArg() > 0 {
+		method = fs.Arg(0)
+	}
+
+	serviceName, funcName, ok := strings.Cut(method, "/")
+	if !ok || serviceName == "" || funcName == "" {
+		return errors.New("usage: agentctl call <service>/<method> -d '{json}'")
+	}
+
+	payload, err := readPayload(*data)
+	if err != nil {
+		return err
+	}
+
+	resp, err := cli.CallMethod(ctx, &agent.CallMethodRequest{
+		Service: serviceName,
+		Method:  funcName,
+		Payload: payload,
+	})
+	if err != nil {
+		return err
+	}
+
+	out := &bytes.Buffer{}
+	if err := json.Indent(out, []byte(resp.Payload), "", "  "); err != nil {
+		out.Reset()
+		out.WriteString(resp.Payload)
+	}
+
+	fmt.Fprintln(w, out.String())
+
+	return nil
+}
+
+func watch(ctx context.Context, cli agent.RegistrationServiceClient, w io.Writer, args []string) error {
+	fs := flag.NewFlagSet("watch", flag.ContinueOnError)
+	from := fs.Uint64("from", 0, "revision to resume from, the changes after it are printed instead of a snapshot")
+
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+
+	stream, err := cli.WatchPlugins(ctx, &agent.WatchPluginsRequest{Revision: *from})
+	if err != nil {
+		return err
+	}
+
+	for {
+		resp, err := stream.Recv()
+		if err != nil {
+			return err
+		}
+
+		if resp.Snapshot {
+			fmt.Fprintf(w, "# snapshot at revision %d\n", resp.Revision)
+		}
+
+		for _, event := range resp.Events {
+			services := make([]string, 0, len(event.Services))
+			for _, service := range event.Services {
+				services = append(services, fmt.Sprintf("%s@%s", service.Name, service.DescriptorHash))
+			}
+
+			fmt.Fprintf(w, "%d\t%s\t%s\t%s\t%s\n",
+				resp.Revision, event.Type, event.Name, event.Address, strings.Join(services, ","))
+		}
+	}
+}
+
+// readPayload returns the payload data stands for.
+func readPayload(data string) (string, error) {
+	name, ok := strings.CutPrefix(data, "@")
+	if !ok {
+		return data, nil
+	}
+
+	var content []byte
+	var err error
+	if name == "-" {
+		content, err = io.ReadAll(os.Stdin)
+	} else {
+		content, err = os.ReadFile(name)
+	}
+
+	return string(content), err
+}
+
+func fail(err error) {
+	if st, ok := status.FromError(err); ok {
+		fmt.Fprintf(os.Stderr, "agentctl: %s: %s\n", st.Code(), st.Message())
+	} else {
+		fmt.Fprintln(os.Stderr, "agentctl:", err)
+	}
+
+	os.Exit(1)
+}
@@ -0,0 +1,147 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"strings"
+	"time"
+
+	"github.com/jhump/protoreflect/desc"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+
+	"github.com/rootwarp/snippets/golang/grpc/reflection/mockplugin"
+	"github.com/rootwarp/snippets/golang/grpc/reflection/pluginsdk"
+	"github.com/rootwarp/snippets/golang/grpc/reflection/proto/agent"
+	"github.com/rootwarp/snippets/golang/grpc/reflection/replay"
+)
+
+type replayOptions struct {
+	// Timeout applies to every replayed call.
+	Timeout time.Duration
+	// Plugin configures the mock plugin.
+	Plugin pluginsdk.Options
+}
+
+func replayRecords(ctx context.Context, conn *grpc.ClientConn, w io.Writer, args []string, opts replayOptions) error {
+	fs := flag.NewFlagSet("replay", flag.ContinueOnError)
+	mock := fs.Bool("mock", false, "serve the recorded responses as a plugin instead of calling the plugins again")
+	name := fs.String("name", "replay", "plugin name of the mock")
+	listen := fs.String("listen", "127.0.0.1:0", "listen address of the mock")
+
+	// The file may come before the flags too.
+	file := ""
+	if len(args) > 0 && !strings.HasPrefix(args[0], "-") {
+		file, args = args[0], args[1:]
+	}
+
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+
+	if file == "" && fs.NArg() > 0 {
+		file = fs.Arg(0)
+	}
+
+	if file == "" {
+		return errors.New("usage: agentctl replay [-mock] <file>")
+	}
+
+	records, err := replay.ReadFile(file)
+	if err != nil {
+		return err
+	}
+
+	if *mock {
+		opts.Plugin.Name = *name
+		opts.Plugin.ListenAddress = *listen
+
+		return serveMock(ctx, conn, w, records, opts.Plugin)
+	}
+
+	return resend(ctx, agent.NewRegistrationServiceClient(conn), w, records, opts.Timeout)
+}
+
+// resend calls the methods of records again and prints how the outcomes
+// differ from the recorded ones.
+func resend(ctx context.Context, cli agent.RegistrationServiceClient, w io.Writer, records []replay.Record, timeout time.Duration) error {
+	differ := 0
+	for _, rec := range records {
+		callCtx, cancel := context.WithTimeout(ctx, timeout)
+		// Files recorded before may hold metadata of the original call.
+		callCtx = metadata.NewOutgoingContext(callCtx, metadata.MD(replay.CallMetadata(rec.Metadata)))
+
+		resp, err := cli.CallMethod(callCtx, &agent.CallMethodRequest{
+			Service: rec.Service,
+			Method:  rec.Method,
+			Payload: string(rec.Request),
+		})
+		cancel()
+
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+
+		diffs, err := replay.Check(rec, []byte(resp.GetPayload()), err)
+		if err != nil {
+			return err
+		}
+
+		if len(diffs) == 0 {
+			fmt.Fprintf(w, "SAME\t%s/%s\n", rec.Service, rec.Method)
+			continue
+		}
+
+		differ++
+		fmt.Fprintf(w, "DIFF\t%s/%s\n", rec.Service, rec.Method)
+		for _, diff := range diffs {
+			fmt.Fprintf(w, "\t%s\n", diff)
+		}
+	}
+
+	fmt.Fprintf(w, "%d calls replayed, %d differ\n", len(records), differ)
+
+	if differ > 0 {
+		return fmt.Errorf("%d of %d calls differ", differ, len(records))
+	}
+
+	return nil
+}
+
+// serveMock serves the recorded services, with the descriptors the agent
+// holds, answering with the recorded responses until ctx is done. The calls
+// which were not recorded are printed.
+func serveMock(ctx context.Context, conn *grpc.ClientConn, w io.Writer, records []replay.Record, opts pluginsdk.Options) error {
+	mock := replay.NewMock(records)
+
+	services, err := mockplugin.Resolve(ctx, conn, mock.Services())
+	if err != nil {
+		return err
+	}
+
+	if opts.DescriptorSet, err = mockplugin.DescriptorSet(services); err != nil {
+		return err
+	}
+
+	opts.DisableReflection = true
+
+	respond := func(ctx context.Context, method *desc.MethodDescriptor, request []byte) ([]byte, error) {
+		serviceName := method.GetService().GetFullyQualifiedName()
+
+		response, err := mock.Respond(serviceName, method.GetName(), request)
+		if status.Code(err) == codes.NotFound {
+			fmt.Fprintf(w, "MISS\t%s/%s\t%s\n", serviceName, method.GetName(), status.Convert(err).Message())
+		}
+
+		return response, err
+	}
+
+	return pluginsdk.Serve(ctx, opts, func(s *grpc.Server) {
+		mockplugin.Register(s, services, respond)
+	})
+}
@@ -0,0 +1,161 @@
+// mockplugin serves the services of a plugin which does not exist yet and
+// registers them with an agent. The descriptors of the services come from the
+// agent, which knows them from the plugins registered with it, or from a
+// descriptor set file. Every method answers with the response of a template
+// file or with random data.
+//
+// The services to serve are always named, the mock would take a share of the
+// calls of every plugin serving one of them otherwise.
+//
+//	mockplugin -services snippet.grpc.reflection.HelloService -template hello.json
+//	mockplugin -services snippet.grpc.reflection.HelloService -descriptor-set hello.pb
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"os"
+	"os/signal"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/jhump/protoreflect/desc"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/credentials"
+
+	"github.com/rootwarp/snippets/golang/grpc/reflection/mockplugin"
+	"github.com/rootwarp/snippets/golang/grpc/reflection/pluginsdk"
+	"github.com/rootwarp/snippets/golang/grpc/reflection/tlsconfig"
+	"github.com/rootwarp/snippets/golang/grpc/reflection/transport"
+)
+
+func main() {
+	agentAddr := flag.String("agent", "localhost:8080", "address of the agent's registration service, host:port or unix:///path")
+	listenAddr := flag.String("listen", "127.0.0.1:0", "listen address of the mock, host:port or unix:///path, an ephemeral port by default")
+	advertiseHost := flag.String("advertise-host", "", "host the agent calls the mock at, the listen host when empty")
+	name := flag.String("name", "mock", "plugin name of the mock")
+	serviceNames := flag.String("services", "", "comma separated services to serve, required")
+	descriptorSetFile := flag.String("descriptor-set", "", "FileDescriptorSet with the services and their imports, the descriptors are fetched from the agent when empty")
+	templateFile := flag.String("template", "", "JSON object of protojson responses by <service>/<method>")
+	random := flag.Bool("random", true, "answer the methods missing from the template with random data, unimplemented otherwise")
+	seed := flag.Int64("seed", 0, "seed of the random data, the current time when 0")
+
+	tlsCfg := tlsconfig.Config{}
+	tlsCfg.AddFlags(flag.CommandLine, "tls-")
+	flag.Parse()
+
+	serverCreds, err := tlsCfg.ServerCredentials()
+	if err != nil {
+		panic(err)
+	}
+
+	dialCreds, err := tlsCfg.ClientCredentials()
+	if err != nil {
+		panic(err)
+	}
+
+	// The mock deregisters when it is stopped.
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	if *serviceNames == "" {
+		panic("-services is required")
+	}
+
+	names := strings.Split(*serviceNames, ",")
+
+	var services []*desc.ServiceDescriptor
+	if *descriptorSetFile != "" {
+		data, err := os.ReadFile(*descriptorSetFile)
+		if err != nil {
+			panic(err)
+		}
+
+		services, err = mockplugin.ServicesFromSet(data, names)
+	} else {
+		services, err = resolveServices(ctx, *agentAddr, dialCreds, names)
+	}
+	if err != nil {
+		panic(err)
+	}
+
+	if len(services) == 0 {
+		panic("no services to serve")
+	}
+
+	if *seed == 0 {
+		*seed = time.Now().UnixNano()
+	}
+
+	var respond mockplugin.Responder
+	if *random {
+		respond = mockplugin.Random(*seed)
+	}
+
+	if *templateFile != "" {
+		data, err := os.ReadFile(*templateFile)
+		if err != nil {
+			panic(err)
+		}
+
+		respond, err = mockplugin.Template(services, data, respond)
+		if err != nil {
+			panic(err)
+		}
+	}
+
+	if respond == nil {
+		panic("no template and no random data to answer with")
+	}
+
+	descriptorSet, err := mockplugin.DescriptorSet(services)
+	if err != nil {
+		panic(err)
+	}
+
+	opts := pluginsdk.Options{
+		Name:              *name,
+		AgentAddress:      *agentAddr,
+		ListenAddress:     *listenAddr,
+		AdvertiseHost:     *advertiseHost,
+		ServerCreds:       serverCreds,
+		DialCreds:         dialCreds,
+		DisableReflection: true,
+		DescriptorSet:     descriptorSet,
+	}
+
+	for _, service := range services {
+		fmt.Println("Mock", service.GetFullyQualifiedName())
+	}
+
+	err = pluginsdk.Serve(ctx, opts, func(s *grpc.Server) {
+		mockplugin.Register(s, services, logCalls(respond))
+	})
+	if err != nil {
+		panic(err)
+	}
+}
+
+// resolveServices fetches the descriptors of the services names from the
+// agent.
+func resolveServices(ctx context.Context, agentAddr string, creds credentials.TransportCredentials, names []string) ([]*desc.ServiceDescriptor, error) {
+	conn, err := transport.Dial(agentAddr, grpc.WithTransportCredentials(creds))
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+
+	return mockplugin.Resolve(ctx, conn, names)
+}
+
+// logCalls prints every call respond answers.
+func logCalls(respond mockplugin.Responder) mockplugin.Responder {
+	return func(ctx context.Context, method *desc.MethodDescriptor, request []byte) ([]byte, error) {
+		response, err := respond(ctx, method, request)
+		fmt.Println(method.GetFullyQualifiedName(), string(request), string(response), err)
+
+		return response, err
+	}
+}
@@ -2,15 +2,21 @@ package main
 
 import (
 	"context"
+	"flag"
 	"fmt"
-	"net"
-	"sync"
+	"io"
+	"os"
+	"os/signal"
+	"strings"
+	"syscall"
 
+	"go.opentelemetry.io/otel/trace"
 	"google.golang.org/grpc"
-	"google.golang.org/grpc/reflection"
 
-	"github.com/rootwarp/snippets/golang/grpc/reflection/proto/agent"
+	"github.com/rootwarp/snippets/golang/grpc/reflection/pluginsdk"
 	"github.com/rootwarp/snippets/golang/grpc/reflection/proto/plugin"
+	"github.com/rootwarp/snippets/golang/grpc/reflection/telemetry"
+	"github.com/rootwarp/snippets/golang/grpc/reflection/tlsconfig"
 )
 
 type helloServer struct {
@@ -18,62 +24,141 @@ type helloServer struct {
 }
 
 func (s *helloServer) Hello(ctx context.Context, in *plugin.HelloRequest) (*plugin.HelloResponse, error) {
-	fmt.Println("Hello", in.Name, in.Age)
+	fmt.Println("Hello", in.Name, in.Age, trace.SpanContextFromContext(ctx).TraceID())
 
 	return &plugin.HelloResponse{
 		GreetingMsg: fmt.Sprintf("Hey %s(%d)", in.Name, in.Age),
 	}, nil
 }
 
-func main() {
-	fmt.Println("Start plugin server")
+func (s *helloServer) HelloFeed(in *plugin.HelloRequest, stream plugin.HelloService_HelloFeedServer) error {
+	fmt.Println("HelloFeed", in.Name, in.Age)
+
+	for i := int32(1); i <= in.Age; i++ {
+		err := stream.Send(&plugin.HelloResponse{
+			GreetingMsg: fmt.Sprintf("Hey %s(%d/%d)", in.Name, i, in.Age),
+		})
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func (s *helloServer) HelloAll(stream plugin.HelloService_HelloAllServer) error {
+	names := []string{}
+	for {
+		in, err := stream.Recv()
+		if err == io.EOF {
+			break
+		}
 
-	wg := sync.WaitGroup{}
-	wg.Add(2)
+		if err != nil {
+			return err
+		}
 
-	go startPluginServer(&wg)
-	go startRegistration(&wg)
+		names = append(names, in.Name)
+	}
+
+	fmt.Println("HelloAll", names)
 
-	wg.Wait()
+	return stream.SendAndClose(&plugin.HelloResponse{
+		GreetingMsg: fmt.Sprintf("Hey %s", strings.Join(names, ", ")),
+	})
 }
 
-func startPluginServer(wg *sync.WaitGroup) {
-	fmt.Println("startPluginServer")
+func (s *helloServer) HelloChat(stream plugin.HelloService_HelloChatServer) error {
+	for {
+		in, err := stream.Recv()
+		if err == io.EOF {
+			return nil
+		}
+
+		if err != nil {
+			return err
+		}
+
+		fmt.Println("HelloChat", in.Name, in.Age)
+
+		err = stream.Send(&plugin.HelloResponse{
+			GreetingMsg: fmt.Sprintf("Hey %s(%d)", in.Name, in.Age),
+		})
+		if err != nil {
+			return err
+		}
+	}
+}
 
-	defer wg.Done()
+func main() {
+	agentAddr := flag.String("agent", "localhost:8080", "address of the agent's registration service, host:port or unix:///path")
+	listenAddr := flag.String("listen", "127.0.0.1:0", "listen address of the plugin, host:port or unix:///path, an ephemeral port by default")
+	advertiseHost := flag.String("advertise-host", "", "host the agent calls the plugin at, the listen host when empty")
+	withReflection := flag.Bool("reflection", true, "serve server reflection")
+	descriptorSetFile := flag.String("descriptor-set", "", "FileDescriptorSet of the plugin's services sent with the registration without reflection, built from the compiled-in descriptors when empty")
+	serviceConfigFile := flag.String("service-config", "", "gRPC service config JSON with timeouts, retries and circuit breakers the agent applies to the plugin's methods")
+
+	tlsCfg := tlsconfig.Config{}
+	tlsCfg.AddFlags(flag.CommandLine, "tls-")
+	traceCfg := telemetry.Config{}
+	traceCfg.AddFlags(flag.CommandLine, "trace-")
+	flag.Parse()
 
-	s := grpc.NewServer()
-	plugin.RegisterHelloServiceServer(s, &helloServer{})
-	reflection.Register(s)
+	fmt.Println("Start plugin server")
 
-	l, err := net.Listen("tcp", "127.0.0.1:9090")
+	serverCreds, err := tlsCfg.ServerCredentials()
 	if err != nil {
 		panic(err)
 	}
 
-	if err := s.Serve(l); err != nil {
+	// The plugin presents the same certificate when it registers.
+	dialCreds, err := tlsCfg.ClientCredentials()
+	if err != nil {
 		panic(err)
 	}
-}
-
-func startRegistration(wg *sync.WaitGroup) {
-	fmt.Println("startRegistration")
-
-	defer wg.Done()
 
-	conn, err := grpc.Dial("localhost:8080", grpc.WithInsecure())
+	tracing, shutdownTracing, err := traceCfg.TracerProvider("hello-plugin")
 	if err != nil {
 		panic(err)
 	}
+	defer shutdownTracing(context.Background())
+
+	var descriptorSet []byte
+	if *descriptorSetFile != "" {
+		descriptorSet, err = os.ReadFile(*descriptorSetFile)
+		if err != nil {
+			panic(err)
+		}
+	}
 
-	cli := agent.NewRegistrationServiceClient(conn)
+	var serviceConfig []byte
+	if *serviceConfigFile != "" {
+		serviceConfig, err = os.ReadFile(*serviceConfigFile)
+		if err != nil {
+			panic(err)
+		}
+	}
 
-	ctx := context.Background()
-	resp, err := cli.RegisterPlugin(ctx, &agent.RegisterRequest{
-		Name:    "snippet.grpc.reflection.HelloService", // TODO:
-		Address: "127.0.0.1",
-		Port:    9090,
-	})
+	opts := pluginsdk.Options{
+		AgentAddress:      *agentAddr,
+		ListenAddress:     *listenAddr,
+		AdvertiseHost:     *advertiseHost,
+		ServerCreds:       serverCreds,
+		DialCreds:         dialCreds,
+		DisableReflection: !*withReflection,
+		DescriptorSet:     descriptorSet,
+		ServiceConfig:     string(serviceConfig),
+		TracerProvider:    tracing,
+	}
+
+	// The plugin deregisters when it is stopped.
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
 
-	fmt.Println(resp, err)
+	err = pluginsdk.Serve(ctx, opts, func(s *grpc.Server) {
+		plugin.RegisterHelloServiceServer(s, &helloServer{})
+	})
+	if err != nil {
+		panic(err)
+	}
 }
@@ -0,0 +1,234 @@
+// Package mockplugin serves gRPC services from their descriptors alone,
+// answering every call with a Responder. It stands in for plugins which do
+// not exist yet, or whose recorded calls are replayed.
+//
+// The descriptors usually come from the agent, which serves the ones of its
+// plugins through server reflection:
+//
+//	services, err := mockplugin.Resolve(ctx, agentConn, []string{"snippet.grpc.reflection.HelloService"})
+//	...
+//	err = pluginsdk.Serve(ctx, opts, func(s *grpc.Server) {
+//		mockplugin.Register(s, services, respond)
+//	})
+//
+// Random and Template are Responders for plugins which exist only as
+// descriptors.
+package mockplugin
+
+import (
+	"context"
+	"io"
+
+	"github.com/jhump/protoreflect/desc"
+	"github.com/jhump/protoreflect/grpcreflect"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/encoding/protojson"
+	"google.golang.org/protobuf/proto"
+	"google.golang.org/protobuf/reflect/protoregistry"
+	"google.golang.org/protobuf/types/descriptorpb"
+	"google.golang.org/protobuf/types/dynamicpb"
+
+	"github.com/rootwarp/snippets/golang/grpc/reflection/protofiles"
+)
+
+// Responder answers a call of method with the protojson request, returning
+// the protojson response. An empty response is an empty message.
+type Responder func(ctx context.Context, method *desc.MethodDescriptor, request []byte) ([]byte, error)
+
+// Register registers services on s, their calls answered by respond. A unary
+// or server streaming method answers its request once, a client streaming
+// one its last request and a bidirectional one every request.
+func Register(s grpc.ServiceRegistrar, services []*desc.ServiceDescriptor, respond Responder) {
+	for _, service := range services {
+		s.RegisterService(newServiceDesc(service, respond), nil)
+	}
+}
+
+func newServiceDesc(service *desc.ServiceDescriptor, respond Responder) *grpc.ServiceDesc {
+	files := &protoregistry.Files{}
+	protofiles.Register(files, service.GetFile())
+	types := dynamicpb.NewTypes(files)
+
+	sd := &grpc.ServiceDesc{
+		ServiceName: service.GetFullyQualifiedName(),
+		HandlerType: (*any)(nil),
+		Metadata:    service.GetFile().GetName(),
+	}
+
+	for _, md := range service.GetMethods() {
+		m := &method{desc: md, types: types, respond: respond}
+
+		if !md.IsClientStreaming() && !md.IsServerStreaming() {
+			sd.Methods = append(sd.Methods, grpc.MethodDesc{
+				MethodName: md.GetName(),
+				Handler:    m.handleUnary,
+			})
+			continue
+		}
+
+		sd.Streams = append(sd.Streams, grpc.StreamDesc{
+			StreamName:    md.GetName(),
+			Handler:       m.handleStream,
+			ClientStreams: md.IsClientStreaming(),
+			ServerStreams: md.IsServerStreaming(),
+		})
+	}
+
+	return sd
+}
+
+// method serves one method of a service.
+type method struct {
+	desc    *desc.MethodDescriptor
+	types   *dynamicpb.Types
+	respond Responder
+}
+
+func (m *method) fullMethod() string {
+	return "/" + m.desc.GetService().GetFullyQualifiedName() + "/" + m.desc.GetName()
+}
+
+func (m *method) newRequest() *dynamicpb.Message {
+	return dynamicpb.NewMessage(m.desc.GetInputType().UnwrapMessage())
+}
+
+// answer returns the response to in.
+func (m *method) answer(ctx context.Context, in *dynamicpb.Message) (*dynamicpb.Message, error) {
+	request, err := protojson.MarshalOptions{Resolver: m.types}.Marshal(in)
+	if err != nil {
+		return nil, status.Error(codes.Internal, err.Error())
+	}
+
+	response, err := m.respond(ctx, m.desc, request)
+	if err != nil {
+		return nil, err
+	}
+
+	out := dynamicpb.NewMessage(m.desc.GetOutputType().UnwrapMessage())
+	if len(response) == 0 {
+		return out, nil
+	}
+
+	if err := (protojson.UnmarshalOptions{Resolver: m.types}).Unmarshal(response, out); err != nil {
+		return nil, status.Errorf(codes.Internal, "invalid response of %s: %v", m.fullMethod(), err)
+	}
+
+	return out, nil
+}
+
+func (m *method) handleUnary(srv any, ctx context.Context, dec func(any) error, interceptor grpc.UnaryServerInterceptor) (any, error) {
+	in := m.newRequest()
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+
+	handler := func(ctx context.Context, req any) (any, error) {
+		return m.answer(ctx, req.(*dynamicpb.Message))
+	}
+
+	if interceptor == nil {
+		return handler(ctx, in)
+	}
+
+	return interceptor(ctx, in, &grpc.UnaryServerInfo{Server: srv, FullMethod: m.fullMethod()}, handler)
+}
+
+func (m *method) handleStream(srv any, stream grpc.ServerStream) error {
+	var last *dynamicpb.Message
+
+	for {
+		in := m.newRequest()
+		err := stream.RecvMsg(in)
+		if err == io.EOF {
+			break
+		}
+
+		if err != nil {
+			return err
+		}
+
+		if !m.desc.IsClientStreaming() || !m.desc.IsServerStreaming() {
+			last = in
+
+			if m.desc.IsClientStreaming() {
+				continue
+			}
+
+			break
+		}
+
+		out, err := m.answer(stream.Context(), in)
+		if err != nil {
+			return err
+		}
+
+		if err := stream.SendMsg(out); err != nil {
+			return err
+		}
+	}
+
+	if m.desc.IsClientStreaming() && m.desc.IsServerStreaming() {
+		return nil
+	}
+
+	if last == nil {
+		return status.Errorf(codes.InvalidArgument, "%s got no request", m.fullMethod())
+	}
+
+	out, err := m.answer(stream.Context(), last)
+	if err != nil {
+		return err
+	}
+
+	return stream.SendMsg(out)
+}
+
+// DescriptorSet returns the serialized FileDescriptorSet of the files
+// defining services and their dependencies, to register the services with
+// the agent without server reflection.
+func DescriptorSet(services []*desc.ServiceDescriptor) ([]byte, error) {
+	set := &descriptorpb.FileDescriptorSet{}
+	seen := map[string]bool{}
+
+	var add func(fd *desc.FileDescriptor)
+	add = func(fd *desc.FileDescriptor) {
+		if seen[fd.GetName()] {
+			return
+		}
+
+		seen[fd.GetName()] = true
+
+		for _, dep := range fd.GetDependencies() {
+			add(dep)
+		}
+
+		set.File = append(set.File, fd.AsFileDescriptorProto())
+	}
+
+	for _, service := range services {
+		add(service.GetFile())
+	}
+
+	return proto.Marshal(set)
+}
+
+// Resolve returns the descriptors of the services names through the server
+// reflection of conn.
+func Resolve(ctx context.Context, conn grpc.ClientConnInterface, names []string) ([]*desc.ServiceDescriptor, error) {
+	cli := grpcreflect.NewClientAuto(ctx, conn)
+	defer cli.Reset()
+
+	services := make([]*desc.ServiceDescriptor, 0, len(names))
+	for _, name := range names {
+		service, err := cli.ResolveService(name)
+		if err != nil {
+			return nil, err
+		}
+
+		services = append(services, service)
+	}
+
+	return services, nil
+}
@@ -0,0 +1,161 @@
+package mockplugin
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"testing"
+
+	"github.com/jhump/protoreflect/desc"
+	"github.com/stretchr/testify/assert"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/reflection"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/proto"
+	"google.golang.org/protobuf/types/descriptorpb"
+
+	"github.com/rootwarp/snippets/golang/grpc/reflection/proto/plugin"
+	"github.com/rootwarp/snippets/golang/grpc/reflection/transport"
+)
+
+// greet answers every request with the method name and the name of the
+// request, a request without name fails.
+func greet(ctx context.Context, method *desc.MethodDescriptor, request []byte) ([]byte, error) {
+	in := struct {
+		Name string `json:"name"`
+	}{}
+
+	if err := json.Unmarshal(request, &in); err != nil {
+		return nil, err
+	}
+
+	if in.Name == "" {
+		return nil, status.Error(codes.InvalidArgument, "no name")
+	}
+
+	return []byte(fmt.Sprintf(`{"greetingMsg": "%s %s"}`, method.GetName(), in.Name)), nil
+}
+
+// serveTestMock serves services answered by respond at the in-process address
+// name and returns a connection to it.
+func serveTestMock(t *testing.T, name string, services []*desc.ServiceDescriptor, respond Responder) *grpc.ClientConn {
+	s := grpc.NewServer()
+	Register(s, services, respond)
+	reflection.Register(s)
+
+	l, err := transport.Listen("inproc://" + name)
+	assert.Nil(t, err)
+
+	go s.Serve(l)
+	t.Cleanup(s.Stop)
+
+	conn, err := transport.Dial("inproc://"+name, grpc.WithTransportCredentials(insecure.NewCredentials()))
+	assert.Nil(t, err)
+	t.Cleanup(func() { conn.Close() })
+
+	return conn
+}
+
+func loadTestService(t *testing.T) *desc.ServiceDescriptor {
+	fd, err := desc.LoadFileDescriptor(plugin.HelloService_ServiceDesc.Metadata.(string))
+	assert.Nil(t, err)
+
+	return fd.FindService(plugin.HelloService_ServiceDesc.ServiceName)
+}
+
+func TestRegister(t *testing.T) {
+	service := loadTestService(t)
+
+	conn := serveTestMock(t, "mock-register", []*desc.ServiceDescriptor{service}, greet)
+	cli := plugin.NewHelloServiceClient(conn)
+
+	ctx := context.Background()
+
+	resp, err := cli.Hello(ctx, &plugin.HelloRequest{Name: "rootwarp"})
+	assert.Nil(t, err)
+	assert.Equal(t, "Hello rootwarp", resp.GreetingMsg)
+
+	_, err = cli.Hello(ctx, &plugin.HelloRequest{})
+	assert.Equal(t, codes.InvalidArgument, status.Code(err))
+
+	// A server stream answers once.
+	feed, err := cli.HelloFeed(ctx, &plugin.HelloRequest{Name: "rootwarp"})
+	assert.Nil(t, err)
+
+	resp, err = feed.Recv()
+	assert.Nil(t, err)
+	assert.Equal(t, "HelloFeed rootwarp", resp.GreetingMsg)
+
+	_, err = feed.Recv()
+	assert.Equal(t, io.EOF, err)
+
+	// A client stream answers the last request.
+	all, err := cli.HelloAll(ctx)
+	assert.Nil(t, err)
+	assert.Nil(t, all.Send(&plugin.HelloRequest{Name: "a"}))
+	assert.Nil(t, all.Send(&plugin.HelloRequest{Name: "b"}))
+
+	resp, err = all.CloseAndRecv()
+	assert.Nil(t, err)
+	assert.Equal(t, "HelloAll b", resp.GreetingMsg)
+
+	// A bidirectional stream answers every request.
+	chat, err := cli.HelloChat(ctx)
+	assert.Nil(t, err)
+
+	for _, name := range []string{"a", "b"} {
+		assert.Nil(t, chat.Send(&plugin.HelloRequest{Name: name}))
+
+		resp, err := chat.Recv()
+		assert.Nil(t, err)
+		assert.Equal(t, "HelloChat "+name, resp.GreetingMsg)
+	}
+
+	assert.Nil(t, chat.CloseSend())
+	_, err = chat.Recv()
+	assert.Equal(t, io.EOF, err)
+
+	// A response which does not fit the output type fails.
+	conn = serveTestMock(t, "mock-invalid", []*desc.ServiceDescriptor{service}, func(ctx context.Context, method *desc.MethodDescriptor, request []byte) ([]byte, error) {
+		return []byte(`{"unknown": 1}`), nil
+	})
+
+	_, err = plugin.NewHelloServiceClient(conn).Hello(ctx, &plugin.HelloRequest{})
+	assert.Equal(t, codes.Internal, status.Code(err))
+}
+
+func TestResolveAndDescriptorSet(t *testing.T) {
+	service := loadTestService(t)
+
+	// The mock serves reflection of the global registry, which knows the
+	// service.
+	conn := serveTestMock(t, "mock-resolve", []*desc.ServiceDescriptor{service}, greet)
+
+	services, err := Resolve(context.Background(), conn, []string{plugin.HelloService_ServiceDesc.ServiceName})
+	assert.Nil(t, err)
+	if assert.Len(t, services, 1) {
+		assert.Len(t, services[0].GetMethods(), 4)
+	}
+
+	_, err = Resolve(context.Background(), conn, []string{"unknown.Service"})
+	assert.NotNil(t, err)
+
+	data, err := DescriptorSet(services)
+	assert.Nil(t, err)
+
+	set := &descriptorpb.FileDescriptorSet{}
+	assert.Nil(t, proto.Unmarshal(data, set))
+
+	files, err := desc.CreateFileDescriptorsFromSet(set)
+	assert.Nil(t, err)
+
+	found := false
+	for _, fd := range files {
+		found = found || fd.FindService(plugin.HelloService_ServiceDesc.ServiceName) != nil
+	}
+
+	assert.True(t, found)
+}
@@ -0,0 +1,150 @@
+package mockplugin
+
+import (
+	"context"
+	"math/rand"
+	"sync"
+
+	"github.com/jhump/protoreflect/desc"
+	"google.golang.org/protobuf/encoding/protojson"
+	"google.golang.org/protobuf/reflect/protoreflect"
+	"google.golang.org/protobuf/types/dynamicpb"
+)
+
+// maxRandomDepth is how deep Random nests messages. Deeper message fields are
+// left unset, unless they are required.
+const maxRandomDepth = 3
+
+// Random answers every call with a random response valid for the output
+// type of the method. The responses of a seed are the same from run to run.
+func Random(seed int64) Responder {
+	var mu sync.Mutex
+	rnd := rand.New(rand.NewSource(seed))
+
+	return func(ctx context.Context, method *desc.MethodDescriptor, request []byte) ([]byte, error) {
+		out := dynamicpb.NewMessage(method.GetOutputType().UnwrapMessage())
+
+		mu.Lock()
+		fillRandom(rnd, out, 0)
+		mu.Unlock()
+
+		return protojson.Marshal(out)
+	}
+}
+
+// fillRandom sets the fields of m, which is nested depth messages deep, to
+// random values. Every oneof gets one of its fields set.
+func fillRandom(rnd *rand.Rand, m protoreflect.Message, depth int) {
+	// An Any needs a resolvable type, an empty one is valid.
+	if m.Descriptor().FullName() == "google.protobuf.Any" {
+		return
+	}
+
+	fields := m.Descriptor().Fields()
+	for i := 0; i < fields.Len(); i++ {
+		fd := fields.Get(i)
+
+		if oneof := fd.ContainingOneof(); oneof != nil && !oneof.IsSynthetic() {
+			continue
+		}
+
+		if isMessage(fd) && depth >= maxRandomDepth && fd.Cardinality() != protoreflect.Required {
+			continue
+		}
+
+		setRandom(rnd, m, fd, depth)
+	}
+
+	oneofs := m.Descriptor().Oneofs()
+	for i := 0; i < oneofs.Len(); i++ {
+		oneof := oneofs.Get(i)
+		if oneof.IsSynthetic() {
+			continue
+		}
+
+		fd := oneof.Fields().Get(rnd.Intn(oneof.Fields().Len()))
+		if isMessage(fd) && depth >= maxRandomDepth {
+			// The field is set to an empty message.
+			m.Set(fd, protoreflect.ValueOfMessage(m.NewField(fd).Message()))
+			continue
+		}
+
+		setRandom(rnd, m, fd, depth)
+	}
+}
+
+// setRandom sets the field fd of m to a random value, one to three elements
+// for a list or a map.
+func setRandom(rnd *rand.Rand, m protoreflect.Message, fd protoreflect.FieldDescriptor, depth int) {
+	switch {
+	case fd.IsList():
+		list := m.Mutable(fd).List()
+		for n := 1 + rnd.Intn(3); n > 0; n-- {
+			list.Append(randomValue(rnd, fd, list.NewElement(), depth))
+		}
+	case fd.IsMap():
+		mp := m.Mutable(fd).Map()
+		for n := 1 + rnd.Intn(3); n > 0; n-- {
+			key := randomScalar(rnd, fd.MapKey()).MapKey()
+			mp.Set(key, randomValue(rnd, fd.MapValue(), mp.NewValue(), depth))
+		}
+	default:
+		m.Set(fd, randomValue(rnd, fd, m.NewField(fd), depth))
+	}
+}
+
+// randomValue returns a random value of fd, filling empty when fd is a
+// message.
+func randomValue(rnd *rand.Rand, fd protoreflect.FieldDescriptor, empty protoreflect.Value, depth int) protoreflect.Value {
+	if !isMessage(fd) {
+		return randomScalar(rnd, fd)
+	}
+
+	fillRandom(rnd, empty.Message(), depth+1)
+
+	return empty
+}
+
+func isMessage(fd protoreflect.FieldDescriptor) bool {
+	return fd.Kind() == protoreflect.MessageKind || fd.Kind() == protoreflect.GroupKind
+}
+
+// randomScalar returns a random value of the scalar field fd. Numbers are
+// small and positive, which keeps them valid for the well-known types too.
+func randomScalar(rnd *rand.Rand, fd protoreflect.FieldDescriptor) protoreflect.Value {
+	switch fd.Kind() {
+	case protoreflect.BoolKind:
+		return protoreflect.ValueOfBool(rnd.Intn(2) == 1)
+	case protoreflect.EnumKind:
+		values := fd.Enum().Values()
+		return protoreflect.ValueOfEnum(values.Get(rnd.Intn(values.Len())).Number())
+	case protoreflect.Int32Kind, protoreflect.Sint32Kind, protoreflect.Sfixed32Kind:
+		return protoreflect.ValueOfInt32(rnd.Int31n(1000))
+	case protoreflect.Uint32Kind, protoreflect.Fixed32Kind:
+		return protoreflect.ValueOfUint32(uint32(rnd.Int31n(1000)))
+	case protoreflect.Int64Kind, protoreflect.Sint64Kind, protoreflect.Sfixed64Kind:
+		return protoreflect.ValueOfInt64(rnd.Int63n(1000))
+	case protoreflect.Uint64Kind, protoreflect.Fixed64Kind:
+		return protoreflect.ValueOfUint64(uint64(rnd.Int63n(1000)))
+	case protoreflect.FloatKind:
+		return protoreflect.ValueOfFloat32(float32(rnd.Intn(100000)) / 100)
+	case protoreflect.DoubleKind:
+		return protoreflect.ValueOfFloat64(float64(rnd.Intn(100000)) / 100)
+	case protoreflect.BytesKind:
+		b := make([]byte, 1+rnd.Intn(8))
+		rnd.Read(b)
+		return protoreflect.ValueOfBytes(b)
+	default:
+		return protoreflect.ValueOfString(randomWord(rnd))
+	}
+}
+
+// randomWord returns a lowercase word of up to eight letters.
+func randomWord(rnd *rand.Rand) string {
+	b := make([]byte, 1+rnd.Intn(8))
+	for i := range b {
+		b[i] = byte('a' + rnd.Intn(26))
+	}
+
+	return string(b)
+}
@@ -0,0 +1,69 @@
+package mockplugin
+
+import (
+	"context"
+	"math/rand"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"google.golang.org/protobuf/encoding/protojson"
+	"google.golang.org/protobuf/proto"
+	"google.golang.org/protobuf/reflect/protoreflect"
+	"google.golang.org/protobuf/types/descriptorpb"
+	"google.golang.org/protobuf/types/dynamicpb"
+	"google.golang.org/protobuf/types/known/anypb"
+	"google.golang.org/protobuf/types/known/durationpb"
+	"google.golang.org/protobuf/types/known/fieldmaskpb"
+	"google.golang.org/protobuf/types/known/structpb"
+	"google.golang.org/protobuf/types/known/timestamppb"
+
+	"github.com/rootwarp/snippets/golang/grpc/reflection/proto/plugin"
+)
+
+func TestRandom(t *testing.T) {
+	method := loadTestService(t).FindMethodByName("Hello")
+
+	first, err := Random(1)(context.Background(), method, []byte(`{}`))
+	assert.Nil(t, err)
+
+	resp := &plugin.HelloResponse{}
+	assert.Nil(t, protojson.Unmarshal(first, resp))
+	assert.NotEmpty(t, resp.GreetingMsg)
+
+	// The same seed gives the same responses.
+	again, err := Random(1)(context.Background(), method, []byte(`{}`))
+	assert.Nil(t, err)
+	assert.Equal(t, first, again)
+}
+
+func TestFillRandom(t *testing.T) {
+	types := []protoreflect.MessageDescriptor{
+		(&plugin.HelloRequest{}).ProtoReflect().Descriptor(),
+		// Nested, recursive and repeated messages, enums, oneofs and
+		// required fields.
+		(&descriptorpb.FileDescriptorSet{}).ProtoReflect().Descriptor(),
+		(&descriptorpb.UninterpretedOption{}).ProtoReflect().Descriptor(),
+		(&anypb.Any{}).ProtoReflect().Descriptor(),
+		(&durationpb.Duration{}).ProtoReflect().Descriptor(),
+		(&fieldmaskpb.FieldMask{}).ProtoReflect().Descriptor(),
+		(&structpb.Struct{}).ProtoReflect().Descriptor(),
+		(&structpb.Value{}).ProtoReflect().Descriptor(),
+		(&timestamppb.Timestamp{}).ProtoReflect().Descriptor(),
+	}
+
+	rnd := rand.New(rand.NewSource(1))
+
+	for _, md := range types {
+		for i := 0; i < 20; i++ {
+			m := dynamicpb.NewMessage(md)
+			fillRandom(rnd, m, 0)
+
+			// The message is complete and renders as valid protojson.
+			assert.Nil(t, proto.CheckInitialized(m), md.FullName())
+
+			data, err := protojson.Marshal(m)
+			assert.Nil(t, err, md.FullName())
+			assert.Nil(t, protojson.Unmarshal(data, dynamicpb.NewMessage(md)), md.FullName())
+		}
+	}
+}
@@ -0,0 +1,120 @@
+package mockplugin
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"sort"
+
+	"github.com/jhump/protoreflect/desc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/encoding/protojson"
+	"google.golang.org/protobuf/proto"
+	"google.golang.org/protobuf/reflect/protoregistry"
+	"google.golang.org/protobuf/types/descriptorpb"
+	"google.golang.org/protobuf/types/dynamicpb"
+
+	"github.com/rootwarp/snippets/golang/grpc/reflection/protofiles"
+)
+
+// Template answers the methods of services with the responses of data, a
+// JSON object of protojson responses by <service>/<method>:
+//
+//	{
+//	  "snippet.grpc.reflection.HelloService/Hello": {"greetingMsg": "Hey"}
+//	}
+//
+// Every response must fit the output type of its method. The methods without
+// a response are answered by fallback, or are unimplemented when fallback is
+// nil.
+func Template(services []*desc.ServiceDescriptor, data []byte, fallback Responder) (Responder, error) {
+	template := map[string]json.RawMessage{}
+	if err := json.Unmarshal(data, &template); err != nil {
+		return nil, fmt.Errorf("invalid template: %w", err)
+	}
+
+	methods := map[string]*desc.MethodDescriptor{}
+	for _, service := range services {
+		for _, md := range service.GetMethods() {
+			methods[service.GetFullyQualifiedName()+"/"+md.GetName()] = md
+		}
+	}
+
+	files := &protoregistry.Files{}
+	for _, service := range services {
+		protofiles.Register(files, service.GetFile())
+	}
+
+	unmarshal := protojson.UnmarshalOptions{Resolver: dynamicpb.NewTypes(files)}
+
+	responses := map[string][]byte{}
+	for key, response := range template {
+		md, ok := methods[key]
+		if !ok {
+			return nil, fmt.Errorf("invalid template: unknown method %q", key)
+		}
+
+		out := dynamicpb.NewMessage(md.GetOutputType().UnwrapMessage())
+		if err := unmarshal.Unmarshal(response, out); err != nil {
+			return nil, fmt.Errorf("invalid template: response of %s: %w", key, err)
+		}
+
+		responses[key] = response
+	}
+
+	return func(ctx context.Context, method *desc.MethodDescriptor, request []byte) ([]byte, error) {
+		key := method.GetService().GetFullyQualifiedName() + "/" + method.GetName()
+		if response, ok := responses[key]; ok {
+			return response, nil
+		}
+
+		if fallback == nil {
+			return nil, status.Errorf(codes.Unimplemented, "no response to %s in the template", key)
+		}
+
+		return fallback(ctx, method, request)
+	}, nil
+}
+
+// ServicesFromSet returns the services names of the serialized
+// FileDescriptorSet data, which holds their files and all of their imports.
+// Every service of data is returned when names is empty.
+func ServicesFromSet(data []byte, names []string) ([]*desc.ServiceDescriptor, error) {
+	set := &descriptorpb.FileDescriptorSet{}
+	if err := proto.Unmarshal(data, set); err != nil {
+		return nil, fmt.Errorf("invalid descriptor set: %w", err)
+	}
+
+	files, err := desc.CreateFileDescriptorsFromSet(set)
+	if err != nil {
+		return nil, fmt.Errorf("invalid descriptor set: %w", err)
+	}
+
+	byName := map[string]*desc.ServiceDescriptor{}
+	for _, fd := range files {
+		for _, service := range fd.GetServices() {
+			byName[service.GetFullyQualifiedName()] = service
+		}
+	}
+
+	if len(names) == 0 {
+		for name := range byName {
+			names = append(names, name)
+		}
+
+		sort.Strings(names)
+	}
+
+	services := make([]*desc.ServiceDescriptor, 0, len(names))
+	for _, name := range names {
+		service, ok := byName[name]
+		if !ok {
+			return nil, fmt.Errorf("service %s is not in the descriptor set", name)
+		}
+
+		services = append(services, service)
+	}
+
+	return services, nil
+}
@@ -0,0 +1,84 @@
+package mockplugin
+
+import (
+	"context"
+	"testing"
+
+	"github.com/jhump/protoreflect/desc"
+	"github.com/stretchr/testify/assert"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+
+	"github.com/rootwarp/snippets/golang/grpc/reflection/proto/plugin"
+)
+
+func TestTemplate(t *testing.T) {
+	service := loadTestService(t)
+	services := []*desc.ServiceDescriptor{service}
+
+	data := []byte(`{
+		"snippet.grpc.reflection.HelloService/Hello": {"greetingMsg": "Hey"},
+		"snippet.grpc.reflection.HelloService/HelloChat": {}
+	}`)
+
+	ctx := context.Background()
+
+	respond, err := Template(services, data, nil)
+	assert.Nil(t, err)
+
+	resp, err := respond(ctx, service.FindMethodByName("Hello"), []byte(`{}`))
+	assert.Nil(t, err)
+	assert.JSONEq(t, `{"greetingMsg": "Hey"}`, string(resp))
+
+	_, err = respond(ctx, service.FindMethodByName("HelloFeed"), []byte(`{}`))
+	assert.Equal(t, codes.Unimplemented, status.Code(err))
+
+	// The methods missing from the template fall back.
+	respond, err = Template(services, data, greet)
+	assert.Nil(t, err)
+
+	resp, err = respond(ctx, service.FindMethodByName("HelloFeed"), []byte(`{"name": "a"}`))
+	assert.Nil(t, err)
+	assert.JSONEq(t, `{"greetingMsg": "HelloFeed a"}`, string(resp))
+
+	// The served responses are the template's.
+	conn := serveTestMock(t, "mock-template", services, respond)
+
+	hello, err := plugin.NewHelloServiceClient(conn).Hello(ctx, &plugin.HelloRequest{})
+	assert.Nil(t, err)
+	assert.Equal(t, "Hey", hello.GreetingMsg)
+
+	invalid := []string{
+		`[]`,
+		`{"snippet.grpc.reflection.HelloService/Unknown": {}}`,
+		`{"unknown.Service/Hello": {}}`,
+		`{"snippet.grpc.reflection.HelloService/Hello": {"name": "a"}}`,
+		`{"snippet.grpc.reflection.HelloService/Hello": {"greetingMsg": 1}}`,
+	}
+
+	for _, data := range invalid {
+		_, err := Template(services, []byte(data), nil)
+		assert.ErrorContains(t, err, "invalid template", data)
+	}
+}
+
+func TestServicesFromSet(t *testing.T) {
+	data, err := DescriptorSet([]*desc.ServiceDescriptor{loadTestService(t)})
+	assert.Nil(t, err)
+
+	services, err := ServicesFromSet(data, nil)
+	assert.Nil(t, err)
+	if assert.Len(t, services, 1) {
+		assert.Equal(t, plugin.HelloService_ServiceDesc.ServiceName, services[0].GetFullyQualifiedName())
+	}
+
+	services, err = ServicesFromSet(data, []string{plugin.HelloService_ServiceDesc.ServiceName})
+	assert.Nil(t, err)
+	assert.Len(t, services, 1)
+
+	_, err = ServicesFromSet(data, []string{"unknown.Service"})
+	assert.NotNil(t, err)
+
+	_, err = ServicesFromSet([]byte("invalid"), nil)
+	assert.NotNil(t, err)
+}
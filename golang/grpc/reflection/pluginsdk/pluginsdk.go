@@ -0,0 +1,442 @@
+// Package pluginsdk serves a plugin and keeps it registered with the agent.
+//
+// A plugin registers its services on the server Serve creates and leaves the
+// rest to Serve:
+//
+//	err := pluginsdk.Serve(ctx, pluginsdk.Options{}, func(s *grpc.Server) {
+//		plugin.RegisterHelloServiceServer(s, &helloServer{})
+//	})
+package pluginsdk
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"sort"
+	"sync"
+	"time"
+
+	"go.opentelemetry.io/otel/trace"
+	"go.opentelemetry.io/otel/trace/noop"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/health"
+	"google.golang.org/grpc/health/grpc_health_v1"
+	"google.golang.org/grpc/reflection"
+	"google.golang.org/grpc/reflection/grpc_reflection_v1"
+	"google.golang.org/grpc/reflection/grpc_reflection_v1alpha"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/proto"
+	"google.golang.org/protobuf/reflect/protodesc"
+	"google.golang.org/protobuf/reflect/protoreflect"
+	"google.golang.org/protobuf/reflect/protoregistry"
+	"google.golang.org/protobuf/types/descriptorpb"
+
+	"github.com/rootwarp/snippets/golang/grpc/reflection/proto/agent"
+	"github.com/rootwarp/snippets/golang/grpc/reflection/telemetry"
+	"github.com/rootwarp/snippets/golang/grpc/reflection/transport"
+)
+
+// Options configure Serve. The zero value serves on an ephemeral port of the
+// loopback interface and registers with an agent on localhost:8080.
+type Options struct {
+	// Name is the plugin's name at the agent, the first of its service names
+	// by default.
+	Name string
+
+	// AgentAddress is the address of the agent's registration service.
+	AgentAddress string
+
+	// ListenAddress is where the plugin listens, 127.0.0.1:0 by default.
+	// Both addresses may be Unix domain socket or in-process addresses of
+	// the transport package as well.
+	ListenAddress string
+
+	// AdvertiseHost is the host the agent calls a TCP listener at, the host
+	// of the listener by default.
+	AdvertiseHost string
+
+	// ServerCreds secure the plugin's server and DialCreds the connection
+	// to the agent, both are insecure when nil.
+	ServerCreds credentials.TransportCredentials
+	DialCreds   credentials.TransportCredentials
+
+	// DisableReflection leaves server reflection out. The plugin registers
+	// with DescriptorSet then, which is built from the descriptors of its
+	// services when empty.
+	DisableReflection bool
+	DescriptorSet     []byte
+
+	// ServiceConfig is the gRPC service config JSON the agent applies to
+	// calls of the plugin's methods.
+	ServiceConfig string
+
+	// TracerProvider traces the calls the plugin takes, nothing is traced
+	// when it is nil.
+	TracerProvider trace.TracerProvider
+
+	// RetryInterval is the initial delay between registration attempts, it
+	// doubles up to a minute. One second by default.
+	RetryInterval time.Duration
+
+	// ServerOptions are passed on to the plugin's grpc.Server.
+	ServerOptions []grpc.ServerOption
+
+	// Ready, if set, is called with the listener's address once the plugin
+	// serves.
+	Ready func(net.Addr)
+}
+
+const (
+	defaultAgentAddress  = "localhost:8080"
+	defaultListenAddress = "127.0.0.1:0"
+	maxRetryInterval     = time.Minute
+	deregisterTimeout    = 5 * time.Second
+)
+
+// Serve serves the services registerFn registers on a new grpc.Server along
+// with server reflection and health, and registers them with the agent,
+// retrying until the agent is up. The registration is renewed by heartbeats
+// while ctx lasts. Once ctx ends Serve deregisters the plugin, stops the
+// server and returns nil.
+//
+// A registration the agent rejects for good, like an invalid service config,
+// ends Serve with its error.
+func Serve(ctx context.Context, opts Options, registerFn func(*grpc.Server)) error {
+	opts.setDefaults()
+
+	serverOpts := append(telemetry.ServerOptions(opts.TracerProvider), grpc.Creds(opts.ServerCreds))
+	s := grpc.NewServer(append(serverOpts, opts.ServerOptions...)...)
+	registerFn(s)
+
+	services := serviceNames(s)
+	if len(services) == 0 {
+		return errors.New("no service is registered")
+	}
+
+	if !opts.DisableReflection {
+		reflection.Register(s)
+	}
+
+	healthServer := health.NewServer()
+	for _, serviceName := range services {
+		healthServer.SetServingStatus(serviceName, grpc_health_v1.HealthCheckResponse_SERVING)
+	}
+	grpc_health_v1.RegisterHealthServer(s, healthServer)
+
+	req, err := opts.registerRequest(services)
+	if err != nil {
+		return err
+	}
+
+	l, err := transport.Listen(opts.ListenAddress)
+	if err != nil {
+		return err
+	}
+
+	host, port, err := advertisedAddress(l.Addr(), opts.AdvertiseHost)
+	if err != nil {
+		l.Close()
+		return err
+	}
+
+	req.Address, req.Port = host, port
+
+	serveErr := make(chan error, 1)
+	go func() {
+		serveErr <- s.Serve(l)
+	}()
+
+	fmt.Println("Serve plugin", req.Name, l.Addr())
+	if opts.Ready != nil {
+		opts.Ready(l.Addr())
+	}
+
+	conn, err := transport.Dial(opts.AgentAddress, grpc.WithTransportCredentials(opts.DialCreds))
+	if err != nil {
+		s.Stop()
+		return err
+	}
+	defer conn.Close()
+
+	r := &registrar{
+		cli:           agent.NewRegistrationServiceClient(conn),
+		req:           req,
+		retryInterval: opts.RetryInterval,
+		done:          make(chan struct{}),
+	}
+
+	regCtx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	regErr := make(chan error, 1)
+	go func() {
+		regErr <- r.run(regCtx)
+	}()
+
+	select {
+	case err = <-serveErr:
+	case err = <-regErr:
+	case <-ctx.Done():
+	}
+
+	cancel()
+	if r.registered() {
+		r.deregister()
+	}
+
+	healthServer.Shutdown()
+	s.GracefulStop()
+
+	return err
+}
+
+func (opts *Options) setDefaults() {
+	if opts.AgentAddress == "" {
+		opts.AgentAddress = defaultAgentAddress
+	}
+
+	if opts.ListenAddress == "" {
+		opts.ListenAddress = defaultListenAddress
+	}
+
+	if opts.ServerCreds == nil {
+		opts.ServerCreds = insecure.NewCredentials()
+	}
+
+	if opts.DialCreds == nil {
+		opts.DialCreds = insecure.NewCredentials()
+	}
+
+	if opts.TracerProvider == nil {
+		opts.TracerProvider = noop.NewTracerProvider()
+	}
+
+	if opts.RetryInterval <= 0 {
+		opts.RetryInterval = time.Second
+	}
+}
+
+func (opts *Options) registerRequest(services []string) (*agent.RegisterRequest, error) {
+	req := &agent.RegisterRequest{
+		Name:            opts.Name,
+		AllowedServices: services,
+		ServiceConfig:   opts.ServiceConfig,
+	}
+
+	if req.Name == "" {
+		req.Name = services[0]
+	}
+
+	if opts.DisableReflection {
+		req.DescriptorSet = opts.DescriptorSet
+		if len(req.DescriptorSet) == 0 {
+			data, err := descriptorSet(services)
+			if err != nil {
+				return nil, err
+			}
+
+			req.DescriptorSet = data
+		}
+	}
+
+	return req, nil
+}
+
+// serviceNames returns the sorted names of the services registered on s.
+func serviceNames(s *grpc.Server) []string {
+	names := []string{}
+	for name := range s.GetServiceInfo() {
+		switch name {
+		case grpc_reflection_v1.ServerReflection_ServiceDesc.ServiceName,
+			grpc_reflection_v1alpha.ServerReflection_ServiceDesc.ServiceName,
+			grpc_health_v1.Health_ServiceDesc.ServiceName:
+			continue
+		}
+
+		names = append(names, name)
+	}
+
+	sort.Strings(names)
+	return names
+}
+
+// descriptorSet returns the serialized FileDescriptorSet of the files
+// defining services and their dependencies, found in the global registry.
+func descriptorSet(services []string) ([]byte, error) {
+	set := &descriptorpb.FileDescriptorSet{}
+	seen := map[string]bool{}
+
+	var add func(fd protoreflect.FileDescriptor)
+	add = func(fd protoreflect.FileDescriptor) {
+		if seen[fd.Path()] {
+			return
+		}
+
+		seen[fd.Path()] = true
+
+		imports := fd.Imports()
+		for i := 0; i < imports.Len(); i++ {
+			add(imports.Get(i).FileDescriptor)
+		}
+
+		set.File = append(set.File, protodesc.ToFileDescriptorProto(fd))
+	}
+
+	for _, serviceName := range services {
+		d, err := protoregistry.GlobalFiles.FindDescriptorByName(protoreflect.FullName(serviceName))
+		if err != nil {
+			return nil, fmt.Errorf("cannot find descriptor of %s: %w", serviceName, err)
+		}
+
+		add(d.ParentFile())
+	}
+
+	return proto.Marshal(set)
+}
+
+// advertisedAddress returns the host and port the agent reaches the listener
+// at addr. The host of a listener other than TCP is its whole address.
+func advertisedAddress(addr net.Addr, advertiseHost string) (string, int32, error) {
+	if addr.Network() != "tcp" {
+		return transport.Address(addr), 0, nil
+	}
+
+	host, port, err := transport.SplitTarget(addr.String())
+	if err != nil {
+		return "", 0, err
+	}
+
+	if advertiseHost != "" {
+		host = advertiseHost
+	}
+
+	return host, int32(port), nil
+}
+
+// registrar keeps the plugin registered with the agent.
+type registrar struct {
+	cli           agent.RegistrationServiceClient
+	req           *agent.RegisterRequest
+	retryInterval time.Duration
+
+	lease time.Duration
+	// done is closed once the first registration succeeded.
+	done chan struct{}
+	once sync.Once
+}
+
+func (r *registrar) registered() bool {
+	select {
+	case <-r.done:
+		return true
+	default:
+		return false
+	}
+}
+
+// run registers the plugin and sends heartbeats until ctx ends. It returns
+// the error of a registration the agent rejected for good, nil otherwise.
+func (r *registrar) run(ctx context.Context) error {
+	if err := r.register(ctx); err != nil || ctx.Err() != nil {
+		return err
+	}
+
+	if r.lease == 0 {
+		// The registration never expires.
+		<-ctx.Done()
+		return nil
+	}
+
+	// Renew the lease well before it ends, register again if the agent
+	// forgot about us.
+	ticker := time.NewTicker(r.lease / 3)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-ticker.C:
+		}
+
+		_, err := r.cli.Heartbeat(ctx, &agent.HeartbeatRequest{
+			Name:    r.req.Name,
+			Address: r.req.Address,
+			Port:    r.req.Port,
+		})
+		if status.Code(err) == codes.NotFound {
+			if err := r.register(ctx); err != nil {
+				return err
+			}
+		} else if err != nil && ctx.Err() == nil {
+			fmt.Println("Heartbeat", err)
+		}
+	}
+}
+
+// register registers the plugin, retrying with backoff while the agent is
+// unreachable or fails.
+func (r *registrar) register(ctx context.Context) error {
+	interval := r.retryInterval
+	for {
+		resp, err := r.cli.RegisterPlugin(ctx, r.req)
+		if err == nil {
+			fmt.Println("Registered", r.req.Name, resp.Services)
+			r.lease = time.Duration(resp.LeaseSeconds) * time.Second
+			r.once.Do(func() { close(r.done) })
+			return nil
+		}
+
+		if ctx.Err() != nil {
+			return nil
+		}
+
+		if isPermanent(err) {
+			return err
+		}
+
+		fmt.Println("Register", err, "retry in", interval)
+
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-time.After(interval):
+		}
+
+		interval *= 2
+		if interval > maxRetryInterval {
+			interval = maxRetryInterval
+		}
+	}
+}
+
+// deregister removes the instance from the agent, independently of the
+// context Serve ran with.
+func (r *registrar) deregister() {
+	ctx, cancel := context.WithTimeout(context.Background(), deregisterTimeout)
+	defer cancel()
+
+	_, err := r.cli.DeregisterPlugin(ctx, &agent.DeregisterRequest{
+		Name:    r.req.Name,
+		Address: r.req.Address,
+		Port:    r.req.Port,
+	})
+	if err != nil {
+		fmt.Println("Deregister", err)
+	}
+}
+
+// isPermanent reports whether the agent rejected a registration in a way
+// retrying does not fix.
+func isPermanent(err error) bool {
+	switch status.Code(err) {
+	case codes.InvalidArgument, codes.FailedPrecondition, codes.PermissionDenied, codes.Unauthenticated:
+		return true
+	}
+
+	return false
+}
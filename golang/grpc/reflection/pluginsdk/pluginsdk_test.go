@@ -0,0 +1,214 @@
+package pluginsdk
+
+import (
+	"context"
+	"net"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/health/grpc_health_v1"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/proto"
+	"google.golang.org/protobuf/types/descriptorpb"
+
+	"github.com/rootwarp/snippets/golang/grpc/reflection/proto/agent"
+	"github.com/rootwarp/snippets/golang/grpc/reflection/proto/plugin"
+)
+
+// testAgent records the calls of plugins. The first heartbeat is answered
+// with NotFound, as if the agent had forgotten the plugin.
+type testAgent struct {
+	agent.UnimplementedRegistrationServiceServer
+
+	registerErr error
+
+	mu           sync.Mutex
+	registered   []*agent.RegisterRequest
+	heartbeats   int
+	deregistered []*agent.DeregisterRequest
+}
+
+func (a *testAgent) RegisterPlugin(ctx context.Context, in *agent.RegisterRequest) (*agent.RegisterResponse, error) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	if a.registerErr != nil {
+		return nil, a.registerErr
+	}
+
+	a.registered = append(a.registered, in)
+	return &agent.RegisterResponse{LeaseSeconds: 1, Services: in.AllowedServices}, nil
+}
+
+func (a *testAgent) Heartbeat(ctx context.Context, in *agent.HeartbeatRequest) (*agent.HeartbeatResponse, error) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	a.heartbeats++
+	if a.heartbeats == 1 {
+		return nil, status.Error(codes.NotFound, "unknown plugin")
+	}
+
+	return &agent.HeartbeatResponse{LeaseSeconds: 1}, nil
+}
+
+func (a *testAgent) DeregisterPlugin(ctx context.Context, in *agent.DeregisterRequest) (*agent.DeregisterResponse, error) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	a.deregistered = append(a.deregistered, in)
+	return &agent.DeregisterResponse{}, nil
+}
+
+func (a *testAgent) calls() (int, int, int) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	return len(a.registered), a.heartbeats, len(a.deregistered)
+}
+
+func startTestAgent(t *testing.T, address string, a *testAgent) {
+	s := grpc.NewServer()
+	agent.RegisterRegistrationServiceServer(s, a)
+
+	l, err := net.Listen("tcp", address)
+	assert.Nil(t, err)
+
+	go s.Serve(l)
+	t.Cleanup(s.Stop)
+}
+
+// freeAddress returns an address nothing listens on yet.
+func freeAddress(t *testing.T) string {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.Nil(t, err)
+	defer l.Close()
+
+	return l.Addr().String()
+}
+
+func registerHello(s *grpc.Server) {
+	plugin.RegisterHelloServiceServer(s, &plugin.UnimplementedHelloServiceServer{})
+}
+
+func TestServe(t *testing.T) {
+	agentAddress := freeAddress(t)
+	serviceName := "snippet.grpc.reflection.HelloService"
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	ready := make(chan net.Addr, 1)
+	opts := Options{
+		AgentAddress:  agentAddress,
+		RetryInterval: 10 * time.Millisecond,
+		Ready:         func(addr net.Addr) { ready <- addr },
+	}
+
+	served := make(chan error, 1)
+	go func() {
+		served <- Serve(ctx, opts, registerHello)
+	}()
+
+	addr := (<-ready).(*net.TCPAddr)
+
+	// The plugin serves health before the agent is up.
+	conn, err := grpc.Dial(addr.String(), grpc.WithTransportCredentials(insecure.NewCredentials()))
+	assert.Nil(t, err)
+	defer conn.Close()
+
+	resp, err := grpc_health_v1.NewHealthClient(conn).Check(ctx, &grpc_health_v1.HealthCheckRequest{Service: serviceName})
+	assert.Nil(t, err)
+	assert.Equal(t, grpc_health_v1.HealthCheckResponse_SERVING, resp.Status)
+
+	time.Sleep(50 * time.Millisecond)
+
+	a := &testAgent{}
+	startTestAgent(t, agentAddress, a)
+
+	// Registered, then registered again after the agent forgot the plugin.
+	assert.Eventually(t, func() bool {
+		registered, heartbeats, _ := a.calls()
+		return registered == 2 && heartbeats >= 2
+	}, 5*time.Second, 10*time.Millisecond)
+
+	a.mu.Lock()
+	req := a.registered[0]
+	a.mu.Unlock()
+
+	assert.Equal(t, serviceName, req.Name)
+	assert.Equal(t, []string{serviceName}, req.AllowedServices)
+	assert.Equal(t, "127.0.0.1", req.Address)
+	assert.Equal(t, int32(addr.Port), req.Port)
+	assert.Empty(t, req.DescriptorSet)
+
+	cancel()
+	assert.Nil(t, <-served)
+
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	assert.Len(t, a.deregistered, 1)
+	assert.Equal(t, serviceName, a.deregistered[0].Name)
+	assert.Equal(t, int32(addr.Port), a.deregistered[0].Port)
+}
+
+func TestServeWithoutReflection(t *testing.T) {
+	agentAddress := freeAddress(t)
+	a := &testAgent{}
+	startTestAgent(t, agentAddress, a)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	opts := Options{
+		Name:              "hello",
+		AgentAddress:      agentAddress,
+		DisableReflection: true,
+	}
+
+	served := make(chan error, 1)
+	go func() {
+		served <- Serve(ctx, opts, registerHello)
+	}()
+
+	assert.Eventually(t, func() bool {
+		registered, _, _ := a.calls()
+		return registered == 1
+	}, 5*time.Second, 10*time.Millisecond)
+
+	a.mu.Lock()
+	req := a.registered[0]
+	a.mu.Unlock()
+
+	assert.Equal(t, "hello", req.Name)
+
+	set := &descriptorpb.FileDescriptorSet{}
+	assert.Nil(t, proto.Unmarshal(req.DescriptorSet, set))
+	assert.Len(t, set.File, 1)
+	assert.Equal(t, "plugin/hello_service.proto", set.File[0].GetName())
+
+	cancel()
+	assert.Nil(t, <-served)
+}
+
+func TestServeRejected(t *testing.T) {
+	agentAddress := freeAddress(t)
+	startTestAgent(t, agentAddress, &testAgent{registerErr: status.Error(codes.InvalidArgument, "invalid service config")})
+
+	opts := Options{
+		AgentAddress:  agentAddress,
+		ServiceConfig: "{",
+	}
+
+	err := Serve(context.Background(), opts, registerHello)
+	assert.Equal(t, codes.InvalidArgument, status.Code(err))
+
+	err = Serve(context.Background(), opts, func(*grpc.Server) {})
+	assert.NotNil(t, err)
+}
@@ -19,7 +19,13 @@ import (
 const _ = grpc.SupportPackageIsVersion7
 
 const (
-	RegistrationService_RegisterPlugin_FullMethodName = "/snippet.grpc.reflection.RegistrationService/RegisterPlugin"
+	RegistrationService_RegisterPlugin_FullMethodName   = "/snippet.grpc.reflection.RegistrationService/RegisterPlugin"
+	RegistrationService_DeregisterPlugin_FullMethodName = "/snippet.grpc.reflection.RegistrationService/DeregisterPlugin"
+	RegistrationService_Heartbeat_FullMethodName        = "/snippet.grpc.reflection.RegistrationService/Heartbeat"
+	RegistrationService_ListPlugins_FullMethodName      = "/snippet.grpc.reflection.RegistrationService/ListPlugins"
+	RegistrationService_DescribeService_FullMethodName  = "/snippet.grpc.reflection.RegistrationService/DescribeService"
+	RegistrationService_CallMethod_FullMethodName       = "/snippet.grpc.reflection.RegistrationService/CallMethod"
+	RegistrationService_WatchPlugins_FullMethodName     = "/snippet.grpc.reflection.RegistrationService/WatchPlugins"
 )
 
 // RegistrationServiceClient is the client API for RegistrationService service.
@@ -27,6 +33,16 @@ const (
 // For semantics around ctx use and closing/ending streaming RPCs, please refer to https://pkg.go.dev/google.golang.org/grpc/?tab=doc#ClientConn.NewStream.
 type RegistrationServiceClient interface {
 	RegisterPlugin(ctx context.Context, in *RegisterRequest, opts ...grpc.CallOption) (*RegisterResponse, error)
+	DeregisterPlugin(ctx context.Context, in *DeregisterRequest, opts ...grpc.CallOption) (*DeregisterResponse, error)
+	Heartbeat(ctx context.Context, in *HeartbeatRequest, opts ...grpc.CallOption) (*HeartbeatResponse, error)
+	ListPlugins(ctx context.Context, in *ListPluginsRequest, opts ...grpc.CallOption) (*ListPluginsResponse, error)
+	DescribeService(ctx context.Context, in *DescribeServiceRequest, opts ...grpc.CallOption) (*DescribeServiceResponse, error)
+	// CallMethod calls a unary method of a plugin, like the HTTP gateway.
+	CallMethod(ctx context.Context, in *CallMethodRequest, opts ...grpc.CallOption) (*CallMethodResponse, error)
+	// WatchPlugins sends a snapshot of the registered plugins, or the
+	// changes since the requested revision, followed by the changes of
+	// every later revision.
+	WatchPlugins(ctx context.Context, in *WatchPluginsRequest, opts ...grpc.CallOption) (RegistrationService_WatchPluginsClient, error)
 }
 
 type registrationServiceClient struct {
@@ -46,11 +62,98 @@ func (c *registrationServiceClient) RegisterPlugin(ctx context.Context, in *Regi
 	return out, nil
 }
 
+func (c *registrationServiceClient) DeregisterPlugin(ctx context.Context, in *DeregisterRequest, opts ...grpc.CallOption) (*DeregisterResponse, error) {
+	out := new(DeregisterResponse)
+	err := c.cc.Invoke(ctx, RegistrationService_DeregisterPlugin_FullMethodName, in, out, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *registrationServiceClient) Heartbeat(ctx context.Context, in *HeartbeatRequest, opts ...grpc.CallOption) (*HeartbeatResponse, error) {
+	out := new(HeartbeatResponse)
+	err := c.cc.Invoke(ctx, RegistrationService_Heartbeat_FullMethodName, in, out, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *registrationServiceClient) ListPlugins(ctx context.Context, in *ListPluginsRequest, opts ...grpc.CallOption) (*ListPluginsResponse, error) {
+	out := new(ListPluginsResponse)
+	err := c.cc.Invoke(ctx, RegistrationService_ListPlugins_FullMethodName, in, out, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *registrationServiceClient) DescribeService(ctx context.Context, in *DescribeServiceRequest, opts ...grpc.CallOption) (*DescribeServiceResponse, error) {
+	out := new(DescribeServiceResponse)
+	err := c.cc.Invoke(ctx, RegistrationService_DescribeService_FullMethodName, in, out, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *registrationServiceClient) CallMethod(ctx context.Context, in *CallMethodRequest, opts ...grpc.CallOption) (*CallMethodResponse, error) {
+	out := new(CallMethodResponse)
+	err := c.cc.Invoke(ctx, RegistrationService_CallMethod_FullMethodName, in, out, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *registrationServiceClient) WatchPlugins(ctx context.Context, in *WatchPluginsRequest, opts ...grpc.CallOption) (RegistrationService_WatchPluginsClient, error) {
+	stream, err := c.cc.NewStream(ctx, &RegistrationService_ServiceDesc.Streams[0], RegistrationService_WatchPlugins_FullMethodName, opts...)
+	if err != nil {
+		return nil, err
+	}
+	x := &registrationServiceWatchPluginsClient{stream}
+	if err := x.ClientStream.SendMsg(in); err != nil {
+		return nil, err
+	}
+	if err := x.ClientStream.CloseSend(); err != nil {
+		return nil, err
+	}
+	return x, nil
+}
+
+type RegistrationService_WatchPluginsClient interface {
+	Recv() (*WatchPluginsResponse, error)
+	grpc.ClientStream
+}
+
+type registrationServiceWatchPluginsClient struct {
+	grpc.ClientStream
+}
+
+func (x *registrationServiceWatchPluginsClient) Recv() (*WatchPluginsResponse, error) {
+	m := new(WatchPluginsResponse)
+	if err := x.ClientStream.RecvMsg(m); err != nil {
+		return nil, err
+	}
+	return m, nil
+}
+
 // RegistrationServiceServer is the server API for RegistrationService service.
 // All implementations must embed UnimplementedRegistrationServiceServer
 // for forward compatibility
 type RegistrationServiceServer interface {
 	RegisterPlugin(context.Context, *RegisterRequest) (*RegisterResponse, error)
+	DeregisterPlugin(context.Context, *DeregisterRequest) (*DeregisterResponse, error)
+	Heartbeat(context.Context, *HeartbeatRequest) (*HeartbeatResponse, error)
+	ListPlugins(context.Context, *ListPluginsRequest) (*ListPluginsResponse, error)
+	DescribeService(context.Context, *DescribeServiceRequest) (*DescribeServiceResponse, error)
+	// CallMethod calls a unary method of a plugin, like the HTTP gateway.
+	CallMethod(context.Context, *CallMethodRequest) (*CallMethodResponse, error)
+	// WatchPlugins sends a snapshot of the registered plugins, or the
+	// changes since the requested revision, followed by the changes of
+	// every later revision.
+	WatchPlugins(*WatchPluginsRequest, RegistrationService_WatchPluginsServer) error
 	mustEmbedUnimplementedRegistrationServiceServer()
 }
 
@@ -61,6 +164,24 @@ type UnimplementedRegistrationServiceServer struct {
 func (UnimplementedRegistrationServiceServer) RegisterPlugin(context.Context, *RegisterRequest) (*RegisterResponse, error) {
 	return nil, status.Errorf(codes.Unimplemented, "method RegisterPlugin not implemented")
 }
+func (UnimplementedRegistrationServiceServer) DeregisterPlugin(context.Context, *DeregisterRequest) (*DeregisterResponse, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method DeregisterPlugin not implemented")
+}
+func (UnimplementedRegistrationServiceServer) Heartbeat(context.Context, *HeartbeatRequest) (*HeartbeatResponse, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method Heartbeat not implemented")
+}
+func (UnimplementedRegistrationServiceServer) ListPlugins(context.Context, *ListPluginsRequest) (*ListPluginsResponse, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method ListPlugins not implemented")
+}
+func (UnimplementedRegistrationServiceServer) DescribeService(context.Context, *DescribeServiceRequest) (*DescribeServiceResponse, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method DescribeService not implemented")
+}
+func (UnimplementedRegistrationServiceServer) CallMethod(context.Context, *CallMethodRequest) (*CallMethodResponse, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method CallMethod not implemented")
+}
+func (UnimplementedRegistrationServiceServer) WatchPlugins(*WatchPluginsRequest, RegistrationService_WatchPluginsServer) error {
+	return status.Errorf(codes.Unimplemented, "method WatchPlugins not implemented")
+}
 func (UnimplementedRegistrationServiceServer) mustEmbedUnimplementedRegistrationServiceServer() {}
 
 // UnsafeRegistrationServiceServer may be embedded to opt out of forward compatibility for this service.
@@ -92,6 +213,117 @@ func _RegistrationService_RegisterPlugin_Handler(srv interface{}, ctx context.Co
 	return interceptor(ctx, in, info, handler)
 }
 
+func _RegistrationService_DeregisterPlugin_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(DeregisterRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(RegistrationServiceServer).DeregisterPlugin(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: RegistrationService_DeregisterPlugin_FullMethodName,
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(RegistrationServiceServer).DeregisterPlugin(ctx, req.(*DeregisterRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _RegistrationService_Heartbeat_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(HeartbeatRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(RegistrationServiceServer).Heartbeat(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: RegistrationService_Heartbeat_FullMethodName,
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(RegistrationServiceServer).Heartbeat(ctx, req.(*HeartbeatRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _RegistrationService_ListPlugins_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(ListPluginsRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(RegistrationServiceServer).ListPlugins(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: RegistrationService_ListPlugins_FullMethodName,
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(RegistrationServiceServer).ListPlugins(ctx, req.(*ListPluginsRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _RegistrationService_DescribeService_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(DescribeServiceRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(RegistrationServiceServer).DescribeService(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: RegistrationService_DescribeService_FullMethodName,
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(RegistrationServiceServer).DescribeService(ctx, req.(*DescribeServiceRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _RegistrationService_CallMethod_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(CallMethodRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(RegistrationServiceServer).CallMethod(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: RegistrationService_CallMethod_FullMethodName,
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(RegistrationServiceServer).CallMethod(ctx, req.(*CallMethodRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _RegistrationService_WatchPlugins_Handler(srv interface{}, stream grpc.ServerStream) error {
+	m := new(WatchPluginsRequest)
+	if err := stream.RecvMsg(m); err != nil {
+		return err
+	}
+	return srv.(RegistrationServiceServer).WatchPlugins(m, &registrationServiceWatchPluginsServer{stream})
+}
+
+type RegistrationService_WatchPluginsServer interface {
+	Send(*WatchPluginsResponse) error
+	grpc.ServerStream
+}
+
+type registrationServiceWatchPluginsServer struct {
+	grpc.ServerStream
+}
+
+func (x *registrationServiceWatchPluginsServer) Send(m *WatchPluginsResponse) error {
+	return x.ServerStream.SendMsg(m)
+}
+
 // RegistrationService_ServiceDesc is the grpc.ServiceDesc for RegistrationService service.
 // It's only intended for direct use with grpc.RegisterService,
 // and not to be introspected or modified (even as a copy)
@@ -103,7 +335,33 @@ var RegistrationService_ServiceDesc = grpc.ServiceDesc{
 			MethodName: "RegisterPlugin",
 			Handler:    _RegistrationService_RegisterPlugin_Handler,
 		},
+		{
+			MethodName: "DeregisterPlugin",
+			Handler:    _RegistrationService_DeregisterPlugin_Handler,
+		},
+		{
+			MethodName: "Heartbeat",
+			Handler:    _RegistrationService_Heartbeat_Handler,
+		},
+		{
+			MethodName: "ListPlugins",
+			Handler:    _RegistrationService_ListPlugins_Handler,
+		},
+		{
+			MethodName: "DescribeService",
+			Handler:    _RegistrationService_DescribeService_Handler,
+		},
+		{
+			MethodName: "CallMethod",
+			Handler:    _RegistrationService_CallMethod_Handler,
+		},
+	},
+	Streams: []grpc.StreamDesc{
+		{
+			StreamName:    "WatchPlugins",
+			Handler:       _RegistrationService_WatchPlugins_Handler,
+			ServerStreams: true,
+		},
 	},
-	Streams:  []grpc.StreamDesc{},
 	Metadata: "agent/registration.proto",
 }
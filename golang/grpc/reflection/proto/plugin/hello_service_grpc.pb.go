@@ -19,7 +19,10 @@ import (
 const _ = grpc.SupportPackageIsVersion7
 
 const (
-	HelloService_Hello_FullMethodName = "/snippet.grpc.reflection.HelloService/Hello"
+	HelloService_Hello_FullMethodName     = "/snippet.grpc.reflection.HelloService/Hello"
+	HelloService_HelloFeed_FullMethodName = "/snippet.grpc.reflection.HelloService/HelloFeed"
+	HelloService_HelloAll_FullMethodName  = "/snippet.grpc.reflection.HelloService/HelloAll"
+	HelloService_HelloChat_FullMethodName = "/snippet.grpc.reflection.HelloService/HelloChat"
 )
 
 // HelloServiceClient is the client API for HelloService service.
@@ -27,6 +30,12 @@ const (
 // For semantics around ctx use and closing/ending streaming RPCs, please refer to https://pkg.go.dev/google.golang.org/grpc/?tab=doc#ClientConn.NewStream.
 type HelloServiceClient interface {
 	Hello(ctx context.Context, in *HelloRequest, opts ...grpc.CallOption) (*HelloResponse, error)
+	// HelloFeed greets the caller repeatedly, once per year of age.
+	HelloFeed(ctx context.Context, in *HelloRequest, opts ...grpc.CallOption) (HelloService_HelloFeedClient, error)
+	// HelloAll greets everybody sent at once.
+	HelloAll(ctx context.Context, opts ...grpc.CallOption) (HelloService_HelloAllClient, error)
+	// HelloChat greets everybody as they arrive.
+	HelloChat(ctx context.Context, opts ...grpc.CallOption) (HelloService_HelloChatClient, error)
 }
 
 type helloServiceClient struct {
@@ -46,11 +55,114 @@ func (c *helloServiceClient) Hello(ctx context.Context, in *HelloRequest, opts .
 	return out, nil
 }
 
+func (c *helloServiceClient) HelloFeed(ctx context.Context, in *HelloRequest, opts ...grpc.CallOption) (HelloService_HelloFeedClient, error) {
+	stream, err := c.cc.NewStream(ctx, &HelloService_ServiceDesc.Streams[0], HelloService_HelloFeed_FullMethodName, opts...)
+	if err != nil {
+		return nil, err
+	}
+	x := &helloServiceHelloFeedClient{stream}
+	if err := x.ClientStream.SendMsg(in); err != nil {
+		return nil, err
+	}
+	if err := x.ClientStream.CloseSend(); err != nil {
+		return nil, err
+	}
+	return x, nil
+}
+
+type HelloService_HelloFeedClient interface {
+	Recv() (*HelloResponse, error)
+	grpc.ClientStream
+}
+
+type helloServiceHelloFeedClient struct {
+	grpc.ClientStream
+}
+
+func (x *helloServiceHelloFeedClient) Recv() (*HelloResponse, error) {
+	m := new(HelloResponse)
+	if err := x.ClientStream.RecvMsg(m); err != nil {
+		return nil, err
+	}
+	return m, nil
+}
+
+func (c *helloServiceClient) HelloAll(ctx context.Context, opts ...grpc.CallOption) (HelloService_HelloAllClient, error) {
+	stream, err := c.cc.NewStream(ctx, &HelloService_ServiceDesc.Streams[1], HelloService_HelloAll_FullMethodName, opts...)
+	if err != nil {
+		return nil, err
+	}
+	x := &helloServiceHelloAllClient{stream}
+	return x, nil
+}
+
+type HelloService_HelloAllClient interface {
+	Send(*HelloRequest) error
+	CloseAndRecv() (*HelloResponse, error)
+	grpc.ClientStream
+}
+
+type helloServiceHelloAllClient struct {
+	grpc.ClientStream
+}
+
+func (x *helloServiceHelloAllClient) Send(m *HelloRequest) error {
+	return x.ClientStream.SendMsg(m)
+}
+
+func (x *helloServiceHelloAllClient) CloseAndRecv() (*HelloResponse, error) {
+	if err := x.ClientStream.CloseSend(); err != nil {
+		return nil, err
+	}
+	m := new(HelloResponse)
+	if err := x.ClientStream.RecvMsg(m); err != nil {
+		return nil, err
+	}
+	return m, nil
+}
+
+func (c *helloServiceClient) HelloChat(ctx context.Context, opts ...grpc.CallOption) (HelloService_HelloChatClient, error) {
+	stream, err := c.cc.NewStream(ctx, &HelloService_ServiceDesc.Streams[2], HelloService_HelloChat_FullMethodName, opts...)
+	if err != nil {
+		return nil, err
+	}
+	x := &helloServiceHelloChatClient{stream}
+	return x, nil
+}
+
+type HelloService_HelloChatClient interface {
+	Send(*HelloRequest) error
+	Recv() (*HelloResponse, error)
+	grpc.ClientStream
+}
+
+type helloServiceHelloChatClient struct {
+	grpc.ClientStream
+}
+
+func (x *helloServiceHelloChatClient) Send(m *HelloRequest) error {
+	return x.ClientStream.SendMsg(m)
+}
+
+func (x *helloServiceHelloChatClient) Recv() (*HelloResponse, error) {
+	m := new(HelloResponse)
+	if err := x.ClientStream.RecvMsg(m); err != nil {
+		return nil, err
+	}
+	return m, nil
+}
+
 // HelloServiceServer is the server API for HelloService service.
 // All implementations must embed UnimplementedHelloServiceServer
 // for forward compatibility
 type HelloServiceServer interface {
 	Hello(context.Context, *HelloRequest) (*HelloResponse, error)
+	// HelloFeed greets the caller repeatedly, once per year of age.
+	HelloFeed(*HelloRequest, HelloService_HelloFeedServer) error
+	// HelloAll greets everybody sent at once.
+	HelloAll(HelloService_HelloAllServer) error
+	// HelloChat greets everybody as they arrive.
+	HelloChat(HelloService_HelloChatServer) error
 	mustEmbedUnimplementedHelloServiceServer()
 }
 
@@ -61,6 +173,15 @@ type UnimplementedHelloServiceServer struct {
 func (UnimplementedHelloServiceServer) Hello(context.Context, *HelloRequest) (*HelloResponse, error) {
 	return nil, status.Errorf(codes.Unimplemented, "method Hello not implemented")
 }
+func (UnimplementedHelloServiceServer) HelloFeed(*HelloRequest, HelloService_HelloFeedServer) error {
+	return status.Errorf(codes.Unimplemented, "method HelloFeed not implemented")
+}
+func (UnimplementedHelloServiceServer) HelloAll(HelloService_HelloAllServer) error {
+	return status.Errorf(codes.Unimplemented, "method HelloAll not implemented")
+}
+func (UnimplementedHelloServiceServer) HelloChat(HelloService_HelloChatServer) error {
+	return status.Errorf(codes.Unimplemented, "method HelloChat not implemented")
+}
 func (UnimplementedHelloServiceServer) mustEmbedUnimplementedHelloServiceServer() {}
 
 // UnsafeHelloServiceServer may be embedded to opt out of forward compatibility for this service.
@@ -92,6 +213,79 @@ func _HelloService_Hello_Handler(srv interface{}, ctx context.Context, dec func(
 	return interceptor(ctx, in, info, handler)
 }
 
+func _HelloService_HelloFeed_Handler(srv interface{}, stream grpc.ServerStream) error {
+	m := new(HelloRequest)
+	if err := stream.RecvMsg(m); err != nil {
+		return err
+	}
+	return srv.(HelloServiceServer).HelloFeed(m, &helloServiceHelloFeedServer{stream})
+}
+
+type HelloService_HelloFeedServer interface {
+	Send(*HelloResponse) error
+	grpc.ServerStream
+}
+
+type helloServiceHelloFeedServer struct {
+	grpc.ServerStream
+}
+
+func (x *helloServiceHelloFeedServer) Send(m *HelloResponse) error {
+	return x.ServerStream.SendMsg(m)
+}
+
+func _HelloService_HelloAll_Handler(srv interface{}, stream grpc.ServerStream) error {
+	return srv.(HelloServiceServer).HelloAll(&helloServiceHelloAllServer{stream})
+}
+
+type HelloService_HelloAllServer interface {
+	SendAndClose(*HelloResponse) error
+	Recv() (*HelloRequest, error)
+	grpc.ServerStream
+}
+
+type helloServiceHelloAllServer struct {
+	grpc.ServerStream
+}
+
+func (x *helloServiceHelloAllServer) SendAndClose(m *HelloResponse) error {
+	return x.ServerStream.SendMsg(m)
+}
+
+func (x *helloServiceHelloAllServer) Recv() (*HelloRequest, error) {
+	m := new(HelloRequest)
+	if err := x.ServerStream.RecvMsg(m); err != nil {
+		return nil, err
+	}
+	return m, nil
+}
+
+func _HelloService_HelloChat_Handler(srv interface{}, stream grpc.ServerStream) error {
+	return srv.(HelloServiceServer).HelloChat(&helloServiceHelloChatServer{stream})
+}
+
+type HelloService_HelloChatServer interface {
+	Send(*HelloResponse) error
+	Recv() (*HelloRequest, error)
+	grpc.ServerStream
+}
+
+type helloServiceHelloChatServer struct {
+	grpc.ServerStream
+}
+
+func (x *helloServiceHelloChatServer) Send(m *HelloResponse) error {
+	return x.ServerStream.SendMsg(m)
+}
+
+func (x *helloServiceHelloChatServer) Recv() (*HelloRequest, error) {
+	m := new(HelloRequest)
+	if err := x.ServerStream.RecvMsg(m); err != nil {
+		return nil, err
+	}
+	return m, nil
+}
+
 // HelloService_ServiceDesc is the grpc.ServiceDesc for HelloService service.
 // It's only intended for direct use with grpc.RegisterService,
 // and not to be introspected or modified (even as a copy)
@@ -104,6 +298,23 @@ var HelloService_ServiceDesc = grpc.ServiceDesc{
 			Handler:    _HelloService_Hello_Handler,
 		},
 	},
-	Streams:  []grpc.StreamDesc{},
+	Streams: []grpc.StreamDesc{
+		{
+			StreamName:    "HelloFeed",
+			Handler:       _HelloService_HelloFeed_Handler,
+			ServerStreams: true,
+		},
+		{
+			StreamName:    "HelloAll",
+			Handler:       _HelloService_HelloAll_Handler,
+			ClientStreams: true,
+		},
+		{
+			StreamName:    "HelloChat",
+			Handler:       _HelloService_HelloChat_Handler,
+			ServerStreams: true,
+			ClientStreams: true,
+		},
+	},
 	Metadata: "plugin/hello_service.proto",
 }
@@ -0,0 +1,23 @@
+// Package protofiles adds the file descriptors of services, along with their
+// imports, to protobuf registries, which resolve the types of dynamic
+// messages.
+package protofiles
+
+import (
+	"github.com/jhump/protoreflect/desc"
+	"google.golang.org/protobuf/reflect/protoregistry"
+)
+
+// Register adds fd and everything it imports to files. Conflicts with an
+// already registered file are ignored on purpose, the first definition wins.
+func Register(files *protoregistry.Files, fd *desc.FileDescriptor) {
+	if _, err := files.FindFileByPath(fd.GetName()); err == nil {
+		return
+	}
+
+	for _, dep := range fd.GetDependencies() {
+		Register(files, dep)
+	}
+
+	_ = files.RegisterFile(fd.UnwrapFile())
+}
@@ -0,0 +1,30 @@
+package protofiles
+
+import (
+	"testing"
+
+	"github.com/jhump/protoreflect/desc"
+	"github.com/stretchr/testify/assert"
+	"google.golang.org/protobuf/reflect/protoregistry"
+
+	"github.com/rootwarp/snippets/golang/grpc/reflection/proto/agent"
+)
+
+func TestRegister(t *testing.T) {
+	fd, err := desc.WrapFile(agent.File_agent_registration_proto)
+	assert.Nil(t, err)
+
+	files := &protoregistry.Files{}
+	Register(files, fd)
+
+	// The imports come along.
+	_, err = files.FindFileByPath("google/protobuf/timestamp.proto")
+	assert.Nil(t, err)
+
+	_, err = files.FindDescriptorByName("snippet.grpc.reflection.RegisterRequest")
+	assert.Nil(t, err)
+
+	// Registering again changes nothing.
+	Register(files, fd)
+	assert.Equal(t, 2, files.NumFiles())
+}
@@ -0,0 +1,132 @@
+package replay
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"sort"
+)
+
+// Diff compares the JSON documents expected and actual and returns one line
+// per difference, naming where it is, like `.greeting: "Hey" != "Hi"`.
+// Formatting and the order of keys do not matter, an empty document counts
+// as null.
+func Diff(expected, actual []byte) ([]string, error) {
+	e, err := decodeJSON(expected)
+	if err != nil {
+		return nil, fmt.Errorf("expected: %w", err)
+	}
+
+	a, err := decodeJSON(actual)
+	if err != nil {
+		return nil, fmt.Errorf("actual: %w", err)
+	}
+
+	diffs := []string{}
+	diffValues("", e, a, &diffs)
+
+	return diffs, nil
+}
+
+func decodeJSON(data []byte) (any, error) {
+	if len(bytes.TrimSpace(data)) == 0 {
+		return nil, nil
+	}
+
+	var v any
+	if err := json.Unmarshal(data, &v); err != nil {
+		return nil, err
+	}
+
+	return v, nil
+}
+
+// missing stands for a key one of the documents does not have.
+type missing struct{}
+
+func diffValues(path string, expected, actual any, diffs *[]string) {
+	switch e := expected.(type) {
+	case map[string]any:
+		if a, ok := actual.(map[string]any); ok {
+			diffObjects(path, e, a, diffs)
+			return
+		}
+	case []any:
+		if a, ok := actual.([]any); ok {
+			diffArrays(path, e, a, diffs)
+			return
+		}
+	default:
+		if expected == actual {
+			return
+		}
+	}
+
+	if path == "" {
+		path = "."
+	}
+
+	*diffs = append(*diffs, fmt.Sprintf("%s: %s != %s", path, formatValue(expected), formatValue(actual)))
+}
+
+func diffObjects(path string, expected, actual map[string]any, diffs *[]string) {
+	keys := []string{}
+	for key := range expected {
+		keys = append(keys, key)
+	}
+
+	for key := range actual {
+		if _, ok := expected[key]; !ok {
+			keys = append(keys, key)
+		}
+	}
+
+	sort.Strings(keys)
+
+	for _, key := range keys {
+		e, ok := expected[key]
+		if !ok {
+			e = missing{}
+		}
+
+		a, ok := actual[key]
+		if !ok {
+			a = missing{}
+		}
+
+		diffValues(path+"."+key, e, a, diffs)
+	}
+}
+
+func diffArrays(path string, expected, actual []any, diffs *[]string) {
+	n := len(expected)
+	if len(actual) > n {
+		n = len(actual)
+	}
+
+	for i := 0; i < n; i++ {
+		var e, a any = missing{}, missing{}
+		if i < len(expected) {
+			e = expected[i]
+		}
+
+		if i < len(actual) {
+			a = actual[i]
+		}
+
+		diffValues(fmt.Sprintf("%s[%d]", path, i), e, a, diffs)
+	}
+}
+
+func formatValue(v any) string {
+	if _, ok := v.(missing); ok {
+		return "missing"
+	}
+
+	data, err := json.Marshal(v)
+	if err != nil {
+		return fmt.Sprint(v)
+	}
+
+	return string(data)
+}
@@ -0,0 +1,33 @@
+package replay
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestDiff(t *testing.T) {
+	tests := []struct {
+		Expected string
+		Actual   string
+		Diffs    []string
+	}{
+		{`{"a": 1, "b": "x"}`, `{ "b":"x","a":1 }`, []string{}},
+		{``, `null`, []string{}},
+		{`{"a": 1}`, `{"a": 2}`, []string{`.a: 1 != 2`}},
+		{`{"a": 1}`, `{"b": 1}`, []string{`.a: 1 != missing`, `.b: missing != 1`}},
+		{`{"a": {"b": [1, 2]}}`, `{"a": {"b": [1]}}`, []string{`.a.b[1]: 2 != missing`}},
+		{`{"a": [{"b": true}]}`, `{"a": [{"b": false}]}`, []string{`.a[0].b: true != false`}},
+		{`{"a": 1}`, `[1]`, []string{`.: {"a":1} != [1]`}},
+		{`{}`, ``, []string{`.: {} != null`}},
+	}
+
+	for _, test := range tests {
+		diffs, err := Diff([]byte(test.Expected), []byte(test.Actual))
+		assert.Nil(t, err)
+		assert.Equal(t, test.Diffs, diffs, test)
+	}
+
+	_, err := Diff([]byte(`{`), nil)
+	assert.NotNil(t, err)
+}
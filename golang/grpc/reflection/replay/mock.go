@@ -0,0 +1,94 @@
+package replay
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// Mock answers calls with the outcome of a recorded call of the same method
+// and an equal request.
+type Mock struct {
+	// records holds the records of every method by its full name.
+	records map[string][]Record
+}
+
+// NewMock returns a Mock answering with records. The latest of the records
+// with equal requests wins.
+func NewMock(records []Record) *Mock {
+	m := &Mock{records: map[string][]Record{}}
+	for _, rec := range records {
+		key := rec.Service + "/" + rec.Method
+		m.records[key] = append(m.records[key], rec)
+	}
+
+	return m
+}
+
+// Services returns the sorted names of the services of the records.
+func (m *Mock) Services() []string {
+	seen := map[string]bool{}
+	services := []string{}
+	for _, records := range m.records {
+		if service := records[0].Service; !seen[service] {
+			seen[service] = true
+			services = append(services, service)
+		}
+	}
+
+	sort.Strings(services)
+
+	return services
+}
+
+// Respond returns the recorded response to request, a protojson request of
+// method of service, or the recorded error. A request which was not recorded
+// fails with NotFound, telling how it differs from the closest recorded one.
+func (m *Mock) Respond(service, method string, request []byte) ([]byte, error) {
+	records := m.records[service+"/"+method]
+	if len(records) == 0 {
+		return nil, status.Errorf(codes.NotFound, "no call of %s/%s was recorded", service, method)
+	}
+
+	var closest []string
+	for i := len(records) - 1; i >= 0; i-- {
+		rec := records[i]
+
+		diffs, err := Diff(rec.Request, request)
+		if err != nil {
+			return nil, status.Error(codes.InvalidArgument, err.Error())
+		}
+
+		if len(diffs) == 0 {
+			if rec.Code != codes.OK {
+				return nil, status.Error(rec.Code, rec.Message)
+			}
+
+			return rec.Response, nil
+		}
+
+		if closest == nil || len(diffs) < len(closest) {
+			closest = diffs
+		}
+	}
+
+	return nil, status.Errorf(codes.NotFound, "no call of %s/%s was recorded with the request, the closest differs in %s", service, method, strings.Join(closest, "; "))
+}
+
+// Check compares the outcome of a replayed call, its response or error, to
+// rec and returns the differences.
+func Check(rec Record, response []byte, err error) ([]string, error) {
+	st := status.Convert(err)
+	if st.Code() != rec.Code {
+		return []string{fmt.Sprintf("code: %s != %s", rec.Code, st.Code())}, nil
+	}
+
+	if rec.Code != codes.OK {
+		return nil, nil
+	}
+
+	return Diff(rec.Response, response)
+}
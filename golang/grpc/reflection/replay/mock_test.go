@@ -0,0 +1,61 @@
+package replay
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+func TestMock(t *testing.T) {
+	m := NewMock([]Record{
+		{Service: "b.Service", Method: "Hello", Request: []byte(`{"name": "a"}`), Response: []byte(`{"greetingMsg": "old"}`)},
+		{Service: "b.Service", Method: "Hello", Request: []byte(`{"name": "a"}`), Response: []byte(`{"greetingMsg": "Hey a"}`)},
+		{Service: "b.Service", Method: "Hello", Request: []byte(`{"name": "b", "age": 3}`), Code: codes.InvalidArgument, Message: "too young"},
+		{Service: "a.Service", Method: "Bye", Request: []byte(`{}`), Response: []byte(`{}`)},
+	})
+
+	assert.Equal(t, []string{"a.Service", "b.Service"}, m.Services())
+
+	// The latest record wins.
+	resp, err := m.Respond("b.Service", "Hello", []byte(`{"name":"a"}`))
+	assert.Nil(t, err)
+	assert.JSONEq(t, `{"greetingMsg": "Hey a"}`, string(resp))
+
+	_, err = m.Respond("b.Service", "Hello", []byte(`{"age": 3, "name": "b"}`))
+	assert.Equal(t, codes.InvalidArgument, status.Code(err))
+	assert.Equal(t, "too young", status.Convert(err).Message())
+
+	_, err = m.Respond("b.Service", "Hello", []byte(`{"name": "c"}`))
+	assert.Equal(t, codes.NotFound, status.Code(err))
+	assert.Contains(t, status.Convert(err).Message(), `.name: "a" != "c"`)
+
+	_, err = m.Respond("b.Service", "Bye", []byte(`{}`))
+	assert.Equal(t, codes.NotFound, status.Code(err))
+}
+
+func TestCheck(t *testing.T) {
+	ok := Record{Response: []byte(`{"greetingMsg": "Hey"}`)}
+	failed := Record{Code: codes.NotFound}
+
+	tests := []struct {
+		Record   Record
+		Response string
+		Err      error
+		Diffs    []string
+	}{
+		{ok, `{"greetingMsg":"Hey"}`, nil, []string{}},
+		{ok, `{"greetingMsg":"Hi"}`, nil, []string{`.greetingMsg: "Hey" != "Hi"`}},
+		{ok, ``, status.Error(codes.Unavailable, "down"), []string{"code: OK != Unavailable"}},
+		{failed, ``, status.Error(codes.NotFound, "other message"), nil},
+		{failed, ``, errors.New("plain"), []string{"code: NotFound != Unknown"}},
+	}
+
+	for _, test := range tests {
+		diffs, err := Check(test.Record, []byte(test.Response), test.Err)
+		assert.Nil(t, err)
+		assert.Equal(t, test.Diffs, diffs, test)
+	}
+}
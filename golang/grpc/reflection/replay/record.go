@@ -0,0 +1,232 @@
+// Package replay records the calls the agent makes to plugins as JSON lines,
+// one Record per call, and plays them back: to a plugin, comparing its
+// responses to the recorded ones, or from a Mock answering with them.
+package replay
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"google.golang.org/grpc/codes"
+)
+
+// Record is one call of a unary method.
+type Record struct {
+	Time    time.Time `json:"time"`
+	Service string    `json:"service"`
+	Method  string    `json:"method"`
+	// Request and Response are protojson, Response is empty when the call
+	// failed.
+	Request  json.RawMessage `json:"request"`
+	Response json.RawMessage `json:"response,omitempty"`
+	// Code and Message are the status of the call.
+	Code      codes.Code `json:"code"`
+	Message   string     `json:"message,omitempty"`
+	LatencyMs float64    `json:"latencyMs"`
+	// Metadata is the metadata the caller sent, as CallMetadata leaves it.
+	Metadata map[string][]string `json:"metadata,omitempty"`
+}
+
+// droppedMetadata are the keys of the metadata which belong to the original
+// call only: credentials, the agent's marker of forwarded calls, the trace
+// context and the headers of the HTTP connection a gateway call came over.
+var droppedMetadata = map[string]bool{
+	"authorization":        true,
+	"cookie":               true,
+	"x-agent-forwarded-by": true,
+	"traceparent":          true,
+	"tracestate":           true,
+	"grpc-trace-bin":       true,
+	"accept-encoding":      true,
+	"connection":           true,
+	"content-length":       true,
+	"content-type":         true,
+	"host":                 true,
+	"keep-alive":           true,
+	"proxy-connection":     true,
+	"te":                   true,
+	"trailer":              true,
+	"transfer-encoding":    true,
+	"upgrade":              true,
+}
+
+// CallMetadata returns the metadata of md worth recording and sending again,
+// leaving out the pseudo headers and the keys bound to the original call.
+// It returns nil when nothing is left.
+func CallMetadata(md map[string][]string) map[string][]string {
+	kept := map[string][]string{}
+	for key, values := range md {
+		key = strings.ToLower(key)
+		if strings.HasPrefix(key, ":") || droppedMetadata[key] {
+			continue
+		}
+
+		kept[key] = append(kept[key], values...)
+	}
+
+	if len(kept) == 0 {
+		return nil
+	}
+
+	return kept
+}
+
+// Writer appends records to a file as JSON lines. A file about to grow past
+// the maximum size is rotated: path becomes path.1, path.1 becomes path.2
+// and so on, the oldest beyond the maximum number of files is removed.
+type Writer struct {
+	path     string
+	maxSize  int64
+	maxFiles int
+
+	mu   sync.Mutex
+	file *os.File
+	size int64
+}
+
+// NewWriter opens the file at path for appending records. A maxSize of zero
+// never rotates it, maxFiles of zero keeps no rotated file.
+func NewWriter(path string, maxSize int64, maxFiles int) (*Writer, error) {
+	w := &Writer{path: path, maxSize: maxSize, maxFiles: maxFiles}
+	if err := w.open(); err != nil {
+		return nil, err
+	}
+
+	return w, nil
+}
+
+func (w *Writer) open() error {
+	f, err := os.OpenFile(w.path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0600)
+	if err != nil {
+		return err
+	}
+
+	info, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return err
+	}
+
+	w.file, w.size = f, info.Size()
+
+	return nil
+}
+
+// Write appends rec.
+func (w *Writer) Write(rec *Record) error {
+	line, err := json.Marshal(rec)
+	if err != nil {
+		return err
+	}
+
+	line = append(line, '\n')
+
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	if w.file == nil {
+		return os.ErrClosed
+	}
+
+	if w.maxSize > 0 && w.size > 0 && w.size+int64(len(line)) > w.maxSize {
+		if err := w.rotate(); err != nil {
+			return err
+		}
+	}
+
+	n, err := w.file.Write(line)
+	w.size += int64(n)
+
+	return err
+}
+
+// rotate moves the files one position down and starts a new one. w.mu must
+// be held.
+func (w *Writer) rotate() error {
+	if err := w.file.Close(); err != nil {
+		return err
+	}
+
+	w.file = nil
+
+	if w.maxFiles == 0 {
+		if err := os.Remove(w.path); err != nil {
+			return err
+		}
+
+		return w.open()
+	}
+
+	for i := w.maxFiles - 1; i > 0; i-- {
+		err := os.Rename(rotatedPath(w.path, i), rotatedPath(w.path, i+1))
+		if err != nil && !errors.Is(err, os.ErrNotExist) {
+			return err
+		}
+	}
+
+	if err := os.Rename(w.path, rotatedPath(w.path, 1)); err != nil {
+		return err
+	}
+
+	return w.open()
+}
+
+func rotatedPath(path string, i int) string {
+	return fmt.Sprintf("%s.%d", path, i)
+}
+
+// Close closes the file.
+func (w *Writer) Close() error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	if w.file == nil {
+		return nil
+	}
+
+	err := w.file.Close()
+	w.file = nil
+
+	return err
+}
+
+// Read returns the records of r, one per line. Empty lines are skipped.
+func Read(r io.Reader) ([]Record, error) {
+	records := []Record{}
+
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(make([]byte, 64*1024), 64*1024*1024)
+
+	for line := 1; scanner.Scan(); line++ {
+		if len(scanner.Bytes()) == 0 {
+			continue
+		}
+
+		rec := Record{}
+		if err := json.Unmarshal(scanner.Bytes(), &rec); err != nil {
+			return nil, fmt.Errorf("line %d: %w", line, err)
+		}
+
+		records = append(records, rec)
+	}
+
+	return records, scanner.Err()
+}
+
+// ReadFile returns the records of the file at path.
+func ReadFile(path string) ([]Record, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	return Read(f)
+}
@@ -0,0 +1,130 @@
+package replay
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"google.golang.org/grpc/codes"
+)
+
+func TestWriter(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "calls.jsonl")
+
+	w, err := NewWriter(path, 400, 2)
+	assert.Nil(t, err)
+
+	for i := 0; i < 10; i++ {
+		err := w.Write(&Record{
+			Service:  "a.Service",
+			Method:   "Hello",
+			Request:  json.RawMessage(fmt.Sprintf(`{"n": %d}`, i)),
+			Response: json.RawMessage(`{"greetingMsg": "Hey"}`),
+		})
+		assert.Nil(t, err)
+	}
+
+	assert.Nil(t, w.Close())
+	assert.ErrorIs(t, w.Write(&Record{}), os.ErrClosed)
+
+	// Two rotated files are kept along with the current one, none is
+	// larger than the maximum.
+	names := []string{}
+	entries, err := os.ReadDir(filepath.Dir(path))
+	assert.Nil(t, err)
+	for _, entry := range entries {
+		names = append(names, entry.Name())
+
+		info, err := entry.Info()
+		assert.Nil(t, err)
+		assert.LessOrEqual(t, info.Size(), int64(400))
+	}
+
+	assert.Equal(t, []string{"calls.jsonl", "calls.jsonl.1", "calls.jsonl.2"}, names)
+
+	// The newest records are in the current file, the older ones follow.
+	seen := []string{}
+	for _, name := range []string{"calls.jsonl.2", "calls.jsonl.1", "calls.jsonl"} {
+		records, err := ReadFile(filepath.Join(filepath.Dir(path), name))
+		assert.Nil(t, err)
+
+		for _, rec := range records {
+			seen = append(seen, string(rec.Request))
+		}
+	}
+
+	if assert.NotEmpty(t, seen) {
+		assert.Equal(t, `{"n":9}`, seen[len(seen)-1])
+	}
+
+	// Appending goes on in the current file.
+	w, err = NewWriter(path, 0, 0)
+	assert.Nil(t, err)
+	assert.Nil(t, w.Write(&Record{Service: "b.Service", Code: codes.NotFound, Message: "no"}))
+	assert.Nil(t, w.Close())
+
+	records, err := ReadFile(path)
+	assert.Nil(t, err)
+	if assert.NotEmpty(t, records) {
+		last := records[len(records)-1]
+		assert.Equal(t, "b.Service", last.Service)
+		assert.Equal(t, codes.NotFound, last.Code)
+		assert.Equal(t, "no", last.Message)
+	}
+}
+
+func TestWriterWithoutRotatedFiles(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "calls.jsonl")
+
+	w, err := NewWriter(path, 100, 0)
+	assert.Nil(t, err)
+	defer w.Close()
+
+	for i := 0; i < 5; i++ {
+		assert.Nil(t, w.Write(&Record{Service: fmt.Sprint(i)}))
+	}
+
+	entries, err := os.ReadDir(filepath.Dir(path))
+	assert.Nil(t, err)
+	assert.Len(t, entries, 1)
+
+	records, err := ReadFile(path)
+	assert.Nil(t, err)
+	if assert.Len(t, records, 1) {
+		assert.Equal(t, "4", records[0].Service)
+	}
+}
+
+func TestRead(t *testing.T) {
+	records, err := Read(strings.NewReader("{\"service\": \"a\"}\n\n{\"service\": \"b\"}\n"))
+	assert.Nil(t, err)
+	assert.Len(t, records, 2)
+
+	_, err = Read(strings.NewReader("{\"service\": \"a\"}\n{\n"))
+	assert.ErrorContains(t, err, "line 2")
+}
+
+func TestCallMetadata(t *testing.T) {
+	md := map[string][]string{
+		"x-request-id":         {"1"},
+		"X-Tenant":             {"a", "b"},
+		":authority":           {"agent"},
+		"authorization":        {"Bearer secret"},
+		"x-agent-forwarded-by": {"peer"},
+		"traceparent":          {"00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01"},
+		"tracestate":           {"a=b"},
+		"connection":           {"keep-alive"},
+		"content-length":       {"2"},
+	}
+
+	assert.Equal(t, map[string][]string{
+		"x-request-id": {"1"},
+		"x-tenant":     {"a", "b"},
+	}, CallMetadata(md))
+
+	assert.Nil(t, CallMetadata(map[string][]string{"cookie": {"a"}}))
+}
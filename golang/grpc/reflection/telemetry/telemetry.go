@@ -0,0 +1,203 @@
+// Package telemetry carries W3C trace context over gRPC metadata and sets up
+// the tracing shared by the agent and its plugins.
+package telemetry
+
+import (
+	"context"
+	"flag"
+	"io"
+	"os"
+	"strings"
+
+	otelcodes "go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/exporters/stdout/stdouttrace"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/sdk/resource"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	semconv "go.opentelemetry.io/otel/semconv/v1.21.0"
+	"go.opentelemetry.io/otel/trace"
+	"go.opentelemetry.io/otel/trace/noop"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+)
+
+// Propagator reads and writes the W3C traceparent and tracestate headers.
+var Propagator propagation.TextMapPropagator = propagation.TraceContext{}
+
+// Config describes where the spans of a process go. The zero value disables
+// tracing.
+type Config struct {
+	// TraceFile receives every finished span as JSON, "-" stands for the
+	// standard output.
+	TraceFile string
+}
+
+// AddFlags registers the flags of c on fs, each name starting with prefix.
+func (c *Config) AddFlags(fs *flag.FlagSet, prefix string) {
+	fs.StringVar(&c.TraceFile, prefix+"file", "", "file finished spans are written to as JSON, - for standard output, empty disables tracing")
+}
+
+// TracerProvider returns the tracer provider of the process serviceName and
+// a function flushing its spans on shutdown.
+func (c *Config) TracerProvider(serviceName string) (trace.TracerProvider, func(context.Context) error, error) {
+	if c.TraceFile == "" {
+		return noop.NewTracerProvider(), func(context.Context) error { return nil }, nil
+	}
+
+	w := io.WriteCloser(os.Stdout)
+	if c.TraceFile != "-" {
+		f, err := os.OpenFile(c.TraceFile, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0600)
+		if err != nil {
+			return nil, nil, err
+		}
+
+		w = f
+	}
+
+	exporter, err := stdouttrace.New(stdouttrace.WithWriter(w))
+	if err != nil {
+		return nil, nil, err
+	}
+
+	tp := sdktrace.NewTracerProvider(
+		sdktrace.WithBatcher(exporter),
+		sdktrace.WithResource(resource.NewWithAttributes(semconv.SchemaURL, semconv.ServiceName(serviceName))),
+	)
+
+	shutdown := func(ctx context.Context) error {
+		err := tp.Shutdown(ctx)
+		if w != os.Stdout {
+			w.Close()
+		}
+
+		return err
+	}
+
+	return tp, shutdown, nil
+}
+
+// MetadataCarrier adapts gRPC metadata to a propagation.TextMapCarrier.
+type MetadataCarrier metadata.MD
+
+func (c MetadataCarrier) Get(key string) string {
+	values := metadata.MD(c).Get(key)
+	if len(values) == 0 {
+		return ""
+	}
+
+	return values[0]
+}
+
+func (c MetadataCarrier) Set(key, value string) {
+	metadata.MD(c).Set(key, value)
+}
+
+func (c MetadataCarrier) Keys() []string {
+	keys := make([]string, 0, len(c))
+	for key := range c {
+		keys = append(keys, key)
+	}
+
+	return keys
+}
+
+// Extract returns ctx carrying the remote span context of its incoming
+// metadata, if any.
+func Extract(ctx context.Context) context.Context {
+	md, _ := metadata.FromIncomingContext(ctx)
+	return Propagator.Extract(ctx, MetadataCarrier(md))
+}
+
+// Inject writes the span context of ctx to md, replacing whatever trace
+// context md held.
+func Inject(ctx context.Context, md metadata.MD) {
+	Propagator.Inject(ctx, MetadataCarrier(md))
+}
+
+// OutgoingContext returns ctx with the span context of ctx added to its
+// outgoing metadata.
+func OutgoingContext(ctx context.Context) context.Context {
+	md, ok := metadata.FromOutgoingContext(ctx)
+	if ok {
+		md = md.Copy()
+	} else {
+		md = metadata.MD{}
+	}
+
+	Inject(ctx, md)
+	return metadata.NewOutgoingContext(ctx, md)
+}
+
+// StartRPCSpan starts the span of a call of fullMethod, given as
+// "/service/method" or "service/method", with the attributes of the RPC
+// semantic conventions.
+func StartRPCSpan(ctx context.Context, tracer trace.Tracer, fullMethod string, kind trace.SpanKind) (context.Context, trace.Span) {
+	name := strings.TrimPrefix(fullMethod, "/")
+	serviceName, funcName, _ := strings.Cut(name, "/")
+
+	return tracer.Start(ctx, name,
+		trace.WithSpanKind(kind),
+		trace.WithAttributes(semconv.RPCSystemGRPC, semconv.RPCService(serviceName), semconv.RPCMethod(funcName)),
+	)
+}
+
+// EndRPCSpan records the status of err on span and ends it.
+func EndRPCSpan(span trace.Span, err error) {
+	st := status.Convert(err)
+	span.SetAttributes(semconv.RPCGRPCStatusCodeKey.Int(int(st.Code())))
+	if err != nil {
+		span.SetStatus(otelcodes.Error, st.Message())
+	}
+
+	span.End()
+}
+
+const instrumentationName = "github.com/rootwarp/snippets/golang/grpc/reflection/telemetry"
+
+// UnaryServerInterceptor traces every unary call a server takes as a child
+// of the caller's span.
+func UnaryServerInterceptor(tp trace.TracerProvider) grpc.UnaryServerInterceptor {
+	tracer := tp.Tracer(instrumentationName)
+	return func(ctx context.Context, req any, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (any, error) {
+		ctx, span := StartRPCSpan(Extract(ctx), tracer, info.FullMethod, trace.SpanKindServer)
+
+		resp, err := handler(ctx, req)
+		EndRPCSpan(span, err)
+
+		return resp, err
+	}
+}
+
+// StreamServerInterceptor traces every streaming call a server takes, calls
+// of unknown services included, as a child of the caller's span.
+func StreamServerInterceptor(tp trace.TracerProvider) grpc.StreamServerInterceptor {
+	tracer := tp.Tracer(instrumentationName)
+	return func(srv any, ss grpc.ServerStream, info *grpc.StreamServerInfo, handler grpc.StreamHandler) error {
+		ctx, span := StartRPCSpan(Extract(ss.Context()), tracer, info.FullMethod, trace.SpanKindServer)
+
+		err := handler(srv, &tracedStream{ServerStream: ss, ctx: ctx})
+		EndRPCSpan(span, err)
+
+		return err
+	}
+}
+
+// tracedStream is a grpc.ServerStream whose context carries the span of the
+// call.
+type tracedStream struct {
+	grpc.ServerStream
+	ctx context.Context
+}
+
+func (s *tracedStream) Context() context.Context {
+	return s.ctx
+}
+
+// ServerOptions returns the interceptors tracing the calls of a server.
+func ServerOptions(tp trace.TracerProvider) []grpc.ServerOption {
+	return []grpc.ServerOption{
+		grpc.ChainUnaryInterceptor(UnaryServerInterceptor(tp)),
+		grpc.ChainStreamInterceptor(StreamServerInterceptor(tp)),
+	}
+}
@@ -0,0 +1,80 @@
+package telemetry
+
+import (
+	"context"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+	semconv "go.opentelemetry.io/otel/semconv/v1.21.0"
+	"go.opentelemetry.io/otel/trace"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+)
+
+const testTraceparent = "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01"
+
+func TestPropagation(t *testing.T) {
+	ctx := metadata.NewIncomingContext(context.Background(), metadata.Pairs("traceparent", testTraceparent))
+	ctx = Extract(ctx)
+
+	sc := trace.SpanContextFromContext(ctx)
+	assert.True(t, sc.IsRemote())
+	assert.Equal(t, "4bf92f3577b34da6a3ce929d0e0e4736", sc.TraceID().String())
+	assert.Equal(t, "00f067aa0ba902b7", sc.SpanID().String())
+
+	// Outgoing metadata keeps its entries and gets the trace context.
+	ctx = metadata.AppendToOutgoingContext(ctx, "x-echo", "hi", "traceparent", "stale")
+	md, _ := metadata.FromOutgoingContext(OutgoingContext(ctx))
+	assert.Equal(t, []string{"hi"}, md.Get("x-echo"))
+	assert.Equal(t, []string{testTraceparent}, md.Get("traceparent"))
+
+	// Nothing to extract.
+	ctx = Extract(context.Background())
+	assert.False(t, trace.SpanContextFromContext(ctx).IsValid())
+}
+
+func TestServerInterceptors(t *testing.T) {
+	exporter := tracetest.NewInMemoryExporter()
+	tp := sdktrace.NewTracerProvider(sdktrace.WithSyncer(exporter))
+
+	ctx := metadata.NewIncomingContext(context.Background(), metadata.Pairs("traceparent", testTraceparent))
+	info := &grpc.UnaryServerInfo{FullMethod: "/snippet.grpc.reflection.HelloService/Hello"}
+
+	var handlerSpan trace.SpanContext
+	_, err := UnaryServerInterceptor(tp)(ctx, nil, info, func(ctx context.Context, req any) (any, error) {
+		handlerSpan = trace.SpanContextFromContext(ctx)
+		return nil, status.Error(codes.InvalidArgument, "bad")
+	})
+	assert.Equal(t, codes.InvalidArgument, status.Code(err))
+
+	spans := exporter.GetSpans()
+	assert.Len(t, spans, 1)
+
+	span := spans[0]
+	assert.Equal(t, "snippet.grpc.reflection.HelloService/Hello", span.Name)
+	assert.Equal(t, trace.SpanKindServer, span.SpanKind)
+	assert.Equal(t, "4bf92f3577b34da6a3ce929d0e0e4736", span.SpanContext.TraceID().String())
+	assert.Equal(t, "00f067aa0ba902b7", span.Parent.SpanID().String())
+	assert.Equal(t, span.SpanContext.SpanID(), handlerSpan.SpanID())
+	assert.Contains(t, span.Attributes, semconv.RPCGRPCStatusCodeKey.Int(int(codes.InvalidArgument)))
+
+	exporter.Reset()
+
+	stream := &tracedStream{ctx: ctx}
+	streamInfo := &grpc.StreamServerInfo{FullMethod: "/snippet.grpc.reflection.HelloService/HelloChat"}
+	err = StreamServerInterceptor(tp)(nil, stream, streamInfo, func(srv any, ss grpc.ServerStream) error {
+		handlerSpan = trace.SpanContextFromContext(ss.Context())
+		return nil
+	})
+	assert.Nil(t, err)
+
+	spans = exporter.GetSpans()
+	assert.Len(t, spans, 1)
+	assert.Equal(t, "snippet.grpc.reflection.HelloService/HelloChat", spans[0].Name)
+	assert.Equal(t, spans[0].SpanContext.SpanID(), handlerSpan.SpanID())
+	assert.Equal(t, "00f067aa0ba902b7", spans[0].Parent.SpanID().String())
+}
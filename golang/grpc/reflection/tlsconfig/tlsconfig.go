@@ -0,0 +1,235 @@
+// Package tlsconfig builds the transport credentials shared by the agent and
+// its plugins from a certificate, its key and a CA bundle.
+package tlsconfig
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+	"strings"
+
+	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/peer"
+)
+
+// Config describes the TLS setup of one side of a connection. The zero value
+// disables TLS.
+type Config struct {
+	// CertFile and KeyFile hold the certificate presented to the peer. A
+	// client presents it as its client certificate.
+	CertFile string
+	KeyFile  string
+
+	// CAFile holds the CA bundle verifying the peer. A client falls back to
+	// the system roots when it is empty.
+	CAFile string
+
+	// RequireClientCert makes a server reject clients without a certificate
+	// signed by the CA bundle.
+	RequireClientCert bool
+
+	// SkipHostnameVerify makes a client verify the server's certificate
+	// chain but not its name, the caller checks the identity by itself.
+	SkipHostnameVerify bool
+}
+
+// AddFlags registers the flags of c on fs, each name starting with prefix.
+func (c *Config) AddFlags(fs *flag.FlagSet, prefix string) {
+	fs.StringVar(&c.CertFile, prefix+"cert", "", "PEM certificate presented to peers, enables TLS")
+	fs.StringVar(&c.KeyFile, prefix+"key", "", "PEM private key of the certificate")
+	fs.StringVar(&c.CAFile, prefix+"ca", "", "PEM CA bundle verifying peers, enables TLS")
+	fs.BoolVar(&c.RequireClientCert, prefix+"client-auth", false, "require clients to present a certificate signed by the CA bundle")
+}
+
+// Enabled reports whether c asks for TLS at all.
+func (c *Config) Enabled() bool {
+	return c.CertFile != "" || c.CAFile != ""
+}
+
+// ServerTLS returns the tls.Config of a server.
+func (c *Config) ServerTLS() (*tls.Config, error) {
+	if c.CertFile == "" || c.KeyFile == "" {
+		return nil, errors.New("a server needs a certificate and its key")
+	}
+
+	cert, err := tls.LoadX509KeyPair(c.CertFile, c.KeyFile)
+	if err != nil {
+		return nil, err
+	}
+
+	cfg := &tls.Config{
+		Certificates: []tls.Certificate{cert},
+		MinVersion:   tls.VersionTLS12,
+	}
+
+	if c.CAFile != "" {
+		pool, err := loadCertPool(c.CAFile)
+		if err != nil {
+			return nil, err
+		}
+
+		cfg.ClientCAs = pool
+		cfg.ClientAuth = tls.VerifyClientCertIfGiven
+	}
+
+	if c.RequireClientCert {
+		if cfg.ClientCAs == nil {
+			return nil, errors.New("client authentication needs a CA bundle")
+		}
+
+		cfg.ClientAuth = tls.RequireAndVerifyClientCert
+	}
+
+	return cfg, nil
+}
+
+// ClientTLS returns the tls.Config of a client.
+func (c *Config) ClientTLS() (*tls.Config, error) {
+	cfg := &tls.Config{
+		MinVersion: tls.VersionTLS12,
+	}
+
+	if c.CertFile != "" {
+		cert, err := tls.LoadX509KeyPair(c.CertFile, c.KeyFile)
+		if err != nil {
+			return nil, err
+		}
+
+		cfg.Certificates = []tls.Certificate{cert}
+	}
+
+	if c.CAFile != "" {
+		pool, err := loadCertPool(c.CAFile)
+		if err != nil {
+			return nil, err
+		}
+
+		cfg.RootCAs = pool
+	}
+
+	if c.SkipHostnameVerify {
+		// Go verifies the chain together with the name, so switch both off
+		// and verify the chain alone.
+		cfg.InsecureSkipVerify = true
+		cfg.VerifyConnection = func(state tls.ConnectionState) error {
+			return verifyChain(state, cfg.RootCAs)
+		}
+	}
+
+	return cfg, nil
+}
+
+// ServerCredentials returns the credentials of a gRPC server, insecure ones
+// when TLS is disabled.
+func (c *Config) ServerCredentials() (credentials.TransportCredentials, error) {
+	if !c.Enabled() {
+		return insecure.NewCredentials(), nil
+	}
+
+	cfg, err := c.ServerTLS()
+	if err != nil {
+		return nil, err
+	}
+
+	return credentials.NewTLS(cfg), nil
+}
+
+// ClientCredentials returns the credentials of a gRPC client, insecure ones
+// when TLS is disabled.
+func (c *Config) ClientCredentials() (credentials.TransportCredentials, error) {
+	if !c.Enabled() {
+		return insecure.NewCredentials(), nil
+	}
+
+	cfg, err := c.ClientTLS()
+	if err != nil {
+		return nil, err
+	}
+
+	return credentials.NewTLS(cfg), nil
+}
+
+func loadCertPool(caFile string) (*x509.CertPool, error) {
+	pem, err := os.ReadFile(caFile)
+	if err != nil {
+		return nil, err
+	}
+
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(pem) {
+		return nil, fmt.Errorf("no certificate found in %s", caFile)
+	}
+
+	return pool, nil
+}
+
+func verifyChain(state tls.ConnectionState, roots *x509.CertPool) error {
+	if len(state.PeerCertificates) == 0 {
+		return errors.New("peer presented no certificate")
+	}
+
+	opts := x509.VerifyOptions{
+		Roots:         roots,
+		Intermediates: x509.NewCertPool(),
+	}
+
+	for _, cert := range state.PeerCertificates[1:] {
+		opts.Intermediates.AddCert(cert)
+	}
+
+	_, err := state.PeerCertificates[0].Verify(opts)
+
+	return err
+}
+
+// Identities returns the names cert was issued for: its common name, DNS
+// names and URIs.
+func Identities(cert *x509.Certificate) []string {
+	identities := []string{}
+	if cert.Subject.CommonName != "" {
+		identities = append(identities, cert.Subject.CommonName)
+	}
+
+	identities = append(identities, cert.DNSNames...)
+	for _, uri := range cert.URIs {
+		identities = append(identities, uri.String())
+	}
+
+	return identities
+}
+
+// PeerIdentities returns the identities of the certificate p authenticated
+// with, nothing when p did not use TLS.
+func PeerIdentities(p *peer.Peer) []string {
+	if p == nil {
+		return nil
+	}
+
+	info, ok := p.AuthInfo.(credentials.TLSInfo)
+	if !ok || len(info.State.PeerCertificates) == 0 {
+		return nil
+	}
+
+	return Identities(info.State.PeerCertificates[0])
+}
+
+// MatchIdentity reports whether one of identities covers name. An identity
+// matches the same name, and an identity ending in ".*" matches every name
+// in that package.
+func MatchIdentity(identities []string, name string) bool {
+	for _, identity := range identities {
+		if strings.EqualFold(identity, name) {
+			return true
+		}
+
+		if pkg, ok := strings.CutSuffix(identity, ".*"); ok && strings.HasPrefix(name, pkg+".") {
+			return true
+		}
+	}
+
+	return false
+}
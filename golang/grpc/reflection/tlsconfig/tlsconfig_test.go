@@ -0,0 +1,182 @@
+package tlsconfig
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"math/big"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/health"
+	"google.golang.org/grpc/health/grpc_health_v1"
+)
+
+type testCA struct {
+	cert *x509.Certificate
+	key  *ecdsa.PrivateKey
+	dir  string
+}
+
+func newTestCA(t *testing.T) *testCA {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	assert.Nil(t, err)
+
+	tmpl := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "test ca"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		KeyUsage:              x509.KeyUsageCertSign,
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+	}
+
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	assert.Nil(t, err)
+
+	cert, err := x509.ParseCertificate(der)
+	assert.Nil(t, err)
+
+	ca := &testCA{cert: cert, key: key, dir: t.TempDir()}
+	ca.write(t, "ca.pem", "CERTIFICATE", der)
+
+	return ca
+}
+
+func (ca *testCA) write(t *testing.T, name, blockType string, der []byte) string {
+	path := filepath.Join(ca.dir, name)
+	err := os.WriteFile(path, pem.EncodeToMemory(&pem.Block{Type: blockType, Bytes: der}), 0600)
+	assert.Nil(t, err)
+
+	return path
+}
+
+// issue returns the certificate and key files of a leaf certificate for cn
+// and dnsNames, valid for 127.0.0.1.
+func (ca *testCA) issue(t *testing.T, name, cn string, dnsNames ...string) (string, string) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	assert.Nil(t, err)
+
+	tmpl := &x509.Certificate{
+		SerialNumber: big.NewInt(time.Now().UnixNano()),
+		Subject:      pkix.Name{CommonName: cn},
+		DNSNames:     dnsNames,
+		IPAddresses:  []net.IP{net.ParseIP("127.0.0.1")},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+	}
+
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, ca.cert, &key.PublicKey, ca.key)
+	assert.Nil(t, err)
+
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	assert.Nil(t, err)
+
+	return ca.write(t, name+".pem", "CERTIFICATE", der), ca.write(t, name+".key", "EC PRIVATE KEY", keyDER)
+}
+
+func startHealthServer(t *testing.T, cfg Config) string {
+	creds, err := cfg.ServerCredentials()
+	assert.Nil(t, err)
+
+	s := grpc.NewServer(grpc.Creds(creds))
+	grpc_health_v1.RegisterHealthServer(s, health.NewServer())
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.Nil(t, err)
+
+	go s.Serve(l)
+	t.Cleanup(s.Stop)
+
+	return l.Addr().String()
+}
+
+func checkHealth(t *testing.T, address string, cfg Config) error {
+	creds, err := cfg.ClientCredentials()
+	assert.Nil(t, err)
+
+	conn, err := grpc.Dial(address, grpc.WithTransportCredentials(creds))
+	assert.Nil(t, err)
+	defer conn.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+	defer cancel()
+
+	_, err = grpc_health_v1.NewHealthClient(conn).Check(ctx, &grpc_health_v1.HealthCheckRequest{})
+
+	return err
+}
+
+func TestCredentials(t *testing.T) {
+	ca := newTestCA(t)
+	caFile := filepath.Join(ca.dir, "ca.pem")
+	serverCert, serverKey := ca.issue(t, "server", "server")
+	clientCert, clientKey := ca.issue(t, "client", "client")
+
+	otherCA := newTestCA(t)
+	otherCAFile := filepath.Join(otherCA.dir, "ca.pem")
+	otherCert, otherKey := otherCA.issue(t, "other", "other")
+
+	// Insecure
+	address := startHealthServer(t, Config{})
+	assert.Nil(t, checkHealth(t, address, Config{}))
+
+	// TLS
+	address = startHealthServer(t, Config{CertFile: serverCert, KeyFile: serverKey})
+	assert.Nil(t, checkHealth(t, address, Config{CAFile: caFile}))
+	assert.NotNil(t, checkHealth(t, address, Config{CAFile: otherCAFile}))
+	assert.NotNil(t, checkHealth(t, address, Config{}))
+
+	// Mutual TLS
+	address = startHealthServer(t, Config{CertFile: serverCert, KeyFile: serverKey, CAFile: caFile, RequireClientCert: true})
+	assert.Nil(t, checkHealth(t, address, Config{CertFile: clientCert, KeyFile: clientKey, CAFile: caFile}))
+	assert.NotNil(t, checkHealth(t, address, Config{CAFile: caFile}))
+	assert.NotNil(t, checkHealth(t, address, Config{CertFile: otherCert, KeyFile: otherKey, CAFile: caFile}))
+
+	// Verifying the chain alone
+	address = startHealthServer(t, Config{CertFile: serverCert, KeyFile: serverKey})
+	address = "localhost" + address[len("127.0.0.1"):]
+	assert.NotNil(t, checkHealth(t, address, Config{CAFile: caFile}))
+	assert.Nil(t, checkHealth(t, address, Config{CAFile: caFile, SkipHostnameVerify: true}))
+	assert.NotNil(t, checkHealth(t, address, Config{CAFile: otherCAFile, SkipHostnameVerify: true}))
+
+	// Misconfiguration
+	_, err := (&Config{CAFile: caFile}).ServerCredentials()
+	assert.NotNil(t, err)
+
+	_, err = (&Config{CertFile: serverCert, KeyFile: serverKey, RequireClientCert: true}).ServerTLS()
+	assert.NotNil(t, err)
+}
+
+func TestMatchIdentity(t *testing.T) {
+	tests := []struct {
+		identities []string
+		name       string
+		match      bool
+	}{
+		{[]string{"snippet.grpc.reflection.HelloService"}, "snippet.grpc.reflection.HelloService", true},
+		{[]string{"snippet.grpc.reflection.helloservice"}, "snippet.grpc.reflection.HelloService", true},
+		{[]string{"snippet.grpc.*"}, "snippet.grpc.reflection.HelloService", true},
+		{[]string{"other", "snippet.grpc.reflection.*"}, "snippet.grpc.reflection.HelloService", true},
+		{[]string{"snippet.grpc.refl.*"}, "snippet.grpc.reflection.HelloService", false},
+		{[]string{"snippet.grpc.reflection.HelloService"}, "snippet.grpc.reflection.ByeService", false},
+		{[]string{"*"}, "snippet.grpc.reflection.HelloService", false},
+		{nil, "snippet.grpc.reflection.HelloService", false},
+	}
+
+	for _, test := range tests {
+		assert.Equal(t, test.match, MatchIdentity(test.identities, test.name), test.identities)
+	}
+}
@@ -0,0 +1,198 @@
+// Package transport carries the traffic between the agent and its plugins
+// over TCP, Unix domain sockets or in-process pipes, depending on the form of
+// the address:
+//
+//	host:port      TCP
+//	unix:///path   Unix domain socket at an absolute path
+//	unix:path      Unix domain socket at a relative path
+//	inproc://name  in-process listener, for tests and embedded plugins
+package transport
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/test/bufconn"
+)
+
+const (
+	unixScheme   = "unix:"
+	inprocScheme = "inproc://"
+
+	inprocBufferSize = 1 << 20
+)
+
+// IsLocal reports whether address is a Unix domain socket or in-process
+// address rather than a TCP one.
+func IsLocal(address string) bool {
+	return strings.HasPrefix(address, unixScheme) || strings.HasPrefix(address, inprocScheme)
+}
+
+// Target returns the address of the instance at host and port. A local
+// host is the address by itself, its port is ignored.
+func Target(host string, port int) string {
+	if IsLocal(host) {
+		return host
+	}
+
+	return net.JoinHostPort(host, strconv.Itoa(port))
+}
+
+// SplitTarget is the reverse of Target, the port of a local address is 0.
+func SplitTarget(address string) (string, int, error) {
+	if IsLocal(address) {
+		return address, 0, nil
+	}
+
+	host, portStr, err := net.SplitHostPort(address)
+	if err != nil {
+		return "", 0, err
+	}
+
+	port, err := strconv.Atoi(portStr)
+	if err != nil {
+		return "", 0, err
+	}
+
+	return host, port, nil
+}
+
+// Listen listens at address.
+func Listen(address string) (net.Listener, error) {
+	if name, ok := strings.CutPrefix(address, inprocScheme); ok {
+		return listenInproc(name)
+	}
+
+	if path, ok := unixPath(address); ok {
+		return net.Listen("unix", path)
+	}
+
+	return net.Listen("tcp", address)
+}
+
+// Address returns the address peers reach the listener at addr, the host of
+// a TCP listener being the one it listens on.
+func Address(addr net.Addr) string {
+	if addr.Network() != "unix" {
+		return addr.String()
+	}
+
+	if filepath.IsAbs(addr.String()) {
+		return unixScheme + "//" + addr.String()
+	}
+
+	return unixScheme + addr.String()
+}
+
+// Dial creates a client connection to address, like grpc.Dial.
+func Dial(address string, opts ...grpc.DialOption) (*grpc.ClientConn, error) {
+	opts = append([]grpc.DialOption{grpc.WithContextDialer(dial)}, opts...)
+
+	if name, ok := strings.CutPrefix(address, inprocScheme); ok {
+		// The name is not a resolvable host, pass the address on as is.
+		opts = append(opts, grpc.WithAuthority(name))
+		address = "passthrough:///" + address
+	}
+
+	return grpc.Dial(address, opts...)
+}
+
+// dial connects to address. A unix address arrives in its original form
+// since a context dialer is in place.
+func dial(ctx context.Context, address string) (net.Conn, error) {
+	if name, ok := strings.CutPrefix(address, inprocScheme); ok {
+		return dialInproc(ctx, name)
+	}
+
+	if path, ok := unixPath(address); ok {
+		return (&net.Dialer{}).DialContext(ctx, "unix", path)
+	}
+
+	return (&net.Dialer{}).DialContext(ctx, "tcp", address)
+}
+
+// unixPath returns the socket path of a unix address.
+func unixPath(address string) (string, bool) {
+	path, ok := strings.CutPrefix(address, unixScheme)
+	if !ok {
+		return "", false
+	}
+
+	if abs, ok := strings.CutPrefix(path, "//"); ok {
+		return abs, true
+	}
+
+	return path, true
+}
+
+var inproc = struct {
+	mu        sync.Mutex
+	listeners map[string]*inprocListener
+}{listeners: map[string]*inprocListener{}}
+
+// inprocListener is an in-memory listener registered under name until it
+// is closed.
+type inprocListener struct {
+	*bufconn.Listener
+
+	name string
+	once sync.Once
+}
+
+func listenInproc(name string) (net.Listener, error) {
+	inproc.mu.Lock()
+	defer inproc.mu.Unlock()
+
+	if name == "" {
+		return nil, fmt.Errorf("%s address without name", inprocScheme)
+	}
+
+	if _, ok := inproc.listeners[name]; ok {
+		return nil, fmt.Errorf("listen %s%s: address already in use", inprocScheme, name)
+	}
+
+	l := &inprocListener{Listener: bufconn.Listen(inprocBufferSize), name: name}
+	inproc.listeners[name] = l
+
+	return l, nil
+}
+
+func dialInproc(ctx context.Context, name string) (net.Conn, error) {
+	inproc.mu.Lock()
+	l, ok := inproc.listeners[name]
+	inproc.mu.Unlock()
+
+	if !ok {
+		return nil, fmt.Errorf("dial %s%s: connection refused", inprocScheme, name)
+	}
+
+	return l.DialContext(ctx)
+}
+
+func (l *inprocListener) Close() error {
+	l.once.Do(func() {
+		inproc.mu.Lock()
+		defer inproc.mu.Unlock()
+
+		if inproc.listeners[l.name] == l {
+			delete(inproc.listeners, l.name)
+		}
+	})
+
+	return l.Listener.Close()
+}
+
+func (l *inprocListener) Addr() net.Addr {
+	return inprocAddr(l.name)
+}
+
+type inprocAddr string
+
+func (a inprocAddr) Network() string { return "inproc" }
+func (a inprocAddr) String() string  { return inprocScheme + string(a) }
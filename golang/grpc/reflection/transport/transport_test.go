@@ -0,0 +1,105 @@
+package transport
+
+import (
+	"context"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/health"
+	"google.golang.org/grpc/health/grpc_health_v1"
+)
+
+func TestTarget(t *testing.T) {
+	tests := []struct {
+		Host    string
+		Port    int
+		Address string
+	}{
+		{"127.0.0.1", 8080, "127.0.0.1:8080"},
+		{"::1", 50051, "[::1]:50051"},
+		{"unix:///tmp/plugin.sock", 0, "unix:///tmp/plugin.sock"},
+		{"unix:plugin.sock", 0, "unix:plugin.sock"},
+		{"inproc://hello", 0, "inproc://hello"},
+	}
+
+	for _, test := range tests {
+		assert.Equal(t, test.Address, Target(test.Host, test.Port))
+
+		host, port, err := SplitTarget(test.Address)
+		assert.Nil(t, err)
+		assert.Equal(t, test.Host, host)
+		assert.Equal(t, test.Port, port)
+	}
+
+	_, _, err := SplitTarget("127.0.0.1")
+	assert.NotNil(t, err)
+}
+
+func TestListenAndDial(t *testing.T) {
+	tests := []struct {
+		Listen string
+		// Address is the expected address of the listener, the host of
+		// TCP ones is left out.
+		Address string
+	}{
+		{"127.0.0.1:0", ""},
+		{"unix://" + filepath.Join(t.TempDir(), "plugin.sock"), ""},
+		{"inproc://plugin", "inproc://plugin"},
+	}
+
+	for _, test := range tests {
+		l, err := Listen(test.Listen)
+		if !assert.Nil(t, err, test.Listen) {
+			continue
+		}
+
+		address := Address(l.Addr())
+		if test.Address != "" {
+			assert.Equal(t, test.Address, address)
+		} else if IsLocal(test.Listen) {
+			assert.Equal(t, test.Listen, address)
+		}
+
+		s := grpc.NewServer()
+		grpc_health_v1.RegisterHealthServer(s, health.NewServer())
+		go s.Serve(l)
+
+		conn, err := Dial(address, grpc.WithTransportCredentials(insecure.NewCredentials()))
+		assert.Nil(t, err)
+
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		resp, err := grpc_health_v1.NewHealthClient(conn).Check(ctx, &grpc_health_v1.HealthCheckRequest{})
+		cancel()
+
+		assert.Nil(t, err, test.Listen)
+		assert.Equal(t, grpc_health_v1.HealthCheckResponse_SERVING, resp.GetStatus())
+
+		conn.Close()
+		s.Stop()
+	}
+}
+
+func TestInproc(t *testing.T) {
+	l, err := Listen("inproc://taken")
+	assert.Nil(t, err)
+
+	_, err = Listen("inproc://taken")
+	assert.NotNil(t, err)
+
+	_, err = Listen("inproc://")
+	assert.NotNil(t, err)
+
+	// The name is free again once the listener is closed.
+	assert.Nil(t, l.Close())
+
+	_, err = dial(context.Background(), "inproc://taken")
+	assert.NotNil(t, err)
+
+	l, err = Listen("inproc://taken")
+	assert.Nil(t, err)
+	l.Close()
+}